@@ -16,6 +16,10 @@ func NewVMCommand(cli *Cli) *cobra.Command {
 	cmd.AddCommand(NewEnableCommand(cli))
 	cmd.AddCommand(NewDisableCommand(cli))
 	cmd.AddCommand(NewStatsCommand(cli))
+	cmd.AddCommand(NewDiskCommand(cli))
+	cmd.AddCommand(NewPruneCommand(cli))
+	cmd.AddCommand(NewSnapshotCommand(cli))
+	cmd.AddCommand(NewModulesCommand(cli))
 
 	return cmd
 }
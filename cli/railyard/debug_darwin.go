@@ -106,18 +106,17 @@ func debugVM(octx context.Context, cli *Cli) error { //nolint:cyclop,funlen
 		return fmt.Errorf("failed to open daemon state: %w", err)
 	}
 
-	defer func() {
-		stateCh <- host.DaemonState{Status: host.StatusStopped}
-		close(stateCh)
-		<-done
-	}()
-
 	vm := &host.VirtualMachine{
 		Layout:       *layout,
 		LogChannel:   logChan,
 		StateChannel: stateCh,
 	}
 
+	defer func() {
+		vm.CloseState(host.DaemonState{Status: host.StatusStopped})
+		<-done
+	}()
+
 	start := time.Now()
 
 	if err := vm.Start(ctx, vmstate); err != nil {
@@ -138,6 +137,7 @@ func debugVM(octx context.Context, cli *Cli) error { //nolint:cyclop,funlen
 		Name:  "dockerd",
 		Path:  "/usr/bin/dockerd",
 		Args:  []string{"dockerd", "--config-file", "/proc/self/fd/0"},
+		Env:   layout.Proxy.Environ(),
 		Input: dockerdJson,
 	}
 
@@ -159,7 +159,7 @@ func debugVM(octx context.Context, cli *Cli) error { //nolint:cyclop,funlen
 	}
 	defer listener.Close()
 
-	control.SetupServer(ctx, vm)
+	control.SetupServer(ctx, vm, vmstate)
 
 	go func() {
 		_ = control.Serve(listener)
@@ -172,6 +172,7 @@ func debugVM(octx context.Context, cli *Cli) error { //nolint:cyclop,funlen
 
 	go host.MonitorContainerd(ctx, vm, sl)
 	go host.MonitorDockerd(ctx, vm, futureListener)
+	go control.AutogrowDisks(ctx)
 
 	for _, listener := range listeners {
 		go vm.ForwardStopLatch(listener, "unix", layout.DockerSocket.ContainerPath, sl)
@@ -179,9 +180,13 @@ func debugVM(octx context.Context, cli *Cli) error { //nolint:cyclop,funlen
 
 	log.Infof("listening on %v", layout.DockerSocket.HostPath)
 
-	<-ctx.Done()
+	select {
+	case <-ctx.Done():
+	case <-control.Restart():
+		log.Infof("stopping to modify disks")
+	}
 
-	stateCh <- host.DaemonState{Status: host.StatusStopping}
+	vm.UpdateState(host.DaemonState{Status: host.StatusStopping})
 
 	if err := svc.Signal(int(syscall.SIGTERM)); err != nil {
 		log.Warnf("failed to signal dockerd: %v", err)
@@ -190,6 +195,9 @@ func debugVM(octx context.Context, cli *Cli) error { //nolint:cyclop,funlen
 	exit := svc.Wait()
 
 	log.Infof("dockerd exited with code %d", exit)
+
+	control.RestoreSnapshots()
+
 	log.Infof("Shutting down VM")
 
 	if err := vm.Shutdown(ctx); err != nil {
@@ -198,6 +206,8 @@ func debugVM(octx context.Context, cli *Cli) error { //nolint:cyclop,funlen
 
 	log.Infof("VM shutdown")
 
+	control.ApplyDiskChanges(ctx)
+
 	return nil
 }
 
@@ -0,0 +1,578 @@
+package railyard
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/amadigan/macoby/internal/client"
+	"github.com/amadigan/macoby/internal/controlsock"
+	"github.com/amadigan/macoby/internal/host"
+	"github.com/amadigan/macoby/internal/host/disk"
+	"github.com/docker/go-units"
+	"github.com/google/uuid"
+	"github.com/spf13/cobra"
+)
+
+// daemonStopTimeout... how long to wait for the daemon to stop the VM before modifying a disk
+const daemonStopTimeout = 2 * time.Minute
+
+func NewDiskCommand(cli *Cli) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "disk",
+		Short: "Manage VM disk images",
+	}
+
+	cmd.AddCommand(NewDiskListCommand(cli))
+	cmd.AddCommand(NewDiskInspectCommand(cli))
+	cmd.AddCommand(NewDiskResizeCommand(cli))
+	cmd.AddCommand(NewDiskPurgeCommand(cli))
+	cmd.AddCommand(NewDiskTrimCommand(cli))
+	cmd.AddCommand(NewDiskExportCommand(cli))
+	cmd.AddCommand(NewDiskImportCommand(cli))
+
+	return cmd
+}
+
+func NewDiskListCommand(cli *Cli) *cobra.Command {
+	return &cobra.Command{
+		Use:     "ls",
+		Aliases: []string{"list"},
+		Short:   "List the configured disks",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return listDisks(cmd.Context(), cli, cmd.OutOrStdout())
+		},
+	}
+}
+
+func NewDiskInspectCommand(cli *Cli) *cobra.Command {
+	return &cobra.Command{
+		Use:   "inspect <disk|image>",
+		Short: "Show the filesystem on a disk image",
+		Long: "Show the filesystem on a disk image. The argument is the label of a configured disk or the path to an " +
+			"image. The image is read directly when the daemon is not running, so the VM does not need to be started.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return inspectDisk(cmd.Context(), cli, args[0], cmd.OutOrStdout())
+		},
+	}
+}
+
+func NewDiskResizeCommand(cli *Cli) *cobra.Command {
+	return &cobra.Command{
+		Use:   "resize <disk> <size>",
+		Short: "Resize a disk",
+		Long: "Resize a disk and its filesystem. A running VM is stopped and restarted, the filesystem is resized as " +
+			"the VM starts. The new size takes precedence over the configured size until the configured size is changed.",
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return changeDisk(cmd.Context(), cli, args[0], args[1], false, cmd.OutOrStdout())
+		},
+	}
+}
+
+func NewDiskPurgeCommand(cli *Cli) *cobra.Command {
+	var force bool
+
+	cmd := &cobra.Command{
+		Use:   "purge <disk>",
+		Short: "Delete a disk image",
+		Long: "Delete a disk image and everything on it. A running VM is stopped and restarted, the disk is created " +
+			"again as the VM starts.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !force && !confirm(cmd.InOrStdin(), cmd.OutOrStdout(), fmt.Sprintf("Delete disk %s and all of its data?", args[0])) {
+				return nil
+			}
+
+			return changeDisk(cmd.Context(), cli, args[0], "", true, cmd.OutOrStdout())
+		},
+	}
+
+	cmd.Flags().BoolVarP(&force, "force", "f", false, "Do not prompt for confirmation")
+
+	return cmd
+}
+
+func NewDiskTrimCommand(cli *Cli) *cobra.Command {
+	return &cobra.Command{
+		Use:   "trim",
+		Short: "Release unused disk space to the host",
+		Long: "Discard the unused blocks of the writable disks in the VM, so the space they occupy in the disk images is " +
+			"released on the host. The VM must be running, disks are also trimmed periodically.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return trimDisks(cmd.Context(), cli, cmd.OutOrStdout())
+		},
+	}
+}
+
+func NewDiskExportCommand(cli *Cli) *cobra.Command {
+	return &cobra.Command{
+		Use:   "export <disk> <file>",
+		Short: "Export a disk to an archive",
+		Long: "Write a compressed, checksummed archive of a disk image, only the space in use by the image is stored. " +
+			"A running VM is stopped during the export and restarted afterwards. Use - to write to stdout.",
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return exportDisk(cmd.Context(), cli, args[0], args[1], cmd.OutOrStdout(), cmd.ErrOrStderr())
+		},
+	}
+}
+
+func NewDiskImportCommand(cli *Cli) *cobra.Command {
+	var force bool
+
+	cmd := &cobra.Command{
+		Use:   "import <disk> <file>",
+		Short: "Replace a disk with an exported archive",
+		Long: "Replace a disk image with the image in an archive written by disk export. The archive must hold the " +
+			"filesystem the disk is configured with. A running VM is stopped during the import and restarted afterwards. " +
+			"Use - to read from stdin.",
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return importDisk(cmd.Context(), cli, args[0], args[1], force, cmd.InOrStdin(), cmd.OutOrStdout())
+		},
+	}
+
+	cmd.Flags().BoolVarP(&force, "force", "f", false, "Do not prompt for confirmation")
+
+	return cmd
+}
+
+func listDisks(ctx context.Context, cli *Cli, out io.Writer) error {
+	if err := cli.setup(); err != nil {
+		return err
+	}
+
+	imgs, err := client.ListDisks(ctx, cli.Config.Home)
+	if errors.Is(err, client.ErrNotRunning) {
+		imgs, err = host.DiskImages(cli.Config)
+	}
+
+	if err != nil {
+		//nolint:wrapcheck
+		return err
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+
+	_, _ = fmt.Fprintln(tw, "DISK\tMOUNT\tFS\tSIZE\tALLOCATED\tUSED\tFREE\tMOUNTED")
+
+	for _, img := range imgs {
+		used, free := "-", "-"
+
+		if fs := img.Filesystem; fs != nil && fs.Type != disk.FSswap {
+			used = units.BytesSize(float64(fs.Size - fs.Free))
+			free = units.BytesSize(float64(fs.Free))
+		}
+
+		size, allocated := "-", "-"
+
+		if img.Exists {
+			size = units.BytesSize(float64(img.Size))
+			allocated = units.BytesSize(float64(img.Allocated))
+		}
+
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%t\n", img.Label, img.Mount, img.FS, size, allocated, used,
+			free, img.Mounted)
+	}
+
+	//nolint:wrapcheck
+	return tw.Flush()
+}
+
+func inspectDisk(ctx context.Context, cli *Cli, name string, out io.Writer) error {
+	if err := cli.setup(); err != nil {
+		return err
+	}
+
+	var img *disk.Image
+	var err error
+
+	if _, ok := cli.Config.Disks[name]; ok {
+		if img, err = client.InspectDisk(ctx, cli.Config.Home, name); errors.Is(err, client.ErrNotRunning) {
+			img, err = host.DiskImage(cli.Config, name)
+		}
+	} else {
+		img = &disk.Image{Path: name}
+		if err = img.Inspect(); err == nil && !img.Exists {
+			err = fmt.Errorf("no such disk or image: %s", name)
+		}
+	}
+
+	if err != nil {
+		//nolint:wrapcheck
+		return err
+	}
+
+	printImage(out, img)
+
+	return nil
+}
+
+func trimDisks(ctx context.Context, cli *Cli, out io.Writer) error {
+	if err := cli.setup(); err != nil {
+		return err
+	}
+
+	results, err := client.TrimDisks(ctx, cli.Config.Home)
+	if err != nil {
+		//nolint:wrapcheck
+		return err
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+
+	_, _ = fmt.Fprintln(tw, "MOUNT\tTRIMMED")
+
+	for _, result := range results {
+		if result.Error != "" {
+			_, _ = fmt.Fprintf(tw, "%s\t%s\n", result.Mount, result.Error)
+		} else {
+			_, _ = fmt.Fprintf(tw, "%s\t%s\n", result.Mount, units.BytesSize(float64(result.Trimmed)))
+		}
+	}
+
+	//nolint:wrapcheck
+	return tw.Flush()
+}
+
+func exportDisk(ctx context.Context, cli *Cli, label, path string, stdout, stderr io.Writer) error {
+	if err := cli.setup(); err != nil {
+		return err
+	}
+
+	if _, ok := cli.Config.Disks[label]; !ok {
+		return fmt.Errorf("no such disk: %s", label)
+	}
+
+	return cli.withDaemonStopped(ctx, stderr, func() error {
+		w := stdout
+
+		if path != "-" {
+			file, err := os.Create(path)
+			if err != nil {
+				//nolint:wrapcheck
+				return err
+			}
+
+			defer file.Close()
+
+			w = file
+		}
+
+		manifest, err := host.ExportDisk(cli.Config, label, w)
+		if err != nil {
+			if path != "-" {
+				_ = os.Remove(path)
+			}
+
+			//nolint:wrapcheck
+			return err
+		}
+
+		_, _ = fmt.Fprintf(stderr, "Exported disk %s (%s %s, %d extents)\n", label, manifest.FS,
+			units.BytesSize(float64(manifest.Size)), len(manifest.Extents))
+
+		return nil
+	})
+}
+
+func importDisk(ctx context.Context, cli *Cli, label, path string, force bool, in io.Reader, out io.Writer) error {
+	if err := cli.setup(); err != nil {
+		return err
+	}
+
+	img, err := host.DiskImage(cli.Config, label)
+	if err != nil {
+		//nolint:wrapcheck
+		return err
+	}
+
+	r := in
+
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			//nolint:wrapcheck
+			return err
+		}
+
+		defer file.Close()
+
+		r = file
+	}
+
+	if img.Exists && !force {
+		if path == "-" {
+			return fmt.Errorf("disk %s exists, use --force to replace it with an archive from stdin", label)
+		}
+
+		if !confirm(in, out, fmt.Sprintf("Replace disk %s and all of its data?", label)) {
+			return nil
+		}
+	}
+
+	return cli.withDaemonStopped(ctx, out, func() error {
+		var manifest *disk.Manifest
+		var importErr error
+
+		if err := host.UpdateDaemonState(cli.Config.StateFile.Resolved, func(state *host.DaemonState) {
+			manifest, state.Disks, importErr = host.ImportDisk(cli.Config, state.Disks, label, r)
+		}); err != nil {
+			//nolint:wrapcheck
+			return err
+		}
+
+		if importErr != nil {
+			//nolint:wrapcheck
+			return importErr
+		}
+
+		_, _ = fmt.Fprintf(out, "Imported disk %s from disk %s (%s %s, exported by railyard %s on %s)\n", label,
+			manifest.Label, manifest.FS, units.BytesSize(float64(manifest.Size)), manifest.Railyard,
+			manifest.Created.Local().Format(time.RFC3339))
+
+		return nil
+	})
+}
+
+// changeDisk... a running daemon stops the VM, applies the change and exits, then it is restarted. Otherwise the
+// change is applied directly while holding the control socket lock, which keeps the daemon from starting.
+func changeDisk(ctx context.Context, cli *Cli, label, size string, purge bool, out io.Writer) error {
+	if err := cli.setup(); err != nil {
+		return err
+	}
+
+	if _, ok := cli.Config.Disks[label]; !ok {
+		return fmt.Errorf("no such disk: %s", label)
+	}
+
+	home := cli.Config.Home
+
+	var err error
+
+	if purge {
+		_, err = client.PurgeDisk(ctx, home, label)
+	} else {
+		_, err = client.ResizeDisk(ctx, home, label, size)
+	}
+
+	if err == nil {
+		_, _ = fmt.Fprintln(out, "Stopping the VM...")
+
+		return cli.restartDaemon(ctx, func() error {
+			//nolint:wrapcheck
+			return host.DiskChangeError(cli.Config.StateFile.Resolved, label)
+		})
+	} else if !errors.Is(err, client.ErrNotRunning) {
+		//nolint:wrapcheck
+		return err
+	}
+
+	return withSocketLock(home, func() error {
+		return applyDiskChange(cli, label, size, purge, out)
+	})
+}
+
+func applyDiskChange(cli *Cli, label, size string, purge bool, out io.Writer) error {
+	img, err := host.DiskImage(cli.Config, label)
+	if err != nil {
+		//nolint:wrapcheck
+		return err
+	}
+
+	change, err := host.ParseDiskChange(img, size, purge)
+	if err != nil {
+		//nolint:wrapcheck
+		return err
+	}
+
+	var applyErr error
+
+	if err := host.UpdateDaemonState(cli.Config.StateFile.Resolved, func(state *host.DaemonState) {
+		state.Disks, applyErr = host.ApplyDiskChange(cli.Config, state.Disks, change)
+	}); err != nil {
+		//nolint:wrapcheck
+		return err
+	}
+
+	if applyErr != nil {
+		//nolint:wrapcheck
+		return applyErr
+	}
+
+	if purge {
+		_, _ = fmt.Fprintf(out, "Disk %s purged\n", label)
+	} else {
+		_, _ = fmt.Fprintf(out, "Disk %s will be resized to %s when the VM starts\n", label, units.BytesSize(float64(change.Size)))
+	}
+
+	return nil
+}
+
+// restartDaemon... waits for the daemon to exit and starts it again through launchd. If check is set, it runs once
+// the daemon has exited, its error is returned after the daemon is started.
+func (cli *Cli) restartDaemon(ctx context.Context, check func() error) error {
+	waitCtx, cancel := context.WithTimeout(ctx, daemonStopTimeout)
+	defer cancel()
+
+	if err := client.WaitStopped(waitCtx, cli.Config.Home); err != nil {
+		return fmt.Errorf("daemon did not stop: %w", err)
+	}
+
+	var checkErr error
+
+	if check != nil {
+		checkErr = check()
+	}
+
+	return errors.Join(checkErr, cli.startDaemon())
+}
+
+func (cli *Cli) startDaemon() error {
+	ctl, err := cli.newLaunchdControl()
+	if err != nil {
+		return err
+	}
+
+	if err := ctl.Restart(); err != nil {
+		log.Warnf("failed to restart the daemon, it starts on the next docker connection: %v", err)
+	}
+
+	return nil
+}
+
+// withDaemonStopped... stops a running daemon and runs fn while holding the control socket lock, so fn can access the
+// disk images directly. The daemon is started again if it was running.
+func (cli *Cli) withDaemonStopped(ctx context.Context, out io.Writer, fn func() error) error {
+	home := cli.Config.Home
+	running := client.Running(home)
+
+	if running {
+		_, _ = fmt.Fprintln(out, "Stopping the VM...")
+
+		ctl, err := cli.newLaunchdControl()
+		if err != nil {
+			return err
+		}
+
+		if err := ctl.Stop(); err != nil {
+			return fmt.Errorf("failed to stop the daemon: %w", err)
+		}
+
+		waitCtx, cancel := context.WithTimeout(ctx, daemonStopTimeout)
+		defer cancel()
+
+		if err := client.WaitStopped(waitCtx, home); err != nil {
+			return fmt.Errorf("daemon did not stop: %w", err)
+		}
+	}
+
+	err := withSocketLock(home, fn)
+
+	if running {
+		if startErr := cli.startDaemon(); err == nil {
+			err = startErr
+		}
+	}
+
+	return err
+}
+
+// withSocketLock... runs fn while holding the control socket lock, which keeps the daemon from starting
+func withSocketLock(home string, fn func() error) error {
+	if err := controlsock.LockSocket(home); err != nil {
+		return fmt.Errorf("failed to lock %s: %w", home, err)
+	}
+
+	defer func() {
+		if err := controlsock.UnlockSocket(home); err != nil {
+			log.Warnf("failed to unlock %s: %v", home, err)
+		}
+	}()
+
+	return fn()
+}
+
+func confirm(in io.Reader, out io.Writer, prompt string) bool {
+	_, _ = fmt.Fprintf(out, "%s [y/N] ", prompt)
+
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	default:
+		return false
+	}
+}
+
+func printImage(out io.Writer, img *disk.Image) {
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+
+	if img.Label != "" {
+		_, _ = fmt.Fprintf(tw, "Disk:\t%s\n", img.Label)
+		_, _ = fmt.Fprintf(tw, "Mount:\t%s\n", img.Mount)
+		_, _ = fmt.Fprintf(tw, "Mounted:\t%t\n", img.Mounted)
+	}
+
+	_, _ = fmt.Fprintf(tw, "Image:\t%s\n", img.Path)
+
+	if !img.Exists {
+		_, _ = fmt.Fprintf(tw, "Image size:\tnot created\n")
+		_ = tw.Flush()
+
+		return
+	}
+
+	_, _ = fmt.Fprintf(tw, "Image size:\t%d\n", img.Size)
+	_, _ = fmt.Fprintf(tw, "Allocated:\t%d\n", img.Allocated)
+
+	fs := img.Filesystem
+
+	if fs == nil {
+		_, _ = fmt.Fprintf(tw, "Filesystem:\tnone\n")
+		_ = tw.Flush()
+
+		return
+	}
+
+	_, _ = fmt.Fprintf(tw, "Filesystem:\t%s\n", fs.Type)
+
+	if fs.Id != uuid.Nil {
+		_, _ = fmt.Fprintf(tw, "UUID:\t%s\n", fs.Id)
+	}
+
+	if fs.Serial != "" {
+		_, _ = fmt.Fprintf(tw, "Serial:\t%s\n", fs.Serial)
+	}
+
+	_, _ = fmt.Fprintf(tw, "Label:\t%s\n", fs.Label)
+	_, _ = fmt.Fprintf(tw, "Size:\t%d\n", fs.Size)
+	_, _ = fmt.Fprintf(tw, "Free:\t%d\n", fs.Free)
+	_, _ = fmt.Fprintf(tw, "Block size:\t%d\n", fs.BlockSize)
+
+	if fs.MaxFiles > 0 {
+		_, _ = fmt.Fprintf(tw, "Inodes:\t%d\n", fs.MaxFiles)
+		_, _ = fmt.Fprintf(tw, "Free inodes:\t%d\n", fs.FreeFiles)
+	}
+
+	if len(fs.Features) > 0 {
+		_, _ = fmt.Fprintf(tw, "Features:\t%s\n", strings.Join(fs.Features, " "))
+	}
+
+	if !fs.Created.IsZero() {
+		_, _ = fmt.Fprintf(tw, "Created:\t%s\n", fs.Created.Local().Format(time.RFC3339))
+	}
+
+	_ = tw.Flush()
+}
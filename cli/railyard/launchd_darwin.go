@@ -298,6 +298,11 @@ func (lc *launchdControl) Restart() error {
 	return run("launchctl", "kickstart", lc.domain+"/"+lc.label)
 }
 
+// Stop... asks the daemon to exit, it is started again by launchd on the next connection
+func (lc *launchdControl) Stop() error {
+	return run("launchctl", "kill", "SIGTERM", lc.domain+"/"+lc.label)
+}
+
 func (lc *launchdControl) Exists() bool {
 	return exec.Command("launchctl", "print", lc.domain+"/"+lc.label) == nil //nolint:gosec
 }
@@ -0,0 +1,128 @@
+package railyard
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/amadigan/macoby/internal/client"
+	"github.com/amadigan/macoby/internal/rpc"
+	"github.com/docker/go-units"
+	"github.com/spf13/cobra"
+)
+
+func NewModulesCommand(cli *Cli) *cobra.Command {
+	var all bool
+
+	cmd := &cobra.Command{
+		Use:   "modules",
+		Short: "List, load and unload guest kernel modules",
+		Long: "List the kernel modules loaded in the guest, or with --all every module built for the guest kernel. " +
+			"Modules loaded here are not loaded again on the next start, add them to modules in the configuration " +
+			"for that. The VM must be running.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return listModules(cmd.Context(), cli, all, cmd.OutOrStdout())
+		},
+	}
+
+	cmd.Flags().BoolVarP(&all, "all", "a", false, "Include the modules that are built in or not loaded")
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "load <module> [parameter=value...]",
+		Short: "Load a kernel module with its dependencies",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return modprobe(cmd.Context(), cli, []string{strings.Join(args, " ")}, false, cmd.OutOrStdout())
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:     "unload <module>...",
+		Aliases: []string{"rm"},
+		Short:   "Unload kernel modules",
+		Long:    "Unload kernel modules that are not in use, their dependencies stay loaded.",
+		Args:    cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return modprobe(cmd.Context(), cli, args, true, cmd.OutOrStdout())
+		},
+	})
+
+	return cmd
+}
+
+func listModules(ctx context.Context, cli *Cli, all bool, out io.Writer) error {
+	if err := cli.setup(); err != nil {
+		return err
+	}
+
+	modules, err := client.ListModules(ctx, cli.Config.Home, all)
+	if err != nil {
+		//nolint:wrapcheck
+		return err
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+
+	_, _ = fmt.Fprintln(tw, "MODULE\tSIZE\tREFS\tUSED BY\tSTATE")
+
+	for _, module := range modules {
+		size, refs := "-", "-"
+
+		if module.Size > 0 {
+			size = units.BytesSize(float64(module.Size))
+			refs = fmt.Sprintf("%d", module.Refs)
+		}
+
+		state := module.State
+		if state == "" {
+			state = "not loaded"
+		}
+
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", module.Name, size, refs, strings.Join(module.UsedBy, ","), state)
+	}
+
+	//nolint:wrapcheck
+	return tw.Flush()
+}
+
+func modprobe(ctx context.Context, cli *Cli, modules []string, remove bool, out io.Writer) error {
+	if err := cli.setup(); err != nil {
+		return err
+	}
+
+	load, verb := client.LoadModules, "load"
+	if remove {
+		load, verb = client.UnloadModules, "unload"
+	}
+
+	results, err := load(ctx, cli.Config.Home, modules)
+	if err != nil {
+		//nolint:wrapcheck
+		return err
+	}
+
+	var failed []string
+
+	for _, result := range results {
+		switch result.Status {
+		case rpc.ModuleLoaded:
+			_, _ = fmt.Fprintf(out, "Loaded %s\n", result.Name)
+		case rpc.ModuleBuiltin:
+			_, _ = fmt.Fprintf(out, "%s is built into the kernel\n", result.Name)
+		case rpc.ModuleRemoved:
+			_, _ = fmt.Fprintf(out, "Unloaded %s\n", result.Name)
+		default:
+			_, _ = fmt.Fprintf(out, "%s %s: %s\n", result.Name, result.Status, result.Error)
+			failed = append(failed, result.Name)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to %s modules: %s", verb, strings.Join(failed, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package railyard
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/amadigan/macoby/internal/client"
+	"github.com/amadigan/macoby/internal/event"
+	"github.com/docker/go-units"
+	"github.com/spf13/cobra"
+)
+
+func NewPruneCommand(cli *Cli) *cobra.Command {
+	var dryRun bool
+
+	cmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Remove unused docker data",
+		Long: "Remove stopped containers, dangling images and unused build cache according to the prune policy in the " +
+			"configuration, or all of them if there is no policy. The VM must be running.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return prune(cmd.Context(), cli, dryRun, cmd.OutOrStdout())
+		},
+	}
+
+	cmd.Flags().BoolVarP(&dryRun, "dry-run", "n", false, "Show what would be removed without removing it")
+
+	return cmd
+}
+
+func prune(ctx context.Context, cli *Cli, dryRun bool, out io.Writer) error {
+	if err := cli.setup(); err != nil {
+		return err
+	}
+
+	report, err := client.Prune(ctx, cli.Config.Home, dryRun)
+	if err != nil {
+		//nolint:wrapcheck
+		return err
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+
+	_, _ = fmt.Fprintln(tw, "TYPE\tID\tNAME\tSIZE\tAGE")
+
+	for _, kind := range []struct {
+		name  string
+		items []event.PrunedItem
+	}{{"container", report.Containers}, {"image", report.Images}, {"build cache", report.BuildCache}} {
+		for _, item := range kind.items {
+			_, _ = fmt.Fprintf(tw, "%s\t%.12s\t%s\t%s\t%s\n", kind.name, item.ID, item.Name,
+				units.BytesSize(float64(item.Size)), units.HumanDuration(time.Since(item.Created)))
+		}
+	}
+
+	if err := tw.Flush(); err != nil {
+		//nolint:wrapcheck
+		return err
+	}
+
+	verb := "Reclaimed"
+	if report.DryRun {
+		verb = "Would reclaim"
+	}
+
+	_, _ = fmt.Fprintf(out, "%s %s\n", verb, units.BytesSize(float64(report.Reclaimed)))
+
+	return nil
+}
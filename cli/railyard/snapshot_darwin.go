@@ -0,0 +1,211 @@
+package railyard
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/amadigan/macoby/internal/client"
+	"github.com/amadigan/macoby/internal/host"
+	"github.com/amadigan/macoby/internal/host/disk"
+	"github.com/amadigan/macoby/internal/util"
+	"github.com/docker/go-units"
+	"github.com/spf13/cobra"
+)
+
+// dockerDataRoot... the default disk for snapshots is the one holding the docker data
+const dockerDataRoot = "/var/lib/docker"
+
+func NewSnapshotCommand(cli *Cli) *cobra.Command {
+	var label string
+
+	cmd := &cobra.Command{
+		Use:   "snapshot",
+		Short: "Manage btrfs snapshots of a disk",
+		Long: "Manage btrfs snapshots of a disk, by default the disk holding the docker data. Snapshots include the " +
+			"nested subvolumes of the disk, such as the layers of the docker btrfs storage driver. The VM must be running.",
+	}
+
+	cmd.PersistentFlags().StringVarP(&label, "disk", "d", "", "The disk to snapshot")
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "create <name>",
+		Short: "Snapshot a disk",
+		Long: "Snapshot a disk while it is in use. Each subvolume is snapshotted atomically, stop the containers " +
+			"first for a consistent snapshot of all of them.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return createSnapshot(cmd.Context(), cli, label, args[0], cmd.OutOrStdout())
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:     "ls",
+		Aliases: []string{"list"},
+		Short:   "List the snapshots of a disk",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return listSnapshots(cmd.Context(), cli, label, cmd.OutOrStdout())
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:     "rm <name>",
+		Aliases: []string{"delete"},
+		Short:   "Delete a snapshot",
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return deleteSnapshot(cmd.Context(), cli, label, args[0], cmd.OutOrStdout())
+		},
+	})
+
+	cmd.AddCommand(newSnapshotRestoreCommand(cli, &label))
+
+	return cmd
+}
+
+func newSnapshotRestoreCommand(cli *Cli, label *string) *cobra.Command {
+	var force bool
+
+	cmd := &cobra.Command{
+		Use:   "restore <name>",
+		Short: "Restore a disk to a snapshot",
+		Long: "Replace the contents of a disk with a snapshot, everything written since the snapshot is lost. dockerd " +
+			"is stopped for the restore, then the VM is restarted. The snapshot is kept.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return restoreSnapshot(cmd.Context(), cli, *label, args[0], force, cmd.InOrStdin(), cmd.OutOrStdout())
+		},
+	}
+
+	cmd.Flags().BoolVarP(&force, "force", "f", false, "Do not prompt for confirmation")
+
+	return cmd
+}
+
+func createSnapshot(ctx context.Context, cli *Cli, label, name string, out io.Writer) error {
+	label, err := cli.snapshotDisk(label)
+	if err != nil {
+		return err
+	}
+
+	snapshot, err := client.CreateSnapshot(ctx, cli.Config.Home, label, name)
+	if err != nil {
+		//nolint:wrapcheck
+		return err
+	}
+
+	_, _ = fmt.Fprintf(out, "Created snapshot %s of disk %s\n", snapshot.Name, label)
+
+	return nil
+}
+
+func listSnapshots(ctx context.Context, cli *Cli, label string, out io.Writer) error {
+	label, err := cli.snapshotDisk(label)
+	if err != nil {
+		return err
+	}
+
+	snapshots, err := client.ListSnapshots(ctx, cli.Config.Home, label)
+	if err != nil {
+		//nolint:wrapcheck
+		return err
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+
+	_, _ = fmt.Fprintln(tw, "SNAPSHOT\tCREATED")
+
+	for _, snapshot := range snapshots {
+		_, _ = fmt.Fprintf(tw, "%s\t%s ago\n", snapshot.Name, units.HumanDuration(time.Since(snapshot.Created)))
+	}
+
+	//nolint:wrapcheck
+	return tw.Flush()
+}
+
+func deleteSnapshot(ctx context.Context, cli *Cli, label, name string, out io.Writer) error {
+	label, err := cli.snapshotDisk(label)
+	if err != nil {
+		return err
+	}
+
+	if err := client.DeleteSnapshot(ctx, cli.Config.Home, label, name); err != nil {
+		//nolint:wrapcheck
+		return err
+	}
+
+	_, _ = fmt.Fprintf(out, "Deleted snapshot %s of disk %s\n", name, label)
+
+	return nil
+}
+
+func restoreSnapshot(ctx context.Context, cli *Cli, label, name string, force bool, in io.Reader, out io.Writer) error {
+	label, err := cli.snapshotDisk(label)
+	if err != nil {
+		return err
+	}
+
+	prompt := fmt.Sprintf("Restore disk %s to snapshot %s? Everything written since is lost.", label, name)
+
+	if !force && !confirm(in, out, prompt) {
+		return nil
+	}
+
+	if err := client.RestoreSnapshot(ctx, cli.Config.Home, label, name); err != nil {
+		//nolint:wrapcheck
+		return err
+	}
+
+	_, _ = fmt.Fprintln(out, "Stopping dockerd to restore the snapshot...")
+
+	if err := cli.restartDaemon(ctx, nil); err != nil {
+		return err
+	}
+
+	_, _ = fmt.Fprintf(out, "Restored disk %s to snapshot %s\n", label, name)
+
+	return nil
+}
+
+// snapshotDisk... the disk named by --disk, or the btrfs disk holding the docker data, or the only btrfs disk
+func (cli *Cli) snapshotDisk(label string) (string, error) {
+	if err := cli.setup(); err != nil {
+		return "", err
+	}
+
+	if label != "" {
+		info, ok := cli.Config.Disks[label]
+		if !ok {
+			return "", fmt.Errorf("no such disk: %s", label)
+		}
+
+		//nolint:wrapcheck
+		return label, host.SnapshotsSupported(label, info)
+	}
+
+	var candidates []string
+
+	for _, name := range util.SortKeys(cli.Config.Disks) {
+		info := cli.Config.Disks[name]
+
+		if host.SnapshotsSupported(name, info) != nil {
+			continue
+		} else if info.Mount == dockerDataRoot {
+			return name, nil
+		}
+
+		candidates = append(candidates, name)
+	}
+
+	switch len(candidates) {
+	case 0:
+		return "", fmt.Errorf("no disk supports snapshots, snapshots need a %s disk", disk.FSbtrfs)
+	case 1:
+		return candidates[0], nil
+	default:
+		return "", fmt.Errorf("more than one disk supports snapshots, choose one with --disk: %v", candidates)
+	}
+}
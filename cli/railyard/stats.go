@@ -3,26 +3,37 @@ package railyard
 import (
 	"context"
 	"fmt"
+	"io"
+	"slices"
 	"strings"
+	"text/tabwriter"
 
 	"github.com/amadigan/macoby/internal/client"
 	"github.com/amadigan/macoby/internal/event"
 	"github.com/spf13/cobra"
 )
 
+type statsOptions struct {
+	Containers bool
+}
+
 func NewStatsCommand(cli *Cli) *cobra.Command {
+	var so statsOptions
+
 	cmd := &cobra.Command{
 		Use:   "stats",
 		Short: "Show statistics",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return stats(cmd.Context(), cli)
+			return stats(cmd.Context(), cli, so, cmd.OutOrStdout())
 		},
 	}
 
+	cmd.Flags().BoolVarP(&so.Containers, "containers", "c", false, "Show per-container statistics")
+
 	return cmd
 }
 
-func stats(ctx context.Context, cli *Cli) error {
+func stats(ctx context.Context, cli *Cli, so statsOptions, out io.Writer) error {
 	if err := cli.setup(); err != nil {
 		return err
 	}
@@ -35,7 +46,11 @@ func stats(ctx context.Context, cli *Cli) error {
 		panic(err)
 	}
 
-	printMetrics(sync.Metrics)
+	if so.Containers {
+		printContainerMetrics(out, sync.Containers)
+	} else {
+		printMetrics(sync.Metrics)
+	}
 
 	for {
 		select {
@@ -46,10 +61,24 @@ func stats(ctx context.Context, cli *Cli) error {
 				return nil
 			}
 
-			if metrics, ok := ev.Event.(event.Metrics); ok {
-				printMetrics(metrics)
-			} else {
-				log.Warnf("unexpected event: %T %+v", ev.Event, ev.Event)
+			switch ev := ev.Event.(type) {
+			case event.Metrics:
+				if !so.Containers {
+					printMetrics(ev)
+				}
+			case event.ContainerMetrics:
+				if so.Containers {
+					printContainerMetrics(out, ev)
+				}
+			case event.DiskLow:
+				if ev.LowSpace || ev.LowInodes {
+					log.Warnf("disk %s is low: %d / %d, inodes %d / %d", ev.Label, ev.Disk.Free, ev.Disk.Total,
+						ev.Disk.FreeFiles, ev.Disk.MaxFiles)
+				} else {
+					log.Infof("disk %s has recovered", ev.Label)
+				}
+			default:
+				log.Debugf("ignoring event: %T %+v", ev, ev)
 			}
 		}
 	}
@@ -62,8 +91,35 @@ func printMetrics(metrics event.Metrics) {
 		metrics.Loads[1], metrics.Loads[2], metrics.MemFree, metrics.Mem))
 
 	for label, disk := range metrics.Disks {
-		buf.WriteString(fmt.Sprintf(", %s: %d / %d", label, disk.Free, disk.Total))
+		buf.WriteString(fmt.Sprintf(", %s: %d / %d (%d allocated)", label, disk.Free, disk.Total, disk.Allocated))
 	}
 
 	log.Info(buf.String())
 }
+
+func printContainerMetrics(out io.Writer, metrics event.ContainerMetrics) {
+	conts := slices.Clone(metrics.Containers)
+
+	// heaviest memory users first
+	slices.SortFunc(conts, func(left, right event.ContainerStats) int {
+		switch {
+		case left.MemoryCurrent > right.MemoryCurrent:
+			return -1
+		case left.MemoryCurrent < right.MemoryCurrent:
+			return 1
+		default:
+			return strings.Compare(left.ID, right.ID)
+		}
+	})
+
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+
+	_, _ = fmt.Fprintln(tw, "CONTAINER\tNAME\tCPU (s)\tMEM\tMEM PEAK\tIO READ\tIO WRITE\tPIDS")
+
+	for _, cont := range conts {
+		_, _ = fmt.Fprintf(tw, "%.12s\t%s\t%.2f\t%d\t%d\t%d\t%d\t%d\n", cont.ID, cont.Name,
+			float64(cont.CPUUsage)/1e6, cont.MemoryCurrent, cont.MemoryPeak, cont.IORead, cont.IOWrite, cont.Pids)
+	}
+
+	_ = tw.Flush()
+}
@@ -0,0 +1,205 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/amadigan/macoby/internal/controlsock"
+	"github.com/amadigan/macoby/internal/event"
+	"github.com/amadigan/macoby/internal/host/disk"
+	"github.com/amadigan/macoby/internal/rpc"
+)
+
+// ErrNotRunning... the daemon is not listening on the control socket
+var ErrNotRunning = errors.New("daemon is not running")
+
+// Running... checks whether the daemon accepts connections on the control socket
+func Running(home string) bool {
+	conn, err := controlsock.DialSocket(home)
+	if err != nil {
+		return false
+	}
+
+	_ = conn.Close()
+
+	return true
+}
+
+// WaitStopped... waits for the daemon to close the control socket
+func WaitStopped(ctx context.Context, home string) error {
+	for Running(home) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err() //nolint:wrapcheck
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+
+	return nil
+}
+
+func ListDisks(ctx context.Context, home string) ([]*disk.Image, error) {
+	var rv []*disk.Image
+
+	return rv, call(ctx, home, http.MethodGet, "/disks", nil, &rv)
+}
+
+func InspectDisk(ctx context.Context, home string, label string) (*disk.Image, error) {
+	var rv disk.Image
+
+	return &rv, call(ctx, home, http.MethodGet, "/disks/"+url.PathEscape(label), nil, &rv)
+}
+
+// ResizeDisk... asks the daemon to resize a disk, the daemon exits once the VM is stopped and the change is recorded
+func ResizeDisk(ctx context.Context, home string, label string, size string) (*disk.Image, error) {
+	var rv disk.Image
+
+	req := map[string]string{"size": size}
+
+	return &rv, call(ctx, home, http.MethodPost, "/disks/"+url.PathEscape(label)+"/resize", req, &rv)
+}
+
+// PurgeDisk... asks the daemon to delete a disk image, the daemon exits once the VM is stopped and the image deleted
+func PurgeDisk(ctx context.Context, home string, label string) (*disk.Image, error) {
+	var rv disk.Image
+
+	return &rv, call(ctx, home, http.MethodPost, "/disks/"+url.PathEscape(label)+"/purge", nil, &rv)
+}
+
+// TrimDisks... asks the daemon to trim the writable disks, the VM must be running
+func TrimDisks(ctx context.Context, home string) ([]rpc.TrimResult, error) {
+	var rv []rpc.TrimResult
+
+	return rv, call(ctx, home, http.MethodPost, "/disks/trim", nil, &rv)
+}
+
+// Prune... asks the daemon to prune unused docker data with the configured prune policy, a dry run only reports what
+// would be removed
+func Prune(ctx context.Context, home string, dryRun bool) (*event.PruneReport, error) {
+	var rv event.PruneReport
+
+	return &rv, call(ctx, home, http.MethodPost, "/docker/prune?dry-run="+strconv.FormatBool(dryRun), nil, &rv)
+}
+
+// ListSnapshots... lists the btrfs snapshots of a disk, oldest first
+func ListSnapshots(ctx context.Context, home string, label string) ([]rpc.Snapshot, error) {
+	var rv []rpc.Snapshot
+
+	return rv, call(ctx, home, http.MethodGet, snapshotsPath(label), nil, &rv)
+}
+
+// CreateSnapshot... snapshots a disk while it is in use
+func CreateSnapshot(ctx context.Context, home string, label string, name string) (*rpc.Snapshot, error) {
+	var rv rpc.Snapshot
+
+	req := map[string]string{"name": name}
+
+	return &rv, call(ctx, home, http.MethodPost, snapshotsPath(label), req, &rv)
+}
+
+// DeleteSnapshot... deletes a snapshot of a disk
+func DeleteSnapshot(ctx context.Context, home string, label string, name string) error {
+	return call(ctx, home, http.MethodDelete, snapshotsPath(label)+"/"+url.PathEscape(name), nil, nil)
+}
+
+// RestoreSnapshot... asks the daemon to restore a snapshot, the daemon stops dockerd, restores the snapshot and exits
+// once the VM is stopped
+func RestoreSnapshot(ctx context.Context, home string, label string, name string) error {
+	return call(ctx, home, http.MethodPost, snapshotsPath(label)+"/"+url.PathEscape(name)+"/restore", nil, nil)
+}
+
+// ListModules... the loaded kernel modules of the guest, or with all every module the guest kernel knows
+func ListModules(ctx context.Context, home string, all bool) ([]rpc.Module, error) {
+	var rv []rpc.Module
+
+	return rv, call(ctx, home, http.MethodGet, "/modules?all="+strconv.FormatBool(all), nil, &rv)
+}
+
+// LoadModules... loads kernel modules with their dependencies, each module is a name optionally followed by its
+// parameters. A module that is missing or fails to load is reported in its result.
+func LoadModules(ctx context.Context, home string, modules []string) ([]rpc.ModuleResult, error) {
+	var rv []rpc.ModuleResult
+
+	return rv, call(ctx, home, http.MethodPost, "/modules/load", map[string][]string{"modules": modules}, &rv)
+}
+
+// UnloadModules... unloads kernel modules, a module that is in use or missing is reported in its result
+func UnloadModules(ctx context.Context, home string, modules []string) ([]rpc.ModuleResult, error) {
+	var rv []rpc.ModuleResult
+
+	return rv, call(ctx, home, http.MethodPost, "/modules/unload", map[string][]string{"modules": modules}, &rv)
+}
+
+func snapshotsPath(label string) string {
+	return "/disks/" + url.PathEscape(label) + "/snapshots"
+}
+
+func call(ctx context.Context, home, method, path string, in any, out any) error {
+	var body io.Reader
+
+	if in != nil {
+		bs, err := json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
+		}
+
+		body = bytes.NewReader(bs)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, "http://localhost"+path, body)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+				return controlsock.DialSocket(home)
+			},
+		},
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return ErrNotRunning
+		}
+
+		return fmt.Errorf("%s %s failed: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	bs, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: %s", method, path, strings.TrimSpace(string(bs)))
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	if err := json.Unmarshal(bs, out); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	return nil
+}
@@ -142,3 +142,8 @@ func ListenSocket(home string) (*net.UnixListener, error) {
 func DialSocket(home string) (*net.UnixConn, error) {
 	return net.DialUnix("unix", nil, &net.UnixAddr{Name: socketPath(home), Net: "unix"})
 }
+
+// UnlockSocket... removes a lock taken with LockSocket
+func UnlockSocket(home string) error {
+	return os.Remove(socketPath(home))
+}
@@ -1,9 +1,26 @@
 package event
 
+import (
+	"net"
+	"time"
+)
+
 func init() {
 	RegisterEventType(OpenLogFile{})
 	RegisterEventType(DeleteLogFile{})
 	RegisterEventType(Metrics{})
+	RegisterEventType(ContainerMetrics{})
+	RegisterEventType(OOMKill{})
+	RegisterEventType(DiskGrowth{})
+	RegisterEventType(DiskLow{})
+	RegisterEventType(PruneReport{})
+	RegisterEventType(PreloadProgress{})
+	RegisterEventType(ProvisionResult{})
+	RegisterEventType(ModuleLoad{})
+	RegisterEventType(LifecyclePoint{})
+	RegisterEventType(ServiceState{})
+	RegisterEventType(ClockStats{})
+	RegisterEventType(AddressChange{})
 	RegisterEventType(Status(""))
 }
 
@@ -33,6 +50,146 @@ type DiskMetrics struct {
 	Free      uint64
 	MaxFiles  uint64
 	FreeFiles uint64
+	ImageSize uint64 // logical size of the disk image on the host
+	Allocated uint64 // bytes allocated to the disk image on the host, what is not used in the guest can be trimmed
+}
+
+type ContainerMetrics struct {
+	Containers []ContainerStats
+}
+
+type ContainerStats struct {
+	ID            string
+	Name          string
+	CPUUsage      uint64 // in microseconds
+	MemoryCurrent uint64
+	MemoryPeak    uint64
+	IORead        uint64
+	IOWrite       uint64
+	Pids          uint64
+	OOMKills      uint64
+}
+
+// OOMKill... the kernel OOM killer was invoked, ContainerID is empty for processes outside of a container
+type OOMKill struct {
+	ContainerID string
+	Name        string
+	Kills       uint64
+}
+
+// DiskGrowth... a disk low on free space was grown by its autogrow policy. Unless Online, the guest could not see the
+// new size of the device and the filesystem is grown on the next start. Restart is set if the daemon stops for that,
+// it does not start again by itself, launchd starts it on the next docker connection.
+type DiskGrowth struct {
+	Label   string
+	Mount   string
+	From    uint64
+	To      uint64
+	Online  bool
+	Restart bool
+}
+
+// DiskLow... the free space or inodes of a disk crossed the thresholds of its alert, emitted when LowSpace or
+// LowInodes change, both are false once the disk has recovered
+type DiskLow struct {
+	Label     string
+	Mount     string
+	LowSpace  bool
+	LowInodes bool
+	Disk      DiskMetrics
+}
+
+// PruneReport... unused docker data removed by a prune, or that would be removed in a dry run. Reclaimed is the sum
+// of the sizes reported by dockerd, shared image layers may make it an overestimate.
+type PruneReport struct {
+	DryRun     bool
+	Reason     string
+	Containers []PrunedItem
+	Images     []PrunedItem
+	BuildCache []PrunedItem
+	Reclaimed  uint64
+}
+
+type PrunedItem struct {
+	ID      string
+	Name    string
+	Size    uint64
+	Created time.Time
+}
+
+// PreloadProgress... the progress of loading a preload source into dockerd. Sent and Total are bytes read from the
+// source, Total is zero if unknown. Emitted while loading and once the source is loaded, skipped or failed.
+type PreloadProgress struct {
+	Source string
+	Images []string
+	Status string
+	Sent   uint64
+	Total  uint64
+	Error  string
+}
+
+const (
+	PreloadLoading = "loading"
+	PreloadLoaded  = "loaded"
+	PreloadSkipped = "skipped"
+	PreloadFailed  = "failed"
+)
+
+// ProvisionResult... the outcome of a provisioning script, Output is the end of its combined output
+type ProvisionResult struct {
+	Name     string
+	Run      string
+	Status   string
+	Exit     int
+	Output   string
+	Error    string
+	Duration time.Duration
+}
+
+const (
+	ProvisionDone   = "done"
+	ProvisionFailed = "failed"
+)
+
+// ModuleLoad... the outcome of loading a kernel module of the configuration at boot, Error is set unless the status is
+// loaded or builtin
+type ModuleLoad struct {
+	Name   string
+	Status string
+	Error  string
+}
+
+// LifecyclePoint... the daemon reached a point of its lifecycle, such as pre-start or dockerd-ready
+type LifecyclePoint struct {
+	Name string
+}
+
+type ServiceState struct {
+	Name  string
+	Pid   int64
+	State string
+	Exit  int
+}
+
+const (
+	ServiceStarted = "started"
+	ServiceExited  = "exited"
+)
+
+// ClockStats... the result of a guest clock synchronization
+type ClockStats struct {
+	Offset    time.Duration
+	Delay     time.Duration
+	Jitter    time.Duration
+	Frequency float64 // in ppm
+	Samples   int
+	Step      bool
+}
+
+// AddressChange... the guest was assigned a new IPv4 address, or configured a new global IPv6 address
+type AddressChange struct {
+	Interface string
+	Address   net.IP
 }
 
 type LogFile struct {
@@ -51,7 +208,8 @@ const (
 )
 
 type Sync struct {
-	Status  Status               `json:"status"`
-	Metrics Metrics              `json:"metrics"`
-	Logs    map[string][]LogFile `json:"logs"`
+	Status     Status               `json:"status"`
+	Metrics    Metrics              `json:"metrics"`
+	Containers ContainerMetrics     `json:"containers"`
+	Logs       map[string][]LogFile `json:"logs"`
 }
@@ -211,17 +211,25 @@ func (l *listeners[T]) close() {
 }
 
 func Emit(ctx context.Context, event any) {
-	bus, ok := ctx.Value(ctxBus{}).(*bus)
-
-	if !ok {
-		return
-	}
+	EmitEnvelope(ctx, NewEnvelope(event))
+}
 
-	e := Envelope{
+// NewEnvelope... wraps an event with a new ID and the current time
+func NewEnvelope(event any) Envelope {
+	return Envelope{
 		Event: event,
 		ID:    uuid.New(),
 		Time:  time.Now(),
 	}
+}
+
+// EmitEnvelope... emits an event that is already wrapped, so the envelope can also be passed on elsewhere
+func EmitEnvelope(ctx context.Context, e Envelope) {
+	bus, ok := ctx.Value(ctxBus{}).(*bus)
+
+	if !ok {
+		return
+	}
 
 	bus.mutex.RLock()
 	defer bus.mutex.RUnlock()
@@ -0,0 +1,227 @@
+package guest
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/amadigan/macoby/internal/rpc"
+)
+
+const (
+	localCertDir   = "/usr/local/share/ca-certificates"
+	dockerCertsDir = "/etc/docker/certs.d"
+	certBundle     = "/etc/ssl/certs/ca-certificates.crt"
+	// certManifest... the names of the certificates installed in a registry directory, other files are left alone
+	certManifest = ".certificates"
+)
+
+// ReadSystemBundle... reads the CA bundle of the read-only root filesystem, which must happen before the upper layer
+// is stacked over it, as a persistent upper layer holds the bundle regenerated on the previous boot
+func ReadSystemBundle() ([]byte, error) {
+	bundle, err := os.ReadFile(certBundle)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Failed to read %s: %v", certBundle, err)
+	}
+
+	return bundle, nil
+}
+
+// AddCertificates... replaces the certificates installed on this or a previous boot, the upper layer of the root may
+// be kept on a disk, and regenerates the bundle from the system bundle and the local certificates. Registry
+// certificates are also installed for dockerd.
+func (g *Guest) AddCertificates(certs []rpc.Certificate, _ *struct{}) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	return installCertificates("/", g.systemBundle, certs)
+}
+
+// installCertificates... installs the certificates in the directories below root, removing any installed before
+func installCertificates(root string, systemBundle []byte, certs []rpc.Certificate) error {
+	localDir := filepath.Join(root, localCertDir)
+	dockerDir := filepath.Join(root, dockerCertsDir)
+	pemData := make([][]byte, len(certs))
+
+	// every certificate is checked before the installed ones are removed
+	for i, cert := range certs {
+		name := filepath.Base(cert.Name)
+		if name == "." || name == "/" || name == ".." {
+			return fmt.Errorf("Invalid certificate name %s", cert.Name)
+		}
+
+		if cert.Registry != "" && (strings.ContainsRune(cert.Registry, '/') || cert.Registry == "." ||
+			cert.Registry == "..") {
+			return fmt.Errorf("Invalid registry %s", cert.Registry)
+		}
+
+		data, err := ValidateCertificates(cert.PEM)
+		if err != nil {
+			return fmt.Errorf("Invalid certificate %s: %v", cert.Name, err)
+		}
+
+		pemData[i] = data
+	}
+
+	if err := removeCertificates(localDir, dockerDir); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(localDir, 0755); err != nil {
+		return fmt.Errorf("Failed to create %s: %v", localDir, err)
+	}
+
+	registries := map[string][]string{}
+
+	for i, cert := range certs {
+		name := filepath.Base(cert.Name) + ".crt"
+
+		if err := os.WriteFile(filepath.Join(localDir, name), pemData[i], 0644); err != nil {
+			return fmt.Errorf("Failed to write certificate %s: %v", name, err)
+		}
+
+		if cert.Registry != "" {
+			dir := filepath.Join(dockerDir, cert.Registry)
+
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return fmt.Errorf("Failed to create %s: %v", dir, err)
+			}
+
+			if err := os.WriteFile(filepath.Join(dir, name), pemData[i], 0644); err != nil {
+				return fmt.Errorf("Failed to write certificate %s for %s: %v", name, cert.Registry, err)
+			}
+
+			registries[cert.Registry] = append(registries[cert.Registry], name)
+		}
+
+		log.Infof("Installed CA certificate %s", name)
+	}
+
+	for registry, names := range registries {
+		manifest := filepath.Join(dockerDir, registry, certManifest)
+
+		if err := os.WriteFile(manifest, []byte(strings.Join(names, "\n")+"\n"), 0644); err != nil {
+			return fmt.Errorf("Failed to write %s: %v", manifest, err)
+		}
+	}
+
+	return writeBundle(filepath.Join(root, certBundle), systemBundle, localDir)
+}
+
+// removeCertificates... removes the local certificate directory and the certificates listed in the manifest of each
+// registry directory, a registry directory left empty is removed
+func removeCertificates(localDir, dockerDir string) error {
+	if err := os.RemoveAll(localDir); err != nil {
+		return fmt.Errorf("Failed to remove %s: %v", localDir, err)
+	}
+
+	entries, err := os.ReadDir(dockerDir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Failed to read %s: %v", dockerDir, err)
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		dir := filepath.Join(dockerDir, entry.Name())
+
+		manifest, err := os.ReadFile(filepath.Join(dir, certManifest))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("Failed to read the certificates of %s: %v", entry.Name(), err)
+		}
+
+		for _, name := range append(strings.Fields(string(manifest)), certManifest) {
+			if err := os.Remove(filepath.Join(dir, filepath.Base(name))); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("Failed to remove certificate %s of %s: %v", name, entry.Name(), err)
+			}
+		}
+
+		if rest, err := os.ReadDir(dir); err == nil && len(rest) == 0 {
+			if err := os.Remove(dir); err != nil {
+				return fmt.Errorf("Failed to remove %s: %v", dir, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// writeBundle... writes the system bundle followed by every certificate in localDir to path
+func writeBundle(path string, systemBundle []byte, localDir string) error {
+	bundle := bytes.NewBuffer(append([]byte{}, systemBundle...))
+
+	entries, err := os.ReadDir(localDir)
+	if err != nil {
+		return fmt.Errorf("Failed to read %s: %v", localDir, err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".crt") {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(localDir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("Failed to read %s: %v", entry.Name(), err)
+		}
+
+		if bundle.Len() > 0 && !bytes.HasSuffix(bundle.Bytes(), []byte("\n")) {
+			bundle.WriteByte('\n')
+		}
+
+		bundle.Write(data)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("Failed to create %s: %v", filepath.Dir(path), err)
+	}
+
+	if err := os.WriteFile(path, bundle.Bytes(), 0644); err != nil {
+		return fmt.Errorf("Failed to write %s: %v", path, err)
+	}
+
+	return nil
+}
+
+// ValidateCertificates... parses every certificate in the PEM data, returning the certificates re-encoded without
+// any other blocks or text
+func ValidateCertificates(data []byte) ([]byte, error) {
+	var out bytes.Buffer
+
+	for {
+		var block *pem.Block
+
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			return nil, err
+		}
+
+		if err := pem.Encode(&out, block); err != nil {
+			return nil, err
+		}
+	}
+
+	if out.Len() == 0 {
+		return nil, fmt.Errorf("no certificates found")
+	}
+
+	return out.Bytes(), nil
+}
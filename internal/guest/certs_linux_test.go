@@ -0,0 +1,142 @@
+package guest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amadigan/macoby/internal/rpc"
+)
+
+func testCertificate(t *testing.T, name string) []byte {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func dirNames(t *testing.T, dir string) []string {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+
+	var names []string
+
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+
+	return names
+}
+
+func TestInstallCertificatesReplaces(t *testing.T) {
+	root := t.TempDir()
+	system := []byte("# system bundle\n")
+	first, second, third := testCertificate(t, "first"), testCertificate(t, "second"), testCertificate(t, "third")
+
+	// a certificate installed by someone else in a registry directory is kept
+	userCert := filepath.Join(root, dockerCertsDir, "old.example.test", "user.crt")
+
+	if err := os.MkdirAll(filepath.Dir(userCert), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(userCert, first, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := installCertificates(root, system, []rpc.Certificate{
+		{Name: "first", Registry: "old.example.test", PEM: first},
+		{Name: "second", Registry: "gone.example.test", PEM: second},
+	})
+	if err != nil {
+		t.Fatalf("first install: %v", err)
+	}
+
+	// the next boot, with a persistent upper layer and a changed list
+	err = installCertificates(root, system, []rpc.Certificate{
+		{Name: "third", Registry: "new.example.test", PEM: third},
+	})
+	if err != nil {
+		t.Fatalf("second install: %v", err)
+	}
+
+	if got := dirNames(t, filepath.Join(root, localCertDir)); !slices.Equal(got, []string{"third.crt"}) {
+		t.Errorf("local certificates = %v, want [third.crt]", got)
+	}
+
+	registries := filepath.Join(root, dockerCertsDir)
+
+	if got := dirNames(t, registries); !slices.Equal(got, []string{"new.example.test", "old.example.test"}) {
+		t.Errorf("registries = %v, want [new.example.test old.example.test]", got)
+	}
+
+	if got := dirNames(t, filepath.Join(registries, "old.example.test")); !slices.Equal(got, []string{"user.crt"}) {
+		t.Errorf("old.example.test = %v, want [user.crt]", got)
+	}
+
+	if data, err := os.ReadFile(filepath.Join(registries, "new.example.test", "third.crt")); err != nil ||
+		string(data) != string(third) {
+		t.Errorf("new.example.test/third.crt = %q, %v", data, err)
+	}
+
+	bundle, err := os.ReadFile(filepath.Join(root, certBundle))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := string(system) + string(third); string(bundle) != want {
+		t.Errorf("bundle holds %d certificates, want the system bundle and third",
+			strings.Count(string(bundle), "BEGIN CERTIFICATE"))
+	}
+}
+
+func TestInstallCertificatesInvalid(t *testing.T) {
+	root := t.TempDir()
+	cert := testCertificate(t, "kept")
+
+	if err := installCertificates(root, nil, []rpc.Certificate{{Name: "kept", PEM: cert}}); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+
+	// a rejected list leaves the installed certificates alone
+	err := installCertificates(root, nil, []rpc.Certificate{{Name: "bad", PEM: []byte("not a certificate")}})
+	if err == nil {
+		t.Fatal("installed an invalid certificate")
+	}
+
+	if got := dirNames(t, filepath.Join(root, localCertDir)); !slices.Equal(got, []string{"kept.crt"}) {
+		t.Errorf("local certificates = %v, want [kept.crt]", got)
+	}
+}
@@ -0,0 +1,199 @@
+package guest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/amadigan/macoby/internal/event"
+)
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+func (g *Guest) ContainerMetrics(_ struct{}, out *event.ContainerMetrics) error {
+	var rv event.ContainerMetrics
+
+	err := filepath.WalkDir(cgroupRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// cgroups may be removed while walking
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+
+			return err
+		}
+
+		if !d.IsDir() {
+			return nil
+		}
+
+		id := containerID(d.Name())
+		if id == "" {
+			return nil
+		}
+
+		stats, err := readContainerStats(path)
+		if err != nil {
+			log.Warnf("Failed to read cgroup %s: %v", path, err)
+		} else {
+			stats.ID = id
+			rv.Containers = append(rv.Containers, stats)
+		}
+
+		// nested cgroups belong to the container
+		return filepath.SkipDir
+	})
+
+	if err != nil {
+		return fmt.Errorf("Failed to walk %s: %v", cgroupRoot, err)
+	}
+
+	*out = rv
+
+	return nil
+}
+
+// containerID extracts the container ID from a cgroup directory name, either <id> (cgroupfs driver) or
+// docker-<id>.scope (systemd driver)
+func containerID(name string) string {
+	name = strings.TrimSuffix(strings.TrimPrefix(name, "docker-"), ".scope")
+
+	if len(name) != 64 {
+		return ""
+	}
+
+	for _, c := range name {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return ""
+		}
+	}
+
+	return name
+}
+
+func readContainerStats(dir string) (event.ContainerStats, error) {
+	var stats event.ContainerStats
+
+	cpu, err := readCgroupKeyed(filepath.Join(dir, "cpu.stat"))
+	if err != nil {
+		return stats, err
+	}
+
+	stats.CPUUsage = cpu["usage_usec"]
+
+	if stats.MemoryCurrent, err = readCgroupValue(filepath.Join(dir, "memory.current")); err != nil {
+		return stats, err
+	}
+
+	// memory.peak is only available on newer kernels
+	if stats.MemoryPeak, err = readCgroupValue(filepath.Join(dir, "memory.peak")); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return stats, err
+	}
+
+	// pids.current is missing unless the pids controller is enabled for the cgroup
+	if stats.Pids, err = readCgroupValue(filepath.Join(dir, "pids.current")); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return stats, err
+	}
+
+	events, err := readCgroupKeyed(filepath.Join(dir, "memory.events"))
+	if err != nil {
+		return stats, err
+	}
+
+	stats.OOMKills = events["oom_kill"]
+
+	stats.IORead, stats.IOWrite, err = readCgroupIO(filepath.Join(dir, "io.stat"))
+
+	return stats, err
+}
+
+func readCgroupValue(path string) (uint64, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	val := strings.TrimSpace(string(bs))
+
+	if val == "max" {
+		return 0, nil
+	}
+
+	return strconv.ParseUint(val, 10, 64)
+}
+
+// readCgroupKeyed reads a flat keyed file such as cpu.stat
+func readCgroupKeyed(path string) (map[string]uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	rv := map[string]uint64{}
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+
+		if val, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			rv[fields[0]] = val
+		}
+	}
+
+	return rv, scanner.Err()
+}
+
+// readCgroupIO sums the bytes read and written across all devices in io.stat
+func readCgroupIO(path string) (read uint64, write uint64, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return 0, 0, nil
+		}
+
+		return 0, 0, err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		// 254:0 rbytes=1234 wbytes=5678 rios=1 wios=2 dbytes=0 dios=0
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+
+		for _, field := range fields[1:] {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				continue
+			}
+
+			val, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				continue
+			}
+
+			switch key {
+			case "rbytes":
+				read += val
+			case "wbytes":
+				write += val
+			}
+		}
+	}
+
+	return read, write, scanner.Err()
+}
@@ -0,0 +1,117 @@
+package guest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/amadigan/macoby/internal/rpc"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	cryptsetup = "/sbin/cryptsetup"
+	mapperDir  = "/dev/mapper"
+)
+
+// Unlock... opens a LUKS device with the key of the request, formatting it first if asked. The key is only ever
+// passed to cryptsetup on stdin. If the device is already open, its mapping is resized to the device instead.
+func (g *Guest) Unlock(req rpc.UnlockRequest, device *string) error {
+	if len(req.Key) == 0 {
+		return fmt.Errorf("No key for %s", req.Device)
+	}
+
+	// keep the key out of swap, and out of memory once the device is open
+	if err := unix.Mlock(req.Key); err != nil {
+		return fmt.Errorf("Failed to lock the key of %s in memory: %v", req.Device, err)
+	}
+
+	defer func() {
+		clear(req.Key)
+
+		if err := unix.Munlock(req.Key); err != nil {
+			log.Warnf("Failed to unlock the key of %s in memory: %v", req.Device, err)
+		}
+	}()
+
+	mapped := rpc.MapperDevice(req.Name)
+
+	if _, err := os.Stat(mapped); err == nil {
+		if err := runCryptsetup(req.Key, "resize", "--key-file=-", req.Name); err != nil {
+			return fmt.Errorf("Failed to resize %s: %v", mapped, err)
+		}
+
+		*device = mapped
+
+		return nil
+	}
+
+	if req.Format {
+		// the key is random and as long as the volume key, a slow key derivation only costs memory and boot time
+		args := []string{"luksFormat", "--batch-mode", "--type=luks2", "--pbkdf=pbkdf2", "--pbkdf-force-iterations=1000",
+			"--label=" + req.Name, "--key-file=-", req.Device}
+
+		if err := runCryptsetup(req.Key, args...); err != nil {
+			return fmt.Errorf("Failed to format %s: %v", req.Device, err)
+		}
+
+		log.Infof("Formatted %s with LUKS", req.Device)
+	}
+
+	args := []string{"open", "--type=luks", "--key-file=-"}
+
+	if req.Discard {
+		args = append(args, "--allow-discards")
+	}
+
+	if req.ReadOnly {
+		args = append(args, "--readonly")
+	}
+
+	if err := runCryptsetup(req.Key, append(args, req.Device, req.Name)...); err != nil {
+		return fmt.Errorf("Failed to unlock %s: %v", req.Device, err)
+	}
+
+	log.Infof("Unlocked %s as %s", req.Device, mapped)
+
+	*device = mapped
+
+	return nil
+}
+
+// LockAll... closes every open LUKS mapping, the filesystems on them must be unmounted
+func LockAll() error {
+	entries, err := os.ReadDir(mapperDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Failed to read %s: %v", mapperDir, err)
+	}
+
+	var errs []error
+
+	for _, entry := range entries {
+		if entry.Name() == "control" {
+			continue
+		}
+
+		if err := runCryptsetup(nil, "close", entry.Name()); err != nil {
+			errs = append(errs, fmt.Errorf("Failed to lock %s: %v", entry.Name(), err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func runCryptsetup(key []byte, args ...string) error {
+	cmd := exec.Command(cryptsetup, args...)
+	cmd.Stdin = bytes.NewReader(key)
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+
+	return nil
+}
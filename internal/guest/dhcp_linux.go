@@ -0,0 +1,270 @@
+package guest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv4/nclient4"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	requestedLeaseTime = 24 * time.Hour
+	minLeaseRetry      = time.Minute
+	acquireRetry       = 10 * time.Second
+)
+
+var errLeaseExpired = errors.New("lease expired")
+
+// leaseManager... maintains a DHCPv4 lease on an interface, renewing at T1 and rebinding at T2 (RFC 2131 4.4.5)
+type leaseManager struct {
+	iface    *net.Interface
+	client   *nclient4.Client
+	lease    *nclient4.Lease
+	addr     net.IPNet
+	dns      []string // overrides the nameservers from the server
+	search   []string // added to the search domains from the server
+	resolv   *resolver
+	hosts    *hostsFile
+	onChange func(net.IP)
+}
+
+func leaseModifiers() []dhcpv4.Modifier {
+	return []dhcpv4.Modifier{
+		dhcpv4.WithOption(dhcpv4.OptIPAddressLeaseTime(requestedLeaseTime)),
+		dhcpv4.WithRequestedOptions(dhcpv4.OptionDNSDomainSearchList),
+	}
+}
+
+// start... brings up the interface and acquires the initial lease
+func (lm *leaseManager) start(ctx context.Context) (net.IP, error) {
+	link, err := netlink.LinkByIndex(lm.iface.Index)
+	if err != nil {
+		return nil, err
+	}
+
+	if link.Attrs().OperState == netlink.OperDown {
+		if err := netlink.LinkSetUp(link); err != nil {
+			return nil, err
+		}
+	}
+
+	if lm.client, err = nclient4.New(lm.iface.Name); err != nil {
+		return nil, err
+	}
+
+	if err := lm.acquire(ctx); err != nil {
+		_ = lm.client.Close()
+
+		return nil, err
+	}
+
+	return lm.addr.IP, nil
+}
+
+func (lm *leaseManager) acquire(ctx context.Context) error {
+	lease, err := lm.client.Request(ctx, leaseModifiers()...)
+	if err != nil {
+		return err
+	}
+
+	return lm.bind(lease)
+}
+
+// bind... applies the address, route and resolvers from a lease, notifying onChange if the address changed
+func (lm *leaseManager) bind(lease *nclient4.Lease) error {
+	ack := lease.ACK
+
+	log.Debugf("Received lease: %s\n", ack.Summary())
+
+	addr := net.IPNet{IP: ack.YourIPAddr, Mask: ack.SubnetMask()}
+	changed := lm.addr.IP != nil && !lm.addr.IP.Equal(addr.IP)
+
+	if changed {
+		log.Infof("Address on %s changed from %s to %s", lm.iface.Name, lm.addr.IP, addr.IP)
+
+		if err := RemoveAddress(lm.iface, lm.addr); err != nil {
+			log.Debugf("Failed to remove old address %s: %v", lm.addr.String(), err)
+		}
+	}
+
+	log.Debugf("Setting address %s on %s", addr.String(), lm.iface.Name)
+
+	if err := SetAddress(lm.iface, addr); err != nil {
+		return fmt.Errorf("Error setting address: %v", err)
+	}
+
+	gateway := ack.GatewayIPAddr
+
+	if routers := ack.Router(); len(routers) > 0 {
+		gateway = routers[0]
+	} else if gateway.IsUnspecified() {
+		gateway = ack.ServerIPAddr
+	}
+
+	if err := SetDefaultRoute(lm.iface, addr.IP, gateway); err != nil {
+		return fmt.Errorf("Error setting route: %v", err)
+	}
+
+	if err := lm.hosts.setGateway(gateway); err != nil {
+		return fmt.Errorf("Error writing /etc/hosts: %v", err)
+	}
+
+	nameservers := ack.DNS()
+
+	if len(lm.dns) > 0 {
+		nameservers = make([]net.IP, 0, len(lm.dns))
+
+		for _, server := range lm.dns {
+			if ip := net.ParseIP(server); ip != nil {
+				nameservers = append(nameservers, ip)
+			}
+		}
+	}
+
+	var search []string
+
+	if labels := ack.DomainSearch(); labels != nil {
+		search = append(search, labels.Labels...)
+	} else if domain := ack.DomainName(); domain != "" {
+		search = append(search, domain)
+	}
+
+	search = append(search, lm.search...)
+
+	if err := lm.resolv.setIPv4(nameservers, search); err != nil {
+		return fmt.Errorf("Error writing resolv.conf: %v", err)
+	}
+
+	lm.lease = lease
+	lm.addr = addr
+
+	if changed && lm.onChange != nil {
+		lm.onChange(addr.IP)
+	}
+
+	return nil
+}
+
+// run... maintains the lease until the context is cancelled, falling back to a new request if the lease is lost
+func (lm *leaseManager) run(ctx context.Context) {
+	defer lm.client.Close()
+
+	for {
+		err := lm.maintain(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err == nil {
+			continue
+		}
+
+		log.Warnf("Lost lease on %s: %v", lm.iface.Name, err)
+
+		// the address may no longer be used once the lease is lost
+		if err := RemoveAddress(lm.iface, lm.addr); err != nil {
+			log.Debugf("Failed to remove address %s: %v", lm.addr.String(), err)
+		}
+
+		for {
+			if err := lm.acquire(ctx); err == nil {
+				break
+			} else {
+				log.Warnf("DHCP request on %s failed: %v", lm.iface.Name, err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(acquireRetry):
+			}
+		}
+	}
+}
+
+// maintain... waits for T1, then renews the lease, switching to rebind after T2. Returns nil once the lease is extended,
+// or an error if the lease is rejected or expires.
+func (lm *leaseManager) maintain(ctx context.Context) error {
+	ack := lm.lease.ACK
+	leaseTime := ack.IPAddressLeaseTime(requestedLeaseTime)
+	created := lm.lease.CreationTime
+	t1 := created.Add(ack.IPAddressRenewalTime(leaseTime / 2))
+	t2 := created.Add(ack.IPAddressRebindingTime(leaseTime * 7 / 8))
+	expiry := created.Add(leaseTime)
+
+	if !sleepUntil(ctx, t1) {
+		return ctx.Err()
+	}
+
+	for {
+		now := time.Now()
+		if !now.Before(expiry) {
+			return errLeaseExpired
+		}
+
+		var lease *nclient4.Lease
+		var err error
+
+		next := t2
+
+		if now.Before(t2) {
+			lease, err = lm.client.Renew(ctx, lm.lease, leaseModifiers()...)
+		} else {
+			next = expiry
+			lease, err = lm.rebind(ctx)
+		}
+
+		if err == nil {
+			return lm.bind(lease)
+		}
+
+		var nak *nclient4.ErrNak
+		if errors.As(err, &nak) {
+			return err
+		}
+
+		log.Warnf("Failed to extend lease on %s: %v", lm.iface.Name, err)
+
+		// retry after half the time remaining until the next state, but not too often
+		wait := min(max(next.Sub(now)/2, minLeaseRetry), expiry.Sub(now))
+
+		if !sleepUntil(ctx, now.Add(wait)) {
+			return ctx.Err()
+		}
+	}
+}
+
+// rebind... broadcasts a request that any server may answer
+func (lm *leaseManager) rebind(ctx context.Context) (*nclient4.Lease, error) {
+	req, err := dhcpv4.NewRenewFromAck(lm.lease.ACK, leaseModifiers()...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create a request: %w", err)
+	}
+
+	resp, err := lm.client.SendAndRead(ctx, lm.client.RemoteAddr(), req,
+		nclient4.IsMessageType(dhcpv4.MessageTypeAck, dhcpv4.MessageTypeNak))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.MessageType() == dhcpv4.MessageTypeNak {
+		return nil, &nclient4.ErrNak{Offer: lm.lease.Offer, Nak: resp}
+	}
+
+	// the responding server may differ, subsequent renewals go to it
+	return &nclient4.Lease{Offer: resp, ACK: resp, CreationTime: time.Now()}, nil
+}
+
+func sleepUntil(ctx context.Context, deadline time.Time) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(time.Until(deadline)):
+		return true
+	}
+}
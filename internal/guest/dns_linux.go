@@ -0,0 +1,376 @@
+package guest
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/amadigan/macoby/internal/rpc"
+	"github.com/mdlayher/vsock"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsQueryTimeout = 5 * time.Second
+	maxUDPResponse  = 512 // without EDNS, RFC 1035 4.2.1
+)
+
+var errTooManyQueries = errors.New("too many outstanding queries")
+
+// StartDNSStub... assigns the stub address to the loopback interface and answers queries on it over UDP and TCP by
+// forwarding them to the host resolver. Addresses on the loopback interface other than 127/8 are reachable from
+// containers, so dockerd can use the same address.
+func StartDNSStub(ctx context.Context, ip net.IP) error {
+	lo, err := netlink.LinkByName("lo")
+	if err != nil {
+		return fmt.Errorf("Failed to fetch loopback device: %v", err)
+	}
+
+	bits := 8 * len(ip)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+	}
+
+	if err := netlink.AddrReplace(lo, &netlink.Addr{IPNet: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}}); err != nil {
+		return fmt.Errorf("Failed to add DNS stub address %s: %v", ip, err)
+	}
+
+	addr := net.JoinHostPort(ip.String(), "53")
+
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("Failed to listen on %s/udp: %v", addr, err)
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		_ = pc.Close()
+
+		return fmt.Errorf("Failed to listen on %s/tcp: %v", addr, err)
+	}
+
+	stub := &dnsStub{pending: map[uint16]chan []byte{}}
+
+	go func() {
+		<-ctx.Done()
+		_ = pc.Close()
+		_ = listener.Close()
+	}()
+
+	go stub.serveUDP(pc)
+	go stub.serveTCP(listener)
+
+	log.Infof("DNS stub listening on %s", addr)
+
+	return nil
+}
+
+// dnsStub... forwards queries to the host over a single vsock connection, rewriting query IDs so that queries from
+// different clients do not collide
+type dnsStub struct {
+	conn    net.Conn
+	pending map[uint16]chan []byte
+	nextID  uint16
+
+	mutex sync.Mutex
+}
+
+func (s *dnsStub) serveUDP(pc net.PacketConn) {
+	buf := make([]byte, 0xffff)
+
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			log.Debugf("DNS stub UDP listener stopped: %v", err)
+
+			return
+		}
+
+		query := slices.Clone(buf[:n])
+
+		go func() {
+			resp := s.answer(query)
+			if resp == nil {
+				return
+			}
+
+			if _, err := pc.WriteTo(truncate(resp, udpLimit(query)), addr); err != nil {
+				log.Debugf("Failed to send DNS response to %s: %v", addr, err)
+			}
+		}()
+	}
+}
+
+func (s *dnsStub) serveTCP(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Debugf("DNS stub TCP listener stopped: %v", err)
+
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			for {
+				_ = conn.SetReadDeadline(time.Now().Add(dnsQueryTimeout))
+
+				query, err := rpc.ReadFrame(conn, nil)
+				if err != nil {
+					return
+				}
+
+				if resp := s.answer(query); resp != nil {
+					if err := rpc.WriteFrame(conn, resp); err != nil {
+						return
+					}
+				}
+			}
+		}()
+	}
+}
+
+// answer... forwards a query to the host, returning SERVFAIL if the host does not answer, or nil if the query is not
+// a valid message
+func (s *dnsStub) answer(query []byte) []byte {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsQueryTimeout)
+	defer cancel()
+
+	resp, err := s.query(ctx, query)
+	if err == nil {
+		return resp
+	}
+
+	log.Debugf("DNS query failed: %v", err)
+
+	var parser dnsmessage.Parser
+
+	header, err := parser.Start(query)
+	if err != nil || header.Response {
+		return nil
+	}
+
+	questions, _ := parser.AllQuestions()
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 header.ID,
+		Response:           true,
+		OpCode:             header.OpCode,
+		RecursionDesired:   header.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              dnsmessage.RCodeServerFailure,
+	})
+
+	if buildQuestions(&builder, questions) != nil {
+		return nil
+	}
+
+	resp, err = builder.Finish()
+	if err != nil {
+		return nil
+	}
+
+	return resp
+}
+
+func (s *dnsStub) query(ctx context.Context, query []byte) ([]byte, error) {
+	if len(query) < 12 {
+		return nil, errors.New("short DNS message")
+	}
+
+	ch := make(chan []byte, 1)
+
+	s.mutex.Lock()
+
+	conn, err := s.connect()
+	if err != nil {
+		s.mutex.Unlock()
+
+		return nil, err
+	}
+
+	id, err := s.allocate(ch)
+	if err != nil {
+		s.mutex.Unlock()
+
+		return nil, err
+	}
+
+	defer func() {
+		s.mutex.Lock()
+		delete(s.pending, id)
+		s.mutex.Unlock()
+	}()
+
+	origID := binary.BigEndian.Uint16(query)
+	msg := slices.Clone(query)
+	binary.BigEndian.PutUint16(msg, id)
+
+	err = rpc.WriteFrame(conn, msg)
+	s.mutex.Unlock()
+
+	if err != nil {
+		_ = conn.Close()
+
+		return nil, fmt.Errorf("Failed to forward DNS query: %v", err)
+	}
+
+	select {
+	case resp := <-ch:
+		binary.BigEndian.PutUint16(resp, origID)
+
+		return resp, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// connect... returns the connection to the host, dialing it if necessary. Must be called with the mutex held.
+func (s *dnsStub) connect() (net.Conn, error) {
+	if s.conn != nil {
+		return s.conn, nil
+	}
+
+	conn, err := vsock.Dial(2, 3, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to host resolver: %v", err)
+	}
+
+	s.conn = conn
+
+	go s.read(conn)
+
+	return conn, nil
+}
+
+// allocate... assigns an unused query ID. Must be called with the mutex held.
+func (s *dnsStub) allocate(ch chan []byte) (uint16, error) {
+	if len(s.pending) > 0xffff {
+		return 0, errTooManyQueries
+	}
+
+	for {
+		s.nextID++
+
+		if _, ok := s.pending[s.nextID]; !ok {
+			s.pending[s.nextID] = ch
+
+			return s.nextID, nil
+		}
+	}
+}
+
+func (s *dnsStub) read(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		msg, err := rpc.ReadFrame(conn, nil)
+		if err != nil {
+			log.Warnf("Host resolver connection closed: %v", err)
+
+			s.mutex.Lock()
+			if s.conn == conn {
+				s.conn = nil
+			}
+			s.mutex.Unlock()
+
+			return
+		}
+
+		if len(msg) < 12 {
+			continue
+		}
+
+		s.mutex.Lock()
+		ch := s.pending[binary.BigEndian.Uint16(msg)]
+		s.mutex.Unlock()
+
+		if ch != nil {
+			select {
+			case ch <- msg:
+			default:
+			}
+		}
+	}
+}
+
+// udpLimit... the largest response the client accepts over UDP, from the EDNS OPT record if present
+func udpLimit(query []byte) int {
+	var parser dnsmessage.Parser
+
+	if _, err := parser.Start(query); err != nil {
+		return maxUDPResponse
+	}
+
+	if parser.SkipAllQuestions() != nil || parser.SkipAllAnswers() != nil || parser.SkipAllAuthorities() != nil {
+		return maxUDPResponse
+	}
+
+	for {
+		header, err := parser.AdditionalHeader()
+		if err != nil {
+			return maxUDPResponse
+		}
+
+		if header.Type == dnsmessage.TypeOPT {
+			// the class of the OPT record is the UDP payload size, RFC 6891 6.1.2
+			return max(int(header.Class), maxUDPResponse)
+		}
+
+		if parser.SkipAdditional() != nil {
+			return maxUDPResponse
+		}
+	}
+}
+
+// truncate... if the response is larger than limit, drops the records and sets the TC bit so that the client retries
+// over TCP
+func truncate(resp []byte, limit int) []byte {
+	if len(resp) <= limit {
+		return resp
+	}
+
+	var parser dnsmessage.Parser
+
+	header, err := parser.Start(resp)
+	if err != nil {
+		return resp[:limit]
+	}
+
+	questions, _ := parser.AllQuestions()
+
+	header.Truncated = true
+	builder := dnsmessage.NewBuilder(nil, header)
+
+	if buildQuestions(&builder, questions) != nil {
+		return resp[:limit]
+	}
+
+	truncated, err := builder.Finish()
+	if err != nil {
+		return resp[:limit]
+	}
+
+	return truncated
+}
+
+func buildQuestions(builder *dnsmessage.Builder, questions []dnsmessage.Question) error {
+	if err := builder.StartQuestions(); err != nil {
+		return err
+	}
+
+	for _, question := range questions {
+		if err := builder.Question(question); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
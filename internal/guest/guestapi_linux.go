@@ -5,6 +5,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -14,6 +15,7 @@ import (
 	"sync"
 	"syscall"
 	"time"
+	"unsafe"
 
 	"github.com/amadigan/macoby/internal/applog"
 	"github.com/amadigan/macoby/internal/event"
@@ -68,7 +70,7 @@ func StartGuest() error {
 	// send logs to the event emitter
 	applog.SetOutput(rpc.NewEmitterWriter(emitter, "guest", rpc.LogInternal))
 
-	g := &Guest{emitter: emitter, processeses: map[string]*os.Process{}}
+	g := &Guest{emitter: emitter, processeses: map[string]*service{}}
 
 	log.Info("guest started")
 
@@ -93,13 +95,25 @@ func StartGuest() error {
 var log = applog.New("guest")
 
 type Guest struct {
-	processeses   map[string]*os.Process
-	emitter       chan<- rpc.LogEvent
+	processeses   map[string]*service
+	emitter       chan<- rpc.GuestEvent
 	shutdownFuncs []func()
+	metricsCh     chan rpc.MetricsRequest
+	network       rpc.NetworkConfig
+	resolv        resolver
+	hosts         hostsFile
+	systemBundle  []byte // the CA bundle of the root filesystem, before local certificates were added
 
 	mutex sync.Mutex
 }
 
+// service... a launched process, done is closed once the process has exited
+type service struct {
+	process *os.Process
+	done    chan struct{}
+	exit    int
+}
+
 func (g *Guest) AddShutdownFunc(fn func()) {
 	g.mutex.Lock()
 	defer g.mutex.Unlock()
@@ -133,22 +147,38 @@ func (g *Guest) Mkdir(path string, _ *struct{}) error {
 }
 
 func (g *Guest) Run(req rpc.Command, out *rpc.CommandOutput) error {
-	cmd := exec.Command(req.Path)
+	ctx := context.Background()
+
+	if req.Timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, req.Timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, req.Path)
 	cmd.Args = req.Args
-	cmd.Env = req.Env
+	cmd.Env = append(os.Environ(), req.Env...)
 	cmd.Dir = req.Dir
 	cmd.Stdin = bytes.NewReader(req.Input)
 
+	// on timeout the whole process group is killed, and the output is no longer waited for if an orphan still holds it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = time.Second
+
 	outbs, err := cmd.CombinedOutput()
 
-	*out = rpc.CommandOutput{Output: outbs}
+	*out = rpc.CommandOutput{Output: outbs, TimedOut: errors.Is(ctx.Err(), context.DeadlineExceeded)}
 
 	if err != nil {
 		var exitErr *exec.ExitError
 
 		if errors.As(err, &exitErr) {
 			out.Exit = exitErr.ExitCode()
-		} else {
+		} else if !out.TimedOut {
 			return err
 		}
 	}
@@ -159,7 +189,7 @@ func (g *Guest) Run(req rpc.Command, out *rpc.CommandOutput) error {
 func (g *Guest) Launch(req rpc.Command, pid *int64) error {
 	cmd := exec.Command(req.Path)
 	cmd.Args = req.Args
-	cmd.Env = req.Env
+	cmd.Env = append(os.Environ(), req.Env...)
 	cmd.Dir = req.Dir
 	cmd.Stdin = bytes.NewReader(req.Input)
 
@@ -176,31 +206,41 @@ func (g *Guest) Launch(req rpc.Command, pid *int64) error {
 		return err
 	}
 
-	*pid = int64(cmd.Process.Pid)
+	// the reply may be reused once Launch returns, so the exit event uses its own copy of the pid
+	procPid := int64(cmd.Process.Pid)
+	*pid = procPid
+
+	svc := &service{process: cmd.Process, done: make(chan struct{})}
 
 	g.mutex.Lock()
-	defer g.mutex.Unlock()
-	g.processeses[name] = cmd.Process
+	g.processeses[name] = svc
+	g.mutex.Unlock()
+
+	g.emitter <- rpc.GuestEvent{Event: event.ServiceState{Name: name, Pid: procPid, State: event.ServiceStarted}}
+
+	go func() {
+		_ = cmd.Wait()
+		svc.exit = cmd.ProcessState.ExitCode()
+		close(svc.done)
+
+		g.emitter <- rpc.GuestEvent{Event: event.ServiceState{Name: name, Pid: procPid, State: event.ServiceExited, Exit: svc.exit}}
+	}()
 
 	return nil
 }
 
 func (g *Guest) Wait(service string, exit *int) error {
 	g.mutex.Lock()
-	process := g.processeses[service]
+	svc := g.processeses[service]
 	g.mutex.Unlock()
 
-	if process == nil {
+	if svc == nil {
 		return fmt.Errorf("no such process: %s", service)
 	}
 
-	state, err := process.Wait()
+	<-svc.done
 
-	if err != nil {
-		return err
-	}
-
-	*exit = state.ExitCode()
+	*exit = svc.exit
 
 	g.mutex.Lock()
 	delete(g.processeses, service)
@@ -211,38 +251,39 @@ func (g *Guest) Wait(service string, exit *int) error {
 
 func (g *Guest) Release(service string, _ *struct{}) error {
 	g.mutex.Lock()
-	process := g.processeses[service]
 	delete(g.processeses, service)
 	g.mutex.Unlock()
 
-	if process != nil {
-		_ = process.Release()
-	}
-
 	return nil
 }
 
-func (g *Guest) Listen(req rpc.ListenRequest, _ *struct{}) error {
-	return fmt.Errorf("not implemented")
-}
-
 func (g *Guest) Signal(req rpc.SignalRequest, _ *struct{}) error {
 	if req.Service != "" {
 		g.mutex.Lock()
-		process := g.processeses[req.Service]
+		svc := g.processeses[req.Service]
 		g.mutex.Unlock()
 
-		if process == nil {
+		if svc == nil {
 			return fmt.Errorf("no such process: %s", req.Service)
 		}
 
-		return process.Signal(syscall.Signal(req.Signal))
+		return svc.process.Signal(syscall.Signal(req.Signal))
 	}
 
 	return syscall.Kill(int(req.Pid), syscall.Signal(req.Signal))
 }
 
-func (g *Guest) Init(req rpc.InitRequest, _ *struct{}) error {
+func (g *Guest) Init(req rpc.InitRequest, out *rpc.InitResponse) error {
+	systemBundle, err := ReadSystemBundle()
+	if err != nil {
+		return err
+	}
+
+	g.mutex.Lock()
+	g.network = req.Network
+	g.systemBundle = systemBundle
+	g.mutex.Unlock()
+
 	ch := make(chan struct{})
 
 	sysctlErr := util.Await(func() (struct{}, error) {
@@ -260,7 +301,7 @@ func (g *Guest) Init(req rpc.InitRequest, _ *struct{}) error {
 		return struct{}{}, writeSysctls(ctls)
 	})
 
-	if err := OverlayRoot(req.OverlaySize); err != nil {
+	if err := OverlayRoot(req.Overlay); err != nil {
 		return err
 	}
 
@@ -268,6 +309,8 @@ func (g *Guest) Init(req rpc.InitRequest, _ *struct{}) error {
 		return fmt.Errorf("Failed to mount /proc: %v", err)
 	}
 
+	// modules are loaded before the sysctls are written, so the settings of a module apply
+	out.Modules = LoadModules(req.Modules)
 	close(ch)
 
 	if err := unix.Mount("sysfs", "/sys", "sysfs", unix.MS_NOEXEC|unix.MS_NOATIME, ""); err != nil {
@@ -285,7 +328,11 @@ func (g *Guest) Init(req rpc.InitRequest, _ *struct{}) error {
 	clockCtx, clockCancel := context.WithCancel(context.Background())
 	g.AddShutdownFunc(clockCancel)
 
-	if err := StartClockSync(clockCtx, req.ClockInterval); err != nil {
+	clockStats := func(stats event.ClockStats) {
+		g.emitter <- rpc.GuestEvent{Event: stats}
+	}
+
+	if err := StartClockSync(clockCtx, req.ClockInterval, clockStats); err != nil {
 		return fmt.Errorf("Failed to start clock sync: %v", err)
 	}
 
@@ -293,6 +340,40 @@ func (g *Guest) Init(req rpc.InitRequest, _ *struct{}) error {
 		return fmt.Errorf("Failed to bring up loopback: %v", err)
 	}
 
+	if req.DNSStub != "" {
+		stub := net.ParseIP(req.DNSStub)
+		if stub == nil {
+			return fmt.Errorf("Invalid DNS stub address %s", req.DNSStub)
+		}
+
+		dnsCtx, dnsCancel := context.WithCancel(context.Background())
+		g.AddShutdownFunc(dnsCancel)
+
+		if err := StartDNSStub(dnsCtx, stub); err != nil {
+			return fmt.Errorf("Failed to start DNS stub: %v", err)
+		}
+
+		if err := g.resolv.setStub(stub); err != nil {
+			return fmt.Errorf("Failed to write resolv.conf: %v", err)
+		}
+	}
+
+	if req.Hostname != "" {
+		if err := SetHostname(req.Hostname); err != nil {
+			return err
+		}
+	}
+
+	if err := g.hosts.init(req.Hostname, req.Hosts, req.GatewayNames); err != nil {
+		return fmt.Errorf("Failed to write /etc/hosts: %v", err)
+	}
+
+	if req.TimeZone != "" {
+		if err := SetTimeZone(req.TimeZone, req.ZoneInfo); err != nil {
+			return err
+		}
+	}
+
 	if _, err := sysctlErr(); err != nil {
 		return fmt.Errorf("Failed to set sysctls: %v", err)
 	}
@@ -300,16 +381,16 @@ func (g *Guest) Init(req rpc.InitRequest, _ *struct{}) error {
 	return nil
 }
 
-func stopAllProcesses(ctx context.Context, procs map[string]*os.Process) {
-	for _, p := range procs {
-		_ = p.Signal(syscall.SIGTERM)
+func stopAllProcesses(ctx context.Context, procs map[string]*service) {
+	for _, svc := range procs {
+		_ = svc.process.Signal(syscall.SIGTERM)
 	}
 
 	done := make(chan struct{})
 
 	go func() {
-		for _, proc := range procs {
-			_, _ = proc.Wait()
+		for _, svc := range procs {
+			<-svc.done
 		}
 
 		close(done)
@@ -318,8 +399,8 @@ func stopAllProcesses(ctx context.Context, procs map[string]*os.Process) {
 	select {
 	case <-done:
 	case <-ctx.Done():
-		for _, p := range procs {
-			_ = p.Kill()
+		for _, svc := range procs {
+			_ = svc.process.Kill()
 		}
 	}
 }
@@ -340,14 +421,30 @@ func (g *Guest) Shutdown(struct{}, *struct{}) error {
 		fn()
 	}
 
+	if err := SwapoffAll(); err != nil {
+		log.Warnf("failed to disable swap: %v", err)
+	}
+
 	if err := UnmountAll(); err != nil {
 		log.Warnf("failed to unmount all: %v", err)
 	}
 
+	if err := LockAll(); err != nil {
+		log.Warnf("failed to lock encrypted disks: %v", err)
+	}
+
+	if err := SyncOverlay(); err != nil {
+		log.Warnf("failed to sync overlay: %v", err)
+	}
+
 	return nil
 }
 
 func (g *Guest) Mount(req rpc.MountRequest, _ *struct{}) error {
+	if req.FS == "swap" {
+		return mountSwap(req)
+	}
+
 	var fsOpts []string = make([]string, 0, len(req.Flags))
 	var flags uintptr
 
@@ -413,6 +510,22 @@ func (g *Guest) Mount(req rpc.MountRequest, _ *struct{}) error {
 	return nil
 }
 
+// DeviceSize... reads the size of a block device with BLKGETSIZE64, the kernel updates it when the host reports a
+// capacity change
+func (g *Guest) DeviceSize(device string, size *uint64) error {
+	fd, err := unix.Open(device, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("Failed to open %s: %v", device, err)
+	}
+	defer unix.Close(fd)
+
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.BLKGETSIZE64, uintptr(unsafe.Pointer(size))); errno != 0 {
+		return fmt.Errorf("Failed to get the size of %s: %v", device, errno)
+	}
+
+	return nil
+}
+
 func writeSysctls(req map[string]string) error {
 	for key, val := range req {
 		chars := []byte(key)
@@ -0,0 +1,46 @@
+package guest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/amadigan/macoby/internal/rpc"
+)
+
+func TestRun(t *testing.T) {
+	var out rpc.CommandOutput
+
+	cmd := rpc.Command{Path: "/bin/sh", Args: []string{"sh", "-c", "echo out; exit 3"}, Timeout: 10 * time.Second}
+
+	if err := (&Guest{}).Run(cmd, &out); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	if string(out.Output) != "out\n" || out.Exit != 3 || out.TimedOut {
+		t.Errorf("output = %+v", out)
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	var out rpc.CommandOutput
+
+	// the background sleep holds the output open after the shell is killed
+	cmd := rpc.Command{
+		Path:    "/bin/sh",
+		Args:    []string{"sh", "-c", "echo started; sleep 60 & sleep 60"},
+		Timeout: 200 * time.Millisecond,
+	}
+	start := time.Now()
+
+	if err := (&Guest{}).Run(cmd, &out); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Run returned after %s", elapsed)
+	}
+
+	if !out.TimedOut || string(out.Output) != "started\n" {
+		t.Errorf("output = %+v, want a timeout", out)
+	}
+}
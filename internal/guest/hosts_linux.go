@@ -0,0 +1,104 @@
+package guest
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/amadigan/macoby/internal/rpc"
+	"golang.org/x/sys/unix"
+)
+
+// SetHostname... sets the kernel hostname and writes /etc/hostname
+func SetHostname(name string) error {
+	if err := unix.Sethostname([]byte(name)); err != nil {
+		return fmt.Errorf("Failed to set hostname: %v", err)
+	}
+
+	if err := os.WriteFile("/etc/hostname", []byte(name+"\n"), 0644); err != nil {
+		return fmt.Errorf("Failed to write /etc/hostname: %v", err)
+	}
+
+	return nil
+}
+
+// SetTimeZone... installs the TZif data as /etc/localtime, the root filesystem has no zoneinfo database
+func SetTimeZone(name string, zoneinfo []byte) error {
+	if len(zoneinfo) < 4 || string(zoneinfo[:4]) != "TZif" {
+		return fmt.Errorf("Invalid zoneinfo for %s", name)
+	}
+
+	// /etc/localtime may be a symlink into a zoneinfo directory
+	if err := os.Remove("/etc/localtime"); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed to remove /etc/localtime: %v", err)
+	}
+
+	if err := os.WriteFile("/etc/localtime", zoneinfo, 0644); err != nil {
+		return fmt.Errorf("Failed to write /etc/localtime: %v", err)
+	}
+
+	if err := os.WriteFile("/etc/timezone", []byte(name+"\n"), 0644); err != nil {
+		return fmt.Errorf("Failed to write /etc/timezone: %v", err)
+	}
+
+	return nil
+}
+
+// hostsFile... generates /etc/hosts from the hostname, the static entries and the default gateway, which is only known
+// once the network is configured
+type hostsFile struct {
+	hostname     string
+	entries      []rpc.HostEntry
+	gatewayNames []string
+	gateway      net.IP
+
+	mutex sync.Mutex
+}
+
+func (h *hostsFile) init(hostname string, entries []rpc.HostEntry, gatewayNames []string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.hostname = hostname
+	h.entries = entries
+	h.gatewayNames = gatewayNames
+
+	return h.write()
+}
+
+func (h *hostsFile) setGateway(gateway net.IP) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if gateway.Equal(h.gateway) {
+		return nil
+	}
+
+	h.gateway = gateway
+
+	return h.write()
+}
+
+func (h *hostsFile) write() error {
+	var hosts strings.Builder
+
+	local := "localhost"
+	if h.hostname != "" {
+		local = "localhost " + h.hostname
+	}
+
+	fmt.Fprintf(&hosts, "127.0.0.1\t%s\n", local)
+	fmt.Fprintf(&hosts, "::1\t%s\n", local)
+
+	if h.gateway != nil && len(h.gatewayNames) > 0 {
+		fmt.Fprintf(&hosts, "%s\t%s\n", h.gateway, strings.Join(h.gatewayNames, " "))
+	}
+
+	for _, entry := range h.entries {
+		fmt.Fprintf(&hosts, "%s\t%s\n", entry.Address, strings.Join(entry.Names, " "))
+	}
+
+	return os.WriteFile("/etc/hosts", []byte(hosts.String()), 0644)
+}
@@ -0,0 +1,249 @@
+package guest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/amadigan/macoby/internal/rpc"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/dhcpv6/nclient6"
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	routerSolicitationInterval = 4 * time.Second // RTR_SOLICITATION_INTERVAL, RFC 4861 10
+	maxRouterSolicitations     = 3               // MAX_RTR_SOLICITATIONS, RFC 4861 10
+	dhcpv6Timeout              = 10 * time.Second
+	unusableAddrFlags          = unix.IFA_F_TENTATIVE | unix.IFA_F_DADFAILED | unix.IFA_F_DEPRECATED
+)
+
+// startIPv6... enables stateless address autoconfiguration on the interface and watches for global addresses in the
+// background, failures are logged as the guest remains usable over IPv4
+func (g *Guest) startIPv6(iface *net.Interface, netconf rpc.NetworkConfig, onChange func(net.IP)) {
+	if err := EnableSLAAC(iface); err != nil {
+		log.Warnf("Failed to enable IPv6 on %s: %v", iface.Name, err)
+
+		return
+	}
+
+	s := &slaac{
+		iface:    iface,
+		dhcp:     netconf.IPv6 == rpc.IPv6DHCP,
+		dns:      netconf.DNS,
+		search:   netconf.Search,
+		resolv:   &g.resolv,
+		onChange: onChange,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	g.AddShutdownFunc(cancel)
+
+	go s.run(ctx)
+}
+
+// EnableSLAAC... configures the kernel to accept router advertisements and autoconfigure addresses on the interface.
+// Forwarding is enabled for docker, which makes the kernel ignore advertisements unless accept_ra is 2.
+func EnableSLAAC(iface *net.Interface) error {
+	settings := []struct{ key, value string }{
+		{"disable_ipv6", "0"},
+		{"accept_ra", "2"},
+		{"autoconf", "1"},
+	}
+
+	for _, setting := range settings {
+		path := filepath.Join("/proc/sys/net/ipv6/conf", iface.Name, setting.key)
+
+		if err := os.WriteFile(path, []byte(setting.value), 0644); err != nil {
+			return fmt.Errorf("Failed to set %s: %v", path, err)
+		}
+	}
+
+	return nil
+}
+
+// slaac... tracks the global IPv6 address of an interface, soliciting routers until one is configured. If dhcp is
+// set, resolvers are requested with stateless DHCPv6 (RFC 8415 6.1) once the first address is configured.
+type slaac struct {
+	iface    *net.Interface
+	dhcp     bool
+	dns      []string // overrides the nameservers from DHCPv6
+	search   []string // added to the search domains from DHCPv6
+	resolv   *resolver
+	onChange func(net.IP)
+	addr     net.IP
+}
+
+func (s *slaac) run(ctx context.Context) {
+	updates := make(chan netlink.AddrUpdate, 16)
+	done := make(chan struct{})
+	defer close(done)
+
+	opts := netlink.AddrSubscribeOptions{
+		ListExisting: true,
+		ErrorCallback: func(err error) {
+			log.Warnf("Address subscription error on %s: %v", s.iface.Name, err)
+		},
+	}
+
+	if err := netlink.AddrSubscribeWithOptions(updates, done, opts); err != nil {
+		log.Warnf("Failed to watch addresses on %s: %v", s.iface.Name, err)
+
+		return
+	}
+
+	solicitations := 0
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			if s.addr != nil || solicitations >= maxRouterSolicitations {
+				continue
+			}
+
+			if err := SendRouterSolicitation(s.iface); err != nil {
+				log.Warnf("Failed to send router solicitation on %s: %v", s.iface.Name, err)
+			}
+
+			solicitations++
+			timer.Reset(routerSolicitationInterval)
+		case update, ok := <-updates:
+			if !ok {
+				return
+			}
+
+			// a lost address is solicited again, as after boot
+			if s.update(ctx, update) {
+				solicitations = 0
+				timer.Reset(0)
+			}
+		}
+	}
+}
+
+// update... tracks the global address of the interface, returns true if the address was removed
+func (s *slaac) update(ctx context.Context, update netlink.AddrUpdate) bool {
+	ip := update.LinkAddress.IP
+
+	if update.LinkIndex != s.iface.Index || ip.To4() != nil || !ip.IsGlobalUnicast() {
+		return false
+	}
+
+	if !update.NewAddr || update.Flags&unusableAddrFlags != 0 {
+		if ip.Equal(s.addr) {
+			log.Infof("IPv6 address %s removed from %s", ip, s.iface.Name)
+			s.addr = nil
+
+			return true
+		}
+
+		return false
+	}
+
+	if ip.Equal(s.addr) {
+		return false
+	}
+
+	first := s.addr == nil
+	s.addr = ip
+
+	log.Infof("IPv6 address on %s is %s", s.iface.Name, ip)
+
+	if first && s.dhcp {
+		if err := s.requestResolvers(ctx); err != nil {
+			log.Warnf("DHCPv6 information request on %s failed: %v", s.iface.Name, err)
+		}
+	}
+
+	s.onChange(ip)
+
+	return false
+}
+
+// requestResolvers... sends an Information-Request for the nameservers and search domains
+func (s *slaac) requestResolvers(ctx context.Context) error {
+	client, err := nclient6.New(s.iface.Name)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	msg, err := dhcpv6.NewMessage(
+		dhcpv6.WithClientID(&dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: s.iface.HardwareAddr}),
+		dhcpv6.WithOption(dhcpv6.OptElapsedTime(0)),
+		dhcpv6.WithRequestedOptions(dhcpv6.OptionDNSRecursiveNameServer, dhcpv6.OptionDomainSearchList),
+	)
+	if err != nil {
+		return err
+	}
+
+	msg.MessageType = dhcpv6.MessageTypeInformationRequest
+
+	ctx, cancel := context.WithTimeout(ctx, dhcpv6Timeout)
+	defer cancel()
+
+	reply, err := client.SendAndRead(ctx, nclient6.AllDHCPRelayAgentsAndServers, msg,
+		nclient6.IsMessageType(dhcpv6.MessageTypeReply))
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("Received DHCPv6 reply: %s", reply.Summary())
+
+	var nameservers []net.IP
+
+	// configured nameservers are already written by the IPv4 configuration
+	if len(s.dns) == 0 {
+		nameservers = reply.Options.DNS()
+	}
+
+	var search []string
+
+	if labels := reply.Options.DomainSearchList(); labels != nil {
+		search = append(search, labels.Labels...)
+	}
+
+	search = append(search, s.search...)
+
+	if err := s.resolv.setIPv6(nameservers, search); err != nil {
+		return fmt.Errorf("Error writing resolv.conf: %v", err)
+	}
+
+	return nil
+}
+
+// SendRouterSolicitation... asks the routers on the link to send an advertisement (RFC 4861 6.3.7), which the kernel
+// uses to configure addresses and the default route
+func SendRouterSolicitation(iface *net.Interface) error {
+	fd, err := unix.Socket(unix.AF_INET6, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.IPPROTO_ICMPV6)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	// neighbor discovery messages must be sent with a hop limit of 255
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_MULTICAST_HOPS, 255); err != nil {
+		return err
+	}
+
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_MULTICAST_IF, iface.Index); err != nil {
+		return err
+	}
+
+	// type, code, checksum (filled in by the kernel) and 4 reserved bytes
+	msg := []byte{133, 0, 0, 0, 0, 0, 0, 0}
+
+	addr := &unix.SockaddrInet6{ZoneId: uint32(iface.Index)} //nolint:gosec
+	copy(addr.Addr[:], net.IPv6linklocalallrouters)
+
+	return unix.Sendto(fd, msg, 0, addr)
+}
@@ -0,0 +1,51 @@
+package guest
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func addrUpdate(ip string, add bool) netlink.AddrUpdate {
+	return netlink.AddrUpdate{
+		LinkAddress: net.IPNet{IP: net.ParseIP(ip), Mask: net.CIDRMask(64, 128)},
+		LinkIndex:   2,
+		NewAddr:     add,
+	}
+}
+
+func TestSlaacUpdate(t *testing.T) {
+	var changes []string
+
+	s := &slaac{
+		iface:    &net.Interface{Index: 2, Name: "eth0"},
+		onChange: func(ip net.IP) { changes = append(changes, ip.String()) },
+	}
+	ctx := context.Background()
+
+	if s.update(ctx, addrUpdate("fe80::1", true)) || s.addr != nil {
+		t.Fatal("tracked a link-local address")
+	}
+
+	if s.update(ctx, addrUpdate("fd00::10", true)) || !s.addr.Equal(net.ParseIP("fd00::10")) {
+		t.Fatalf("address = %v, want fd00::10", s.addr)
+	}
+
+	if s.update(ctx, addrUpdate("fd00::99", false)) {
+		t.Error("removing another address reported the address as lost")
+	}
+
+	if !s.update(ctx, addrUpdate("fd00::10", false)) || s.addr != nil {
+		t.Errorf("removing the address was not reported, address = %v", s.addr)
+	}
+
+	if s.update(ctx, addrUpdate("fd00::20", true)) || !s.addr.Equal(net.ParseIP("fd00::20")) {
+		t.Fatalf("address = %v, want fd00::20", s.addr)
+	}
+
+	if len(changes) != 2 || changes[0] != "fd00::10" || changes[1] != "fd00::20" {
+		t.Errorf("changes = %v", changes)
+	}
+}
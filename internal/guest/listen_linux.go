@@ -0,0 +1,80 @@
+package guest
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/amadigan/macoby/internal/applog"
+	"github.com/amadigan/macoby/internal/rpc"
+	"github.com/mdlayher/vsock"
+)
+
+// Listen... listens on a stream socket in the guest, each accepted connection is forwarded to the host proxy port
+// preceded by a ConnectionRequest. The listener is closed on shutdown.
+func (g *Guest) Listen(req rpc.ListenRequest, _ *struct{}) error {
+	switch req.Network {
+	case "tcp", "tcp4", "tcp6", "unix":
+	default:
+		return fmt.Errorf("Unsupported network for listen: %s", req.Network)
+	}
+
+	listener, err := net.Listen(req.Network, req.Address)
+	if err != nil {
+		return fmt.Errorf("Failed to listen on %s/%s: %v", req.Address, req.Network, err)
+	}
+
+	g.AddShutdownFunc(func() { _ = listener.Close() })
+
+	log.Infof("Forwarding %s/%s to host", req.Address, req.Network)
+
+	go applog.FanOut(listener.Accept, func(conn net.Conn) {
+		if err := forwardToHost(req, conn); err != nil {
+			log.Warnf("Failed to forward connection on %s to host: %v", req.Address, err)
+		}
+	}, log)
+
+	return nil
+}
+
+func forwardToHost(req rpc.ListenRequest, conn net.Conn) error {
+	defer conn.Close()
+
+	host, err := vsock.Dial(2, 5, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to connect to host proxy: %v", err)
+	}
+	defer host.Close()
+
+	connReq := rpc.ConnectionRequest{
+		Network: req.Network,
+		Listen:  req.Address,
+		Local:   conn.LocalAddr().String(),
+		Remote:  conn.RemoteAddr().String(),
+	}
+
+	if err := gob.NewEncoder(host).Encode(connReq); err != nil {
+		return fmt.Errorf("Failed to send connection request: %v", err)
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		_, _ = io.Copy(host, conn)
+		_ = host.CloseWrite()
+	}()
+
+	_, _ = io.Copy(conn, host)
+
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	} else {
+		_ = conn.Close()
+	}
+
+	<-done
+
+	return nil
+}
@@ -0,0 +1,151 @@
+package guest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/amadigan/macoby/internal/event"
+	"github.com/amadigan/macoby/internal/rpc"
+)
+
+func (g *Guest) PushMetrics(req rpc.MetricsRequest, _ *struct{}) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.metricsCh == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.shutdownFuncs = append(g.shutdownFuncs, cancel)
+		g.metricsCh = make(chan rpc.MetricsRequest, 1)
+
+		go g.pushMetrics(ctx, g.metricsCh)
+	}
+
+	// replace any request the pusher has not picked up yet
+	select {
+	case <-g.metricsCh:
+	default:
+	}
+
+	g.metricsCh <- req
+
+	return nil
+}
+
+// pushMetrics... emits metrics on the event stream at the most recently requested interval, a new request is
+// answered immediately so that a new subscriber does not wait for the previous interval to expire
+func (g *Guest) pushMetrics(ctx context.Context, ch <-chan rpc.MetricsRequest) {
+	var req rpc.MetricsRequest
+	var timer <-chan time.Time
+
+	ooms := &oomTracker{containers: map[string]uint64{}}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case req = <-ch:
+			log.Debugf("pushing metrics every %v", req.Interval)
+		case <-timer:
+		}
+
+		if req.Interval <= 0 {
+			timer = nil
+
+			continue
+		}
+
+		g.emitMetrics(req.Disks, ooms)
+
+		timer = time.After(req.Interval)
+	}
+}
+
+func (g *Guest) emitMetrics(disks []string, ooms *oomTracker) {
+	var metrics event.Metrics
+
+	if err := g.Metrics(disks, &metrics); err != nil {
+		log.Warnf("Failed to collect metrics: %v", err)
+	} else {
+		g.emitter <- rpc.GuestEvent{Event: metrics}
+	}
+
+	var cmetrics event.ContainerMetrics
+
+	if err := g.ContainerMetrics(struct{}{}, &cmetrics); err != nil {
+		log.Warnf("Failed to collect container metrics: %v", err)
+
+		return
+	}
+
+	for _, oom := range ooms.update(cmetrics) {
+		g.emitter <- rpc.GuestEvent{Event: oom}
+	}
+
+	g.emitter <- rpc.GuestEvent{Event: cmetrics}
+}
+
+// oomTracker... converts the cumulative oom_kill counters from the kernel into OOM events
+type oomTracker struct {
+	containers map[string]uint64
+	system     uint64
+}
+
+func (o *oomTracker) update(metrics event.ContainerMetrics) []event.OOMKill {
+	var rv []event.OOMKill
+
+	seen := make(map[string]uint64, len(metrics.Containers))
+	var containerKills uint64
+
+	for _, cont := range metrics.Containers {
+		seen[cont.ID] = cont.OOMKills
+
+		if prev := o.containers[cont.ID]; cont.OOMKills > prev {
+			containerKills += cont.OOMKills - prev
+			rv = append(rv, event.OOMKill{ContainerID: cont.ID, Kills: cont.OOMKills - prev})
+		}
+	}
+
+	o.containers = seen
+
+	system, err := readVMStat("oom_kill")
+	if err != nil {
+		log.Warnf("Failed to read oom_kill: %v", err)
+
+		return rv
+	}
+
+	// the system-wide counter includes kills inside containers, only report the excess
+	if system > o.system {
+		if kills := system - o.system; kills > containerKills {
+			rv = append(rv, event.OOMKill{Kills: kills - containerKills})
+		}
+	}
+
+	o.system = system
+
+	return rv
+}
+
+func readVMStat(key string) (uint64, error) {
+	bs, err := os.ReadFile("/proc/vmstat")
+	if err != nil {
+		return 0, err
+	}
+
+	for line := range strings.SplitSeq(string(bs), "\n") {
+		if name, value, ok := strings.Cut(line, " "); ok && name == key {
+			val, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("Failed to parse %s: %v", line, err)
+			}
+
+			return val, nil
+		}
+	}
+
+	return 0, nil
+}
@@ -0,0 +1,336 @@
+package guest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/amadigan/macoby/internal/rpc"
+	"golang.org/x/sys/unix"
+)
+
+const modulesRoot = "/lib/modules"
+
+var modulesMutex sync.Mutex
+
+// moduleIndex... the modules built for the running kernel, from the files written by depmod
+type moduleIndex struct {
+	dir     string
+	deps    map[string][]string // module name to its path followed by the paths of its dependencies
+	builtin map[string]bool
+}
+
+// Modprobe... loads or unloads each module, a failure is reported in the result of that module
+func (g *Guest) Modprobe(req rpc.ModprobeRequest, out *[]rpc.ModuleResult) error {
+	results, err := modprobe(req)
+	*out = results
+
+	return err
+}
+
+// ListModules... the loaded modules from /proc/modules, with all the modules that are built in or could be loaded
+func (g *Guest) ListModules(all bool, out *[]rpc.Module) error {
+	modulesMutex.Lock()
+	defer modulesMutex.Unlock()
+
+	loaded, err := loadedModules()
+	if err != nil {
+		return err
+	}
+
+	if all {
+		index, err := loadModuleIndex()
+		if err != nil {
+			return err
+		}
+
+		for name := range index.deps {
+			if _, ok := loaded[name]; !ok {
+				loaded[name] = rpc.Module{Name: name}
+			}
+		}
+
+		for name := range index.builtin {
+			loaded[name] = rpc.Module{Name: name, State: rpc.ModuleBuiltin}
+		}
+	}
+
+	modules := make([]rpc.Module, 0, len(loaded))
+
+	for _, module := range loaded {
+		modules = append(modules, module)
+	}
+
+	slices.SortFunc(modules, func(a, b rpc.Module) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	*out = modules
+
+	return nil
+}
+
+// LoadModules... loads the modules of the init request, failures are logged and reported in the results
+func LoadModules(specs []string) []rpc.ModuleResult {
+	if len(specs) == 0 {
+		return nil
+	}
+
+	results, err := modprobe(rpc.ModprobeRequest{Modules: specs})
+	if err != nil {
+		log.Errorf("Failed to load modules: %v", err)
+
+		results = make([]rpc.ModuleResult, 0, len(specs))
+
+		for _, spec := range specs {
+			name, _, _ := strings.Cut(strings.TrimSpace(spec), " ")
+			result := rpc.ModuleResult{Name: normalizeModule(name), Status: rpc.ModuleFailed, Error: err.Error()}
+			results = append(results, result)
+		}
+
+		return results
+	}
+
+	for _, result := range results {
+		switch result.Status {
+		case rpc.ModuleLoaded, rpc.ModuleBuiltin:
+			log.Infof("Module %s %s", result.Name, result.Status)
+		default:
+			log.Errorf("Module %s %s: %s", result.Name, result.Status, result.Error)
+		}
+	}
+
+	return results
+}
+
+func modprobe(req rpc.ModprobeRequest) ([]rpc.ModuleResult, error) {
+	modulesMutex.Lock()
+	defer modulesMutex.Unlock()
+
+	index, err := loadModuleIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]rpc.ModuleResult, 0, len(req.Modules))
+
+	for _, spec := range req.Modules {
+		if req.Remove {
+			results = append(results, index.remove(spec))
+		} else {
+			results = append(results, index.load(spec))
+		}
+	}
+
+	return results, nil
+}
+
+func loadModuleIndex() (*moduleIndex, error) {
+	var uts unix.Utsname
+
+	if err := unix.Uname(&uts); err != nil {
+		return nil, fmt.Errorf("Failed to get the kernel release: %v", err)
+	}
+
+	index := &moduleIndex{
+		dir:     filepath.Join(modulesRoot, unix.ByteSliceToString(uts.Release[:])),
+		deps:    map[string][]string{},
+		builtin: map[string]bool{},
+	}
+
+	err := readLines(filepath.Join(index.dir, "modules.dep"), func(line string) {
+		path, deps, ok := strings.Cut(line, ":")
+		if ok {
+			index.deps[moduleName(path)] = append([]string{path}, strings.Fields(deps)...)
+		}
+	})
+
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("Failed to read the module dependencies: %v", err)
+	}
+
+	err = readLines(filepath.Join(index.dir, "modules.builtin"), func(line string) {
+		index.builtin[moduleName(line)] = true
+	})
+
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("Failed to read the builtin modules: %v", err)
+	}
+
+	return index, nil
+}
+
+// load... loads a module after the dependencies that are not loaded yet, the last dependency first like modprobe
+func (idx *moduleIndex) load(spec string) rpc.ModuleResult {
+	name, params, _ := strings.Cut(strings.TrimSpace(spec), " ")
+	result := rpc.ModuleResult{Name: normalizeModule(name)}
+
+	if idx.builtin[result.Name] {
+		result.Status = rpc.ModuleBuiltin
+
+		return result
+	}
+
+	paths, ok := idx.deps[result.Name]
+	if !ok {
+		result.Status = rpc.ModuleMissing
+		result.Error = fmt.Sprintf("Module %s not found in %s", result.Name, idx.dir)
+
+		return result
+	}
+
+	loaded, err := loadedModules()
+	if err != nil {
+		result.Status = rpc.ModuleFailed
+		result.Error = err.Error()
+
+		return result
+	}
+
+	for i := len(paths) - 1; i >= 0; i-- {
+		dep := moduleName(paths[i])
+		if _, ok := loaded[dep]; ok {
+			continue
+		}
+
+		args := ""
+		if i == 0 {
+			args = strings.TrimSpace(params)
+		}
+
+		if err := idx.insmod(paths[i], args); err != nil {
+			result.Status = rpc.ModuleFailed
+			result.Error = err.Error()
+
+			return result
+		}
+
+		log.Debugf("Loaded module %s", dep)
+	}
+
+	result.Status = rpc.ModuleLoaded
+
+	return result
+}
+
+func (idx *moduleIndex) insmod(path, params string) error {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(idx.dir, path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Failed to open %s: %v", path, err)
+	}
+
+	defer f.Close()
+
+	if err := unix.FinitModule(int(f.Fd()), params, 0); err != nil && !errors.Is(err, unix.EEXIST) {
+		return fmt.Errorf("Failed to load %s: %v", moduleName(path), err)
+	}
+
+	return nil
+}
+
+// remove... unloads a module, without waiting for it to be released. Unloading a module that is not loaded succeeds.
+func (idx *moduleIndex) remove(spec string) rpc.ModuleResult {
+	name, _, _ := strings.Cut(strings.TrimSpace(spec), " ")
+	result := rpc.ModuleResult{Name: normalizeModule(name), Status: rpc.ModuleFailed}
+
+	loaded, err := loadedModules()
+	if err != nil {
+		result.Error = err.Error()
+
+		return result
+	}
+
+	module, isLoaded := loaded[result.Name]
+
+	switch {
+	case idx.builtin[result.Name]:
+		result.Error = fmt.Sprintf("Module %s is built into the kernel", result.Name)
+	case !isLoaded && idx.deps[result.Name] == nil:
+		result.Status = rpc.ModuleMissing
+		result.Error = fmt.Sprintf("Module %s not found in %s", result.Name, idx.dir)
+	case !isLoaded:
+		result.Status = rpc.ModuleRemoved
+	case len(module.UsedBy) > 0:
+		result.Error = fmt.Sprintf("Module %s is used by %s", result.Name, strings.Join(module.UsedBy, ", "))
+	default:
+		if err := unix.DeleteModule(result.Name, unix.O_NONBLOCK); err != nil {
+			result.Error = fmt.Sprintf("Failed to unload %s: %v", result.Name, err)
+		} else {
+			result.Status = rpc.ModuleRemoved
+		}
+	}
+
+	return result
+}
+
+// loadedModules... the modules in /proc/modules, each line is the name, size, reference count, users, state and
+// address of a module
+func loadedModules() (map[string]rpc.Module, error) {
+	modules := map[string]rpc.Module{}
+
+	err := readLines("/proc/modules", func(line string) {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			return
+		}
+
+		module := rpc.Module{Name: fields[0], State: strings.ToLower(fields[4])}
+		module.Size, _ = strconv.ParseUint(fields[1], 10, 64)
+		module.Refs, _ = strconv.Atoi(fields[2])
+
+		for _, user := range strings.Split(fields[3], ",") {
+			if user != "" && user != "-" {
+				module.UsedBy = append(module.UsedBy, user)
+			}
+		}
+
+		modules[module.Name] = module
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read /proc/modules: %v", err)
+	}
+
+	return modules, nil
+}
+
+func readLines(path string, fn func(string)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			fn(line)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// moduleName... the name of a module from its path, kernel/net/bridge/br_netfilter.ko is br_netfilter
+func moduleName(path string) string {
+	name, _, _ := strings.Cut(filepath.Base(path), ".ko")
+
+	return normalizeModule(name)
+}
+
+// normalizeModule... dashes and underscores are interchangeable in module names, the kernel uses underscores
+func normalizeModule(name string) string {
+	return strings.ReplaceAll(name, "-", "_")
+}
@@ -141,45 +141,3 @@ func MountCgroup() error {
 
 	return nil
 }
-
-func OverlayRoot(size uint64) error {
-	if err := MountTmp("tmpfs", "/mnt", size); err != nil {
-		return fmt.Errorf("Failed to mount tmpfs: %w", err)
-	}
-
-	if err := os.MkdirAll("/mnt/upper", 0755); err != nil {
-		return fmt.Errorf("Failed to create upper overlay directory: %w", err)
-	}
-
-	if err := os.MkdirAll("/mnt/work", 0755); err != nil {
-		return fmt.Errorf("Failed to create work overlay directory: %w", err)
-	}
-
-	if err := os.MkdirAll("/mnt/newroot", 0755); err != nil {
-		return fmt.Errorf("Failed to create merged overlay directory: %w", err)
-	}
-
-	if err := unix.Mount("overlay", "/mnt/newroot", "overlay", 0, "lowerdir=/,upperdir=/mnt/upper,workdir=/mnt/work"); err != nil {
-		return fmt.Errorf("Failed to mount overlay: %w", err)
-	}
-
-	// mount the newroot to /, and then mount the oldroot over it
-	if err := unix.PivotRoot("/mnt/newroot", "/mnt/newroot"); err != nil {
-		return fmt.Errorf("Failed to pivot root: %w", err)
-	}
-
-	if err := os.Chdir("/"); err != nil {
-		return fmt.Errorf("Failed to change directory: %w", err)
-	}
-
-	// unmount the oldroot to uncover the newroot
-	if err := unix.Unmount("/", unix.MNT_DETACH); err != nil {
-		return fmt.Errorf("Failed to unmount /: %w", err)
-	}
-
-	if err := unix.Mount("devtmpfs", "/dev", "devtmpfs", unix.MS_NOSUID|unix.MS_STRICTATIME, ""); err != nil {
-		return fmt.Errorf("Failed to mount /dev: %w", err)
-	}
-
-	return nil
-}
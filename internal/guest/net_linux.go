@@ -5,33 +5,90 @@ import (
 	"fmt"
 	"net"
 	"os"
-	"time"
+	"slices"
+	"strings"
+	"sync"
 
+	"github.com/amadigan/macoby/internal/event"
 	"github.com/amadigan/macoby/internal/rpc"
-	"github.com/insomniacslk/dhcp/dhcpv4"
-	"github.com/insomniacslk/dhcp/dhcpv4/nclient4"
 	"github.com/vishvananda/netlink"
 	"golang.org/x/sys/unix"
 )
 
 func (g *Guest) DHCP(_ struct{}, resp *rpc.DHCPResponse) error {
-	ifaces, err := FindConfigurableInterfaces()
+	g.mutex.Lock()
+	netconf := g.network
+	g.mutex.Unlock()
+
+	iface, err := g.primaryInterface(netconf)
 	if err != nil {
-		return fmt.Errorf("Unable to fetch configurable interfaces: %v", err)
+		return err
 	}
 
-	if len(ifaces) > 0 {
-		v4, err := RequestDHCP(context.Background(), &ifaces[0])
-		if err != nil {
+	onChange := func(addr net.IP) {
+		g.emitter <- rpc.GuestEvent{Event: event.AddressChange{Interface: iface.Name, Address: addr}}
+	}
+
+	var v4 net.IP
+
+	if netconf.Address != "" {
+		if v4, err = ConfigureStatic(iface, netconf, &g.resolv, &g.hosts); err != nil {
+			return fmt.Errorf("Static network configuration error: %v", err)
+		}
+	} else {
+		lm := &leaseManager{
+			iface:    iface,
+			dns:      netconf.DNS,
+			search:   netconf.Search,
+			resolv:   &g.resolv,
+			hosts:    &g.hosts,
+			onChange: onChange,
+		}
+
+		if v4, err = lm.start(context.Background()); err != nil {
 			return fmt.Errorf("DHCP error: %v", err)
 		}
 
-		*resp = rpc.DHCPResponse{Address: v4}
+		ctx, cancel := context.WithCancel(context.Background())
+		g.AddShutdownFunc(cancel)
+
+		go lm.run(ctx)
+	}
+
+	// the host network stack only handles IPv4
+	if netconf.IPv6 != rpc.IPv6Off && netconf.Mode != rpc.NetworkVsock {
+		g.startIPv6(iface, netconf, onChange)
+	}
+
+	*resp = rpc.DHCPResponse{Address: v4}
+
+	return nil
+}
+
+// primaryInterface... the interface to configure, in vsock mode a TAP interface connected to the host network stack
+func (g *Guest) primaryInterface(netconf rpc.NetworkConfig) (*net.Interface, error) {
+	if netconf.Mode == rpc.NetworkVsock {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.AddShutdownFunc(cancel)
+
+		iface, err := StartVirtualNetwork(ctx, virtualInterface)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to start virtual network: %v", err)
+		}
+
+		return iface, nil
+	}
+
+	ifaces, err := FindConfigurableInterfaces()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to fetch configurable interfaces: %v", err)
+	}
 
-		return nil
+	if len(ifaces) == 0 {
+		return nil, fmt.Errorf("No configurable interfaces found")
 	}
 
-	return fmt.Errorf("No configurable interfaces found")
+	return &ifaces[0], nil
 }
 
 func SetAddress(iface *net.Interface, addr net.IPNet) error {
@@ -51,93 +108,161 @@ func SetAddress(iface *net.Interface, addr net.IPNet) error {
 	return nil
 }
 
-func FindConfigurableInterfaces() ([]net.Interface, error) {
-	links, err := netlink.LinkList()
+func RemoveAddress(iface *net.Interface, addr net.IPNet) error {
+	link, err := netlink.LinkByIndex(iface.Index)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	rv := make([]net.Interface, 0, len(links))
+	return netlink.AddrDel(link, &netlink.Addr{IPNet: &addr})
+}
 
-	for _, link := range links {
-		attrs := link.Attrs()
-		if attrs.OperState == netlink.OperDown && attrs.RawFlags&unix.IFF_LOOPBACK == 0 {
-			iface, err := net.InterfaceByIndex(attrs.Index)
-			if err != nil {
-				return nil, err
-			}
+func SetDefaultRoute(iface *net.Interface, src net.IP, gateway net.IP) error {
+	return netlink.RouteReplace(&netlink.Route{
+		Src:       src,
+		Dst:       &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+		Gw:        gateway,
+		LinkIndex: iface.Index,
+	})
+}
 
-			rv = append(rv, *iface)
-		}
+// ConfigureStatic... applies a static address, default route, resolver and gateway hosts configuration
+func ConfigureStatic(iface *net.Interface, netconf rpc.NetworkConfig, resolv *resolver, hosts *hostsFile) (net.IP, error) {
+	ip, ipnet, err := net.ParseCIDR(netconf.Address)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid address %s: %v", netconf.Address, err)
 	}
 
-	return rv, nil
-}
+	addr := net.IPNet{IP: ip, Mask: ipnet.Mask}
 
-func RequestDHCP(ctx context.Context, iface *net.Interface) (net.IP, error) {
-	link, err := netlink.LinkByIndex(iface.Index)
-	if err != nil {
-		return nil, err
+	log.Debugf("Setting static address %s on %s", addr.String(), iface.Name)
+
+	if err := SetAddress(iface, addr); err != nil {
+		return nil, fmt.Errorf("Error setting address: %v", err)
 	}
 
-	if link.Attrs().OperState == netlink.OperDown {
-		err = netlink.LinkSetUp(link)
-		if err != nil {
-			return nil, err
+	if netconf.Gateway != "" {
+		gateway := net.ParseIP(netconf.Gateway)
+		if gateway == nil {
+			return nil, fmt.Errorf("Invalid gateway %s", netconf.Gateway)
 		}
-	}
 
-	client, err := nclient4.New(iface.Name)
-	if err != nil {
-		return nil, err
+		if err := SetDefaultRoute(iface, ip, gateway); err != nil {
+			return nil, fmt.Errorf("Error setting route: %v", err)
+		}
+
+		if err := hosts.setGateway(gateway); err != nil {
+			return nil, fmt.Errorf("Error writing /etc/hosts: %v", err)
+		}
 	}
 
-	lease, err := client.Request(ctx, func(d *dhcpv4.DHCPv4) {
-		d.Options.Update(dhcpv4.OptIPAddressLeaseTime(24 * time.Hour))
-	})
-	if err != nil {
-		return nil, err
+	nameservers := make([]net.IP, 0, len(netconf.DNS))
+
+	for _, server := range netconf.DNS {
+		if ip := net.ParseIP(server); ip != nil {
+			nameservers = append(nameservers, ip)
+		} else {
+			return nil, fmt.Errorf("Invalid nameserver %s", server)
+		}
 	}
 
-	log.Debugf("Received offer: %s\n", lease.Offer.Summary())
-	log.Debugf("DHCP options: %s\n", lease.Offer.Options)
+	return ip, resolv.setIPv4(nameservers, netconf.Search)
+}
+
+// resolver... combines the nameservers and search domains learned over IPv4 and IPv6 into /etc/resolv.conf, so that
+// a renewal on one family does not discard the other. If the DNS stub is running, it is the only nameserver.
+type resolver struct {
+	stub         net.IP
+	nameservers4 []net.IP
+	nameservers6 []net.IP
+	search4      []string
+	search6      []string
+
+	mutex sync.Mutex
+}
+
+func (r *resolver) setIPv4(nameservers []net.IP, search []string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.nameservers4 = nameservers
+	r.search4 = search
+
+	return r.write()
+}
+
+func (r *resolver) setIPv6(nameservers []net.IP, search []string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.nameservers6 = nameservers
+	r.search6 = search
+
+	return r.write()
+}
 
-	addr := net.IPNet{
-		IP:   lease.Offer.YourIPAddr,
-		Mask: lease.Offer.SubnetMask(),
+func (r *resolver) setStub(stub net.IP) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.stub = stub
+
+	return r.write()
+}
+
+func (r *resolver) write() error {
+	nameservers := append(slices.Clone(r.nameservers4), r.nameservers6...)
+
+	if r.stub != nil {
+		nameservers = []net.IP{r.stub}
 	}
 
-	log.Debugf("Setting address %s on %s", addr.String(), iface.Name)
+	var search []string
 
-	if err = SetAddress(iface, addr); err != nil {
-		return nil, fmt.Errorf("Error setting address: %v", err)
+	for _, domain := range append(slices.Clone(r.search4), r.search6...) {
+		if !slices.Contains(search, domain) {
+			search = append(search, domain)
+		}
 	}
 
-	gateway := lease.Offer.GatewayIPAddr
+	return WriteResolvConf(nameservers, search)
+}
+
+func WriteResolvConf(nameservers []net.IP, search []string) error {
+	var resolvConf strings.Builder
 
-	if gateway.IsUnspecified() {
-		gateway = lease.Offer.ServerIPAddr
+	if len(search) > 0 {
+		resolvConf.WriteString(fmt.Sprintf("search %s\n", strings.Join(search, " ")))
 	}
 
-	err = netlink.RouteReplace(&netlink.Route{
-		Src:       addr.IP,
-		Dst:       &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
-		Gw:        gateway,
-		LinkIndex: link.Attrs().Index,
-	})
+	for _, resolver := range nameservers {
+		resolvConf.WriteString(fmt.Sprintf("nameserver %s\n", resolver.String()))
+	}
 
+	return os.WriteFile("/etc/resolv.conf", []byte(resolvConf.String()), 0644)
+}
+
+func FindConfigurableInterfaces() ([]net.Interface, error) {
+	links, err := netlink.LinkList()
 	if err != nil {
-		return nil, fmt.Errorf("Error setting route: %v", err)
+		return nil, err
 	}
 
-	resolvConf := ""
-	resolvers := lease.Offer.DNS()
+	rv := make([]net.Interface, 0, len(links))
 
-	for _, resolver := range resolvers {
-		resolvConf = resolvConf + fmt.Sprintf("nameserver %s\n", resolver.String())
+	for _, link := range links {
+		attrs := link.Attrs()
+		if attrs.OperState == netlink.OperDown && attrs.RawFlags&unix.IFF_LOOPBACK == 0 {
+			iface, err := net.InterfaceByIndex(attrs.Index)
+			if err != nil {
+				return nil, err
+			}
+
+			rv = append(rv, *iface)
+		}
 	}
 
-	return addr.IP, os.WriteFile("/etc/resolv.conf", []byte(resolvConf), 0644)
+	return rv, nil
 }
 
 func EnableLoopback() error {
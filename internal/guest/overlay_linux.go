@@ -0,0 +1,376 @@
+package guest
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/amadigan/macoby/internal/rpc"
+	"golang.org/x/sys/unix"
+)
+
+// The tmpfs at overlayRoot holds the upper layer, unless it is kept on a device mounted at overlayDisk, and the mount
+// points of the extension layers. None of them are visible once the root has been pivoted to the overlay.
+const (
+	overlayRoot   = "/mnt"
+	overlayDisk   = "/mnt/disk"
+	extensionRoot = "/mnt/ext"
+	newRoot       = "/mnt/newroot"
+)
+
+// overlayUpper... a descriptor of the filesystem of a persistent upper layer, -1 if the upper layer is a tmpfs
+var overlayUpper = -1
+
+// OverlayRoot... overlays the read-only root with a writable upper layer and the extension layers, then pivots to the
+// overlay
+func OverlayRoot(cfg rpc.OverlayConfig) error {
+	if err := MountTmp("tmpfs", overlayRoot, cfg.Size); err != nil {
+		return fmt.Errorf("Failed to mount tmpfs: %w", err)
+	}
+
+	upper := overlayRoot
+
+	if cfg.Device != "" {
+		if err := mountOverlayDisk(cfg); err != nil {
+			return err
+		}
+
+		upper = overlayDisk
+	}
+
+	lower := make([]string, 0, len(cfg.Extensions)+1)
+
+	for i, layer := range cfg.Extensions {
+		dir, err := mountExtension(i, layer)
+		if err != nil {
+			return err
+		}
+
+		lower = append(lower, dir)
+	}
+
+	lower = append(lower, "/")
+
+	for _, dir := range []string{filepath.Join(upper, "upper"), filepath.Join(upper, "work"), newRoot} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("Failed to create overlay directory %s: %w", dir, err)
+		}
+	}
+
+	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s/upper,workdir=%s/work", strings.Join(lower, ":"), upper, upper)
+
+	if err := unix.Mount("overlay", newRoot, "overlay", 0, opts); err != nil {
+		return fmt.Errorf("Failed to mount overlay: %w", err)
+	}
+
+	// mount the newroot to /, and then mount the oldroot over it
+	if err := unix.PivotRoot(newRoot, newRoot); err != nil {
+		return fmt.Errorf("Failed to pivot root: %w", err)
+	}
+
+	if err := os.Chdir("/"); err != nil {
+		return fmt.Errorf("Failed to change directory: %w", err)
+	}
+
+	// unmount the oldroot to uncover the newroot
+	if err := unix.Unmount("/", unix.MNT_DETACH); err != nil {
+		return fmt.Errorf("Failed to unmount /: %w", err)
+	}
+
+	if err := unix.Mount("devtmpfs", "/dev", "devtmpfs", unix.MS_NOSUID|unix.MS_STRICTATIME, ""); err != nil {
+		return fmt.Errorf("Failed to mount /dev: %w", err)
+	}
+
+	return nil
+}
+
+// mountOverlayDisk... mounts the device of a persistent upper layer, formatting or growing it first if asked. The
+// tools check /proc/mounts, so /proc is mounted on the old root while they run.
+func mountOverlayDisk(cfg rpc.OverlayConfig) error {
+	if err := os.MkdirAll(overlayDisk, 0755); err != nil {
+		return fmt.Errorf("Failed to create %s: %v", overlayDisk, err)
+	}
+
+	if err := unix.Mount("proc", "/proc", "proc", unix.MS_NOSUID, ""); err != nil {
+		return fmt.Errorf("Failed to mount /proc: %v", err)
+	}
+
+	defer func() {
+		if err := unix.Unmount("/proc", 0); err != nil {
+			log.Warnf("Failed to unmount /proc: %v", err)
+		}
+	}()
+
+	if len(cfg.Mkfs) > 0 {
+		if err := runTool(cfg.Mkfs...); err != nil {
+			return fmt.Errorf("Failed to format %s: %v", cfg.Device, err)
+		}
+
+		log.Infof("Formatted %s as %s for the overlay", cfg.Device, cfg.FS)
+	}
+
+	if err := unix.Mount(cfg.Device, overlayDisk, cfg.FS, unix.MS_NOATIME, ""); err != nil {
+		return fmt.Errorf("Failed to mount %s: %v", cfg.Device, err)
+	}
+
+	if cfg.Grow {
+		var err error
+
+		switch cfg.FS {
+		case "ext4":
+			err = runTool("/usr/sbin/resize2fs", cfg.Device)
+		case "btrfs":
+			err = runTool("/sbin/btrfs", "filesystem", "resize", "max", overlayDisk)
+		case "xfs":
+			err = runTool("/usr/sbin/xfs_growfs", overlayDisk)
+		default:
+			err = fmt.Errorf("cannot grow %s", cfg.FS)
+		}
+
+		if err != nil {
+			log.Warnf("Failed to grow the overlay on %s: %v", cfg.Device, err)
+		}
+	}
+
+	fd, err := unix.Open(overlayDisk, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("Failed to open %s: %v", overlayDisk, err)
+	}
+
+	overlayUpper = fd
+
+	return nil
+}
+
+// SyncOverlay... flushes the filesystem of a persistent upper layer, it stays mounted under the root until power off
+func SyncOverlay() error {
+	if overlayUpper < 0 {
+		return nil
+	}
+
+	if err := unix.Syncfs(overlayUpper); err != nil {
+		return fmt.Errorf("Failed to sync the overlay: %v", err)
+	}
+
+	return nil
+}
+
+// mountExtension... mounts an extension layer, a tar archive is unpacked to a tmpfs as large as its device
+func mountExtension(index int, layer rpc.OverlayLayer) (string, error) {
+	dir := filepath.Join(extensionRoot, strconv.Itoa(index))
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("Failed to create %s: %v", dir, err)
+	}
+
+	if layer.FS != rpc.LayerTar {
+		if err := unix.Mount(layer.Device, dir, layer.FS, unix.MS_RDONLY|unix.MS_NOATIME, ""); err != nil {
+			return "", fmt.Errorf("Failed to mount extension %s: %v", layer.Device, err)
+		}
+
+		return dir, nil
+	}
+
+	f, err := os.Open(layer.Device)
+	if err != nil {
+		return "", fmt.Errorf("Failed to open extension %s: %v", layer.Device, err)
+	}
+
+	defer f.Close()
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get the size of %s: %v", layer.Device, err)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("Failed to seek %s: %v", layer.Device, err)
+	}
+
+	if err := unix.Mount("tmpfs", dir, "tmpfs", unix.MS_NOATIME, fmt.Sprintf("uid=0,gid=0,mode=0755,size=%d", size)); err != nil {
+		return "", fmt.Errorf("Failed to mount tmpfs on %s: %v", dir, err)
+	}
+
+	if err := extractTar(f, dir); err != nil {
+		return "", fmt.Errorf("Failed to unpack extension %s: %v", layer.Device, err)
+	}
+
+	return dir, nil
+}
+
+// extractTar... unpacks a tar archive to dir, keeping owners, modes and device nodes. Entries outside of dir are
+// rejected, including those whose parent is a symlink unpacked earlier, as the link would be followed. An entry
+// replaces an earlier one of the same name, a symlink is removed rather than written through.
+func extractTar(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		name := filepath.Clean(hdr.Name)
+		if name == "." {
+			continue
+		} else if !filepath.IsLocal(name) {
+			return fmt.Errorf("invalid path %s", hdr.Name)
+		}
+
+		path := filepath.Join(dir, name)
+		mode := uint32(hdr.Mode) & 07777 //nolint:gosec
+
+		if err := checkParents(dir, name); err != nil {
+			return err
+		}
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+
+		if err := replaceEntry(path, hdr.Typeflag == tar.TypeDir); err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.Mkdir(path, 0755); err != nil && !errors.Is(err, os.ErrExist) {
+				return err
+			}
+		case tar.TypeReg:
+			if err := writeTarFile(tr, path); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, path); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			target := filepath.Clean(hdr.Linkname)
+			if !filepath.IsLocal(target) {
+				return fmt.Errorf("invalid link target %s", hdr.Linkname)
+			}
+
+			if err := checkParents(dir, target); err != nil {
+				return err
+			}
+
+			if err := os.Link(filepath.Join(dir, target), path); err != nil {
+				return err
+			}
+
+			continue
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			typ := map[byte]uint32{tar.TypeChar: unix.S_IFCHR, tar.TypeBlock: unix.S_IFBLK, tar.TypeFifo: unix.S_IFIFO}
+			dev := unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor)) //nolint:gosec
+
+			if err := unix.Mknod(path, typ[hdr.Typeflag]|mode, int(dev)); err != nil { //nolint:gosec
+				return err
+			}
+		default:
+			log.Warnf("Skipping %s in extension, unsupported type %c", hdr.Name, hdr.Typeflag)
+
+			continue
+		}
+
+		if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+
+		if hdr.Typeflag != tar.TypeSymlink {
+			// chmod after chown, which clears the setuid and setgid bits
+			if err := unix.Chmod(path, mode); err != nil {
+				return err
+			}
+		}
+
+		ts := []unix.Timespec{unix.NsecToTimespec(hdr.ModTime.UnixNano()), unix.NsecToTimespec(hdr.ModTime.UnixNano())}
+
+		if err := unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return err
+		}
+	}
+}
+
+// checkParents... fails if a parent directory of name inside dir is a symlink or not a directory. Missing parents are
+// created as directories.
+func checkParents(dir, name string) error {
+	path := dir
+
+	for _, part := range strings.Split(filepath.Dir(name), string(filepath.Separator)) {
+		if part == "." {
+			return nil
+		}
+
+		path = filepath.Join(path, part)
+
+		stat, err := os.Lstat(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if stat.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("invalid path %s, %s is a symlink", name, part)
+		} else if !stat.IsDir() {
+			return fmt.Errorf("invalid path %s, %s is not a directory", name, part)
+		}
+	}
+
+	return nil
+}
+
+// replaceEntry... removes an earlier entry at path, unless both are directories
+func replaceEntry(path string, dir bool) error {
+	stat, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if stat.IsDir() {
+		if dir {
+			return nil
+		}
+
+		return fmt.Errorf("%s is a directory", path)
+	}
+
+	return os.Remove(path)
+}
+
+func writeTarFile(r io.Reader, path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY|unix.O_NOFOLLOW, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+
+		return err
+	}
+
+	return f.Close()
+}
+
+func runTool(args ...string) error {
+	cmd := exec.Command(args[0], args[1:]...)
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+
+	return nil
+}
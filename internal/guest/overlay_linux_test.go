@@ -0,0 +1,124 @@
+package guest
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type tarEntry struct {
+	name     string
+	typ      byte
+	linkname string
+	data     string
+}
+
+func buildTar(t *testing.T, entries ...tarEntry) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	tw := tar.NewWriter(&buf)
+
+	for _, entry := range entries {
+		hdr := &tar.Header{
+			Name:     entry.name,
+			Typeflag: entry.typ,
+			Linkname: entry.linkname,
+			Mode:     0644,
+			Size:     int64(len(entry.data)),
+			Uid:      os.Getuid(),
+			Gid:      os.Getgid(),
+			ModTime:  time.Unix(1700000000, 0),
+		}
+
+		if entry.typ == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := tw.Write([]byte(entry.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return &buf
+}
+
+func TestExtractTar(t *testing.T) {
+	dir := t.TempDir()
+
+	archive := buildTar(t,
+		tarEntry{name: "etc/", typ: tar.TypeDir},
+		tarEntry{name: "etc/motd", typ: tar.TypeReg, data: "hello"},
+		tarEntry{name: "etc/issue", typ: tar.TypeSymlink, linkname: "motd"},
+		tarEntry{name: "usr/bin/tool", typ: tar.TypeReg, data: "#!/bin/sh"},
+		tarEntry{name: "usr/bin/alias", typ: tar.TypeLink, linkname: "usr/bin/tool"},
+	)
+
+	if err := extractTar(archive, dir); err != nil {
+		t.Fatalf("extractTar: %v", err)
+	}
+
+	if data, err := os.ReadFile(filepath.Join(dir, "etc/issue")); err != nil || string(data) != "hello" {
+		t.Errorf("etc/issue = %q, %v", data, err)
+	}
+
+	if data, err := os.ReadFile(filepath.Join(dir, "usr/bin/alias")); err != nil || string(data) != "#!/bin/sh" {
+		t.Errorf("usr/bin/alias = %q, %v", data, err)
+	}
+}
+
+func TestExtractTarSymlinkParent(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+
+	archive := buildTar(t,
+		tarEntry{name: "a", typ: tar.TypeSymlink, linkname: outside},
+		tarEntry{name: "a/passwd", typ: tar.TypeReg, data: "root::0:0::/:/bin/sh"},
+	)
+
+	if err := extractTar(archive, dir); err == nil {
+		t.Error("unpacked an entry below a symlink")
+	}
+
+	if _, err := os.Lstat(filepath.Join(outside, "passwd")); err == nil {
+		t.Error("wrote outside of the destination through a symlink")
+	}
+}
+
+func TestExtractTarReplacesSymlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(t.TempDir(), "passwd")
+
+	if err := os.WriteFile(target, []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := buildTar(t,
+		tarEntry{name: "passwd", typ: tar.TypeSymlink, linkname: target},
+		tarEntry{name: "passwd", typ: tar.TypeReg, data: "replaced"},
+	)
+
+	if err := extractTar(archive, dir); err != nil {
+		t.Fatalf("extractTar: %v", err)
+	}
+
+	if data, _ := os.ReadFile(target); string(data) != "original" {
+		t.Errorf("wrote %q through a symlink", data)
+	}
+
+	if data, _ := os.ReadFile(filepath.Join(dir, "passwd")); string(data) != "replaced" {
+		t.Errorf("passwd = %q, want the regular file", data)
+	}
+}
@@ -0,0 +1,381 @@
+package guest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amadigan/macoby/internal/rpc"
+	"golang.org/x/sys/unix"
+)
+
+// The top level subvolume of a disk holds the snapshots, and the copies of snapshots made by a restore. The default
+// subvolume is the live tree mounted at the disk mount point, at first it is the top level subvolume itself.
+const (
+	btrfsProg     = "/sbin/btrfs"
+	topLevelRoot  = "/run/railyard/btrfs"
+	snapshotDir   = ".snapshots"
+	liveDir       = ".live"
+	topLevelSubId = "5"
+)
+
+var snapshotMutex sync.Mutex
+
+// Snapshot... snapshots copy the nested subvolumes of the live tree as well, such as the layers of the docker btrfs
+// storage driver. A snapshot is only consistent per subvolume.
+func (g *Guest) Snapshot(req rpc.SnapshotRequest, out *[]rpc.Snapshot) error {
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+
+	if req.Op != rpc.SnapshotList && !rpc.ValidSnapshotName(req.Name) {
+		return fmt.Errorf("Invalid snapshot name %q", req.Name)
+	}
+
+	if req.Op == rpc.SnapshotRestore && req.Mount != "" {
+		// the filesystem must not be in use while its live tree is replaced
+		if err := unix.Unmount(req.Mount, unix.MNT_DETACH); err != nil && !errors.Is(err, unix.EINVAL) {
+			return fmt.Errorf("Failed to unmount %s: %v", req.Mount, err)
+		}
+	}
+
+	top := filepath.Join(topLevelRoot, filepath.Base(req.Device))
+
+	if err := os.MkdirAll(top, 0700); err != nil {
+		return fmt.Errorf("Failed to create %s: %v", top, err)
+	}
+
+	if err := unix.Mount(req.Device, top, "btrfs", unix.MS_NOATIME, "subvolid="+topLevelSubId); err != nil {
+		return fmt.Errorf("Failed to mount the top level subvolume of %s: %v", req.Device, err)
+	}
+
+	defer func() {
+		if err := unix.Unmount(top, 0); err != nil {
+			log.Warnf("Failed to unmount %s: %v", top, err)
+		}
+	}()
+
+	switch req.Op {
+	case rpc.SnapshotList:
+		return listSnapshots(top, out)
+	case rpc.SnapshotCreate:
+		return createSnapshot(top, req.Name, out)
+	case rpc.SnapshotDelete:
+		return deleteSnapshot(top, req.Name, out)
+	case rpc.SnapshotRestore:
+		return restoreSnapshot(top, req.Name, out)
+	default:
+		return fmt.Errorf("Unknown snapshot operation %s", req.Op)
+	}
+}
+
+func listSnapshots(top string, out *[]rpc.Snapshot) error {
+	entries, err := os.ReadDir(filepath.Join(top, snapshotDir))
+	if errors.Is(err, os.ErrNotExist) {
+		*out = nil
+
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Failed to read snapshots: %v", err)
+	}
+
+	snapshots := make([]rpc.Snapshot, 0, len(entries))
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			snapshots = append(snapshots, snapshotInfo(top, entry.Name()))
+		}
+	}
+
+	slices.SortFunc(snapshots, func(a, b rpc.Snapshot) int {
+		return a.Created.Compare(b.Created)
+	})
+
+	*out = snapshots
+
+	return nil
+}
+
+func createSnapshot(top, name string, out *[]rpc.Snapshot) error {
+	path := filepath.Join(snapshotDir, name)
+
+	if err := os.Mkdir(filepath.Join(top, snapshotDir), 0700); err != nil && !errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("Failed to create snapshot directory: %v", err)
+	}
+
+	if _, err := os.Lstat(filepath.Join(top, path)); err == nil {
+		return fmt.Errorf("Snapshot %s already exists", name)
+	}
+
+	live, err := defaultSubvolume(top)
+	if err != nil {
+		return err
+	}
+
+	subvols, err := listSubvolumes(top)
+	if err != nil {
+		return err
+	}
+
+	if err := snapshotTree(top, live, path, subvols); err != nil {
+		discardTree(top, path)
+
+		return err
+	}
+
+	log.Infof("Created snapshot %s of %s", name, top)
+
+	*out = []rpc.Snapshot{snapshotInfo(top, name)}
+
+	return nil
+}
+
+func deleteSnapshot(top, name string, out *[]rpc.Snapshot) error {
+	path := filepath.Join(snapshotDir, name)
+
+	if _, err := os.Lstat(filepath.Join(top, path)); err != nil {
+		return fmt.Errorf("No such snapshot: %s", name)
+	}
+
+	info := snapshotInfo(top, name)
+
+	subvols, err := listSubvolumes(top)
+	if err != nil {
+		return err
+	}
+
+	if err := deleteTree(top, path, subvols); err != nil {
+		return err
+	}
+
+	log.Infof("Deleted snapshot %s of %s", name, top)
+
+	*out = []rpc.Snapshot{info}
+
+	return nil
+}
+
+// restoreSnapshot... copies the snapshot to a new live tree and makes it the default subvolume, the previous live tree
+// is deleted
+func restoreSnapshot(top, name string, out *[]rpc.Snapshot) error {
+	path := filepath.Join(snapshotDir, name)
+
+	if _, err := os.Lstat(filepath.Join(top, path)); err != nil {
+		return fmt.Errorf("No such snapshot: %s", name)
+	}
+
+	old, err := defaultSubvolume(top)
+	if err != nil {
+		return err
+	}
+
+	subvols, err := listSubvolumes(top)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Mkdir(filepath.Join(top, liveDir), 0700); err != nil && !errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("Failed to create live directory: %v", err)
+	}
+
+	live := filepath.Join(liveDir, strconv.FormatInt(time.Now().UnixNano(), 36))
+
+	if err := snapshotTree(top, path, live, subvols); err != nil {
+		discardTree(top, live)
+
+		return err
+	}
+
+	if _, err := btrfs("subvolume", "set-default", filepath.Join(top, live)); err != nil {
+		discardTree(top, live)
+
+		return fmt.Errorf("Failed to set the default subvolume: %v", err)
+	}
+
+	if subvols, err = listSubvolumes(top); err != nil {
+		return err
+	}
+
+	if err := deleteTree(top, old, subvols); err != nil {
+		log.Warnf("Failed to delete the previous live tree of %s: %v", top, err)
+	}
+
+	log.Infof("Restored snapshot %s of %s", name, top)
+
+	*out = []rpc.Snapshot{snapshotInfo(top, name)}
+
+	return nil
+}
+
+// snapshotTree... snapshots src and the subvolumes nested in it to dst, paths are relative to the top level
+func snapshotTree(top, src, dst string, subvols []string) error {
+	if _, err := btrfs("subvolume", "snapshot", filepath.Join(top, src), filepath.Join(top, dst)); err != nil {
+		return fmt.Errorf("Failed to snapshot %s: %v", src, err)
+	}
+
+	if src == "" {
+		// the snapshot of the top level has placeholders for the snapshots and live trees
+		for _, dir := range []string{snapshotDir, liveDir} {
+			if err := os.RemoveAll(filepath.Join(top, dst, dir)); err != nil {
+				return fmt.Errorf("Failed to remove %s from snapshot: %v", dir, err)
+			}
+		}
+	}
+
+	for _, sub := range nestedSubvolumes(src, subvols) {
+		target := filepath.Join(top, dst, strings.TrimPrefix(sub, src))
+
+		// a nested subvolume is an empty directory in the snapshot of its parent
+		if err := os.Remove(target); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("Failed to replace %s: %v", target, err)
+		}
+
+		if _, err := btrfs("subvolume", "snapshot", filepath.Join(top, sub), target); err != nil {
+			return fmt.Errorf("Failed to snapshot %s: %v", sub, err)
+		}
+	}
+
+	return nil
+}
+
+// deleteTree... deletes path and the subvolumes nested in it. The top level subvolume cannot be deleted, only its
+// contents are, except for the snapshots and live trees.
+func deleteTree(top, path string, subvols []string) error {
+	nested := nestedSubvolumes(path, subvols)
+	slices.Reverse(nested)
+
+	for _, sub := range nested {
+		if _, err := btrfs("subvolume", "delete", filepath.Join(top, sub)); err != nil {
+			return fmt.Errorf("Failed to delete %s: %v", sub, err)
+		}
+	}
+
+	if path != "" {
+		if _, err := btrfs("subvolume", "delete", filepath.Join(top, path)); err != nil {
+			return fmt.Errorf("Failed to delete %s: %v", path, err)
+		}
+
+		return nil
+	}
+
+	entries, err := os.ReadDir(top)
+	if err != nil {
+		return fmt.Errorf("Failed to read %s: %v", top, err)
+	}
+
+	for _, entry := range entries {
+		if name := entry.Name(); name != snapshotDir && name != liveDir {
+			if err := os.RemoveAll(filepath.Join(top, name)); err != nil {
+				return fmt.Errorf("Failed to delete %s: %v", name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// discardTree... removes what was copied of a tree before a failure
+func discardTree(top, path string) {
+	if _, err := os.Lstat(filepath.Join(top, path)); err != nil {
+		return
+	}
+
+	subvols, err := listSubvolumes(top)
+	if err == nil {
+		err = deleteTree(top, path, subvols)
+	}
+
+	if err != nil {
+		log.Warnf("Failed to remove partial copy %s: %v", path, err)
+	}
+}
+
+// nestedSubvolumes... the subvolumes below path, parents before children. Below the top level, the snapshots and live
+// trees are not nested subvolumes.
+func nestedSubvolumes(path string, subvols []string) []string {
+	var rv []string
+
+	for _, sub := range subvols {
+		if path == "" {
+			if !strings.HasPrefix(sub, snapshotDir+"/") && !strings.HasPrefix(sub, liveDir+"/") {
+				rv = append(rv, sub)
+			}
+		} else if strings.HasPrefix(sub, path+"/") {
+			rv = append(rv, sub)
+		}
+	}
+
+	slices.Sort(rv)
+
+	return rv
+}
+
+// listSubvolumes... the paths of all subvolumes relative to the top level, which must be mounted at top
+func listSubvolumes(top string) ([]string, error) {
+	out, err := btrfs("subvolume", "list", top)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list subvolumes: %v", err)
+	}
+
+	var rv []string
+
+	for _, line := range strings.Split(out, "\n") {
+		if _, path, ok := strings.Cut(line, " path "); ok {
+			rv = append(rv, strings.TrimPrefix(path, "<FS_TREE>/"))
+		}
+	}
+
+	return rv, nil
+}
+
+// defaultSubvolume... the path of the live tree relative to the top level, empty if it is the top level
+func defaultSubvolume(top string) (string, error) {
+	out, err := btrfs("subvolume", "get-default", top)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get the default subvolume: %v", err)
+	}
+
+	if _, path, ok := strings.Cut(strings.TrimSpace(out), " path "); ok {
+		return strings.TrimPrefix(path, "<FS_TREE>/"), nil
+	}
+
+	return "", nil
+}
+
+// snapshotInfo... the creation time of a snapshot is the birth time of its root directory
+func snapshotInfo(top, name string) rpc.Snapshot {
+	info := rpc.Snapshot{Name: name}
+	path := filepath.Join(top, snapshotDir, name)
+
+	var stx unix.Statx_t
+
+	if err := unix.Statx(unix.AT_FDCWD, path, 0, unix.STATX_BTIME|unix.STATX_MTIME, &stx); err == nil {
+		ts := stx.Mtime
+
+		if stx.Mask&unix.STATX_BTIME != 0 {
+			ts = stx.Btime
+		}
+
+		info.Created = time.Unix(ts.Sec, int64(ts.Nsec))
+	}
+
+	return info
+}
+
+func btrfs(args ...string) (string, error) {
+	cmd := exec.Command(btrfsProg, args...)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+
+	return string(out), nil
+}
@@ -0,0 +1,187 @@
+package guest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"github.com/amadigan/macoby/internal/rpc"
+	"github.com/google/uuid"
+	"golang.org/x/sys/unix"
+)
+
+// swapon flags, from linux/swap.h
+const (
+	swapFlagPrefer   = 0x8000
+	swapFlagPrioMask = 0x7fff
+	swapFlagDiscard  = 0x10000
+)
+
+const (
+	zramDevice       = "/dev/zram0"
+	zramSysfs        = "/sys/block/zram0"
+	zramDefaultPrio  = 100 // above disk swap, which defaults to a negative priority
+	swapHeaderOffset = 1024
+)
+
+// Swapon... enables swapping on a device, a negative priority lets the kernel choose
+func Swapon(device string, priority int, discard bool) error {
+	path, err := unix.BytePtrFromString(device)
+	if err != nil {
+		return err
+	}
+
+	var flags uintptr
+
+	if priority >= 0 {
+		flags |= swapFlagPrefer | uintptr(priority&swapFlagPrioMask) //nolint:gosec
+	}
+
+	if discard {
+		flags |= swapFlagDiscard
+	}
+
+	if _, _, errno := unix.Syscall(unix.SYS_SWAPON, uintptr(unsafe.Pointer(path)), flags, 0); errno != 0 {
+		return fmt.Errorf("Failed to enable swap on %s: %v", device, errno)
+	}
+
+	return nil
+}
+
+func Swapoff(device string) error {
+	path, err := unix.BytePtrFromString(device)
+	if err != nil {
+		return err
+	}
+
+	if _, _, errno := unix.Syscall(unix.SYS_SWAPOFF, uintptr(unsafe.Pointer(path)), 0, 0); errno != 0 {
+		return fmt.Errorf("Failed to disable swap on %s: %v", device, errno)
+	}
+
+	return nil
+}
+
+// SwapoffAll... disables every swap device listed in /proc/swaps
+func SwapoffAll() error {
+	file, err := os.Open("/proc/swaps")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var devices []string
+
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // header
+
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) > 0 {
+			devices = append(devices, fields[0])
+		}
+	}
+
+	for _, device := range devices {
+		if err := Swapoff(device); err != nil {
+			log.Warnf("%v", err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// mountSwap... handles a Mount request with the swap filesystem, the flags may contain discard and pri=<priority>
+func mountSwap(req rpc.MountRequest) error {
+	priority := -1
+	discard := false
+
+	for _, flag := range req.Flags {
+		switch {
+		case flag == "discard":
+			discard = true
+		case strings.HasPrefix(flag, "pri="):
+			prio, err := strconv.Atoi(flag[4:])
+			if err != nil || prio < 0 || prio > swapFlagPrioMask {
+				return fmt.Errorf("Invalid swap priority %s", flag)
+			}
+
+			priority = prio
+		case flag == "defaults":
+		default:
+			return fmt.Errorf("Unsupported swap option %s", flag)
+		}
+	}
+
+	return Swapon(req.Device, priority, discard)
+}
+
+// Zram... configures a compressed swap device in memory. The device is created by the kernel at boot, its size can
+// only be set once.
+func (g *Guest) Zram(req rpc.ZramRequest, _ *struct{}) error {
+	if req.Algorithm != "" {
+		if err := os.WriteFile(zramSysfs+"/comp_algorithm", []byte(req.Algorithm), 0644); err != nil {
+			return fmt.Errorf("Failed to set zram compression %s: %v", req.Algorithm, err)
+		}
+	}
+
+	if err := os.WriteFile(zramSysfs+"/disksize", []byte(strconv.FormatUint(req.Size, 10)), 0644); err != nil {
+		return fmt.Errorf("Failed to set zram size: %v", err)
+	}
+
+	if err := MakeSwap(zramDevice, "zram"); err != nil {
+		return err
+	}
+
+	priority := req.Priority
+	if priority == 0 {
+		priority = zramDefaultPrio
+	}
+
+	if err := Swapon(zramDevice, priority, true); err != nil {
+		return err
+	}
+
+	log.Infof("Enabled %d bytes of zram swap", req.Size)
+
+	return nil
+}
+
+// MakeSwap... writes a swap header covering the whole device, like mkswap
+func MakeSwap(device string, label string) error {
+	file, err := os.OpenFile(device, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("Failed to open %s: %v", device, err)
+	}
+	defer file.Close()
+
+	size, err := unix.IoctlGetInt(int(file.Fd()), unix.BLKGETSIZE64)
+	if err != nil {
+		return fmt.Errorf("Failed to get size of %s: %v", device, err)
+	}
+
+	pageSize := os.Getpagesize()
+	pages := size / pageSize
+
+	if pages < 10 {
+		return fmt.Errorf("Device %s is too small for swap", device)
+	}
+
+	page := make([]byte, pageSize)
+	header := page[swapHeaderOffset:]
+
+	binary.LittleEndian.PutUint32(header[0x0:0x4], 1)               // version
+	binary.LittleEndian.PutUint32(header[0x4:0x8], uint32(pages-1)) //nolint:gosec
+	id := uuid.New()
+	copy(header[0xC:0x1C], id[:])
+	copy(header[0x1C:0x2C], label)
+	copy(page[pageSize-10:], "SWAPSPACE2")
+
+	if _, err := file.WriteAt(page, 0); err != nil {
+		return fmt.Errorf("Failed to write swap header to %s: %v", device, err)
+	}
+
+	return file.Sync()
+}
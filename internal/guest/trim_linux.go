@@ -0,0 +1,65 @@
+package guest
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"unsafe"
+
+	"github.com/amadigan/macoby/internal/rpc"
+	"golang.org/x/sys/unix"
+)
+
+// fitrim... FITRIM from linux/fs.h, _IOWR('X', 121, struct fstrim_range)
+const fitrim = 0xC0185879
+
+// fstrimRange... struct fstrim_range, on return Len is the number of bytes trimmed
+type fstrimRange struct {
+	Start  uint64
+	Len    uint64
+	MinLen uint64
+}
+
+// Trim... trims each mount point, a failure is reported in the result of that mount point
+func (g *Guest) Trim(mounts []string, out *[]rpc.TrimResult) error {
+	results := make([]rpc.TrimResult, 0, len(mounts))
+
+	for _, mount := range mounts {
+		result := rpc.TrimResult{Mount: mount}
+
+		if trimmed, err := Fstrim(mount); err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Trimmed = trimmed
+			log.Infof("Trimmed %d bytes from %s", trimmed, mount)
+		}
+
+		results = append(results, result)
+	}
+
+	*out = results
+
+	return nil
+}
+
+// Fstrim... discards the unused blocks of the filesystem mounted at mount, the block device passes the discards to the
+// disk image so the host can release the space
+func Fstrim(mount string) (uint64, error) {
+	fd, err := unix.Open(mount, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to open %s: %v", mount, err)
+	}
+	defer unix.Close(fd)
+
+	r := fstrimRange{Len: math.MaxUint64}
+
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), fitrim, uintptr(unsafe.Pointer(&r))); errno != 0 {
+		if errors.Is(errno, unix.EOPNOTSUPP) {
+			return 0, fmt.Errorf("Discard is not supported by the device of %s", mount)
+		}
+
+		return 0, fmt.Errorf("Failed to trim %s: %v", mount, errno)
+	}
+
+	return r.Len, nil
+}
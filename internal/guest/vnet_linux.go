@@ -0,0 +1,78 @@
+package guest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/amadigan/macoby/internal/rpc"
+	"github.com/mdlayher/vsock"
+	"golang.org/x/sys/unix"
+)
+
+const virtualInterface = "eth0"
+
+// StartVirtualNetwork... creates a TAP interface whose frames are exchanged with the userspace network stack of the
+// host over vsock. The host stack does not offer DHCP, the interface must be configured statically.
+func StartVirtualNetwork(ctx context.Context, name string) (*net.Interface, error) {
+	tap, err := OpenTap(name)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := vsock.Dial(2, 4, nil)
+	if err != nil {
+		_ = tap.Close()
+
+		return nil, fmt.Errorf("Failed to connect to host network: %v", err)
+	}
+
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		_ = tap.Close()
+		_ = conn.Close()
+
+		return nil, fmt.Errorf("Failed to fetch interface %s: %v", name, err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+		_ = tap.Close()
+	}()
+
+	go func() {
+		if err := rpc.PumpFrames(tap, conn); err != nil && ctx.Err() == nil {
+			log.Errorf("Virtual network stopped: %v", err)
+		}
+	}()
+
+	return iface, nil
+}
+
+// OpenTap... creates a TAP interface, each read and write on the returned file is a single ethernet frame
+func OpenTap(name string) (*os.File, error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open /dev/net/tun: %v", err)
+	}
+
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		_ = unix.Close(fd)
+
+		return nil, fmt.Errorf("Invalid interface name %s: %v", name, err)
+	}
+
+	ifr.SetUint16(unix.IFF_TAP | unix.IFF_NO_PI)
+
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		_ = unix.Close(fd)
+
+		return nil, fmt.Errorf("Failed to create tap %s: %v", name, err)
+	}
+
+	// non-blocking, so that reads use the runtime poller and Close interrupts them
+	return os.NewFile(uintptr(fd), "/dev/net/tun"), nil
+}
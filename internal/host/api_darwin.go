@@ -29,17 +29,24 @@ type ControlServer struct {
 	vm             *VirtualMachine
 	logFiles       map[string]*util.List[applog.LogFile]
 	mux            *http.ServeMux
+	diskStates     map[string]DiskState
+	diskChanges    []DiskChange
+	grown          util.Set[string] // disks grown by autogrow that wait for the next start
+	restart        chan struct{}
 
 	mutex sync.RWMutex
 }
 
-func (cs *ControlServer) SetupServer(ctx context.Context, vm *VirtualMachine) {
+func (cs *ControlServer) SetupServer(ctx context.Context, vm *VirtualMachine, state DaemonState) {
 	cs.mutex.Lock()
 	defer cs.mutex.Unlock()
 
 	cs.mux = cs.newMux(ctx)
 	cs.Handler = cs
 	cs.vm = vm
+	cs.diskStates = state.Disks
+	cs.grown = util.NewSet[string]()
+	cs.restart = make(chan struct{})
 }
 
 func (cs *ControlServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -57,6 +64,20 @@ func (c *ControlServer) newMux(ctx context.Context) *http.ServeMux {
 		c.handleEvents(ctx, w, r)
 	})
 
+	mux.HandleFunc("GET /disks", c.handleDisks)
+	mux.HandleFunc("POST /disks/trim", c.handleDiskTrim)
+	mux.HandleFunc("GET /disks/{label}", c.handleDisk)
+	mux.HandleFunc("POST /disks/{label}/resize", c.handleDiskResize)
+	mux.HandleFunc("POST /disks/{label}/purge", c.handleDiskPurge)
+	mux.HandleFunc("GET /disks/{label}/snapshots", c.handleSnapshots)
+	mux.HandleFunc("POST /disks/{label}/snapshots", c.handleSnapshotCreate)
+	mux.HandleFunc("DELETE /disks/{label}/snapshots/{name}", c.handleSnapshotDelete)
+	mux.HandleFunc("POST /disks/{label}/snapshots/{name}/restore", c.handleSnapshotRestore)
+	mux.HandleFunc("POST /docker/prune", c.handlePrune)
+	mux.HandleFunc("GET /modules", c.handleModules)
+	mux.HandleFunc("POST /modules/load", c.handleModuleLoad)
+	mux.HandleFunc("POST /modules/unload", c.handleModuleUnload)
+
 	return mux
 }
 
@@ -91,9 +112,10 @@ func (c *ControlServer) handleEvents(ctx context.Context, w http.ResponseWriter,
 	}()
 
 	sync := event.Sync{
-		Status:  event.StatusReady, // TODO
-		Metrics: c.vm.Metrics(),
-		Logs:    make(map[string][]event.LogFile, len(c.logFiles)),
+		Status:     event.StatusReady, // TODO
+		Metrics:    c.vm.Metrics(),
+		Containers: c.vm.LastContainerMetrics(),
+		Logs:       make(map[string][]event.LogFile, len(c.logFiles)),
 	}
 
 	for stream, files := range c.logFiles {
@@ -117,6 +139,9 @@ func (c *ControlServer) handleEvents(ctx context.Context, w http.ResponseWriter,
 	event.Tap(ctx, ch)
 	defer event.Untap(ctx, ch)
 
+	// metrics are pushed more frequently while anyone is watching
+	defer c.vm.Watch()()
+
 	for e := range ch {
 		if err := writeEvent(ctx, conn, e); err != nil {
 			if !errors.Is(err, context.Canceled) && !errors.Is(err, io.EOF) {
@@ -0,0 +1,195 @@
+package host
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/amadigan/macoby/internal/event"
+	"github.com/amadigan/macoby/internal/host/config"
+	"github.com/amadigan/macoby/internal/host/disk"
+	"github.com/amadigan/macoby/internal/rpc"
+	"github.com/amadigan/macoby/internal/util"
+)
+
+// AutogrowDisks... grows the disks with an autogrow policy as the metrics from the guest show them running low on
+// space, until ctx is done
+func (c *ControlServer) AutogrowDisks(ctx context.Context) {
+	var labels []string
+
+	for _, label := range util.SortKeys(c.Layout.Disks) {
+		info := c.Layout.Disks[label]
+		if info.Autogrow == nil || info.Mount == "" || info.ReadOnly {
+			continue
+		}
+
+		switch info.FS {
+		case string(disk.FSext), string(disk.FSbtrfs), string(disk.FSxfs):
+			labels = append(labels, label)
+		default:
+			log.Warnf("disk %s: growing %s filesystems is not supported, autogrow is disabled", label, info.FS)
+		}
+	}
+
+	if len(labels) == 0 {
+		return
+	}
+
+	ch := make(chan event.TypedEnvelope[event.Metrics], 1)
+	event.Listen(ctx, ch)
+
+	for ev := range ch {
+		if c.vm.Status() != event.StatusReady {
+			continue
+		}
+
+		for _, label := range labels {
+			info := c.Layout.Disks[label]
+
+			metrics, ok := ev.Event.Disks[info.Mount]
+			if !ok || metrics.ImageSize == 0 {
+				continue
+			}
+
+			if err := c.autogrow(ctx, label, info, metrics); err != nil {
+				log.Errorf("failed to grow disk %s: %v", label, err)
+			}
+		}
+	}
+}
+
+// autogrow... grows the image and then the filesystem online. If the guest does not see the new size of the device,
+// the filesystem is grown on the next start, the daemon stops for it unless the policy opts out. launchd starts the
+// daemon again on the next docker connection.
+func (c *ControlServer) autogrow(ctx context.Context, label string, info *config.DiskImage, metrics event.DiskMetrics) error {
+	c.mutex.RLock()
+	pending := len(c.diskChanges) > 0 || c.grown.Contains(label)
+	c.mutex.RUnlock()
+
+	if pending {
+		return nil
+	}
+
+	size := util.Int64(metrics.ImageSize)
+
+	newSize, err := info.Autogrow.Grow(size, util.Int64(metrics.Total), util.Int64(metrics.Free))
+	if err != nil || newSize == 0 {
+		//nolint:wrapcheck
+		return err
+	}
+
+	log.Infof("disk %s has %d of %d bytes free, growing it to %d bytes", label, metrics.Free, metrics.Total, newSize)
+
+	if err := setFileSize(info.Path.Resolved, newSize); err != nil {
+		return err
+	}
+
+	growth := event.DiskGrowth{Label: label, Mount: info.Mount, From: metrics.ImageSize, To: util.Uint64(newSize)}
+
+	if growth.Online, err = c.vm.growFilesystem(label, info, newSize); err != nil {
+		return err
+	}
+
+	change := DiskChange{Label: label, Size: newSize}
+
+	switch {
+	case growth.Online:
+		log.Infof("grew filesystem %s to %d bytes", info.Mount, newSize)
+		// the new size is recorded, so the filesystem is not shrunk to the configured size on the next start
+		c.recordDiskChange(change)
+	case info.Autogrow.Restart == nil || *info.Autogrow.Restart:
+		log.Infof("the guest cannot see the new size of disk %s, stopping to grow it, the VM starts again on the next "+
+			"docker connection", label)
+
+		growth.Restart = true
+		c.scheduleDiskChange(change)
+	default:
+		log.Warnf("the guest cannot see the new size of disk %s, it is grown on the next start", label)
+		c.recordDiskChange(change)
+
+		c.mutex.Lock()
+		c.grown.Add(label)
+		c.mutex.Unlock()
+	}
+
+	event.Emit(ctx, growth)
+
+	return nil
+}
+
+// recordDiskChange... records a resize in the daemon state without stopping, it takes effect on the next start
+func (c *ControlServer) recordDiskChange(change DiskChange) {
+	c.mutex.Lock()
+
+	disks, err := ApplyDiskChange(c.Layout, c.diskStates, change)
+	if err == nil {
+		c.diskStates = disks
+	}
+
+	c.mutex.Unlock()
+
+	if err != nil {
+		log.Errorf("failed to %s: %v", change, err)
+
+		return
+	}
+
+	c.vm.UpdateState(DaemonState{Disks: disks})
+}
+
+// growFilesystem... grows the filesystem of a disk to the new size of its image, returns false if the block device in
+// the guest has not grown
+func (vm *VirtualMachine) growFilesystem(label string, info *config.DiskImage, size int64) (bool, error) {
+	device, ok := vm.devices[label]
+	if !ok {
+		return false, fmt.Errorf("disk %s is not attached", label)
+	}
+
+	var deviceSize uint64
+
+	if err := vm.client.DeviceSize(device, &deviceSize); err != nil {
+		return false, fmt.Errorf("failed to get the size of %s: %w", device, err)
+	}
+
+	if deviceSize < util.Uint64(size) {
+		return false, nil
+	}
+
+	if info.Encrypt {
+		var err error
+
+		// resizes the open mapping to the device
+		if device, err = vm.unlockDisk(label, info, device, false); err != nil {
+			return false, err
+		}
+	}
+
+	if err := vm.growMounted(info, device); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// growMounted... grows a mounted filesystem to fill its device
+func (vm *VirtualMachine) growMounted(info *config.DiskImage, device string) error {
+	var cmd rpc.Command
+
+	switch info.FS {
+	case string(disk.FSext):
+		cmd = rpc.Command{Path: "/usr/sbin/resize2fs", Args: []string{"resize2fs", device}}
+	case string(disk.FSbtrfs):
+		cmd = rpc.Command{Path: "/sbin/btrfs", Args: []string{"btrfs", "filesystem", "resize", "max", info.Mount}}
+	case string(disk.FSxfs):
+		cmd = rpc.Command{Path: "/usr/sbin/xfs_growfs", Args: []string{"xfs_growfs", info.Mount}}
+	default:
+		return fmt.Errorf("growing %s filesystems is not supported", info.FS)
+	}
+
+	if out, err := vm.Run(cmd); err != nil {
+		return fmt.Errorf("failed to run %s: %w", cmd.Args[0], err)
+	} else if out.Exit != 0 {
+		return fmt.Errorf("%s failed: %s", cmd.Args[0], out.Output)
+	}
+
+	return nil
+}
@@ -0,0 +1,48 @@
+package host
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/amadigan/macoby/internal/rpc"
+)
+
+// installCACertificates... sends the CA certificates of the layout to the guest, which must happen before dockerd is
+// launched as dockerd only reads the certificates at startup. The guest replaces the certificates installed before, so
+// with an overlay disk an empty list is sent to remove the certificates of a previous boot.
+func (vm *VirtualMachine) installCACertificates() error {
+	if len(vm.Layout.CACertificates) == 0 && vm.Layout.Overlay.Disk == "" {
+		return nil
+	}
+
+	certs := make([]rpc.Certificate, 0, len(vm.Layout.CACertificates))
+	names := map[string]int{}
+
+	for _, cert := range vm.Layout.CACertificates {
+		data, err := os.ReadFile(cert.Path.Resolved)
+		if err != nil {
+			return fmt.Errorf("failed to read ca certificate %s: %w", cert.Path.Resolved, err)
+		}
+
+		base := filepath.Base(cert.Path.Resolved)
+		name := strings.TrimSuffix(base, filepath.Ext(base))
+
+		// certificates from different directories may share a file name
+		if count := names[name]; count > 0 {
+			names[name]++
+			name = fmt.Sprintf("%s-%d", name, count)
+		} else {
+			names[name] = 1
+		}
+
+		certs = append(certs, rpc.Certificate{Name: name, Registry: cert.Registry, PEM: data})
+	}
+
+	if err := vm.client.AddCertificates(certs, nil); err != nil {
+		return fmt.Errorf("failed to install ca certificates: %w", err)
+	}
+
+	return nil
+}
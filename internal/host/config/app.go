@@ -115,8 +115,13 @@ func LoadConfig(env map[string]string, home string) (*Layout, *Path, error) {
 		return nil, confPath, fmt.Errorf("failed to read parse %s: %w", confPath.Resolved, err)
 	}
 
+	layout.Proxy.ImportEnv(env)
 	layout.SetDefaults()
 
+	if err := layout.Validate(); err != nil {
+		return nil, confPath, fmt.Errorf("invalid configuration %s: %w", confPath.Resolved, err)
+	}
+
 	if err := layout.ResolvePaths(env); err != nil {
 		return &layout, confPath, fmt.Errorf("failed to resolve paths: %w", err)
 	}
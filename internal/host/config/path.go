@@ -200,6 +200,30 @@ func (l *Layout) ResolvePaths(env map[string]string) error {
 		if _, err := disk.Path.ResolveOutputFile(env, l.Home); err != nil {
 			return fmt.Errorf("cannot resolve disk path %s: %w", label, err)
 		}
+
+		if disk.Encrypt {
+			if _, err := disk.KeyFile.ResolveOutputFile(env, l.Home); err != nil {
+				return fmt.Errorf("cannot resolve key file of disk %s: %w", label, err)
+			}
+		}
+	}
+
+	for _, cert := range l.CACertificates {
+		if !cert.Path.ResolveInputFile(env, l.Home) {
+			return fmt.Errorf("ca certificate not found: %s", cert.Path.Original)
+		}
+	}
+
+	for _, ext := range l.Overlay.Extensions {
+		if !ext.ResolveInputFile(env, l.Home) {
+			return fmt.Errorf("overlay extension not found: %s", ext.Original)
+		}
+	}
+
+	for _, script := range l.Provision {
+		if script.Path != nil && !script.Path.ResolveInputFile(env, l.Home) {
+			return fmt.Errorf("provision script not found: %s", script.Path.Original)
+		}
 	}
 
 	for dst, share := range l.Shares {
@@ -208,5 +232,17 @@ func (l *Layout) ResolvePaths(env map[string]string) error {
 		}
 	}
 
+	preload := l.Preload[:0]
+
+	for _, dir := range l.Preload {
+		if dir.ResolveInputDir(env, l.Home) {
+			preload = append(preload, dir)
+		} else {
+			log.Warnf("preload directory not found: %s", dir.Original)
+		}
+	}
+
+	l.Preload = preload
+
 	return nil
 }
@@ -0,0 +1,157 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// ProxyConfig... HTTP(S) proxy used by dockerd for pulls and pushes. If FromEnv is set, fields that are not set are
+// imported from HTTP_PROXY, HTTPS_PROXY and NO_PROXY (or their lowercase forms) of the host environment.
+type ProxyConfig struct {
+	HTTP    string   `json:"http,omitempty" yaml:"http,omitempty"`
+	HTTPS   string   `json:"https,omitempty" yaml:"https,omitempty"`
+	NoProxy []string `json:"no-proxy,omitempty" yaml:"no-proxy,omitempty"`
+	FromEnv bool     `json:"from-env,omitempty" yaml:"from-env,omitempty"`
+}
+
+var proxyConfigValidator = newFieldValidator(ProxyConfig{})
+
+func (p *ProxyConfig) UnmarshalJSON(data []byte) error {
+	if err := proxyConfigValidator.Validate(data); err != nil {
+		return err
+	}
+
+	type proxyConfig ProxyConfig
+
+	if err := json.Unmarshal(data, (*proxyConfig)(p)); err != nil {
+		//nolint:wrapcheck
+		return err
+	}
+
+	for _, proxy := range []string{p.HTTP, p.HTTPS} {
+		if proxy == "" {
+			continue
+		}
+
+		if _, _, err := ProxyAddress(proxy); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ImportEnv... fills the unset fields from the environment if FromEnv is set
+func (p *ProxyConfig) ImportEnv(env map[string]string) {
+	if !p.FromEnv {
+		return
+	}
+
+	lookup := func(name string) string {
+		if val := env[name]; val != "" {
+			return val
+		}
+
+		return env[strings.ToLower(name)]
+	}
+
+	if p.HTTP == "" {
+		p.HTTP = lookup("HTTP_PROXY")
+	}
+
+	if p.HTTPS == "" {
+		p.HTTPS = lookup("HTTPS_PROXY")
+	}
+
+	if len(p.NoProxy) == 0 {
+		for _, host := range strings.Split(lookup("NO_PROXY"), ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				p.NoProxy = append(p.NoProxy, host)
+			}
+		}
+	}
+}
+
+// Enabled... true if either proxy is set
+func (p ProxyConfig) Enabled() bool {
+	return p.HTTP != "" || p.HTTPS != ""
+}
+
+// Environ... the proxy variables for a process, in both cases as not all programs read the uppercase names
+func (p ProxyConfig) Environ() []string {
+	var env []string
+
+	add := func(name, val string) {
+		if val != "" {
+			env = append(env, name+"="+val, strings.ToLower(name)+"="+val)
+		}
+	}
+
+	add("HTTP_PROXY", p.HTTP)
+	add("HTTPS_PROXY", p.HTTPS)
+	add("NO_PROXY", strings.Join(p.NoProxy, ","))
+
+	return env
+}
+
+// DockerConfig... the value of the proxies key of the dockerd configuration
+func (p ProxyConfig) DockerConfig() map[string]any {
+	proxies := map[string]any{}
+
+	if p.HTTP != "" {
+		proxies["http-proxy"] = p.HTTP
+	}
+
+	if p.HTTPS != "" {
+		proxies["https-proxy"] = p.HTTPS
+	}
+
+	if len(p.NoProxy) > 0 {
+		proxies["no-proxy"] = strings.Join(p.NoProxy, ",")
+	}
+
+	return proxies
+}
+
+// ProxyAddress... the host and port of a proxy URL, the port defaults to the default port of the scheme
+func ProxyAddress(proxy string) (string, string, error) {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid proxy %q: %w", proxy, err)
+	}
+
+	if u.Host == "" {
+		return "", "", fmt.Errorf("invalid proxy %q: missing host", proxy)
+	}
+
+	port := u.Port()
+
+	if port == "" {
+		switch u.Scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		case "socks5", "socks5h":
+			port = "1080"
+		default:
+			return "", "", fmt.Errorf("invalid proxy %q: missing port", proxy)
+		}
+	}
+
+	return u.Hostname(), port, nil
+}
+
+// IsLoopbackHost... true if the host name or address refers to the loopback interface
+func IsLoopbackHost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
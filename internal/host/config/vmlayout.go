@@ -2,11 +2,16 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/url"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/amadigan/macoby/internal/util"
 	"github.com/pbnjay/memory"
 )
 
@@ -24,12 +29,321 @@ type Layout struct {
 	JsonConfigs    map[string]any        `json:"json-conf" yaml:"json-conf"`
 	HostIface      string                `json:"host-iface,omitempty" yaml:"host-iface,omitempty"`
 	Sysctl         map[string]string     `json:"sysctl" yaml:"sysctl"`
+	Modules        []string              `json:"modules,omitempty" yaml:"modules,omitempty"` // name and parameters
 	StateFile      *Path                 `json:"state-file,omitempty" yaml:"state-file,omitempty"`
 	Log            LogConfig             `json:"logs" yaml:"logs"`
 	DockerConfig   map[string]any        `json:"dockerd" yaml:"dockerd"`
 	MetricInterval uint16                `json:"metric-interval,omitempty" yaml:"metric-interval,omitempty"`
+	IdleMetrics    uint16                `json:"idle-metric-interval,omitempty" yaml:"idle-metric-interval,omitempty"`
 	Rosetta        *bool                 `json:"rosetta,omitempty" yaml:"rosetta,omitempty"`
 	IdleTimeout    time.Duration         `json:"idle-timeout,omitempty" yaml:"idle-timeout,omitempty"`
+	Network        NetworkConfig         `json:"network,omitempty" yaml:"network,omitempty"`
+	Proxy          ProxyConfig           `json:"proxy,omitempty" yaml:"proxy,omitempty"`
+	CACertificates []*CACertificate      `json:"ca-certificates,omitempty" yaml:"ca-certificates,omitempty"`
+	Hostname       string                `json:"hostname,omitempty" yaml:"hostname,omitempty"`
+	Hosts          map[string]string     `json:"hosts,omitempty" yaml:"hosts,omitempty"`       // name to address
+	TimeZone       string                `json:"timezone,omitempty" yaml:"timezone,omitempty"` // defaults to the host zone
+	Zram           *ZramConfig           `json:"zram,omitempty" yaml:"zram,omitempty"`
+	Overlay        OverlayConfig         `json:"overlay,omitempty" yaml:"overlay,omitempty"`
+	Provision      []*ProvisionScript    `json:"provision,omitempty" yaml:"provision,omitempty"`
+	Hooks          map[string][]*Hook    `json:"hooks,omitempty" yaml:"hooks,omitempty"` // by hook point
+	// TrimInterval... seconds between trims of the disk filesystems, negative to disable
+	TrimInterval int32        `json:"trim-interval,omitempty" yaml:"trim-interval,omitempty"`
+	Prune        *PrunePolicy `json:"prune,omitempty" yaml:"prune,omitempty"`
+	// Preload... directories of docker save tarballs and OCI layouts, loaded into dockerd if their images are missing
+	Preload Paths `json:"preload,omitempty" yaml:"preload,omitempty"`
+}
+
+// NetworkConfig... guest network settings, if Address is set DHCP is not used
+type NetworkConfig struct {
+	Address string   `json:"address,omitempty" yaml:"address,omitempty"`
+	Gateway string   `json:"gateway,omitempty" yaml:"gateway,omitempty"`
+	DNS     []string `json:"dns,omitempty" yaml:"dns,omitempty"`
+	Search  []string `json:"search,omitempty" yaml:"search,omitempty"`
+	IPv6    string   `json:"ipv6,omitempty" yaml:"ipv6,omitempty"` // "slaac" (default), "dhcpv6" or "off"
+	Mode    string   `json:"mode,omitempty" yaml:"mode,omitempty"` // "nat" (default) or "vsock"
+	// HostDNS... resolve names in the guest with the host resolver, defaults to true unless DNS is set
+	HostDNS *bool `json:"host-dns,omitempty" yaml:"host-dns,omitempty"`
+}
+
+// HostDNSAddress... the address of the guest DNS stub that forwards to the host resolver
+const HostDNSAddress = "169.254.53.53"
+
+// GatewayHostname... the name of the default gateway of the guest in /etc/hosts, which is the host in NAT mode
+const GatewayHostname = "host." + Name + ".internal"
+
+// CACertificate... a PEM file on the host with CA certificates trusted by the guest. If Registry is set, the
+// certificates are also installed in /etc/docker/certs.d/<registry> for dockerd.
+type CACertificate struct {
+	Path     *Path  `json:"path" yaml:"path"`
+	Registry string `json:"registry,omitempty" yaml:"registry,omitempty"`
+}
+
+// ZramConfig... a compressed swap device in guest memory, Size is a size such as 2G or a percentage of the guest RAM
+type ZramConfig struct {
+	Size      string `json:"size" yaml:"size"`
+	Algorithm string `json:"algorithm,omitempty" yaml:"algorithm,omitempty"` // e.g. zstd (default) or lzo-rle
+	Priority  int    `json:"priority,omitempty" yaml:"priority,omitempty"`
+}
+
+// Bytes... the size of the device for a guest with ram MB of memory
+func (z *ZramConfig) Bytes(ram uint64) (uint64, error) {
+	size, ok := sizeOrPercent(z.Size, ram*1024*1024)
+	if !ok {
+		return 0, fmt.Errorf("invalid zram size %s", z.Size)
+	}
+
+	return size, nil
+}
+
+// OverlayConfig... the writable layer over the read-only root filesystem of the guest. Size is the size of the tmpfs
+// holding the layer, such as 64M or a percentage of the guest RAM. With Disk, the layer is kept on the disk with that
+// label instead and survives a reboot, the disk must have no mount point. Extensions are squashfs or uncompressed tar
+// images stacked over the root at boot, the first one on top.
+type OverlayConfig struct {
+	Size       string `json:"size,omitempty" yaml:"size,omitempty"`
+	Disk       string `json:"disk,omitempty" yaml:"disk,omitempty"`
+	Extensions Paths  `json:"extensions,omitempty" yaml:"extensions,omitempty"`
+}
+
+// Bytes... the size of the tmpfs for a guest with ram MB of memory
+func (o *OverlayConfig) Bytes(ram uint64) (uint64, error) {
+	size, ok := sizeOrPercent(o.Size, ram*1024*1024)
+	if !ok {
+		return 0, fmt.Errorf("invalid overlay size %s", o.Size)
+	}
+
+	return size, nil
+}
+
+// validate... the overlay disk must be a writable, unencrypted disk of a filesystem that can hold an upper layer,
+// without a mount point of its own. Without this check, a missing disk would leave the upper layer on the tmpfs.
+func (o *OverlayConfig) validate(disks map[string]*DiskImage) error {
+	if _, err := o.Bytes(1); err != nil {
+		return err
+	}
+
+	if o.Disk == "" {
+		return nil
+	}
+
+	info, ok := disks[o.Disk]
+
+	switch {
+	case !ok:
+		return fmt.Errorf("overlay disk %s is not defined in disks", o.Disk)
+	case info.Mount != "":
+		return fmt.Errorf("overlay disk %s cannot have a mount point", o.Disk)
+	case info.ReadOnly:
+		return fmt.Errorf("overlay disk %s cannot be read-only", o.Disk)
+	case info.Encrypt:
+		return fmt.Errorf("overlay disk %s cannot be encrypted", o.Disk)
+	case info.FS != "ext4" && info.FS != "btrfs" && info.FS != "xfs":
+		return fmt.Errorf("overlay disk %s must be ext4, btrfs or xfs, not %s", o.Disk, info.FS)
+	}
+
+	return nil
+}
+
+// ProvisionScript... a shell script run by /bin/sh in the guest once the disks are mounted, before dockerd starts. The
+// script is Script, or the file at Path on the host. A script with Run set to once runs again only if it changed, or
+// if the marker kept on Disk is gone, such as after the disk was purged. Disk defaults to the disk mounted at
+// /var/lib/docker. Name identifies the script in logs, events and markers, it defaults to the file name of Path or a
+// digest of Script. A failed script is reported and the start continues, unless Required is set. A script still
+// running after Timeout seconds, 300 by default, is killed and fails.
+type ProvisionScript struct {
+	Name     string `json:"name,omitempty" yaml:"name,omitempty"`
+	Script   string `json:"script,omitempty" yaml:"script,omitempty"`
+	Path     *Path  `json:"path,omitempty" yaml:"path,omitempty"`
+	Run      string `json:"run,omitempty" yaml:"run,omitempty"` // "boot" (default) or "once"
+	Disk     string `json:"disk,omitempty" yaml:"disk,omitempty"`
+	Required bool   `json:"required,omitempty" yaml:"required,omitempty"`
+	Timeout  uint16 `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+}
+
+const (
+	ProvisionBoot = "boot"
+	ProvisionOnce = "once"
+)
+
+// dockerDataRoot... the mount point of the disk holding the docker data
+const dockerDataRoot = "/var/lib/docker"
+
+// ProvisionDisk... the mount point of the disk keeping the markers of a once script, Disk or the disk mounted at
+// /var/lib/docker
+func (l *Layout) ProvisionDisk(script *ProvisionScript) (string, error) {
+	label := script.Disk
+
+	if label == "" {
+		for _, name := range util.SortKeys(l.Disks) {
+			if l.Disks[name].Mount == dockerDataRoot {
+				label = name
+
+				break
+			}
+		}
+
+		if label == "" {
+			return "", fmt.Errorf("no disk is mounted at %s, set the disk of the script", dockerDataRoot)
+		}
+	}
+
+	info, ok := l.Disks[label]
+	if !ok {
+		return "", fmt.Errorf("no such disk: %s", label)
+	} else if info.Mount == "" || info.ReadOnly || info.FS == "swap" {
+		return "", fmt.Errorf("disk %s is not mounted writable", label)
+	}
+
+	return info.Mount, nil
+}
+
+// validate... checks the run mode, the name and the disk of a script
+func (p *ProvisionScript) validate(l *Layout) error {
+	if p.Script == "" && (p.Path == nil || p.Path.Original == "") {
+		return errors.New("a script or a path is required")
+	}
+
+	if p.Name == "." || p.Name == ".." || strings.ContainsAny(p.Name, "/\x00") {
+		return fmt.Errorf("invalid name %q", p.Name)
+	}
+
+	switch p.Run {
+	case "", ProvisionBoot:
+		if p.Disk != "" {
+			return errors.New("only scripts run once keep a marker on a disk")
+		}
+	case ProvisionOnce:
+		if _, err := l.ProvisionDisk(p); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid run mode %q, expected boot or once", p.Run)
+	}
+
+	return nil
+}
+
+// Hook... a host command, or an HTTP POST to URL, run by the daemon at a hook point. The JSON of the event envelope is
+// passed on stdin or as the request body. Timeout is in seconds, 30 by default.
+type Hook struct {
+	Command []string          `json:"command,omitempty" yaml:"command,omitempty"`
+	URL     string            `json:"url,omitempty" yaml:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	Timeout uint16            `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+}
+
+// Hook points, the lifecycle points of the daemon and the events that trigger hooks, named after their event type
+const (
+	HookPreStart     = "pre-start"
+	HookGuestReady   = "guest-ready"
+	HookDockerdReady = "dockerd-ready"
+	HookPreStop      = "pre-stop"
+	HookStopped      = "stopped"
+	HookDiskLow      = "disk-low"
+	HookOOMKill      = "oom-kill"
+)
+
+var hookPoints = []string{HookPreStart, HookGuestReady, HookDockerdReady, HookPreStop, HookStopped, HookDiskLow,
+	HookOOMKill}
+
+// validate... checks that the hook has either a command or an http(s) URL
+func (h *Hook) validate() error {
+	switch {
+	case len(h.Command) > 0 && h.URL != "":
+		return errors.New("a hook has either a command or a url")
+	case len(h.Command) > 0:
+		if h.Command[0] == "" {
+			return errors.New("empty hook command")
+		}
+	case h.URL != "":
+		if u, err := url.Parse(h.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid hook url %s", h.URL)
+		}
+	default:
+		return errors.New("a hook needs a command or a url")
+	}
+
+	return nil
+}
+
+// AutogrowPolicy... grows a disk while the VM runs, when the free space in its filesystem falls below Threshold.
+// Threshold and Step are a size such as 5G or a percentage of the disk size, the disk is not grown beyond Max.
+type AutogrowPolicy struct {
+	Threshold string `json:"threshold,omitempty" yaml:"threshold,omitempty"` // default 10%
+	Step      string `json:"step,omitempty" yaml:"step,omitempty"`           // default 25%
+	Max       string `json:"max" yaml:"max"`
+	// Restart... stop the VM to grow the filesystem if the guest cannot see the new size of the device, defaults to
+	// true. If false, the filesystem is grown on the next start.
+	Restart *bool `json:"restart,omitempty" yaml:"restart,omitempty"`
+}
+
+// Validate... checks the threshold, step and max size, so that an invalid policy is rejected with the configuration
+// rather than failing each time the disk is checked
+func (p *AutogrowPolicy) Validate() error {
+	if _, ok := sizeOrPercent(p.Threshold, 100); !ok {
+		return fmt.Errorf("invalid autogrow threshold %s", p.Threshold)
+	}
+
+	if _, ok := sizeOrPercent(p.Step, 100); !ok {
+		return fmt.Errorf("invalid autogrow step %s", p.Step)
+	}
+
+	if maxSize, err := ParseSize(p.Max); err != nil || maxSize <= 0 {
+		return fmt.Errorf("invalid autogrow max size %s", p.Max)
+	}
+
+	return nil
+}
+
+// Grow... the size to grow a disk of size bytes to, given the size and free space of its filesystem. Returns 0 if the
+// disk has enough free space or has reached the maximum size.
+func (p *AutogrowPolicy) Grow(size, fsSize, free int64) (int64, error) {
+	threshold, ok := sizeOrPercent(p.Threshold, util.Uint64(fsSize))
+	if !ok {
+		return 0, fmt.Errorf("invalid autogrow threshold %s", p.Threshold)
+	}
+
+	if free >= util.Int64(threshold) {
+		return 0, nil
+	}
+
+	step, ok := sizeOrPercent(p.Step, util.Uint64(size))
+	if !ok {
+		return 0, fmt.Errorf("invalid autogrow step %s", p.Step)
+	}
+
+	maxSize, err := ParseSize(p.Max)
+	if err != nil || maxSize <= 0 {
+		return 0, fmt.Errorf("invalid autogrow max size %s", p.Max)
+	}
+
+	// whole megabytes, which every filesystem can be resized to
+	newSize := min(size+util.Int64(step), maxSize) &^ (1<<20 - 1)
+	if newSize <= size {
+		return 0, nil
+	}
+
+	return newSize, nil
+}
+
+// sizeOrPercent... parses a size such as 2G, or a percentage of total
+func sizeOrPercent(value string, total uint64) (uint64, bool) {
+	if percent, ok := strings.CutSuffix(value, "%"); ok {
+		val, err := strconv.ParseUint(percent, 10, 64)
+		if err != nil || val == 0 {
+			return 0, false
+		}
+
+		return total * val / 100, true
+	}
+
+	size, err := ParseSize(value)
+	if err != nil || size <= 0 {
+		return 0, false
+	}
+
+	return uint64(size), true
 }
 
 type DiskImage struct {
@@ -41,6 +355,112 @@ type DiskImage struct {
 	ReadOnly      bool     `json:"ro,omitempty" yaml:"ro,omitempty"`
 	Options       []string `json:"opts" yaml:"opts"`
 	Path          *Path    `json:"path,omitempty" yaml:"path,omitempty"`
+	// Autogrow... grow the disk when it runs low on space, only ext4, btrfs and xfs disks can be grown
+	Autogrow *AutogrowPolicy `json:"autogrow,omitempty" yaml:"autogrow,omitempty"`
+	Alert    *DiskAlert      `json:"alert,omitempty" yaml:"alert,omitempty"`
+	// Encrypt... format the disk with LUKS in the guest, unlocked at each boot with the key in KeyFile. A missing key
+	// file is generated when the disk is formatted.
+	Encrypt bool  `json:"encrypt,omitempty" yaml:"encrypt,omitempty"`
+	KeyFile *Path `json:"key-file,omitempty" yaml:"key-file,omitempty"`
+}
+
+// validate... checks the disk settings, encrypted is the label of an encrypted disk if there is one. The guest holds
+// the keys and the decrypted data of encrypted disks in memory, so swap on a disk would write them out in the clear.
+func (d *DiskImage) validate(encrypted string) error {
+	if d.FS == "swap" {
+		if d.Encrypt {
+			return errors.New("swap disks cannot be encrypted")
+		}
+
+		if encrypted != "" {
+			return fmt.Errorf("swap on a disk is not allowed with the encrypted disk %s, use zram instead", encrypted)
+		}
+	}
+
+	if d.Autogrow != nil {
+		if err := d.Autogrow.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if d.Alert != nil {
+		// the totals only matter for percentages, which are checked all the same
+		if _, _, err := d.Alert.Low(100, 100, 100, 100); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DiskAlert... thresholds below which a disk-low event is emitted. Free is a size such as 5G or a percentage of the
+// filesystem, FreeFiles is a number or a percentage of the inodes. An empty threshold is not checked.
+type DiskAlert struct {
+	Free      string `json:"free,omitempty" yaml:"free,omitempty"`
+	FreeFiles string `json:"free-files,omitempty" yaml:"free-files,omitempty"`
+}
+
+// Low... checks the free space and inodes of a filesystem against the thresholds
+func (a *DiskAlert) Low(total, free, files, freeFiles uint64) (space bool, inodes bool, err error) {
+	if a.Free != "" {
+		threshold, ok := sizeOrPercent(a.Free, total)
+		if !ok {
+			return false, false, fmt.Errorf("invalid free space threshold %s", a.Free)
+		}
+
+		space = free < threshold
+	}
+
+	// filesystems with dynamic inode allocation, such as btrfs, report no inodes
+	if a.FreeFiles != "" && files > 0 {
+		threshold, ok := sizeOrPercent(a.FreeFiles, files)
+		if !ok {
+			return false, false, fmt.Errorf("invalid free files threshold %s", a.FreeFiles)
+		}
+
+		inodes = freeFiles < threshold
+	}
+
+	return space, inodes, nil
+}
+
+// PrunePolicy... removes unused docker data when a disk-low event is emitted, and every Interval seconds if set. If
+// none of Containers, Images and BuildCache are set, all of them are pruned.
+type PrunePolicy struct {
+	Containers bool   `json:"containers,omitempty" yaml:"containers,omitempty"`   // stopped containers
+	Images     bool   `json:"images,omitempty" yaml:"images,omitempty"`           // dangling images
+	BuildCache bool   `json:"build-cache,omitempty" yaml:"build-cache,omitempty"` // build cache not in use
+	Age        string `json:"age,omitempty" yaml:"age,omitempty"`                 // only remove older data, e.g. 72h
+	KeepLast   int    `json:"keep-last,omitempty" yaml:"keep-last,omitempty"`     // keep the most recent of each kind
+	Interval   int32  `json:"interval,omitempty" yaml:"interval,omitempty"`       // seconds, 0 to only prune on disk-low
+	DryRun     bool   `json:"dry-run,omitempty" yaml:"dry-run,omitempty"`         // report what would be removed
+}
+
+// validate... checks the age and the counts of the policy
+func (p *PrunePolicy) validate() error {
+	if _, err := p.MinAge(); err != nil {
+		return err
+	}
+
+	if p.KeepLast < 0 {
+		return fmt.Errorf("invalid prune keep-last %d", p.KeepLast)
+	}
+
+	return nil
+}
+
+// MinAge... the age below which data is kept
+func (p *PrunePolicy) MinAge() (time.Duration, error) {
+	if p.Age == "" {
+		return 0, nil
+	}
+
+	age, err := time.ParseDuration(p.Age)
+	if err != nil || age < 0 {
+		return 0, fmt.Errorf("invalid prune age %s", p.Age)
+	}
+
+	return age, nil
 }
 
 type DockerSocket struct {
@@ -86,6 +506,10 @@ func (l *Layout) SetDefaults() { //nolint:cyclop
 		l.MetricInterval = 15
 	}
 
+	if l.IdleMetrics == 0 {
+		l.IdleMetrics = 60
+	}
+
 	if l.Kernel == nil || l.Kernel.Original == "" {
 		l.Kernel = &Path{Original: fmt.Sprintf("${%s}/linux/kernel", HomeEnv)}
 	}
@@ -102,6 +526,29 @@ func (l *Layout) SetDefaults() { //nolint:cyclop
 		if disk.Path == nil || disk.Path.Original == "" {
 			disk.Path = &Path{Original: fmt.Sprintf("${%s}/data/%s.img", HomeEnv, label)}
 		}
+
+		if disk.Encrypt && (disk.KeyFile == nil || disk.KeyFile.Original == "") {
+			disk.KeyFile = &Path{Original: fmt.Sprintf("${%s}/keys/%s.key", HomeEnv, label)}
+		}
+
+		if disk.Alert == nil && disk.Mount != "" {
+			disk.Alert = &DiskAlert{Free: "10%", FreeFiles: "5%"}
+		}
+
+		if disk.Autogrow != nil {
+			if disk.Autogrow.Threshold == "" {
+				disk.Autogrow.Threshold = "10%"
+			}
+
+			if disk.Autogrow.Step == "" {
+				disk.Autogrow.Step = "25%"
+			}
+
+			if disk.Autogrow.Restart == nil {
+				restart := true
+				disk.Autogrow.Restart = &restart
+			}
+		}
 	}
 
 	if l.DockerSocket.ContainerPath == "" {
@@ -116,9 +563,118 @@ func (l *Layout) SetDefaults() { //nolint:cyclop
 		l.Log.Directory = &Path{Original: fmt.Sprintf("${HOME}/Library/Logs/%s", AppID)}
 	}
 
+	// hook output goes to its own log files unless the hooks stream is mapped elsewhere, "" for the main log
+	if _, ok := l.Log.Streams["hooks"]; !ok && len(l.Hooks) > 0 {
+		if l.Log.Streams == nil {
+			l.Log.Streams = map[string]string{}
+		}
+
+		l.Log.Streams["hooks"] = "hooks"
+	}
+
+	if l.Network.HostDNS == nil {
+		hostDNS := len(l.Network.DNS) == 0
+		l.Network.HostDNS = &hostDNS
+	}
+
+	if *l.Network.HostDNS {
+		if l.DockerConfig == nil {
+			l.DockerConfig = map[string]any{}
+		}
+
+		if _, ok := l.DockerConfig["dns"]; !ok {
+			l.DockerConfig["dns"] = []string{HostDNSAddress}
+		}
+	}
+
+	if l.Proxy.Enabled() {
+		if l.DockerConfig == nil {
+			l.DockerConfig = map[string]any{}
+		}
+
+		if _, ok := l.DockerConfig["proxies"]; !ok {
+			l.DockerConfig["proxies"] = l.Proxy.DockerConfig()
+		}
+	}
+
+	if l.Hostname == "" {
+		l.Hostname = Name
+	}
+
 	if l.IdleTimeout == 0 {
 		l.IdleTimeout = time.Minute
 	}
+
+	if l.TrimInterval == 0 {
+		l.TrimInterval = 24 * 60 * 60
+	}
+
+	if l.Overlay.Size == "" {
+		l.Overlay.Size = "16M"
+	}
+
+	for _, script := range l.Provision {
+		if script.Timeout == 0 {
+			script.Timeout = 300
+		}
+	}
+}
+
+// Validate... checks the settings that are only used once the VM runs, after SetDefaults
+func (l *Layout) Validate() error {
+	var encrypted string
+
+	for _, label := range util.SortKeys(l.Disks) {
+		if l.Disks[label].Encrypt {
+			encrypted = label
+
+			break
+		}
+	}
+
+	for _, label := range util.SortKeys(l.Disks) {
+		if err := l.Disks[label].validate(encrypted); err != nil {
+			return fmt.Errorf("disk %s: %w", label, err)
+		}
+	}
+
+	if err := l.Overlay.validate(l.Disks); err != nil {
+		return err
+	}
+
+	if l.Prune != nil {
+		if err := l.Prune.validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, point := range util.SortKeys(l.Hooks) {
+		if !slices.Contains(hookPoints, point) {
+			return fmt.Errorf("unknown hook point %s", point)
+		}
+
+		for i, hook := range l.Hooks[point] {
+			if err := hook.validate(); err != nil {
+				return fmt.Errorf("hook %s[%d]: %w", point, i, err)
+			}
+		}
+	}
+
+	names := map[string]int{}
+
+	for i, script := range l.Provision {
+		if err := script.validate(l); err != nil {
+			return fmt.Errorf("provision script #%d: %w", i, err)
+		}
+
+		if prev, ok := names[script.Name]; ok && script.Name != "" {
+			return fmt.Errorf("provision script #%d: name %s is already used by script #%d", i, script.Name, prev)
+		}
+
+		names[script.Name] = i
+	}
+
+	return nil
 }
 
 func (l *Layout) SetDefaultSockets() {
@@ -131,6 +687,9 @@ var layoutValidator = newFieldValidator(Layout{})
 var diskImageValidator = newFieldValidator(DiskImage{})
 var dockerSocketValidator = newFieldValidator(DockerSocket{})
 var logConfigValidator = newFieldValidator(LogConfig{})
+var networkConfigValidator = newFieldValidator(NetworkConfig{})
+var caCertificateValidator = newFieldValidator(CACertificate{})
+var zramConfigValidator = newFieldValidator(ZramConfig{})
 
 func (l *Layout) UnmarshalJSON(data []byte) error {
 	if err := layoutValidator.Validate(data); err != nil {
@@ -219,3 +778,93 @@ func (l LogConfig) MarshalJSON() ([]byte, error) {
 
 	return json.Marshal(m)
 }
+
+func (n *NetworkConfig) UnmarshalJSON(data []byte) error {
+	if err := networkConfigValidator.Validate(data); err != nil {
+		return err
+	}
+
+	type networkConfig NetworkConfig
+
+	if err := json.Unmarshal(data, (*networkConfig)(n)); err != nil {
+		//nolint:wrapcheck
+		return err
+	}
+
+	switch n.IPv6 {
+	case "", "slaac", "dhcpv6", "off":
+	default:
+		return fmt.Errorf("invalid ipv6 mode %q, expected slaac, dhcpv6 or off", n.IPv6)
+	}
+
+	switch n.Mode {
+	case "", "nat", "vsock":
+		return nil
+	default:
+		return fmt.Errorf("invalid network mode %q, expected nat or vsock", n.Mode)
+	}
+}
+
+func (c *CACertificate) UnmarshalJSON(data []byte) error {
+	var str string
+
+	if err := json.Unmarshal(data, &str); err == nil {
+		c.Path = &Path{Original: str}
+
+		return nil
+	}
+
+	if err := caCertificateValidator.Validate(data); err != nil {
+		return err
+	}
+
+	type caCertificate CACertificate
+
+	if err := json.Unmarshal(data, (*caCertificate)(c)); err != nil {
+		//nolint:wrapcheck
+		return err
+	}
+
+	if c.Path == nil || c.Path.Original == "" {
+		return errors.New("ca certificate requires a path")
+	}
+
+	if strings.ContainsAny(c.Registry, "/\\") || c.Registry == "." || c.Registry == ".." {
+		return fmt.Errorf("invalid registry %q, expected host or host:port", c.Registry)
+	}
+
+	return nil
+}
+
+func (c CACertificate) MarshalJSON() ([]byte, error) {
+	if c.Registry == "" {
+		return json.Marshal(c.Path)
+	}
+
+	type caCertificate CACertificate
+
+	return json.Marshal(caCertificate(c))
+}
+
+func (z *ZramConfig) UnmarshalJSON(data []byte) error {
+	var str string
+
+	if err := json.Unmarshal(data, &str); err == nil {
+		z.Size = str
+	} else {
+		if err := zramConfigValidator.Validate(data); err != nil {
+			return err
+		}
+
+		type zramConfig ZramConfig
+
+		if err := json.Unmarshal(data, (*zramConfig)(z)); err != nil {
+			//nolint:wrapcheck
+			return err
+		}
+	}
+
+	_, err := z.Bytes(1)
+
+	return err
+}
@@ -0,0 +1,142 @@
+package host
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/amadigan/macoby/internal/event"
+	"github.com/amadigan/macoby/internal/host/config"
+	"github.com/amadigan/macoby/internal/host/disk"
+	"github.com/amadigan/macoby/internal/rpc"
+	"github.com/amadigan/macoby/internal/util"
+)
+
+// diskKeySize... the size of a generated key, as long as the 512 bit volume key of aes-xts
+const diskKeySize = 64
+
+// diskKey... reads the key file of an encrypted disk. A missing key is only generated for a disk about to be
+// formatted, otherwise the disk could never be unlocked again.
+func diskKey(label string, info *config.DiskImage, create bool) ([]byte, error) {
+	if info.KeyFile == nil || info.KeyFile.Resolved == "" {
+		return nil, fmt.Errorf("disk %s has no key file", label)
+	}
+
+	path := info.KeyFile.Resolved
+
+	key, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && create {
+		return createDiskKey(path)
+	} else if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("key file %s of encrypted disk %s is missing", path, label)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read key file %s: %w", path, err)
+	} else if len(key) == 0 {
+		return nil, fmt.Errorf("key file %s is empty", path)
+	}
+
+	if stat, err := os.Stat(path); err == nil && stat.Mode().Perm()&0077 != 0 {
+		log.Warnf("key file %s of disk %s is readable by other users", path, label)
+	}
+
+	return key, nil
+}
+
+func createDiskKey(path string) ([]byte, error) {
+	key := make([]byte, diskKeySize)
+
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	if err := os.Chmod(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to protect key directory: %w", err)
+	}
+
+	// O_EXCL, a key that appeared in the meantime must not be replaced
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create key file %s: %w", path, err)
+	}
+
+	if _, err := file.Write(key); err != nil {
+		_ = file.Close()
+		_ = os.Remove(path)
+
+		return nil, fmt.Errorf("failed to write key file %s: %w", path, err)
+	}
+
+	if err := file.Close(); err != nil {
+		_ = os.Remove(path)
+
+		return nil, fmt.Errorf("failed to write key file %s: %w", path, err)
+	}
+
+	log.Infof("generated key file %s", path)
+
+	return key, nil
+}
+
+// unlockDisk... opens the LUKS device of an encrypted disk in the guest, formatting it first if format is set. An
+// already open device is resized to the device. Returns the path of the unlocked device.
+func (vm *VirtualMachine) unlockDisk(label string, info *config.DiskImage, device string, format bool) (string, error) {
+	key, err := diskKey(label, info, format)
+	if err != nil {
+		return "", err
+	}
+
+	req := rpc.UnlockRequest{Device: device, Name: label, Key: key, Format: format, Discard: true, ReadOnly: info.ReadOnly}
+
+	var mapped string
+
+	if err := vm.client.Unlock(req, &mapped); err != nil {
+		return "", fmt.Errorf("failed to unlock disk %s: %w", label, err)
+	}
+
+	return mapped, nil
+}
+
+// mountEncrypted... the filesystem of an encrypted disk cannot be inspected from the host. A blank disk is formatted with
+// LUKS and then mkfs, a LUKS disk is unlocked, mounted and grown to fill the image, which only grows. A disk holding a
+// plaintext filesystem is refused, encrypting it in place would destroy its contents.
+func (vm *VirtualMachine) mountEncrypted(label string, info *config.DiskImage, device string, size int64, result *disk.Filesystem) error {
+	if result != nil && result.Type != disk.FSluks {
+		return fmt.Errorf("disk %s holds an unencrypted %s filesystem, purge or export the disk before enabling encryption",
+			label, result.Type)
+	}
+
+	format := result == nil
+
+	if format && info.ReadOnly {
+		return fmt.Errorf("disk %s is read-only and blank, it cannot be encrypted", label)
+	}
+
+	mapped, err := vm.unlockDisk(label, info, device, format)
+	if err != nil {
+		return err
+	}
+
+	if format {
+		if err := vm.mkfs(label, info, mapped); err != nil {
+			return err
+		}
+
+		vm.setDiskMetrics(info.Mount, event.DiskMetrics{Total: util.Uint64(size), Free: util.Uint64(size)})
+	} else if stat, err := os.Stat(info.Path.Resolved); err == nil && size != 0 && stat.Size() > size {
+		log.Warnf("disk %s is encrypted and cannot be shrunk, keeping %d bytes", label, stat.Size())
+	}
+
+	if err := vm.Mount(mapped, info.Mount, info.FS, info.Options); err != nil {
+		return fmt.Errorf("failed to mount %s: %w", info.Mount, err)
+	}
+
+	if !format && !info.ReadOnly {
+		if err := vm.growMounted(info, mapped); err != nil {
+			log.Warnf("failed to grow filesystem %s: %v", info.Mount, err)
+		}
+	}
+
+	return nil
+}
@@ -23,6 +23,9 @@ import (
 	"github.com/bored-engineer/go-launchd"
 )
 
+// dockerdReadyTimeout... how long dockerd has to answer once it is launched, before the dockerd-ready hooks are skipped
+const dockerdReadyTimeout = time.Minute
+
 func IsDaemon(osArgs []string) bool {
 	if len(osArgs) == 0 {
 		return false
@@ -75,18 +78,17 @@ func RunDaemon(osArgs []string, env map[string]string) {
 		log.Fatal(fmt.Errorf("failed to open daemon state: %w", err))
 	}
 
-	defer func() {
-		stateCh <- DaemonState{Status: StatusStopped}
-		close(stateCh)
-		<-done
-	}()
-
 	vm := &VirtualMachine{
 		Layout:       *control.Layout,
 		LogChannel:   control.LogChannel,
 		StateChannel: stateCh,
 	}
 
+	defer func() {
+		vm.CloseState(DaemonState{Status: StatusStopped})
+		<-done
+	}()
+
 	dockerJson := util.Await(func() ([]byte, error) {
 		if len(control.Layout.DockerConfig) > 0 {
 			return json.Marshal(control.Layout.DockerConfig)
@@ -95,7 +97,9 @@ func RunDaemon(osArgs []string, env map[string]string) {
 		return nil, nil
 	})
 
-	control.SetupServer(ctx, vm)
+	control.SetupServer(ctx, vm, state)
+
+	hooks := newHookRunner(control.Layout, control.LogChannel)
 
 	go func() {
 		if err := control.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
@@ -105,6 +109,9 @@ func RunDaemon(osArgs []string, env map[string]string) {
 
 	defer control.Close()
 
+	hooks.lifecycle(ctx, config.HookPreStart)
+	defer hooks.lifecycle(ctx, config.HookStopped)
+
 	start := time.Now()
 
 	if err := control.vm.Start(ctx, state); err != nil {
@@ -113,6 +120,8 @@ func RunDaemon(osArgs []string, env map[string]string) {
 		return
 	}
 
+	hooks.lifecycle(ctx, config.HookGuestReady)
+
 	dockerBs, err := dockerJson()
 	if err != nil {
 		log.Errorf("failed to get docker config: %w", err)
@@ -126,6 +135,7 @@ func RunDaemon(osArgs []string, env map[string]string) {
 		Name:  "dockerd",
 		Path:  "/usr/bin/dockerd",
 		Args:  []string{"dockerd", "--config-file", "/proc/self/fd/0"},
+		Env:   control.Layout.Proxy.Environ(),
 		Input: dockerBs,
 	}
 
@@ -142,9 +152,17 @@ func RunDaemon(osArgs []string, env map[string]string) {
 	log.Infof("dockerd started in %s", time.Since(start))
 
 	go MonitorDockerd(ctx, control.vm, futureListener) // forwards container ports to the host
+	go control.AutogrowDisks(ctx)
 
+	hooks.listen(ctx)
 	control.vm.UpdateStatus(ctx, event.StatusReady)
 
+	if err := control.vm.WaitDockerd(ctx, dockerdReadyTimeout); err != nil {
+		log.Errorf("not running the %s hooks: %v", config.HookDockerdReady, err)
+	} else {
+		hooks.lifecycle(ctx, config.HookDockerdReady)
+	}
+
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh)
 
@@ -172,15 +190,29 @@ func RunDaemon(osArgs []string, env map[string]string) {
 		log.Errorf("failed to GC: %w", err)
 	}
 
-	for sig := range sigCh {
-		log.Infof("received signal %s", sig)
+wait:
+	for {
+		select {
+		case sig, ok := <-sigCh:
+			if !ok {
+				break wait
+			}
+
+			log.Infof("received signal %s", sig)
 
-		if sig == syscall.SIGINT || sig == syscall.SIGTERM {
-			break
+			if sig == syscall.SIGINT || sig == syscall.SIGTERM {
+				break wait
+			}
+		case <-control.Restart():
+			log.Info("stopping to modify disks")
+
+			break wait
 		}
 	}
 
-	stateCh <- DaemonState{Status: StatusStopping}
+	vm.UpdateState(DaemonState{Status: StatusStopping})
+
+	hooks.lifecycle(ctx, config.HookPreStop)
 
 	log.Info("shutting down")
 
@@ -191,6 +223,16 @@ func RunDaemon(osArgs []string, env map[string]string) {
 	exit := svc.Wait()
 
 	log.Infof("dockerd exited with code %d", exit)
+
+	control.RestoreSnapshots()
+
+	if err := control.vm.Shutdown(ctx); err != nil {
+		log.Errorf("failed to shutdown VM: %v", err)
+
+		return
+	}
+
+	control.ApplyDiskChanges(ctx)
 }
 
 func (cs *ControlServer) SetupLogging(ctx context.Context) error {
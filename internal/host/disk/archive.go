@@ -0,0 +1,382 @@
+package disk
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/sys/unix"
+)
+
+// ArchiveVersion... the version of the archive format written by Export, Import reads this version and older
+const ArchiveVersion = 1
+
+// An archive is a zstd compressed tar with the manifest as its first entry, then one entry per extent, named by its
+// offset, and finally the hex sha256 of the manifest and the extents, in archive order.
+const (
+	manifestEntry = "manifest.json"
+	checksumEntry = "sha256"
+	extentPrefix  = "extents/"
+	maxManifest   = 16 * 1024 * 1024
+	sparseBlock   = 4096
+	copyBuffer    = 1024 * 1024
+)
+
+// Manifest... describes the image in an archive
+type Manifest struct {
+	Version    int         `json:"version"`
+	Railyard   string      `json:"railyard"` // version of railyard that wrote the archive
+	Label      string      `json:"label"`
+	FS         string      `json:"fs"`
+	Size       int64       `json:"size"` // logical size of the image
+	Created    time.Time   `json:"created"`
+	Filesystem *Filesystem `json:"filesystem"`
+	Extents    []Extent    `json:"extents"`
+}
+
+// Extent... a range of the image that holds data, the ranges between extents are holes
+type Extent struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// Export... writes an archive of an inspected image, only the data extents of a sparse image are stored
+func Export(w io.Writer, img *Image, railyard string) (*Manifest, error) {
+	if !img.Exists || img.Filesystem == nil {
+		return nil, fmt.Errorf("disk %s has no filesystem to export", img.Label)
+	}
+
+	file, err := os.Open(img.Path)
+	if err != nil {
+		//nolint:wrapcheck
+		return nil, err
+	}
+	defer file.Close()
+
+	extents, err := dataExtents(file, img.Size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to map extents of %s: %w", img.Path, err)
+	}
+
+	manifest := &Manifest{
+		Version:    ArchiveVersion,
+		Railyard:   railyard,
+		Label:      img.Label,
+		FS:         img.FS,
+		Size:       img.Size,
+		Created:    time.Now().UTC().Truncate(time.Second),
+		Filesystem: img.Filesystem,
+		Extents:    extents,
+	}
+
+	bs, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create compressor: %w", err)
+	}
+
+	if err := writeArchive(zw, file, manifest, bs); err != nil {
+		_ = zw.Close()
+
+		return nil, err
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write archive: %w", err)
+	}
+
+	return manifest, nil
+}
+
+// writeArchive... writes the manifest, the extents of file and the checksum as a tar to w
+func writeArchive(w io.Writer, file *os.File, manifest *Manifest, bs []byte) error {
+	tw := tar.NewWriter(w)
+	hash := sha256.New()
+
+	if err := writeEntry(tw, manifestEntry, manifest.Created, int64(len(bs)), io.TeeReader(bytes.NewReader(bs), hash)); err != nil {
+		return err
+	}
+
+	for _, extent := range manifest.Extents {
+		data := io.TeeReader(io.NewSectionReader(file, extent.Offset, extent.Length), hash)
+
+		if err := writeEntry(tw, extentName(extent.Offset), manifest.Created, extent.Length, data); err != nil {
+			return err
+		}
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil)) + "\n"
+
+	if err := writeEntry(tw, checksumEntry, manifest.Created, int64(len(sum)), strings.NewReader(sum)); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+
+	return nil
+}
+
+// Import... recreates an image from an archive at path, the holes of the exported image and blocks of zeros are left
+// unallocated. check validates the manifest before anything is written. The image is written next to path and
+// renamed over it once the checksum and filesystem are verified.
+func Import(r io.Reader, path string, check func(*Manifest) error) (*Manifest, error) {
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create decompressor: %w", err)
+	}
+	defer zr.Close()
+
+	tr := tar.NewReader(zr)
+	hash := sha256.New()
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive: %w", err)
+	} else if hdr.Name != manifestEntry || hdr.Size > maxManifest {
+		return nil, errors.New("not a disk archive")
+	}
+
+	bs, err := io.ReadAll(io.TeeReader(tr, hash))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	manifest := &Manifest{}
+	if err := json.Unmarshal(bs, manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+
+	if err := manifest.validate(); err != nil {
+		return nil, err
+	}
+
+	if check != nil {
+		if err := check(manifest); err != nil {
+			return nil, err
+		}
+	}
+
+	tmp := path + ".import"
+
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		//nolint:wrapcheck
+		return nil, err
+	}
+
+	if err := importImage(tr, hash, file, manifest); err != nil {
+		_ = file.Close()
+		_ = os.Remove(tmp)
+
+		return nil, err
+	}
+
+	if err := file.Close(); err != nil {
+		_ = os.Remove(tmp)
+
+		return nil, fmt.Errorf("failed to write %s: %w", tmp, err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+
+		//nolint:wrapcheck
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+func importImage(tr *tar.Reader, hash hash.Hash, file *os.File, manifest *Manifest) error {
+	if err := file.Truncate(manifest.Size); err != nil {
+		return fmt.Errorf("failed to size %s: %w", file.Name(), err)
+	}
+
+	buf := make([]byte, copyBuffer)
+
+	for _, extent := range manifest.Extents {
+		hdr, err := tr.Next()
+		if err != nil {
+			return fmt.Errorf("archive is truncated: %w", err)
+		}
+
+		if hdr.Name != extentName(extent.Offset) || hdr.Size != extent.Length {
+			return fmt.Errorf("archive entry %s does not match the manifest", hdr.Name)
+		}
+
+		if n, err := writeSparse(file, extent.Offset, io.TeeReader(tr, hash), buf); err != nil {
+			return fmt.Errorf("failed to write %s: %w", file.Name(), err)
+		} else if n != extent.Length {
+			return fmt.Errorf("archive entry %s is truncated", hdr.Name)
+		}
+	}
+
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != checksumEntry {
+		return errors.New("archive has no checksum")
+	}
+
+	sum, err := io.ReadAll(io.LimitReader(tr, 1024))
+	if err != nil {
+		return fmt.Errorf("failed to read checksum: %w", err)
+	}
+
+	if strings.TrimSpace(string(sum)) != hex.EncodeToString(hash.Sum(nil)) {
+		return errors.New("archive checksum does not match, the archive is corrupt")
+	}
+
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", file.Name(), err)
+	}
+
+	fs, err := Identify(manifest.Size, file)
+	if err != nil {
+		return fmt.Errorf("failed to identify imported filesystem: %w", err)
+	}
+
+	if fs == nil || fs.Type != manifest.Filesystem.Type || fs.Id != manifest.Filesystem.Id {
+		return errors.New("imported image does not hold the filesystem in the manifest")
+	}
+
+	return nil
+}
+
+func (m *Manifest) validate() error {
+	if m.Version < 1 || m.Version > ArchiveVersion {
+		return fmt.Errorf("unsupported archive version %d, upgrade railyard (archive written by %s)", m.Version, m.Railyard)
+	}
+
+	if m.Filesystem == nil || string(m.Filesystem.Type) != m.FS {
+		return fmt.Errorf("archive does not hold a %s filesystem", m.FS)
+	}
+
+	var end int64
+
+	for _, extent := range m.Extents {
+		if extent.Offset < end || extent.Length <= 0 || extent.Offset+extent.Length > m.Size {
+			return fmt.Errorf("invalid extent at %d in manifest", extent.Offset)
+		}
+
+		end = extent.Offset + extent.Length
+	}
+
+	return nil
+}
+
+// dataExtents... maps the data of a sparse file with SEEK_DATA and SEEK_HOLE, a filesystem without support for them
+// reports the whole file as data
+func dataExtents(file *os.File, size int64) ([]Extent, error) {
+	var extents []Extent
+
+	for offset := int64(0); offset < size; {
+		start, err := file.Seek(offset, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			break
+		} else if errors.Is(err, unix.EINVAL) && offset == 0 {
+			return []Extent{{Offset: 0, Length: size}}, nil
+		} else if err != nil {
+			//nolint:wrapcheck
+			return nil, err
+		}
+
+		end, err := file.Seek(start, unix.SEEK_HOLE)
+		if err != nil {
+			//nolint:wrapcheck
+			return nil, err
+		}
+
+		end = min(end, size)
+
+		if end > start {
+			extents = append(extents, Extent{Offset: start, Length: end - start})
+		}
+
+		offset = end
+	}
+
+	return extents, nil
+}
+
+// writeSparse... copies r to file at offset, skipping blocks of zeros so they remain holes
+func writeSparse(file *os.File, offset int64, r io.Reader, buf []byte) (int64, error) {
+	var written int64
+
+	for {
+		n, err := io.ReadFull(r, buf)
+
+		for block := 0; block < n; {
+			end := min(block+sparseBlock, n)
+
+			if isZero(buf[block:end]) {
+				block = end
+
+				continue
+			}
+
+			// extend the run over the following non-zero blocks
+			for end < n && !isZero(buf[end:min(end+sparseBlock, n)]) {
+				end = min(end+sparseBlock, n)
+			}
+
+			if _, err := file.WriteAt(buf[block:end], offset+written+int64(block)); err != nil {
+				//nolint:wrapcheck
+				return written, err
+			}
+
+			block = end
+		}
+
+		written += int64(n)
+
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return written, nil
+		} else if err != nil {
+			//nolint:wrapcheck
+			return written, err
+		}
+	}
+}
+
+func isZero(bs []byte) bool {
+	for _, b := range bs {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func extentName(offset int64) string {
+	return fmt.Sprintf("%s%016x", extentPrefix, offset)
+}
+
+func writeEntry(tw *tar.Writer, name string, modTime time.Time, size int64, r io.Reader) error {
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: size, ModTime: modTime, Typeflag: tar.TypeReg}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+
+	if _, err := io.Copy(tw, r); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,238 @@
+package disk
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// exportImage... formats a sparse ext4 image with a block of data written past the filesystem metadata and exports it
+func exportImage(t *testing.T) (*Image, []byte) {
+	t.Helper()
+
+	path := makeImage(t, 64*mib, "mkfs.ext4", "-q", "-F", "-b", "4096", "-L", "data", "-U", testUUID.String())
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := file.WriteAt(bytes.Repeat([]byte("railyard"), 1024), 48*mib); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = file.Close()
+
+	img := &Image{Label: "data", Path: path, FS: string(FSext)}
+	if err := img.Inspect(); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+
+	if _, err := Export(&buf, img, "test"); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+
+	return img, buf.Bytes()
+}
+
+// rewriteArchive... recompresses an archive with the body of each entry replaced by edit
+func rewriteArchive(t *testing.T, archive []byte, edit func(name string, body []byte) []byte) []byte {
+	t.Helper()
+
+	zr, err := zstd.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+
+	var out bytes.Buffer
+
+	zw, err := zstd.NewWriter(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr, tw := tar.NewReader(zr), tar.NewWriter(zw)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		body, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body = edit(hdr.Name, body)
+
+		if err := writeEntry(tw, hdr.Name, hdr.ModTime, int64(len(body)), bytes.NewReader(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return out.Bytes()
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	img, archive := exportImage(t)
+	path := filepath.Join(t.TempDir(), "imported.img")
+
+	manifest, err := Import(bytes.NewReader(archive), path, nil)
+	if err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+
+	if manifest.Label != "data" || manifest.Size != img.Size || manifest.Filesystem.Id != testUUID {
+		t.Errorf("manifest = %+v", manifest)
+	}
+
+	want, err := os.ReadFile(img.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Error("imported image differs from the exported image")
+	}
+
+	if size, allocated, err := Allocation(path); err != nil {
+		t.Fatal(err)
+	} else if size != img.Size || allocated >= size {
+		t.Errorf("imported image is %d bytes with %d allocated, want a sparse %d byte image", size, allocated, img.Size)
+	}
+
+	if _, err := os.Stat(path + ".import"); !os.IsNotExist(err) {
+		t.Errorf("temporary image was left behind: %v", err)
+	}
+}
+
+func TestImportCorrupt(t *testing.T) {
+	_, archive := exportImage(t)
+
+	tests := []struct {
+		name string
+		edit func(name string, body []byte) []byte
+		want string
+	}{
+		{
+			name: "checksum",
+			edit: func(name string, body []byte) []byte {
+				if name == checksumEntry {
+					return []byte(strings.Repeat("0", 64) + "\n")
+				}
+
+				return body
+			},
+			want: "checksum does not match",
+		},
+		{
+			name: "extent",
+			edit: func(name string, body []byte) []byte {
+				if strings.HasPrefix(name, extentPrefix) {
+					body[len(body)-1] ^= 0xff
+				}
+
+				return body
+			},
+			want: "checksum does not match",
+		},
+		{
+			name: "version",
+			edit: editManifest(t, func(m *Manifest) { m.Version = ArchiveVersion + 1 }),
+			want: "unsupported archive version",
+		},
+		{
+			name: "extents",
+			edit: editManifest(t, func(m *Manifest) { m.Extents[len(m.Extents)-1].Length = m.Size }),
+			want: "invalid extent",
+		},
+		{
+			name: "filesystem",
+			edit: editManifest(t, func(m *Manifest) { m.FS = string(FSxfs) }),
+			want: "does not hold a xfs filesystem",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "imported.img")
+
+			_, err := Import(bytes.NewReader(rewriteArchive(t, bytes.Clone(archive), test.edit)), path, nil)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("Import error = %v, want %q", err, test.want)
+			}
+
+			if got := dirNames(t, dir); len(got) != 0 {
+				t.Errorf("rejected import left %v", got)
+			}
+		})
+	}
+}
+
+func editManifest(t *testing.T, edit func(*Manifest)) func(string, []byte) []byte {
+	t.Helper()
+
+	return func(name string, body []byte) []byte {
+		if name != manifestEntry {
+			return body
+		}
+
+		manifest := &Manifest{}
+		if err := json.Unmarshal(body, manifest); err != nil {
+			t.Fatal(err)
+		}
+
+		edit(manifest)
+
+		bs, err := json.Marshal(manifest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return bs
+	}
+}
+
+func dirNames(t *testing.T, dir string) []string {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := make([]string, 0, len(entries))
+
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+
+	return names
+}
@@ -8,6 +8,34 @@ import (
 
 const MinSizeBtrfs = 0x10000 + 1000
 
+var btrfsROCompatFeatures = map[uint64]string{
+	0x1: "free_space_tree",
+	0x2: "free_space_tree_valid",
+	0x4: "verity",
+	0x8: "block_group_tree",
+}
+
+var btrfsIncompatFeatures = map[uint64]string{
+	0x1:     "mixed_backref",
+	0x2:     "default_subvol",
+	0x4:     "mixed_groups",
+	0x8:     "compress_lzo",
+	0x10:    "compress_zstd",
+	0x20:    "big_metadata",
+	0x40:    "extended_iref",
+	0x80:    "raid56",
+	0x100:   "skinny_metadata",
+	0x200:   "no_holes",
+	0x400:   "metadata_uuid",
+	0x800:   "raid1c34",
+	0x1000:  "zoned",
+	0x2000:  "extent_tree_v2",
+	0x4000:  "raid_stripe_tree",
+	0x10000: "simple_quota",
+}
+
+// IdentifyBtrfs... btrfs has no fixed inode table, so MaxFiles and FreeFiles are zero like in statfs, and does not
+// record a creation time in the superblock
 func IdentifyBtrfs(file io.ReaderAt) (*Filesystem, error) {
 	superblock := make([]byte, 1000)
 
@@ -25,11 +53,16 @@ func IdentifyBtrfs(file io.ReaderAt) (*Filesystem, error) {
 		Label: readLabel(superblock[0x12B:0x22B]),
 		//nolint:gosec
 		Size: int64(binary.LittleEndian.Uint64(superblock[0x70:0x78])),
+		//nolint:gosec
+		BlockSize: int64(binary.LittleEndian.Uint32(superblock[0x90:0x94])),
 	}
 
 	//nolint:gosec
 	used := int64(binary.LittleEndian.Uint64(superblock[0x78:0x80]))
 	p.Free = p.Size - used
 
+	p.Features = append(featureNames(binary.LittleEndian.Uint64(superblock[0xB4:0xBC]), btrfsROCompatFeatures),
+		featureNames(binary.LittleEndian.Uint64(superblock[0xBC:0xC4]), btrfsIncompatFeatures)...)
+
 	return &p, nil
 }
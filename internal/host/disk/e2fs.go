@@ -4,12 +4,65 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"time"
 )
 
-const MinSizeExt = 1024 + 0x88
+const MinSizeExt = 1024 + 1024
+
+const (
+	extFeatureIncompat64bit = 0x80
+)
+
+var extCompatFeatures = map[uint64]string{
+	0x1:    "dir_prealloc",
+	0x2:    "imagic_inodes",
+	0x4:    "has_journal",
+	0x8:    "ext_attr",
+	0x10:   "resize_inode",
+	0x20:   "dir_index",
+	0x200:  "sparse_super2",
+	0x400:  "fast_commit",
+	0x800:  "stable_inodes",
+	0x1000: "orphan_file",
+}
+
+var extIncompatFeatures = map[uint64]string{
+	0x1:     "compression",
+	0x2:     "filetype",
+	0x4:     "needs_recovery",
+	0x8:     "journal_dev",
+	0x10:    "meta_bg",
+	0x40:    "extent",
+	0x80:    "64bit",
+	0x100:   "mmp",
+	0x200:   "flex_bg",
+	0x400:   "ea_inode",
+	0x1000:  "dirdata",
+	0x2000:  "metadata_csum_seed",
+	0x4000:  "large_dir",
+	0x8000:  "inline_data",
+	0x10000: "encrypt",
+	0x20000: "casefold",
+}
+
+var extROCompatFeatures = map[uint64]string{
+	0x1:     "sparse_super",
+	0x2:     "large_file",
+	0x8:     "huge_file",
+	0x10:    "uninit_bg",
+	0x20:    "dir_nlink",
+	0x40:    "extra_isize",
+	0x100:   "quota",
+	0x200:   "bigalloc",
+	0x400:   "metadata_csum",
+	0x1000:  "readonly",
+	0x2000:  "project",
+	0x8000:  "verity",
+	0x10000: "orphan_present",
+}
 
 func IdentifyExt(file io.ReaderAt) (*Filesystem, error) {
-	bs := make([]byte, 0x88)
+	bs := make([]byte, 1024)
 	if _, err := file.ReadAt(bs, 1024); err != nil {
 		return nil, fmt.Errorf("failed to read superblock: %w", err)
 	}
@@ -24,12 +77,34 @@ func IdentifyExt(file io.ReaderAt) (*Filesystem, error) {
 		Label: readLabel(bs[0x78:0x88]),
 	}
 
-	sBlocksCount := binary.LittleEndian.Uint32(bs[0x4:0x8])
 	sLogBlockSize := binary.LittleEndian.Uint32(bs[0x18:0x1C])
+	compat := binary.LittleEndian.Uint32(bs[0x5C:0x60])
+	incompat := binary.LittleEndian.Uint32(bs[0x60:0x64])
+	roCompat := binary.LittleEndian.Uint32(bs[0x64:0x68])
+
+	blocksCount := uint64(binary.LittleEndian.Uint32(bs[0x4:0x8]))
+	freeBlocks := uint64(binary.LittleEndian.Uint32(bs[0xC:0x10]))
+
+	if incompat&extFeatureIncompat64bit != 0 {
+		blocksCount |= uint64(binary.LittleEndian.Uint32(bs[0x150:0x154])) << 32
+		freeBlocks |= uint64(binary.LittleEndian.Uint32(bs[0x158:0x15C])) << 32
+	}
+
+	p.BlockSize = int64(1024 << sLogBlockSize)
+	//nolint:gosec
+	p.Size = int64(blocksCount) * p.BlockSize
+	//nolint:gosec
+	p.Free = int64(freeBlocks) * p.BlockSize
+	p.MaxFiles = uint64(binary.LittleEndian.Uint32(bs[0x0:0x4]))
+	p.FreeFiles = uint64(binary.LittleEndian.Uint32(bs[0x10:0x14]))
 
-	blockSize := int64(1024 << sLogBlockSize)
+	p.Features = append(featureNames(uint64(compat), extCompatFeatures), featureNames(uint64(incompat), extIncompatFeatures)...)
+	p.Features = append(p.Features, featureNames(uint64(roCompat), extROCompatFeatures)...)
 
-	p.Size = int64(sBlocksCount) * blockSize
+	// s_mkfs_time, extended by 8 bits in s_mkfs_time_hi
+	if mkfsTime := int64(binary.LittleEndian.Uint32(bs[0x108:0x10C])) | int64(bs[0x276])<<32; mkfsTime != 0 {
+		p.Created = time.Unix(mkfsTime, 0).UTC()
+	}
 
 	return &p, nil
 }
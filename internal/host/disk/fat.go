@@ -0,0 +1,230 @@
+package disk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const MinSizeFat = 512
+
+const (
+	fat12MaxClusters = 4085
+	fat16MaxClusters = 65525
+	fatNoLabel       = "NO NAME"
+	fatFSInfoFree    = 0x1E8
+	fatScanChunk     = 1 << 20
+	fat32ClusterMask = 0x0FFFFFFF
+)
+
+// fatBPB... the BIOS parameter block common to FAT12, FAT16 and FAT32
+type fatBPB struct {
+	bytesPerSector    int64
+	sectorsPerCluster int64
+	reservedSectors   int64
+	fats              int64
+	rootEntries       int64
+	totalSectors      int64
+	fatSectors        int64
+}
+
+func (b fatBPB) clusters() int64 {
+	rootSectors := (b.rootEntries*32 + b.bytesPerSector - 1) / b.bytesPerSector
+	dataSectors := b.totalSectors - b.reservedSectors - b.fats*b.fatSectors - rootSectors
+
+	return dataSectors / b.sectorsPerCluster
+}
+
+func powerOfTwo(n int64) bool {
+	return n > 0 && n&(n-1) == 0
+}
+
+// IdentifyFat... FAT has no UUID, the 32-bit volume id is reported as Serial in the form shown by blkid. Free space
+// comes from the FSInfo sector on FAT32, or by counting free clusters in the first FAT when it is not known.
+func IdentifyFat(file io.ReaderAt) (*Filesystem, error) {
+	bs := make([]byte, 512)
+
+	if _, err := file.ReadAt(bs, 0); err != nil {
+		return nil, fmt.Errorf("failed to read boot sector: %w", err)
+	}
+
+	if bs[510] != 0x55 || bs[511] != 0xAA || (bs[0] != 0xEB && bs[0] != 0xE9) {
+		return nil, nil
+	}
+
+	bpb := fatBPB{
+		bytesPerSector:    int64(binary.LittleEndian.Uint16(bs[0x0B:0x0D])),
+		sectorsPerCluster: int64(bs[0x0D]),
+		reservedSectors:   int64(binary.LittleEndian.Uint16(bs[0x0E:0x10])),
+		fats:              int64(bs[0x10]),
+		rootEntries:       int64(binary.LittleEndian.Uint16(bs[0x11:0x13])),
+		totalSectors:      int64(binary.LittleEndian.Uint16(bs[0x13:0x15])),
+		fatSectors:        int64(binary.LittleEndian.Uint16(bs[0x16:0x18])),
+	}
+
+	// a master boot record has the same signature, but not a valid BPB
+	if bpb.bytesPerSector < 512 || bpb.bytesPerSector > 4096 || !powerOfTwo(bpb.bytesPerSector) ||
+		!powerOfTwo(bpb.sectorsPerCluster) || bpb.reservedSectors == 0 || bpb.fats == 0 {
+		return nil, nil
+	}
+
+	if bpb.totalSectors == 0 {
+		bpb.totalSectors = int64(binary.LittleEndian.Uint32(bs[0x20:0x24]))
+	}
+
+	fat32 := bpb.fatSectors == 0
+	extended := bs[0x26:]
+
+	if fat32 {
+		bpb.fatSectors = int64(binary.LittleEndian.Uint32(bs[0x24:0x28]))
+		extended = bs[0x42:]
+	}
+
+	clusters := bpb.clusters()
+	if clusters <= 0 {
+		return nil, nil
+	}
+
+	p := Filesystem{
+		Type:      FSfat,
+		BlockSize: bpb.bytesPerSector * bpb.sectorsPerCluster,
+	}
+
+	p.Size = clusters * p.BlockSize
+
+	// extended boot signature, older filesystems have no serial or label
+	if extended[0] == 0x29 {
+		serial := binary.LittleEndian.Uint32(extended[0x1:0x5])
+		p.Serial = fmt.Sprintf("%04X-%04X", serial>>16, serial&0xFFFF)
+
+		if label := strings.TrimRight(string(extended[0x5:0x10]), " \x00"); label != fatNoLabel {
+			p.Label = label
+		}
+	}
+
+	var bits int
+
+	switch {
+	case fat32:
+		bits = 32
+	case clusters < fat12MaxClusters:
+		bits = 12
+	case clusters < fat16MaxClusters:
+		bits = 16
+	default:
+		return nil, nil
+	}
+
+	p.Features = []string{fmt.Sprintf("FAT%d", bits)}
+
+	free := int64(-1)
+
+	if fat32 {
+		var err error
+		if free, err = readFSInfo(file, bpb, bs); err != nil {
+			return nil, err
+		}
+	}
+
+	if free < 0 {
+		var err error
+		if free, err = countFreeClusters(file, bpb, bits, clusters); err != nil {
+			return nil, err
+		}
+	}
+
+	p.Free = free * p.BlockSize
+
+	return &p, nil
+}
+
+// readFSInfo... the free cluster count from the FSInfo sector, -1 if it is not present or not known
+func readFSInfo(file io.ReaderAt, bpb fatBPB, bs []byte) (int64, error) {
+	sector := int64(binary.LittleEndian.Uint16(bs[0x30:0x32]))
+	if sector == 0 || sector == 0xFFFF || sector >= bpb.reservedSectors {
+		return -1, nil
+	}
+
+	info := make([]byte, 512)
+
+	if _, err := file.ReadAt(info, sector*bpb.bytesPerSector); err != nil {
+		return -1, fmt.Errorf("failed to read FSInfo sector: %w", err)
+	}
+
+	if string(info[0:4]) != "RRaA" || string(info[0x1E4:0x1E8]) != "rrAa" {
+		return -1, nil
+	}
+
+	free := binary.LittleEndian.Uint32(info[fatFSInfoFree : fatFSInfoFree+4])
+	if free == 0xFFFFFFFF {
+		return -1, nil
+	}
+
+	return int64(free), nil
+}
+
+// countFreeClusters... scans the first FAT, entries 0 and 1 are reserved so data clusters start at entry 2
+func countFreeClusters(file io.ReaderAt, bpb fatBPB, bits int, clusters int64) (int64, error) {
+	offset := bpb.reservedSectors * bpb.bytesPerSector
+	entries := clusters + 2
+
+	if bits == 12 {
+		return countFreeClusters12(file, offset, entries)
+	}
+
+	entryBytes := int64(bits / 8)
+	size := entries * entryBytes
+	buf := make([]byte, min(fatScanChunk, size))
+
+	var free int64
+
+	for pos := int64(0); pos < size; pos += int64(len(buf)) {
+		n := min(int64(len(buf)), size-pos)
+
+		if _, err := file.ReadAt(buf[:n], offset+pos); err != nil {
+			return 0, fmt.Errorf("failed to read FAT: %w", err)
+		}
+
+		for i := max(2, pos/entryBytes); i < (pos+n)/entryBytes; i++ {
+			start := i*entryBytes - pos
+
+			var entry uint32
+			if bits == 16 {
+				entry = uint32(binary.LittleEndian.Uint16(buf[start:]))
+			} else {
+				entry = binary.LittleEndian.Uint32(buf[start:]) & fat32ClusterMask
+			}
+
+			if entry == 0 {
+				free++
+			}
+		}
+	}
+
+	return free, nil
+}
+
+// countFreeClusters12... FAT12 entries straddle bytes, the FAT is at most 6KB so it is read at once
+func countFreeClusters12(file io.ReaderAt, offset int64, entries int64) (int64, error) {
+	buf := make([]byte, (entries*12+7)/8+1)
+
+	if _, err := file.ReadAt(buf[:len(buf)-1], offset); err != nil {
+		return 0, fmt.Errorf("failed to read FAT: %w", err)
+	}
+
+	var free int64
+
+	for i := int64(2); i < entries; i++ {
+		entry := binary.LittleEndian.Uint16(buf[i*3/2:])
+		if i%2 == 1 {
+			entry >>= 4
+		}
+
+		if entry&0xFFF == 0 {
+			free++
+		}
+	}
+
+	return free, nil
+}
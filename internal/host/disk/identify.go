@@ -2,7 +2,9 @@ package disk
 
 import (
 	"bytes"
+	"fmt"
 	"io"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -17,21 +19,32 @@ const (
 	FSswap   FSType = "swap"
 	FSfat    FSType = "vfat"
 	FSsquash FSType = "squashfs"
+	FSluks   FSType = "crypto_LUKS" // not a filesystem, the header of an encrypted disk
 )
 
 const squashfsMagic uint32 = 0x73717368
 
 type Filesystem struct {
-	Type      FSType
-	Id        uuid.UUID
-	Label     string
-	Size      int64 // in bytes
-	Free      int64
-	MaxFiles  uint64
-	FreeFiles uint64
+	Type      FSType    `json:"type"`
+	Id        uuid.UUID `json:"uuid"`
+	Serial    string    `json:"serial,omitempty"` // volume serial of filesystems without a UUID (vfat)
+	Label     string    `json:"label"`
+	Size      int64     `json:"size"` // in bytes
+	Free      int64     `json:"free"`
+	BlockSize int64     `json:"block-size"`
+	MaxFiles  uint64    `json:"max-files"`
+	FreeFiles uint64    `json:"free-files"`
+	Features  []string  `json:"features,omitempty"`
+	Created   time.Time `json:"created,omitzero"` // zero if the filesystem does not record it
 }
 
 func Identify(size int64, f io.ReaderAt) (*Filesystem, error) {
+	if size > MinSizeLuks {
+		if rv, err := IdentifyLuks(f); rv != nil || err != nil {
+			return rv, err
+		}
+	}
+
 	if size > MinSizeSquashfs {
 		if rv, err := IdentifySquashfs(f); rv != nil || err != nil {
 			return rv, err
@@ -44,6 +57,12 @@ func Identify(size int64, f io.ReaderAt) (*Filesystem, error) {
 		}
 	}
 
+	if size > MinSizeSwap {
+		if rv, err := IdentifySwap(f); rv != nil || err != nil {
+			return rv, err
+		}
+	}
+
 	if size > 0x10000+1000 {
 		if rv, err := IdentifyBtrfs(f); rv != nil || err != nil {
 			return rv, err
@@ -56,6 +75,13 @@ func Identify(size int64, f io.ReaderAt) (*Filesystem, error) {
 		}
 	}
 
+	// the boot sector signature is the weakest, a filesystem created over a fat filesystem may leave it intact
+	if size > MinSizeFat {
+		if rv, err := IdentifyFat(f); rv != nil || err != nil {
+			return rv, err
+		}
+	}
+
 	return nil, nil
 }
 
@@ -73,3 +99,22 @@ func readLabel(bs []byte) string {
 
 	return string(bs)
 }
+
+// featureNames... the names of the bits set in flags, unknown bits are named by their value
+func featureNames(flags uint64, names map[uint64]string) []string {
+	var rv []string
+
+	for bit := uint64(1); bit != 0 && bit <= flags; bit <<= 1 {
+		if flags&bit == 0 {
+			continue
+		}
+
+		if name, ok := names[bit]; ok {
+			rv = append(rv, name)
+		} else {
+			rv = append(rv, fmt.Sprintf("0x%x", bit))
+		}
+	}
+
+	return rv
+}
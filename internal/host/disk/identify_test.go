@@ -0,0 +1,365 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const mib = 1 << 20
+
+var testUUID = uuid.MustParse("6f1c1e0a-2b8e-4f7c-9a51-3d2e4b5c6d7e")
+
+// mkfsTool... the path of a mkfs tool, which is often in an sbin directory outside of PATH. The test is skipped if
+// the tool is not installed.
+func mkfsTool(t *testing.T, name string) string {
+	t.Helper()
+
+	if path, err := exec.LookPath(name); err == nil {
+		return path
+	}
+
+	for _, dir := range []string{"/usr/sbin", "/sbin", "/usr/local/sbin", "/opt/homebrew/sbin"} {
+		if path := filepath.Join(dir, name); isExecutable(path) {
+			return path
+		}
+	}
+
+	t.Skipf("%s is not installed", name)
+
+	return ""
+}
+
+func isExecutable(path string) bool {
+	stat, err := os.Stat(path)
+
+	return err == nil && stat.Mode().IsRegular() && stat.Mode().Perm()&0111 != 0
+}
+
+// makeImage... runs a mkfs tool on a sparse image of size bytes, the image path is appended to args unless one of the
+// arguments is the empty string, which is replaced by the path
+func makeImage(t *testing.T, size int64, tool string, args ...string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "disk.img")
+
+	if size > 0 {
+		file, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := file.Truncate(size); err != nil {
+			t.Fatal(err)
+		}
+
+		_ = file.Close()
+	}
+
+	if i := slices.Index(args, ""); i >= 0 {
+		args[i] = path
+	} else {
+		args = append(args, path)
+	}
+
+	if out, err := exec.Command(mkfsTool(t, tool), args...).CombinedOutput(); err != nil {
+		t.Fatalf("%s failed: %v\n%s", tool, err, out)
+	}
+
+	return path
+}
+
+func identifyImage(t *testing.T, path string) *Filesystem {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs, err := Identify(stat.Size(), file)
+	if err != nil {
+		t.Fatalf("Identify: %v", err)
+	}
+
+	if fs == nil {
+		t.Fatal("filesystem not identified")
+	}
+
+	return fs
+}
+
+func checkFeatures(t *testing.T, fs *Filesystem, want ...string) {
+	t.Helper()
+
+	for _, feature := range want {
+		if !slices.Contains(fs.Features, feature) {
+			t.Errorf("features %v do not include %s", fs.Features, feature)
+		}
+	}
+}
+
+func checkCreated(t *testing.T, fs *Filesystem) {
+	t.Helper()
+
+	if since := time.Since(fs.Created); since < -time.Minute || since > time.Hour {
+		t.Errorf("created = %v, want about now", fs.Created)
+	}
+}
+
+func TestIdentifyExt4(t *testing.T) {
+	path := makeImage(t, 64*mib, "mkfs.ext4", "-q", "-F", "-b", "4096", "-i", "16384", "-I", "256", "-L", "data",
+		"-U", testUUID.String())
+	fs := identifyImage(t, path)
+
+	if fs.Type != FSext || fs.Id != testUUID || fs.Label != "data" {
+		t.Errorf("identified %s %s %q", fs.Type, fs.Id, fs.Label)
+	}
+
+	if fs.Size != 64*mib || fs.BlockSize != 4096 {
+		t.Errorf("size = %d, block size = %d", fs.Size, fs.BlockSize)
+	}
+
+	if fs.Free <= 0 || fs.Free >= fs.Size {
+		t.Errorf("free = %d of %d", fs.Free, fs.Size)
+	}
+
+	// one inode per 16KB, of which the first 11 are reserved
+	if fs.MaxFiles != 4096 || fs.FreeFiles != 4085 {
+		t.Errorf("inodes = %d, free inodes = %d", fs.MaxFiles, fs.FreeFiles)
+	}
+
+	checkFeatures(t, fs, "has_journal", "extent", "filetype")
+	checkCreated(t, fs)
+}
+
+func TestIdentifyXfs(t *testing.T) {
+	path := makeImage(t, 320*mib, "mkfs.xfs", "-q", "-f", "-b", "size=4096", "-i", "maxpct=25", "-L", "data",
+		"-m", "uuid="+testUUID.String())
+	fs := identifyImage(t, path)
+
+	if fs.Type != FSxfs || fs.Id != testUUID || fs.Label != "data" {
+		t.Errorf("identified %s %s %q", fs.Type, fs.Id, fs.Label)
+	}
+
+	if fs.Size != 320*mib || fs.BlockSize != 4096 {
+		t.Errorf("size = %d, block size = %d", fs.Size, fs.BlockSize)
+	}
+
+	if fs.Free <= 0 || fs.Free >= fs.Size {
+		t.Errorf("free = %d of %d", fs.Free, fs.Size)
+	}
+
+	// inodes may use a quarter of the data blocks, at the default inode size of 512 bytes
+	if want := uint64(320*mib/4096) * 25 / 100 * 8; fs.MaxFiles != want {
+		t.Errorf("max files = %d, want %d", fs.MaxFiles, want)
+	}
+
+	if fs.FreeFiles == 0 || fs.FreeFiles >= fs.MaxFiles {
+		t.Errorf("free files = %d of %d", fs.FreeFiles, fs.MaxFiles)
+	}
+
+	checkFeatures(t, fs, "crc", "finobt", "ftype")
+
+	if err := CheckResize("data", string(FSxfs), fs, fs.Size+64*mib); err != nil {
+		t.Errorf("growing: %v", err)
+	}
+
+	if err := CheckResize("data", string(FSxfs), fs, fs.Size-64*mib); err == nil {
+		t.Error("shrinking an xfs filesystem was allowed")
+	}
+}
+
+// TestIdentifyXfsSuperblock... the fields of the xfs superblock are big-endian, unlike the other filesystems, a
+// superblock read in the wrong byte order would report sizes that let CheckResize accept a shrink
+func TestIdentifyXfsSuperblock(t *testing.T) {
+	superblock := make([]byte, 512)
+
+	copy(superblock[0x0:0x4], "XFSB")
+	binary.BigEndian.PutUint32(superblock[0x4:0x8], 4096)      // block size
+	binary.BigEndian.PutUint64(superblock[0x8:0x10], 0x20000)  // data blocks, 512MB
+	copy(superblock[0x20:0x30], testUUID[:])                   // uuid
+	binary.BigEndian.PutUint16(superblock[0x64:0x66], 0xB4A5)  // version 5 with feature bits
+	binary.BigEndian.PutUint16(superblock[0x68:0x6A], 512)     // inode size
+	copy(superblock[0x6C:0x78], "data")                        // label
+	superblock[0x7F] = 25                                      // imax_pct
+	binary.BigEndian.PutUint64(superblock[0x80:0x88], 64)      // allocated inodes
+	binary.BigEndian.PutUint64(superblock[0x88:0x90], 61)      // free inodes
+	binary.BigEndian.PutUint64(superblock[0x90:0x98], 0x18000) // free blocks, 384MB
+	binary.BigEndian.PutUint32(superblock[0xD4:0xD8], 0x1)     // finobt
+	binary.BigEndian.PutUint32(superblock[0xD8:0xDC], 0x3)     // ftype, sparse
+
+	image := make([]byte, 64*1024)
+	copy(image, superblock)
+
+	fs, err := Identify(int64(len(image)), bytes.NewReader(image))
+	if err != nil || fs == nil {
+		t.Fatalf("Identify = %v, %v", fs, err)
+	}
+
+	if fs.Type != FSxfs || fs.Id != testUUID || fs.Label != "data" {
+		t.Errorf("identified %s %s %q", fs.Type, fs.Id, fs.Label)
+	}
+
+	if fs.BlockSize != 4096 || fs.Size != 512*mib || fs.Free != 384*mib {
+		t.Errorf("block size = %d, size = %d, free = %d", fs.BlockSize, fs.Size, fs.Free)
+	}
+
+	if want := uint64(0x20000) * 25 / 100 * 8; fs.MaxFiles != want || fs.FreeFiles != want-3 {
+		t.Errorf("max files = %d, free files = %d, want %d and %d", fs.MaxFiles, fs.FreeFiles, want, want-3)
+	}
+
+	if want := []string{"crc", "finobt", "ftype", "sparse"}; !slices.Equal(fs.Features, want) {
+		t.Errorf("features = %v, want %v", fs.Features, want)
+	}
+
+	if err := CheckResize("data", string(FSxfs), fs, 1024*mib); err != nil {
+		t.Errorf("growing: %v", err)
+	}
+
+	if err := CheckResize("data", string(FSxfs), fs, 256*mib); err == nil {
+		t.Error("shrinking an xfs filesystem was allowed")
+	}
+}
+
+func TestIdentifyBtrfs(t *testing.T) {
+	path := makeImage(t, 256*mib, "mkfs.btrfs", "-q", "-f", "-L", "data", "-U", testUUID.String())
+	fs := identifyImage(t, path)
+
+	if fs.Type != FSbtrfs || fs.Id != testUUID || fs.Label != "data" {
+		t.Errorf("identified %s %s %q", fs.Type, fs.Id, fs.Label)
+	}
+
+	if fs.Size != 256*mib || fs.BlockSize != 4096 {
+		t.Errorf("size = %d, block size = %d", fs.Size, fs.BlockSize)
+	}
+
+	if fs.Free <= 0 || fs.Free >= fs.Size {
+		t.Errorf("free = %d of %d", fs.Free, fs.Size)
+	}
+
+	if fs.MaxFiles != 0 || fs.FreeFiles != 0 {
+		t.Errorf("inodes = %d, free inodes = %d, btrfs has no inode table", fs.MaxFiles, fs.FreeFiles)
+	}
+
+	checkFeatures(t, fs, "extended_iref", "skinny_metadata")
+
+	if err := CheckResize("data", string(FSbtrfs), fs, fs.Size-fs.Free); err == nil {
+		t.Error("shrinking below the used space was allowed")
+	}
+
+	if err := CheckResize("data", string(FSbtrfs), fs, fs.Size-fs.Free+64*mib); err != nil {
+		t.Errorf("shrinking above the used space: %v", err)
+	}
+}
+
+func TestIdentifyFat(t *testing.T) {
+	for _, bits := range []string{"12", "16", "32"} {
+		t.Run("FAT"+bits, func(t *testing.T) {
+			size := int64(64 * mib)
+			if bits == "12" {
+				size = 4 * mib
+			}
+
+			path := makeImage(t, size, "mkfs.vfat", "-F", bits, "-n", "DATA", "-i", "1234ABCD")
+			fs := identifyImage(t, path)
+
+			if fs.Type != FSfat || fs.Serial != "1234-ABCD" || fs.Label != "DATA" || fs.Id != uuid.Nil {
+				t.Errorf("identified %s %q %q %s", fs.Type, fs.Serial, fs.Label, fs.Id)
+			}
+
+			checkFeatures(t, fs, "FAT"+bits)
+
+			// Size is the data area, less than the image
+			if fs.Size <= 0 || fs.Size >= size || fs.Size%fs.BlockSize != 0 {
+				t.Errorf("size = %d, block size = %d", fs.Size, fs.BlockSize)
+			}
+
+			// an empty filesystem, FAT32 keeps its root directory in a cluster
+			used := int64(0)
+			if bits == "32" {
+				used = fs.BlockSize
+			}
+
+			if fs.Free != fs.Size-used {
+				t.Errorf("free = %d, want %d", fs.Free, fs.Size-used)
+			}
+		})
+	}
+}
+
+func TestIdentifySwap(t *testing.T) {
+	path := makeImage(t, 16*mib, "mkswap", "-L", "swap", "-U", testUUID.String())
+	fs := identifyImage(t, path)
+
+	if fs.Type != FSswap || fs.Id != testUUID || fs.Label != "swap" {
+		t.Errorf("identified %s %s %q", fs.Type, fs.Id, fs.Label)
+	}
+
+	if pageSize := int64(os.Getpagesize()); fs.BlockSize != pageSize || fs.Size != 16*mib {
+		t.Errorf("size = %d, page size = %d", fs.Size, fs.BlockSize)
+	}
+}
+
+func TestIdentifySquashfs(t *testing.T) {
+	src := t.TempDir()
+
+	for _, name := range []string{"a", "b", "dir/c"} {
+		path := filepath.Join(src, name)
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	before := time.Now().Add(-time.Second).Truncate(time.Second)
+	path := makeImage(t, 0, "mksquashfs", src, "", "-comp", "gzip", "-noappend", "-quiet")
+	fs := identifyImage(t, path)
+
+	if fs.Type != FSsquash {
+		t.Fatalf("identified %s", fs.Type)
+	}
+
+	// three files and two directories
+	if fs.MaxFiles != 5 || fs.FreeFiles != 0 || fs.Free != 0 {
+		t.Errorf("inodes = %d, free inodes = %d, free = %d", fs.MaxFiles, fs.FreeFiles, fs.Free)
+	}
+
+	if stat, err := os.Stat(path); err != nil || fs.Size <= 0 || fs.Size > stat.Size() {
+		t.Errorf("size = %d, image %v", fs.Size, stat)
+	}
+
+	if fs.BlockSize != 128*1024 {
+		t.Errorf("block size = %d", fs.BlockSize)
+	}
+
+	checkFeatures(t, fs, "gzip")
+
+	if fs.Created.Before(before) {
+		t.Errorf("created = %v, before %v", fs.Created, before)
+	}
+}
+
+func TestIdentifyBlank(t *testing.T) {
+	fs, err := Identify(mib, bytes.NewReader(make([]byte, mib)))
+	if fs != nil || err != nil {
+		t.Errorf("Identify = %v, %v on a blank image", fs, err)
+	}
+}
@@ -0,0 +1,94 @@
+package disk
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Image... a disk image as seen from the host, Filesystem is nil if the image has not been formatted
+type Image struct {
+	Label      string      `json:"label"`
+	Path       string      `json:"path"`
+	Mount      string      `json:"mount,omitempty"`
+	FS         string      `json:"fs"`
+	Size       int64       `json:"size"`      // logical size of the image file
+	Allocated  int64       `json:"allocated"` // bytes allocated on the host, less than Size for a sparse image
+	Exists     bool        `json:"exists"`
+	Mounted    bool        `json:"mounted"`
+	Filesystem *Filesystem `json:"filesystem,omitempty"`
+}
+
+// Inspect... reads the size, allocation and filesystem of an image file. A missing image is not an error, Exists
+// is false.
+func (img *Image) Inspect() error {
+	file, err := os.Open(img.Path)
+	if os.IsNotExist(err) {
+		img.Exists = false
+
+		return nil
+	} else if err != nil {
+		//nolint:wrapcheck
+		return err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", img.Path, err)
+	}
+
+	img.Exists = true
+	img.Size, img.Allocated = allocation(stat)
+
+	if img.Filesystem, err = Identify(img.Size, file); err != nil {
+		return fmt.Errorf("failed to identify filesystem in %s: %w", img.Path, err)
+	}
+
+	return nil
+}
+
+// CheckResize... refuses a resize that would lose data: shrinking below the space in use, shrinking xfs, which can
+// only grow, or resizing a filesystem without resize support
+func CheckResize(label, fstype string, result *Filesystem, size int64) error {
+	switch fstype {
+	case string(FSext), string(FSbtrfs), string(FSxfs):
+	default:
+		return fmt.Errorf("disk %s: resizing %s filesystems is not supported, restore the size %d", label, fstype, result.Size)
+	}
+
+	if size >= result.Size {
+		return nil
+	}
+
+	if fstype == string(FSxfs) {
+		return fmt.Errorf("disk %s: xfs filesystems cannot be shrunk from %d to %d bytes", label, result.Size, size)
+	}
+
+	if used := result.Size - result.Free; size <= used {
+		return fmt.Errorf("disk %s: cannot shrink to %d bytes, %d bytes are in use", label, size, used)
+	}
+
+	return nil
+}
+
+// Allocation... the logical size of an image file and the bytes allocated to it, which is less for a sparse file
+func Allocation(path string) (size int64, allocated int64, err error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		//nolint:wrapcheck
+		return 0, 0, err
+	}
+
+	size, allocated = allocation(stat)
+
+	return size, allocated, nil
+}
+
+func allocation(stat os.FileInfo) (int64, int64) {
+	if sys, ok := stat.Sys().(*syscall.Stat_t); ok {
+		return stat.Size(), sys.Blocks * 512 // st_blocks is in 512 byte units on Linux and macOS
+	}
+
+	return stat.Size(), stat.Size()
+}
@@ -0,0 +1,41 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/google/uuid"
+)
+
+const MinSizeLuks = 4096
+
+const luksHeaderSize = 0xD0
+
+var luksMagic = []byte{'L', 'U', 'K', 'S', 0xBA, 0xBE}
+
+// IdentifyLuks... a LUKS header hides the filesystem inside it, so only the UUID, the label of a LUKS2 header and the
+// version are known. Size and Free are zero.
+func IdentifyLuks(file io.ReaderAt) (*Filesystem, error) {
+	header := make([]byte, luksHeaderSize)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return nil, fmt.Errorf("failed to read LUKS header: %w", err)
+	} else if !bytes.Equal(header[:len(luksMagic)], luksMagic) {
+		return nil, nil
+	}
+
+	version := binary.BigEndian.Uint16(header[0x6:0x8])
+	p := Filesystem{Type: FSluks, Features: []string{fmt.Sprintf("luks%d", version)}}
+
+	// the UUID is stored as text in both versions
+	if id, err := uuid.Parse(readLabel(header[0xA8:0xD0])); err == nil {
+		p.Id = id
+	}
+
+	if version == 2 {
+		p.Label = readLabel(header[0x18:0x48])
+	}
+
+	return &p, nil
+}
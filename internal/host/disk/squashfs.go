@@ -4,17 +4,72 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"time"
 )
 
 const MinSizeSquashfs = 4
 
+const squashfsSuperblockSize = 96
+
+var squashfsCompression = map[uint16]string{
+	1: "gzip",
+	2: "lzma",
+	3: "lzo",
+	4: "xz",
+	5: "lz4",
+	6: "zstd",
+}
+
+var squashfsFlags = map[uint64]string{
+	0x1:   "uncompressed_inodes",
+	0x2:   "uncompressed_data",
+	0x4:   "check",
+	0x8:   "uncompressed_fragments",
+	0x10:  "no_fragments",
+	0x20:  "always_fragments",
+	0x40:  "duplicates",
+	0x80:  "exportable",
+	0x100: "uncompressed_xattrs",
+	0x200: "no_xattrs",
+	0x400: "compressor_options",
+	0x800: "uncompressed_ids",
+}
+
+// IdentifySquashfs... squashfs is read-only, so Free and FreeFiles are always zero and Size is the bytes used by the
+// image. The modification time in the superblock is when the image was built, which is reported as Created.
 func IdentifySquashfs(file io.ReaderAt) (*Filesystem, error) {
 	magic := make([]byte, 4)
 	if _, err := file.ReadAt(magic, 0); err != nil {
 		return nil, fmt.Errorf("failed to read paritition magic: %w", err)
-	} else if binary.LittleEndian.Uint32(magic) == squashfsMagic {
-		return &Filesystem{Type: FSsquash}, nil
+	} else if binary.LittleEndian.Uint32(magic) != squashfsMagic {
+		return nil, nil
+	}
+
+	superblock := make([]byte, squashfsSuperblockSize)
+	if _, err := file.ReadAt(superblock, 0); err != nil {
+		return nil, fmt.Errorf("failed to read superblock: %w", err)
 	}
 
-	return nil, nil
+	p := Filesystem{
+		Type:      FSsquash,
+		BlockSize: int64(binary.LittleEndian.Uint32(superblock[0xC:0x10])),
+		MaxFiles:  uint64(binary.LittleEndian.Uint32(superblock[0x4:0x8])),
+		//nolint:gosec
+		Size: int64(binary.LittleEndian.Uint64(superblock[0x28:0x30])),
+	}
+
+	if mtime := binary.LittleEndian.Uint32(superblock[0x8:0xC]); mtime != 0 {
+		p.Created = time.Unix(int64(mtime), 0).UTC()
+	}
+
+	compression := binary.LittleEndian.Uint16(superblock[0x14:0x16])
+	if name, ok := squashfsCompression[compression]; ok {
+		p.Features = append(p.Features, name)
+	} else {
+		p.Features = append(p.Features, fmt.Sprintf("compression=%d", compression))
+	}
+
+	p.Features = append(p.Features, featureNames(uint64(binary.LittleEndian.Uint16(superblock[0x18:0x1A])), squashfsFlags)...)
+
+	return &p, nil
 }
@@ -0,0 +1,50 @@
+package disk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const MinSizeSwap = 4096
+
+// swapPageSizes... the swap header fills the first page, with the magic in its last 10 bytes, so the page size of the
+// kernel that created it is found by probing each supported size
+var swapPageSizes = []int64{4096, 16384, 65536}
+
+func IdentifySwap(file io.ReaderAt) (*Filesystem, error) {
+	magic := make([]byte, 10)
+
+	for _, pageSize := range swapPageSizes {
+		if _, err := file.ReadAt(magic, pageSize-10); err != nil {
+			if err == io.EOF {
+				return nil, nil
+			}
+
+			return nil, fmt.Errorf("failed to read swap signature: %w", err)
+		}
+
+		if string(magic) != "SWAPSPACE2" {
+			continue
+		}
+
+		// struct swap_header_v1_2, following 1024 bytes of boot block
+		header := make([]byte, 44)
+
+		if _, err := file.ReadAt(header, 1024); err != nil {
+			return nil, fmt.Errorf("failed to read swap header: %w", err)
+		}
+
+		lastPage := int64(binary.LittleEndian.Uint32(header[0x4:0x8]))
+
+		return &Filesystem{
+			Type:      FSswap,
+			Id:        readFilesystemId(header, 0xC),
+			Label:     readLabel(header[0x1C:0x2C]),
+			Size:      (lastPage + 1) * pageSize,
+			BlockSize: pageSize,
+		}, nil
+	}
+
+	return nil, nil
+}
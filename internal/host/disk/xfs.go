@@ -8,6 +8,28 @@ import (
 
 const MinSizeXfs = 512
 
+const xfsVersion5 = 5
+
+var xfsROCompatFeatures = map[uint64]string{
+	0x1: "finobt",
+	0x2: "rmapbt",
+	0x4: "reflink",
+	0x8: "inobtcount",
+}
+
+var xfsIncompatFeatures = map[uint64]string{
+	0x1:  "ftype",
+	0x2:  "sparse",
+	0x4:  "meta_uuid",
+	0x8:  "bigtime",
+	0x10: "needsrepair",
+	0x20: "nrext64",
+	0x40: "exchange",
+	0x80: "parent",
+}
+
+// IdentifyXfs... the superblock is big-endian. XFS does not record a creation time, and allocates inodes dynamically
+// up to imax_pct of the data blocks, which is reported as MaxFiles.
 func IdentifyXfs(file io.ReaderAt) (*Filesystem, error) {
 	superblock := make([]byte, 512)
 
@@ -25,11 +47,33 @@ func IdentifyXfs(file io.ReaderAt) (*Filesystem, error) {
 		Label: readLabel(superblock[0x6C:0x78]),
 	}
 
-	sbBlocksize := binary.LittleEndian.Uint32(superblock[0x4:0x8])
+	blockSize := uint64(binary.BigEndian.Uint32(superblock[0x4:0x8]))
+	dataBlocks := binary.BigEndian.Uint64(superblock[0x8:0x10])
+	inodeSize := uint64(binary.BigEndian.Uint16(superblock[0x68:0x6A]))
+	imaxPct := uint64(superblock[0x7F])
+	inodes := binary.BigEndian.Uint64(superblock[0x80:0x88])
+	freeInodes := binary.BigEndian.Uint64(superblock[0x88:0x90])
+	freeBlocks := binary.BigEndian.Uint64(superblock[0x90:0x98])
+
+	//nolint:gosec
+	p.BlockSize = int64(blockSize)
 	//nolint:gosec
-	sbDblocks := int64(binary.LittleEndian.Uint64(superblock[0x10:0x18]))
+	p.Size = int64(blockSize * dataBlocks)
+	//nolint:gosec
+	p.Free = int64(blockSize * freeBlocks)
+
+	if inodeSize > 0 && imaxPct > 0 {
+		p.MaxFiles = dataBlocks * imaxPct / 100 * (blockSize / inodeSize)
+	}
 
-	p.Size = int64(sbBlocksize) * sbDblocks
+	if used := inodes - freeInodes; p.MaxFiles > used {
+		p.FreeFiles = p.MaxFiles - used
+	}
+
+	if binary.BigEndian.Uint16(superblock[0x64:0x66])&0xF == xfsVersion5 {
+		p.Features = append([]string{"crc"}, featureNames(uint64(binary.BigEndian.Uint32(superblock[0xD4:0xD8])), xfsROCompatFeatures)...)
+		p.Features = append(p.Features, featureNames(uint64(binary.BigEndian.Uint32(superblock[0xD8:0xDC])), xfsIncompatFeatures)...)
+	}
 
 	return &p, nil
 }
@@ -34,7 +34,9 @@ func newBlockDevice(path string, readOnly bool, cache vz.DiskImageCachingMode, s
 	return cfg, nil
 }
 
-func (vm *VirtualMachine) prepareDisks() error {
+// prepareDisks... a size set with the disk resize command takes precedence over the configured size, as long as the
+// configured size has not changed since
+func (vm *VirtualMachine) prepareDisks(sizes map[string]DiskState) error {
 	log.Debugf("root disk: %s", vm.Layout.Root)
 
 	rootImage, err := newBlockDevice(vm.Layout.Root.Resolved, true, vz.DiskImageCachingModeCached, vz.DiskImageSynchronizationModeNone)
@@ -48,7 +50,11 @@ func (vm *VirtualMachine) prepareDisks() error {
 
 	for _, label := range util.SortKeys(vm.Layout.Disks) {
 		diskInfo := vm.Layout.Disks[label]
-		if diskInfo.Mount == "" {
+		swap := diskInfo.FS == string(disk.FSswap)
+
+		overlay := label == vm.Layout.Overlay.Disk
+
+		if diskInfo.Mount == "" && !swap && !overlay {
 			continue
 		}
 
@@ -63,11 +69,17 @@ func (vm *VirtualMachine) prepareDisks() error {
 			}
 		}
 
+		if override, ok := sizes[label]; ok && override.ConfigSize == diskInfo.Size {
+			size = override.Size
+		}
+
 		var fsIdentify func() (*disk.Filesystem, error)
 
 		stat, err := os.Stat(diskInfo.Path.Resolved)
 		if size == 0 && err == nil {
+			// an existing image without a configured size keeps the size it was created with
 			size = stat.Size()
+		} else if size == 0 && errors.Is(err, os.ErrNotExist) {
 			fsIdentify = func() (*disk.Filesystem, error) {
 				return nil, nil
 			}
@@ -87,6 +99,11 @@ func (vm *VirtualMachine) prepareDisks() error {
 			}
 		} else if err != nil {
 			return fmt.Errorf("failed to stat disk %s: %w", label, err)
+		} else if swap && stat.Size() > size {
+			// swap is formatted again on resize, the contents do not survive a reboot anyway
+			if err := setFileSize(diskInfo.Path.Resolved, size); err != nil {
+				return fmt.Errorf("failed to truncate disk %s: %w", label, err)
+			}
 		}
 
 		if fsIdentify == nil {
@@ -100,6 +117,19 @@ func (vm *VirtualMachine) prepareDisks() error {
 
 		device := fmt.Sprintf("/dev/vd%c", 'a'+len(vm.storages))
 		vm.storages = append(vm.storages, dev)
+
+		if vm.devices == nil {
+			vm.devices = map[string]string{}
+		}
+
+		vm.devices[label] = device
+
+		if overlay {
+			vm.overlayDisk = &overlayDisk{label: label, info: diskInfo, device: device, size: size, identify: fsIdentify}
+
+			continue
+		}
+
 		mounted := false
 
 		dm := diskMount{
@@ -110,26 +140,30 @@ func (vm *VirtualMachine) prepareDisks() error {
 					return fmt.Errorf("failed to identify filesystem: %w", err)
 				}
 
-				if result == nil || string(result.Type) != diskInfo.FS {
-					progname := "mkfs." + diskInfo.FS
-					args := append([]string{progname, "-L", label}, diskInfo.FormatOptions...)
-					args = append(args, device)
+				if swap {
+					return vm.enableSwap(label, device, size, result, diskInfo.Options)
+				}
 
-					// mkfs
-					cmd := rpc.Command{Path: "/sbin/" + progname, Args: args}
+				if diskInfo.Encrypt {
+					return vm.mountEncrypted(label, diskInfo, device, size, result)
+				}
 
-					if out, err := vm.Run(cmd); err != nil {
-						return fmt.Errorf("failed to run mkfs: %w", err)
-					} else if out.Exit != 0 {
-						return fmt.Errorf("mkfs failed: %s", out.Output)
+				if result == nil || string(result.Type) != diskInfo.FS {
+					if err := vm.mkfs(label, diskInfo, device); err != nil {
+						return err
 					}
 
 					metrics := event.DiskMetrics{Total: uint64(size), Free: uint64(size)}
 					vm.setDiskMetrics(diskInfo.Mount, metrics)
 				} else if size != result.Size && size != 0 {
+					if err := disk.CheckResize(label, diskInfo.FS, result, size); err != nil {
+						return err
+					}
+
 					log.Infof("resizing filesystem %s from %d to %d", diskInfo.Mount, result.Size, size)
 
-					if diskInfo.FS == "ext4" {
+					switch diskInfo.FS {
+					case string(disk.FSext):
 						cmd := rpc.Command{Path: "/sbin/e2fsck", Args: []string{"e2fsck", "-f", "-y", device}}
 						if out, err := vm.Run(cmd); err != nil {
 							return fmt.Errorf("failed to run e2fsck: %w", err)
@@ -150,7 +184,7 @@ func (vm *VirtualMachine) prepareDisks() error {
 								return fmt.Errorf("failed to truncate disk %s: %w", label, err)
 							}
 						}
-					} else if diskInfo.FS == "btrfs" {
+					case string(disk.FSbtrfs):
 						// mount the filesystem
 						if err := vm.Mount(device, diskInfo.Mount, diskInfo.FS, diskInfo.Options); err != nil {
 							return fmt.Errorf("failed to mount %s: %w", diskInfo.Mount, err)
@@ -170,6 +204,20 @@ func (vm *VirtualMachine) prepareDisks() error {
 								return fmt.Errorf("failed to truncate disk %s: %w", label, err)
 							}
 						}
+					case string(disk.FSxfs):
+						// xfs only grows, online
+						if err := vm.Mount(device, diskInfo.Mount, diskInfo.FS, diskInfo.Options); err != nil {
+							return fmt.Errorf("failed to mount %s: %w", diskInfo.Mount, err)
+						}
+
+						mounted = true
+						cmd := rpc.Command{Path: "/usr/sbin/xfs_growfs", Args: []string{"xfs_growfs", diskInfo.Mount}}
+
+						if out, err := vm.Run(cmd); err != nil {
+							return fmt.Errorf("failed to run xfs_growfs: %w", err)
+						} else if out.Exit != 0 {
+							return fmt.Errorf("xfs_growfs failed: %s", out.Output)
+						}
 					}
 
 					metrics := event.DiskMetrics{
@@ -213,6 +261,50 @@ func (vm *VirtualMachine) prepareDisks() error {
 	return nil
 }
 
+// mkfs... formats a device with the filesystem of a disk, labelled with the disk label
+func (vm *VirtualMachine) mkfs(label string, info *config.DiskImage, device string) error {
+	if out, err := vm.Run(mkfsCommand(label, info, device)); err != nil {
+		return fmt.Errorf("failed to run mkfs: %w", err)
+	} else if out.Exit != 0 {
+		return fmt.Errorf("mkfs failed: %s", out.Output)
+	}
+
+	return nil
+}
+
+func mkfsCommand(label string, info *config.DiskImage, device string) rpc.Command {
+	progname := "mkfs." + info.FS
+	args := append([]string{progname, "-L", label}, info.FormatOptions...)
+	args = append(args, device)
+
+	return rpc.Command{Path: "/sbin/" + progname, Args: args}
+}
+
+// swapResizeSlack... a swap header covers whole pages, so it may be smaller than the device by up to the largest page
+// size without the device having been resized
+const swapResizeSlack = 64 * 1024
+
+// enableSwap... formats the device with mkswap unless it already has a swap header for its size, and enables it
+func (vm *VirtualMachine) enableSwap(label, device string, size int64, result *disk.Filesystem, options []string) error {
+	if result == nil || result.Type != disk.FSswap || (size != 0 && (result.Size > size || size-result.Size >= swapResizeSlack)) {
+		cmd := rpc.Command{Path: "/sbin/mkswap", Args: []string{"mkswap", "-L", label, device}}
+
+		if out, err := vm.Run(cmd); err != nil {
+			return fmt.Errorf("failed to run mkswap: %w", err)
+		} else if out.Exit != 0 {
+			return fmt.Errorf("mkswap failed: %s", out.Output)
+		}
+	}
+
+	if err := vm.Mount(device, "", string(disk.FSswap), options); err != nil {
+		return fmt.Errorf("failed to enable swap on %s: %w", label, err)
+	}
+
+	log.Infof("enabled swap %s on %s", label, device)
+
+	return nil
+}
+
 func (vm *VirtualMachine) setDiskMetrics(mountpoint string, metrics event.DiskMetrics) {
 	vm.mutex.Lock()
 	defer vm.mutex.Unlock()
@@ -315,3 +407,23 @@ func disableBackup(path string) error {
 func enableBackup(path string) error {
 	return unix.Removexattr(path, timeMachieBackupXattr)
 }
+
+// enableZram... configures the zram swap device of the layout, if any
+func (vm *VirtualMachine) enableZram() error {
+	if vm.Layout.Zram == nil {
+		return nil
+	}
+
+	size, err := vm.Layout.Zram.Bytes(vm.Layout.Ram)
+	if err != nil {
+		return err
+	}
+
+	req := rpc.ZramRequest{Size: size, Algorithm: vm.Layout.Zram.Algorithm, Priority: vm.Layout.Zram.Priority}
+
+	if err := vm.client.Zram(req, nil); err != nil {
+		return fmt.Errorf("failed to enable zram: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+package host
+
+import (
+	"context"
+
+	"github.com/amadigan/macoby/internal/event"
+	"github.com/amadigan/macoby/internal/util"
+)
+
+// checkDiskAlerts... compares the disk metrics from the guest to the alert thresholds of each disk, a disk-low event is
+// emitted when a disk crosses them in either direction
+func (vm *VirtualMachine) checkDiskAlerts(ctx context.Context, disks map[string]event.DiskMetrics) {
+	for _, label := range util.SortKeys(vm.Layout.Disks) {
+		info := vm.Layout.Disks[label]
+
+		metrics, ok := disks[info.Mount]
+		if !ok || info.Mount == "" || info.Alert == nil {
+			continue
+		}
+
+		space, inodes, err := info.Alert.Low(metrics.Total, metrics.Free, metrics.MaxFiles, metrics.FreeFiles)
+		if err != nil {
+			log.Warnf("disk %s: %v", label, err)
+
+			continue
+		}
+
+		low := event.DiskLow{Label: label, Mount: info.Mount, LowSpace: space, LowInodes: inodes, Disk: metrics}
+
+		vm.mutex.Lock()
+		last := vm.lowDisks[label]
+		changed := last.LowSpace != space || last.LowInodes != inodes
+
+		if changed {
+			if vm.lowDisks == nil {
+				vm.lowDisks = map[string]event.DiskLow{}
+			}
+
+			vm.lowDisks[label] = low
+		}
+		vm.mutex.Unlock()
+
+		if !changed {
+			continue
+		}
+
+		if space || inodes {
+			log.Warnf("disk %s is low: %d of %d bytes and %d of %d inodes free", label, metrics.Free, metrics.Total,
+				metrics.FreeFiles, metrics.MaxFiles)
+		} else {
+			log.Infof("disk %s has recovered: %d of %d bytes free", label, metrics.Free, metrics.Total)
+		}
+
+		event.Emit(ctx, low)
+	}
+}
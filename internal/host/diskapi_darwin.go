@@ -0,0 +1,247 @@
+package host
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/amadigan/macoby/internal/event"
+	"github.com/amadigan/macoby/internal/host/config"
+	"github.com/amadigan/macoby/internal/host/disk"
+	"github.com/amadigan/macoby/internal/util"
+)
+
+// DiskResizeRequest... the body of POST /disks/{label}/resize, the size is in the format of the configuration file
+type DiskResizeRequest struct {
+	Size string `json:"size"`
+}
+
+func (c *ControlServer) handleDisks(w http.ResponseWriter, _ *http.Request) {
+	imgs, err := DiskImages(c.Layout)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	for _, img := range imgs {
+		c.liveDiskUsage(img)
+	}
+
+	writeJSON(w, http.StatusOK, imgs)
+}
+
+func (c *ControlServer) handleDisk(w http.ResponseWriter, r *http.Request) {
+	img, ok := c.diskImage(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, img)
+}
+
+func (c *ControlServer) handleDiskResize(w http.ResponseWriter, r *http.Request) {
+	img, ok := c.diskImage(w, r)
+	if !ok {
+		return
+	}
+
+	var req DiskResizeRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid resize request: %v", err), http.StatusBadRequest)
+
+		return
+	}
+
+	change, err := ParseDiskChange(img, req.Size, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	c.scheduleDiskChange(change)
+	writeJSON(w, http.StatusAccepted, img)
+}
+
+func (c *ControlServer) handleDiskPurge(w http.ResponseWriter, r *http.Request) {
+	img, ok := c.diskImage(w, r)
+	if !ok {
+		return
+	}
+
+	change, _ := ParseDiskChange(img, "", true)
+
+	c.scheduleDiskChange(change)
+	writeJSON(w, http.StatusAccepted, img)
+}
+
+// handleDiskTrim... trims all writable disks and returns the result for each mount point
+func (c *ControlServer) handleDiskTrim(w http.ResponseWriter, _ *http.Request) {
+	if c.vm == nil || c.vm.Status() != event.StatusReady {
+		http.Error(w, "the VM is not running", http.StatusServiceUnavailable)
+
+		return
+	}
+
+	results, err := c.vm.Trim()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, results)
+}
+
+// handlePrune... prunes docker data with the configured prune policy, or everything unused if there is none. With
+// dry-run=true, only reports what would be removed.
+func (c *ControlServer) handlePrune(w http.ResponseWriter, r *http.Request) {
+	if c.vm == nil || c.vm.Status() != event.StatusReady {
+		http.Error(w, "the VM is not running", http.StatusServiceUnavailable)
+
+		return
+	}
+
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry-run"))
+
+	var policy config.PrunePolicy
+
+	if c.Layout.Prune != nil {
+		policy = *c.Layout.Prune
+	}
+
+	report, err := c.vm.Prune(r.Context(), policy, dryRun)
+	if errors.Is(err, ErrDockerNotReady) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	report.Reason = "request"
+	logPruneReport(report)
+	writeJSON(w, http.StatusOK, report)
+}
+
+func (c *ControlServer) diskImage(w http.ResponseWriter, r *http.Request) (*disk.Image, bool) {
+	label := r.PathValue("label")
+
+	if _, ok := c.Layout.Disks[label]; !ok {
+		http.Error(w, "no such disk: "+label, http.StatusNotFound)
+
+		return nil, false
+	}
+
+	img, err := DiskImage(c.Layout, label)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return nil, false
+	}
+
+	c.liveDiskUsage(img)
+
+	return img, true
+}
+
+// liveDiskUsage... the superblock of a mounted filesystem is not kept up to date, the usage reported by the guest is
+// used instead
+func (c *ControlServer) liveDiskUsage(img *disk.Image) {
+	if c.vm == nil || img.Mount == "" || c.vm.Status() != event.StatusReady {
+		return
+	}
+
+	metrics, ok := c.vm.Metrics().Disks[img.Mount]
+	if !ok {
+		return
+	}
+
+	img.Mounted = true
+
+	if fs := img.Filesystem; fs != nil {
+		fs.Size = util.Int64(metrics.Total)
+		fs.Free = util.Int64(metrics.Free)
+		fs.MaxFiles = metrics.MaxFiles
+		fs.FreeFiles = metrics.FreeFiles
+	}
+}
+
+// scheduleDiskChange... queues a change to apply once the VM has stopped, and asks the daemon to stop. The client
+// restarts the daemon once it has exited. Until the change is applied, the daemon state records it as an error, so a
+// daemon that fails to stop does not report success.
+func (c *ControlServer) scheduleDiskChange(change DiskChange) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	log.Infof("scheduled disk change: %s", change)
+
+	if len(c.diskChanges) == 0 {
+		close(c.restart)
+	}
+
+	c.diskChanges = append(c.diskChanges, change)
+
+	pending := make(map[string]string, len(c.diskChanges))
+
+	for _, change := range c.diskChanges {
+		pending[change.Label] = fmt.Sprintf("the daemon stopped before it could %s", change)
+	}
+
+	c.vm.UpdateState(DaemonState{DiskErrors: pending})
+}
+
+// Restart... closed when the daemon should stop to apply disk changes
+func (c *ControlServer) Restart() <-chan struct{} {
+	return c.restart
+}
+
+// ApplyDiskChanges... applies the scheduled disk changes, the VM must have been shut down. The changes that failed are
+// recorded in the daemon state, for the client waiting on the daemon to exit.
+func (c *ControlServer) ApplyDiskChanges(ctx context.Context) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.diskChanges) == 0 {
+		return
+	}
+
+	c.vm.UpdateStatus(ctx, event.StatusModifying)
+
+	disks := c.diskStates
+	errs := map[string]string{}
+
+	for _, change := range c.diskChanges {
+		var err error
+		if disks, err = ApplyDiskChange(c.Layout, disks, change); err != nil {
+			log.Errorf("failed to %s: %v", change, err)
+
+			errs[change.Label] = fmt.Sprintf("failed to %s: %v", change, err)
+		}
+	}
+
+	c.diskStates = disks
+	c.diskChanges = nil
+	c.vm.UpdateState(DaemonState{Disks: disks, DiskErrors: errs})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(bs)))
+	w.WriteHeader(status)
+	_, _ = w.Write(bs)
+}
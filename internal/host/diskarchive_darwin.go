@@ -0,0 +1,93 @@
+package host
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/amadigan/macoby/internal/host/config"
+	"github.com/amadigan/macoby/internal/host/disk"
+	"github.com/amadigan/macoby/internal/util"
+)
+
+// ExportDisk... writes an archive of a disk image, the VM must not be running
+func ExportDisk(layout *config.Layout, label string, w io.Writer) (*disk.Manifest, error) {
+	img, err := DiskImage(layout, label)
+	if err != nil {
+		return nil, err
+	}
+
+	if img.FS == string(disk.FSswap) {
+		return nil, fmt.Errorf("disk %s is a swap disk, there is nothing to export", label)
+	} else if layout.Disks[label].Encrypt {
+		return nil, fmt.Errorf("disk %s is encrypted, it cannot be exported", label)
+	} else if !img.Exists {
+		return nil, fmt.Errorf("disk %s has not been created", label)
+	} else if img.Filesystem == nil || string(img.Filesystem.Type) != img.FS {
+		return nil, fmt.Errorf("disk %s does not hold a %s filesystem", label, img.FS)
+	}
+
+	//nolint:wrapcheck
+	return disk.Export(w, img, Version)
+}
+
+// ImportDisk... replaces a disk image with the image in an archive, the VM must not be running. The archive must hold
+// the filesystem the disk is configured with. If the disk cannot be resized to its configured size, the imported size
+// is recorded in the daemon state, as if the disk had been resized to it.
+func ImportDisk(layout *config.Layout, disks map[string]DiskState, label string, r io.Reader) (*disk.Manifest, map[string]DiskState, error) {
+	info, ok := layout.Disks[label]
+	if !ok {
+		return nil, disks, fmt.Errorf("no such disk: %s", label)
+	} else if info.FS == string(disk.FSswap) {
+		return nil, disks, fmt.Errorf("disk %s is a swap disk, it cannot be imported", label)
+	} else if info.Encrypt {
+		return nil, disks, fmt.Errorf("disk %s is encrypted, it cannot be imported", label)
+	} else if info.Path == nil || info.Path.Resolved == "" {
+		return nil, disks, fmt.Errorf("disk %s has no image path", label)
+	}
+
+	var size int64
+
+	if info.Size != "" {
+		var err error
+		if size, err = config.ParseSize(info.Size); err != nil {
+			//nolint:wrapcheck
+			return nil, disks, err
+		}
+	}
+
+	if override, ok := disks[label]; ok && override.ConfigSize == info.Size {
+		size = override.Size
+	}
+
+	var keepSize bool
+
+	manifest, err := disk.Import(r, info.Path.Resolved, func(m *disk.Manifest) error {
+		if m.FS != info.FS {
+			return fmt.Errorf("archive holds a %s filesystem, disk %s is configured for %s", m.FS, label, info.FS)
+		}
+
+		keepSize = size != 0 && size != m.Size && disk.CheckResize(label, m.FS, m.Filesystem, size) != nil
+
+		return nil
+	})
+	if err != nil {
+		return nil, disks, fmt.Errorf("failed to import disk %s: %w", label, err)
+	}
+
+	if !info.Backup {
+		if err := disableBackup(info.Path.Resolved); err != nil {
+			log.Warnf("failed to disable backup for disk %s: %v", label, err)
+		}
+	}
+
+	disks = util.MapCopy(disks)
+
+	if keepSize {
+		disks[label] = DiskState{Size: manifest.Size, ConfigSize: info.Size}
+		log.Infof("disk %s cannot be resized to %d bytes, keeping the imported size %d", label, size, manifest.Size)
+	}
+
+	log.Infof("imported disk %s from %s archive of disk %s", label, manifest.Railyard, manifest.Label)
+
+	return manifest, disks, nil
+}
@@ -0,0 +1,136 @@
+package host
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/amadigan/macoby/internal/host/config"
+	"github.com/amadigan/macoby/internal/host/disk"
+	"github.com/amadigan/macoby/internal/util"
+)
+
+// DiskChange... a modification of a disk image that requires the VM to be stopped, see ApplyDiskChange
+type DiskChange struct {
+	Label   string
+	Purge   bool
+	Size    int64
+	Restore string // a snapshot restored before the VM stops, see ControlServer.RestoreSnapshots
+}
+
+// DiskImage... inspects the image of a configured disk
+func DiskImage(layout *config.Layout, label string) (*disk.Image, error) {
+	info, ok := layout.Disks[label]
+	if !ok {
+		return nil, fmt.Errorf("no such disk: %s", label)
+	}
+
+	img := &disk.Image{Label: label, Mount: info.Mount, FS: info.FS}
+
+	if info.Path != nil {
+		img.Path = info.Path.Resolved
+	}
+
+	if img.Path == "" {
+		return img, nil
+	}
+
+	if err := img.Inspect(); err != nil {
+		return nil, fmt.Errorf("failed to inspect disk %s: %w", label, err)
+	}
+
+	return img, nil
+}
+
+// DiskImages... inspects the images of all configured disks, sorted by label
+func DiskImages(layout *config.Layout) ([]*disk.Image, error) {
+	rv := make([]*disk.Image, 0, len(layout.Disks))
+
+	for _, label := range util.SortKeys(layout.Disks) {
+		img, err := DiskImage(layout, label)
+		if err != nil {
+			return nil, err
+		}
+
+		rv = append(rv, img)
+	}
+
+	return rv, nil
+}
+
+// ParseDiskChange... validates a resize or purge of a disk, a resize must not lose data in the filesystem
+func ParseDiskChange(img *disk.Image, size string, purge bool) (DiskChange, error) {
+	change := DiskChange{Label: img.Label, Purge: purge}
+
+	if purge {
+		return change, nil
+	}
+
+	var err error
+
+	if change.Size, err = config.ParseSize(size); err != nil {
+		//nolint:wrapcheck
+		return change, err
+	} else if change.Size <= 0 {
+		return change, fmt.Errorf("invalid disk size %s", size)
+	}
+
+	if fs := img.Filesystem; fs != nil && fs.Type == disk.FSluks && change.Size < img.Size {
+		return change, fmt.Errorf("disk %s is encrypted, it cannot be shrunk below %d bytes", img.Label, img.Size)
+	} else if fs != nil && img.FS != string(disk.FSswap) && string(fs.Type) == img.FS {
+		if err := disk.CheckResize(img.Label, img.FS, fs, change.Size); err != nil {
+			//nolint:wrapcheck
+			return change, err
+		}
+	}
+
+	return change, nil
+}
+
+// ApplyDiskChange... modifies a disk while the VM is stopped. A purge deletes the image, which is created again on the
+// next start. A resize is recorded in the daemon state and performed on the next start, when the filesystem can be
+// resized along with the image.
+func ApplyDiskChange(layout *config.Layout, disks map[string]DiskState, change DiskChange) (map[string]DiskState, error) {
+	info, ok := layout.Disks[change.Label]
+	if !ok {
+		return disks, fmt.Errorf("no such disk: %s", change.Label)
+	}
+
+	if change.Restore != "" {
+		// already restored in the guest
+		return disks, nil
+	}
+
+	disks = util.MapCopy(disks)
+
+	if change.Purge {
+		delete(disks, change.Label)
+
+		if info.Path == nil || info.Path.Resolved == "" {
+			return disks, nil
+		}
+
+		if err := os.Remove(info.Path.Resolved); err != nil && !os.IsNotExist(err) {
+			return disks, fmt.Errorf("failed to purge disk %s: %w", change.Label, err)
+		}
+
+		log.Infof("purged disk %s (%s)", change.Label, info.Path.Resolved)
+
+		return disks, nil
+	}
+
+	disks[change.Label] = DiskState{Size: change.Size, ConfigSize: info.Size}
+
+	log.Infof("disk %s will be resized to %d bytes", change.Label, change.Size)
+
+	return disks, nil
+}
+
+func (c DiskChange) String() string {
+	if c.Purge {
+		return "purge " + c.Label
+	} else if c.Restore != "" {
+		return fmt.Sprintf("restore %s to snapshot %s", c.Label, c.Restore)
+	}
+
+	return fmt.Sprintf("resize %s to %d bytes", c.Label, c.Size)
+}
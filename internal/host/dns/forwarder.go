@@ -0,0 +1,461 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amadigan/macoby/internal/applog"
+	"github.com/amadigan/macoby/internal/rpc"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var log = applog.New("dns")
+
+const (
+	defaultTTL      = 30
+	defaultTimeout  = 10 * time.Second
+	maxTXTString    = 255
+	ednsPayloadSize = 1232
+	maxInFlight     = 256
+)
+
+// Forwarder... answers DNS queries from the guest with a Go resolver. The default resolver uses the system resolver
+// on macOS, which includes the scoped resolvers configured by VPN clients. The resolver does not report TTLs, answers
+// use a fixed TTL instead.
+type Forwarder struct {
+	Resolver *net.Resolver // nil uses net.DefaultResolver
+	TTL      uint32
+	Timeout  time.Duration
+}
+
+// Serve... answers framed queries on the connection until it is closed, queries are answered concurrently. Once
+// maxInFlight queries are pending, no more queries are read until one is answered.
+func (f *Forwarder) Serve(conn net.Conn) {
+	defer conn.Close()
+
+	var mutex sync.Mutex
+
+	inFlight := make(chan struct{}, maxInFlight)
+
+	for {
+		query, err := rpc.ReadFrame(conn, nil)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Warnf("dns connection failed: %v", err)
+			}
+
+			return
+		}
+
+		inFlight <- struct{}{}
+
+		go func() {
+			defer func() { <-inFlight }()
+
+			ctx, cancel := context.WithTimeout(context.Background(), f.timeout())
+			defer cancel()
+
+			resp, err := f.Answer(ctx, query)
+			if err != nil {
+				log.Debugf("dropping dns query: %v", err)
+
+				return
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			if err := rpc.WriteFrame(conn, resp); err != nil {
+				log.Warnf("failed to write dns response: %v", err)
+			}
+		}()
+	}
+}
+
+// Answer... resolves a single query, returning the response message. An error is returned only if the query can not
+// be parsed well enough to respond to.
+func (f *Forwarder) Answer(ctx context.Context, query []byte) ([]byte, error) {
+	var parser dnsmessage.Parser
+
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dns message: %w", err)
+	}
+
+	if header.Response {
+		return nil, errors.New("unexpected dns response")
+	}
+
+	questions, err := parser.AllQuestions()
+	if err != nil {
+		return response(header, nil, false, dnsmessage.RCodeFormatError, nil)
+	}
+
+	edns := hasOPT(&parser)
+
+	if header.OpCode != 0 || len(questions) != 1 {
+		return response(header, questions, edns, dnsmessage.RCodeNotImplemented, nil)
+	}
+
+	question := questions[0]
+
+	if question.Class != dnsmessage.ClassINET && question.Class != dnsmessage.ClassANY {
+		return response(header, questions, edns, dnsmessage.RCodeNotImplemented, nil)
+	}
+
+	answers, err := f.lookup(ctx, question)
+	if err != nil {
+		return response(header, questions, edns, f.errorCode(ctx, question, err), nil)
+	}
+
+	ttl := f.TTL
+	if ttl == 0 {
+		ttl = defaultTTL
+	}
+
+	for i := range answers {
+		answers[i].Header = dnsmessage.ResourceHeader{
+			Name:  question.Name,
+			Type:  question.Type,
+			Class: dnsmessage.ClassINET,
+			TTL:   ttl,
+		}
+	}
+
+	return response(header, questions, edns, dnsmessage.RCodeSuccess, answers)
+}
+
+var errNotImplemented = errors.New("query type not implemented")
+
+func (f *Forwarder) lookup(ctx context.Context, question dnsmessage.Question) ([]dnsmessage.Resource, error) {
+	resolver := f.resolver()
+	name := question.Name.String()
+
+	var answers []dnsmessage.Resource
+
+	switch question.Type {
+	case dnsmessage.TypeA, dnsmessage.TypeAAAA:
+		addrs, err := resolver.LookupNetIP(ctx, "ip", name)
+		if err != nil {
+			//nolint:wrapcheck
+			return nil, err
+		}
+
+		for _, addr := range addrs {
+			addr = addr.Unmap()
+
+			if addr.Is4() && question.Type == dnsmessage.TypeA {
+				answers = append(answers, dnsmessage.Resource{Body: &dnsmessage.AResource{A: addr.As4()}})
+			} else if addr.Is6() && question.Type == dnsmessage.TypeAAAA {
+				answers = append(answers, dnsmessage.Resource{Body: &dnsmessage.AAAAResource{AAAA: addr.As16()}})
+			}
+		}
+	case dnsmessage.TypeCNAME:
+		cname, err := resolver.LookupCNAME(ctx, name)
+		if err != nil {
+			//nolint:wrapcheck
+			return nil, err
+		}
+
+		if !strings.EqualFold(cname, name) {
+			target, err := dnsmessage.NewName(cname)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cname %s: %w", cname, err)
+			}
+
+			answers = append(answers, dnsmessage.Resource{Body: &dnsmessage.CNAMEResource{CNAME: target}})
+		}
+	case dnsmessage.TypeMX:
+		mxs, err := resolver.LookupMX(ctx, name)
+		if err != nil {
+			//nolint:wrapcheck
+			return nil, err
+		}
+
+		for _, mx := range mxs {
+			if host, err := dnsmessage.NewName(mx.Host); err == nil {
+				answers = append(answers, dnsmessage.Resource{Body: &dnsmessage.MXResource{Pref: mx.Pref, MX: host}})
+			}
+		}
+	case dnsmessage.TypeNS:
+		nss, err := resolver.LookupNS(ctx, name)
+		if err != nil {
+			//nolint:wrapcheck
+			return nil, err
+		}
+
+		for _, ns := range nss {
+			if host, err := dnsmessage.NewName(ns.Host); err == nil {
+				answers = append(answers, dnsmessage.Resource{Body: &dnsmessage.NSResource{NS: host}})
+			}
+		}
+	case dnsmessage.TypeTXT:
+		txts, err := resolver.LookupTXT(ctx, name)
+		if err != nil {
+			//nolint:wrapcheck
+			return nil, err
+		}
+
+		for _, txt := range txts {
+			answers = append(answers, dnsmessage.Resource{Body: &dnsmessage.TXTResource{TXT: splitTXT(txt)}})
+		}
+	case dnsmessage.TypeSRV:
+		_, srvs, err := resolver.LookupSRV(ctx, "", "", name)
+		if err != nil {
+			//nolint:wrapcheck
+			return nil, err
+		}
+
+		for _, srv := range srvs {
+			if target, err := dnsmessage.NewName(srv.Target); err == nil {
+				answers = append(answers, dnsmessage.Resource{Body: &dnsmessage.SRVResource{
+					Priority: srv.Priority,
+					Weight:   srv.Weight,
+					Port:     srv.Port,
+					Target:   target,
+				}})
+			}
+		}
+	case dnsmessage.TypePTR:
+		addr, ok := reverseAddr(name)
+		if !ok {
+			return nil, &net.DNSError{Err: "not a reverse lookup name", Name: name, IsNotFound: true}
+		}
+
+		names, err := resolver.LookupAddr(ctx, addr.String())
+		if err != nil {
+			//nolint:wrapcheck
+			return nil, err
+		}
+
+		for _, host := range names {
+			if ptr, err := dnsmessage.NewName(host); err == nil {
+				answers = append(answers, dnsmessage.Resource{Body: &dnsmessage.PTRResource{PTR: ptr}})
+			}
+		}
+	default:
+		return nil, errNotImplemented
+	}
+
+	return answers, nil
+}
+
+// errorCode... maps a lookup error to a response code. The resolver reports a name without records of the requested
+// type the same way as a name that does not exist, returning NXDOMAIN for an existing name causes some stub resolvers
+// to discard the answers for other types, so an empty answer is returned if the name has addresses.
+func (f *Forwarder) errorCode(ctx context.Context, question dnsmessage.Question, err error) dnsmessage.RCode {
+	if errors.Is(err, errNotImplemented) {
+		return dnsmessage.RCodeNotImplemented
+	}
+
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		log.Debugf("lookup of %s %s failed: %v", question.Type, question.Name, err)
+
+		return dnsmessage.RCodeServerFailure
+	}
+
+	if question.Type != dnsmessage.TypeA && question.Type != dnsmessage.TypeAAAA {
+		if _, err := f.resolver().LookupNetIP(ctx, "ip", question.Name.String()); err == nil {
+			return dnsmessage.RCodeSuccess
+		}
+	}
+
+	return dnsmessage.RCodeNameError
+}
+
+func (f *Forwarder) resolver() *net.Resolver {
+	if f.Resolver != nil {
+		return f.Resolver
+	}
+
+	return net.DefaultResolver
+}
+
+func (f *Forwarder) timeout() time.Duration {
+	if f.Timeout > 0 {
+		return f.Timeout
+	}
+
+	return defaultTimeout
+}
+
+// hasOPT... reports whether the additional records of a query include an OPT record, the parser must be positioned
+// after the questions
+func hasOPT(parser *dnsmessage.Parser) bool {
+	if parser.SkipAllAnswers() != nil || parser.SkipAllAuthorities() != nil {
+		return false
+	}
+
+	for {
+		header, err := parser.AdditionalHeader()
+		if err != nil {
+			return false
+		}
+
+		if header.Type == dnsmessage.TypeOPT {
+			return true
+		}
+
+		if parser.SkipAdditional() != nil {
+			return false
+		}
+	}
+}
+
+// response... builds a response to the query. A response to an EDNS query carries an OPT record advertising
+// ednsPayloadSize, the guest stub truncates UDP responses to the size advertised by its client.
+func response(query dnsmessage.Header, questions []dnsmessage.Question, edns bool, rcode dnsmessage.RCode,
+	answers []dnsmessage.Resource,
+) ([]byte, error) {
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 query.ID,
+		Response:           true,
+		OpCode:             query.OpCode,
+		RecursionDesired:   query.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	builder.EnableCompression()
+
+	if err := builder.StartQuestions(); err != nil {
+		//nolint:wrapcheck
+		return nil, err
+	}
+
+	for _, question := range questions {
+		if err := builder.Question(question); err != nil {
+			//nolint:wrapcheck
+			return nil, err
+		}
+	}
+
+	if err := builder.StartAnswers(); err != nil {
+		//nolint:wrapcheck
+		return nil, err
+	}
+
+	for _, answer := range answers {
+		if err := addResource(&builder, answer); err != nil {
+			return nil, fmt.Errorf("failed to add %s record: %w", answer.Header.Type, err)
+		}
+	}
+
+	if edns {
+		if err := builder.StartAdditionals(); err != nil {
+			//nolint:wrapcheck
+			return nil, err
+		}
+
+		var opt dnsmessage.ResourceHeader
+
+		if err := opt.SetEDNS0(ednsPayloadSize, dnsmessage.RCodeSuccess, false); err != nil {
+			//nolint:wrapcheck
+			return nil, err
+		}
+
+		if err := builder.OPTResource(opt, dnsmessage.OPTResource{}); err != nil {
+			//nolint:wrapcheck
+			return nil, err
+		}
+	}
+
+	//nolint:wrapcheck
+	return builder.Finish()
+}
+
+func addResource(builder *dnsmessage.Builder, res dnsmessage.Resource) error {
+	//nolint:wrapcheck
+	switch body := res.Body.(type) {
+	case *dnsmessage.AResource:
+		return builder.AResource(res.Header, *body)
+	case *dnsmessage.AAAAResource:
+		return builder.AAAAResource(res.Header, *body)
+	case *dnsmessage.CNAMEResource:
+		return builder.CNAMEResource(res.Header, *body)
+	case *dnsmessage.MXResource:
+		return builder.MXResource(res.Header, *body)
+	case *dnsmessage.NSResource:
+		return builder.NSResource(res.Header, *body)
+	case *dnsmessage.TXTResource:
+		return builder.TXTResource(res.Header, *body)
+	case *dnsmessage.SRVResource:
+		return builder.SRVResource(res.Header, *body)
+	case *dnsmessage.PTRResource:
+		return builder.PTRResource(res.Header, *body)
+	default:
+		return fmt.Errorf("unsupported resource %T", res.Body)
+	}
+}
+
+// splitTXT... the resolver joins the strings of a TXT record, split it back into strings of at most 255 bytes
+func splitTXT(txt string) []string {
+	if txt == "" {
+		return []string{""}
+	}
+
+	var rv []string
+
+	for len(txt) > maxTXTString {
+		rv = append(rv, txt[:maxTXTString])
+		txt = txt[maxTXTString:]
+	}
+
+	return append(rv, txt)
+}
+
+// reverseAddr... parses an in-addr.arpa or ip6.arpa name into an address
+func reverseAddr(name string) (netip.Addr, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	if labels, ok := strings.CutSuffix(name, ".in-addr.arpa"); ok {
+		octets := strings.Split(labels, ".")
+		if len(octets) != 4 {
+			return netip.Addr{}, false
+		}
+
+		var addr [4]byte
+
+		for i, octet := range octets {
+			val, err := strconv.ParseUint(octet, 10, 8)
+			if err != nil {
+				return netip.Addr{}, false
+			}
+
+			addr[3-i] = byte(val)
+		}
+
+		return netip.AddrFrom4(addr), true
+	}
+
+	if labels, ok := strings.CutSuffix(name, ".ip6.arpa"); ok {
+		nibbles := strings.Split(labels, ".")
+		if len(nibbles) != 32 {
+			return netip.Addr{}, false
+		}
+
+		var addr [16]byte
+
+		for i, nibble := range nibbles {
+			val, err := strconv.ParseUint(nibble, 16, 4)
+			if err != nil || len(nibble) != 1 {
+				return netip.Addr{}, false
+			}
+
+			pos := 31 - i
+			addr[pos/2] |= byte(val) << (4 * (1 - pos%2))
+		}
+
+		return netip.AddrFrom16(addr), true
+	}
+
+	return netip.Addr{}, false
+}
@@ -0,0 +1,355 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/amadigan/macoby/internal/rpc"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeUpstream... a DNS server on the loopback interface that answers A and AAAA queries from a fixed zone, names
+// outside the zone are NXDOMAIN and other types are answered with no records
+type fakeUpstream struct {
+	conn net.PacketConn
+	zone map[string][]netip.Addr
+}
+
+func startUpstream(t *testing.T, zone map[string][]netip.Addr) *fakeUpstream {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	t.Cleanup(func() { _ = conn.Close() })
+
+	upstream := &fakeUpstream{conn: conn, zone: zone}
+
+	go upstream.serve()
+
+	return upstream
+}
+
+func (u *fakeUpstream) serve() {
+	buf := make([]byte, 0xffff)
+
+	for {
+		n, addr, err := u.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		if resp, err := u.answer(buf[:n]); err == nil {
+			_, _ = u.conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (u *fakeUpstream) answer(query []byte) ([]byte, error) {
+	var msg dnsmessage.Message
+
+	if err := msg.Unpack(query); err != nil {
+		return nil, err
+	}
+
+	msg.Header.Response = true
+	msg.Header.RecursionAvailable = true
+	msg.Answers = nil
+	msg.Additionals = nil
+
+	question := msg.Questions[0]
+
+	addrs, ok := u.zone[question.Name.String()]
+	if !ok {
+		msg.Header.RCode = dnsmessage.RCodeNameError
+
+		return msg.Pack()
+	}
+
+	for _, addr := range addrs {
+		header := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 300}
+
+		switch {
+		case addr.Is4() && question.Type == dnsmessage.TypeA:
+			header.Type = dnsmessage.TypeA
+			body := &dnsmessage.AResource{A: addr.As4()}
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: header, Body: body})
+		case addr.Is6() && question.Type == dnsmessage.TypeAAAA:
+			header.Type = dnsmessage.TypeAAAA
+			body := &dnsmessage.AAAAResource{AAAA: addr.As16()}
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: header, Body: body})
+		}
+	}
+
+	return msg.Pack()
+}
+
+func (u *fakeUpstream) resolver() *net.Resolver {
+	address := u.conn.LocalAddr().String()
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+
+			return dialer.DialContext(ctx, "udp", address)
+		},
+	}
+}
+
+var testZone = map[string][]netip.Addr{
+	"dual.example.test.": {netip.MustParseAddr("192.0.2.10"), netip.MustParseAddr("2001:db8::10")},
+	"v4.example.test.":   {netip.MustParseAddr("192.0.2.20")},
+}
+
+func newForwarder(t *testing.T) *Forwarder {
+	t.Helper()
+
+	return &Forwarder{Resolver: startUpstream(t, testZone).resolver(), TTL: 60, Timeout: 5 * time.Second}
+}
+
+func buildQuery(t *testing.T, name string, qtype dnsmessage.Type, edns bool) []byte {
+	t.Helper()
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 0x1234, RecursionDesired: true})
+	builder.EnableCompression()
+
+	if err := builder.StartQuestions(); err != nil {
+		t.Fatal(err)
+	}
+
+	question := dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET}
+	if err := builder.Question(question); err != nil {
+		t.Fatal(err)
+	}
+
+	if edns {
+		if err := builder.StartAdditionals(); err != nil {
+			t.Fatal(err)
+		}
+
+		var opt dnsmessage.ResourceHeader
+
+		if err := opt.SetEDNS0(4096, dnsmessage.RCodeSuccess, false); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := builder.OPTResource(opt, dnsmessage.OPTResource{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	query, err := builder.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return query
+}
+
+func answer(t *testing.T, f *Forwarder, query []byte) dnsmessage.Message {
+	t.Helper()
+
+	resp, err := f.Answer(context.Background(), query)
+	if err != nil {
+		t.Fatalf("Answer: %v", err)
+	}
+
+	var msg dnsmessage.Message
+
+	if err := msg.Unpack(resp); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+
+	if !msg.Header.Response || msg.Header.ID != 0x1234 {
+		t.Errorf("response header = %+v", msg.Header)
+	}
+
+	return msg
+}
+
+func answerAddrs(msg dnsmessage.Message) []netip.Addr {
+	var addrs []netip.Addr
+
+	for _, res := range msg.Answers {
+		switch body := res.Body.(type) {
+		case *dnsmessage.AResource:
+			addrs = append(addrs, netip.AddrFrom4(body.A))
+		case *dnsmessage.AAAAResource:
+			addrs = append(addrs, netip.AddrFrom16(body.AAAA))
+		}
+	}
+
+	return addrs
+}
+
+func TestAnswerAddresses(t *testing.T) {
+	f := newForwarder(t)
+
+	tests := []struct {
+		name  string
+		qtype dnsmessage.Type
+		want  []netip.Addr
+	}{
+		{"dual.example.test.", dnsmessage.TypeA, []netip.Addr{netip.MustParseAddr("192.0.2.10")}},
+		{"dual.example.test.", dnsmessage.TypeAAAA, []netip.Addr{netip.MustParseAddr("2001:db8::10")}},
+		{"v4.example.test.", dnsmessage.TypeA, []netip.Addr{netip.MustParseAddr("192.0.2.20")}},
+		{"v4.example.test.", dnsmessage.TypeAAAA, nil}, // the name exists, so no records rather than NXDOMAIN
+	}
+
+	for _, test := range tests {
+		t.Run(test.name+test.qtype.String(), func(t *testing.T) {
+			msg := answer(t, f, buildQuery(t, test.name, test.qtype, false))
+
+			if msg.Header.RCode != dnsmessage.RCodeSuccess {
+				t.Fatalf("rcode = %s, want success", msg.Header.RCode)
+			}
+
+			if got := answerAddrs(msg); !slices.Equal(got, test.want) {
+				t.Errorf("answers = %v, want %v", got, test.want)
+			}
+
+			for _, res := range msg.Answers {
+				if res.Header.TTL != 60 || res.Header.Type != test.qtype {
+					t.Errorf("answer header = %+v", res.Header)
+				}
+			}
+		})
+	}
+}
+
+func TestAnswerNameError(t *testing.T) {
+	f := newForwarder(t)
+
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA, dnsmessage.TypeMX} {
+		msg := answer(t, f, buildQuery(t, "missing.example.test.", qtype, false))
+
+		if msg.Header.RCode != dnsmessage.RCodeNameError {
+			t.Errorf("%s: rcode = %s, want NXDOMAIN", qtype, msg.Header.RCode)
+		}
+
+		if len(msg.Answers) != 0 {
+			t.Errorf("%s: unexpected answers %v", qtype, msg.Answers)
+		}
+	}
+}
+
+func TestAnswerEmpty(t *testing.T) {
+	f := newForwarder(t)
+
+	// the resolver reports no MX records as not found, the name has addresses so it is an empty answer
+	msg := answer(t, f, buildQuery(t, "dual.example.test.", dnsmessage.TypeMX, false))
+
+	if msg.Header.RCode != dnsmessage.RCodeSuccess {
+		t.Errorf("rcode = %s, want success", msg.Header.RCode)
+	}
+
+	if len(msg.Answers) != 0 {
+		t.Errorf("unexpected answers %v", msg.Answers)
+	}
+}
+
+func TestAnswerNotImplemented(t *testing.T) {
+	f := newForwarder(t)
+
+	msg := answer(t, f, buildQuery(t, "dual.example.test.", dnsmessage.TypeSOA, false))
+
+	if msg.Header.RCode != dnsmessage.RCodeNotImplemented {
+		t.Errorf("rcode = %s, want not implemented", msg.Header.RCode)
+	}
+}
+
+func TestAnswerEDNS(t *testing.T) {
+	f := newForwarder(t)
+
+	for _, edns := range []bool{false, true} {
+		msg := answer(t, f, buildQuery(t, "dual.example.test.", dnsmessage.TypeA, edns))
+
+		var opts []dnsmessage.Resource
+
+		for _, res := range msg.Additionals {
+			if res.Header.Type == dnsmessage.TypeOPT {
+				opts = append(opts, res)
+			}
+		}
+
+		if !edns {
+			if len(opts) != 0 {
+				t.Errorf("OPT record in the response to a query without EDNS")
+			}
+
+			continue
+		}
+
+		if len(opts) != 1 {
+			t.Fatalf("%d OPT records in the response to an EDNS query, want 1", len(opts))
+		}
+
+		// the class of the OPT record is the UDP payload size
+		if size := int(opts[0].Header.Class); size != ednsPayloadSize {
+			t.Errorf("payload size = %d, want %d", size, ednsPayloadSize)
+		}
+
+		if len(answerAddrs(msg)) != 1 {
+			t.Errorf("answers = %v", msg.Answers)
+		}
+	}
+}
+
+func TestServe(t *testing.T) {
+	f := newForwarder(t)
+	guest, host := net.Pipe()
+
+	go f.Serve(host)
+
+	defer guest.Close()
+
+	names := []string{"dual.example.test.", "v4.example.test.", "missing.example.test."}
+
+	// the queries are answered concurrently, the responses may arrive in any order
+	for i, name := range names {
+		query := buildQuery(t, name, dnsmessage.TypeA, false)
+		query[0], query[1] = 0, byte(i)
+
+		if err := rpc.WriteFrame(guest, query); err != nil {
+			t.Fatalf("failed to write query: %v", err)
+		}
+	}
+
+	_ = guest.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	rcodes := map[uint16]dnsmessage.RCode{}
+
+	for range names {
+		frame, err := rpc.ReadFrame(guest, nil)
+		if err != nil {
+			t.Fatalf("failed to read response: %v", err)
+		}
+
+		var msg dnsmessage.Message
+
+		if err := msg.Unpack(frame); err != nil {
+			t.Fatalf("invalid response: %v", err)
+		}
+
+		rcodes[msg.Header.ID] = msg.Header.RCode
+	}
+
+	want := map[uint16]dnsmessage.RCode{
+		0: dnsmessage.RCodeSuccess,
+		1: dnsmessage.RCodeSuccess,
+		2: dnsmessage.RCodeNameError,
+	}
+
+	for id, rcode := range want {
+		if rcodes[id] != rcode {
+			t.Errorf("query %d: rcode = %s, want %s", id, rcodes[id], rcode)
+		}
+	}
+}
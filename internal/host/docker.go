@@ -2,24 +2,93 @@ package host
 
 import (
 	"context"
+	"fmt"
 	"net"
+	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/amadigan/macoby/internal/util"
+	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/client"
 )
 
-func MonitorDockerd(ctx context.Context, vm *VirtualMachine, futureListener func() (*Listener, error)) {
-	log.Infof("monitoring dockerd")
+// containerNames... maps container IDs to names, as reported by dockerd
+type containerNames struct {
+	names map[string]string
+
+	mutex sync.RWMutex
+}
+
+func (c *containerNames) set(id, name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.names[id] = strings.TrimPrefix(name, "/")
+}
+
+func (c *containerNames) remove(id string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-	dclient, err := client.NewClientWithOpts(
+	delete(c.names, id)
+}
+
+func (c *containerNames) get(id string) string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.names[id]
+}
+
+// dockerClient... a client of dockerd over its socket in the guest
+func (vm *VirtualMachine) dockerClient() (*client.Client, error) {
+	//nolint:wrapcheck
+	return client.NewClientWithOpts(
 		client.WithHost("http://localhost"),
 		client.WithDialContext(func(ctx context.Context, network, addr string) (net.Conn, error) {
 			return vm.Dial("unix", "/run/docker.sock")
 		}),
 	)
+}
+
+// WaitDockerd... pings dockerd until it answers, as it opens its socket some time after it is launched
+func (vm *VirtualMachine) WaitDockerd(ctx context.Context, timeout time.Duration) error {
+	dclient, err := vm.dockerClient()
+	if err != nil {
+		return fmt.Errorf("failed to create docker client: %w", err)
+	}
+
+	defer dclient.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		pingCtx, pingCancel := context.WithTimeout(ctx, 5*time.Second)
+		_, err := dclient.Ping(pingCtx)
+		pingCancel()
+
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("dockerd did not answer within %s: %w", timeout, err)
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+}
+
+func MonitorDockerd(ctx context.Context, vm *VirtualMachine, futureListener func() (*Listener, error)) {
+	log.Infof("monitoring dockerd")
 
+	dclient, err := vm.dockerClient()
 	if err != nil {
 		log.Errorf("failed to connect to dockerd: %v", err)
 
@@ -28,8 +97,40 @@ func MonitorDockerd(ctx context.Context, vm *VirtualMachine, futureListener func
 
 	defer dclient.Close()
 
+	pruner := &dockerPruner{client: dclient}
+
+	vm.mutex.Lock()
+	vm.pruner = pruner
+	vm.mutex.Unlock()
+
+	defer func() {
+		vm.mutex.Lock()
+		vm.pruner = nil
+		vm.mutex.Unlock()
+	}()
+
+	if vm.Layout.Prune != nil {
+		go pruner.runPolicy(ctx, *vm.Layout.Prune)
+	}
+
+	if len(vm.Layout.Preload) > 0 {
+		go preloadImages(ctx, dclient, vm.Layout.Preload, filepath.Dir(vm.Layout.StateFile.Resolved))
+	}
+
 	msgCh, errCh := dclient.Events(ctx, events.ListOptions{})
 
+	names := vm.names
+
+	if conts, err := dclient.ContainerList(ctx, container.ListOptions{All: true}); err != nil {
+		log.Errorf("failed to list containers: %v", err)
+	} else {
+		for _, cont := range conts {
+			if len(cont.Names) > 0 {
+				names.set(cont.ID, cont.Names[0])
+			}
+		}
+	}
+
 	go func() {
 		for err := range errCh {
 			log.Errorf("dockerd event error: %v", err)
@@ -50,6 +151,15 @@ func MonitorDockerd(ctx context.Context, vm *VirtualMachine, futureListener func
 		action := msg.Action
 		actor := msg.Actor
 
+		if typ == events.ContainerEventType {
+			switch action { //nolint:exhaustive
+			case events.ActionCreate, events.ActionRename:
+				names.set(actor.ID, actor.Attributes["name"])
+			case events.ActionDestroy:
+				names.remove(actor.ID)
+			}
+		}
+
 		if typ == events.ContainerEventType && action == events.ActionStart {
 			cont, err := dclient.ContainerInspect(ctx, actor.ID)
 			if err != nil {
@@ -59,12 +169,11 @@ func MonitorDockerd(ctx context.Context, vm *VirtualMachine, futureListener func
 			}
 
 			if len(cont.NetworkSettings.Ports) > 0 {
-				var ip net.IP
+				ip := containerAddress(cont.NetworkSettings)
+				if ip == nil {
+					log.Warnf("container %s has published ports but no address", actor.ID)
 
-				if cont.NetworkSettings.IPAddress != "" {
-					ip = net.ParseIP(cont.NetworkSettings.IPAddress)
-				} else if cont.NetworkSettings.GlobalIPv6Address != "" {
-					ip = net.ParseIP(cont.NetworkSettings.GlobalIPv6Address)
+					continue
 				}
 
 				ports := make(map[GuestPort]util.Set[int], len(cont.NetworkSettings.Ports))
@@ -100,3 +209,43 @@ func MonitorDockerd(ctx context.Context, vm *VirtualMachine, futureListener func
 		}
 	}
 }
+
+// defaultBridge... the name of the network of containers started without a network
+const defaultBridge = "bridge"
+
+// containerAddress... selects the address to forward published ports to, preferring IPv4 and falling back to the
+// global IPv6 address. Containers on user-defined networks only have addresses in their network endpoints, which are
+// tried in order of name after the default bridge network, so a container on several networks always gets the same one.
+func containerAddress(settings *container.NetworkSettings) net.IP {
+	if settings.IPAddress != "" {
+		return net.ParseIP(settings.IPAddress)
+	}
+
+	var ipv6 string
+
+	names := util.SortKeys(settings.Networks)
+	if i := slices.Index(names, defaultBridge); i > 0 {
+		names = slices.Insert(slices.Delete(names, i, i+1), 0, defaultBridge)
+	}
+
+	for _, name := range names {
+		endpoint := settings.Networks[name]
+		if endpoint == nil {
+			continue
+		}
+
+		if endpoint.IPAddress != "" {
+			return net.ParseIP(endpoint.IPAddress)
+		}
+
+		if ipv6 == "" {
+			ipv6 = endpoint.GlobalIPv6Address
+		}
+	}
+
+	if ipv6 == "" {
+		ipv6 = settings.GlobalIPv6Address
+	}
+
+	return net.ParseIP(ipv6)
+}
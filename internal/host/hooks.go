@@ -0,0 +1,199 @@
+package host
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/amadigan/macoby/internal/applog"
+	"github.com/amadigan/macoby/internal/event"
+	"github.com/amadigan/macoby/internal/host/config"
+)
+
+const (
+	hookStream      = "hooks"
+	hookTimeout     = 30 * time.Second
+	hookResponseMax = 4096 // bytes of an HTTP hook response that are logged
+)
+
+// hookRunner... runs the hooks of the layout, their output is written to the hooks log stream. The hooks are checked
+// when the configuration is loaded.
+type hookRunner struct {
+	hooks map[string][]*config.Hook
+	dir   string
+	logs  chan<- applog.Message
+}
+
+func newHookRunner(layout *config.Layout, logs chan<- applog.Message) *hookRunner {
+	return &hookRunner{hooks: layout.Hooks, dir: layout.Home, logs: logs}
+}
+
+// lifecycle... emits a lifecycle event for a point and runs its hooks, returning once they are done
+func (r *hookRunner) lifecycle(ctx context.Context, point string) {
+	env := event.NewEnvelope(event.LifecyclePoint{Name: point})
+	event.EmitEnvelope(ctx, env)
+
+	r.run(point, env)
+}
+
+// listen... runs the disk-low and oom-kill hooks as their events are emitted, until ctx is done
+func (r *hookRunner) listen(ctx context.Context) {
+	if len(r.hooks[config.HookDiskLow]) > 0 {
+		lowCh := make(chan event.TypedEnvelope[event.DiskLow], 10)
+		event.Listen(ctx, lowCh)
+
+		go func() {
+			defer event.Unlisten(ctx, lowCh)
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case ev, ok := <-lowCh:
+					if !ok {
+						return
+					}
+
+					r.run(config.HookDiskLow, ev.Envelope())
+				}
+			}
+		}()
+	}
+
+	if len(r.hooks[config.HookOOMKill]) > 0 {
+		oomCh := make(chan event.TypedEnvelope[event.OOMKill], 10)
+		event.Listen(ctx, oomCh)
+
+		go func() {
+			defer event.Unlisten(ctx, oomCh)
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case ev, ok := <-oomCh:
+					if !ok {
+						return
+					}
+
+					r.run(config.HookOOMKill, ev.Envelope())
+				}
+			}
+		}()
+	}
+}
+
+// run... runs the hooks of a point in order, a failed hook is logged and the next one runs
+func (r *hookRunner) run(point string, env event.Envelope) {
+	hooks := r.hooks[point]
+	if len(hooks) == 0 {
+		return
+	}
+
+	payload, err := json.Marshal(env)
+	if err != nil {
+		log.Errorf("failed to encode %s event: %v", point, err)
+
+		return
+	}
+
+	for i, hook := range hooks {
+		name := fmt.Sprintf("%s[%d]", point, i)
+		timeout := hookTimeout
+
+		if hook.Timeout > 0 {
+			timeout = time.Duration(hook.Timeout) * time.Second
+		}
+
+		// hooks run during shutdown as well, so they only stop on their timeout
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		start := time.Now()
+
+		if len(hook.Command) > 0 {
+			err = r.runCommand(ctx, name, point, hook, payload)
+		} else {
+			err = r.post(ctx, name, point, hook, payload)
+		}
+
+		cancel()
+
+		if err != nil {
+			log.Errorf("hook %s failed: %v", name, err)
+			r.logf(name, "failed after %s: %v", time.Since(start).Round(time.Millisecond), err)
+		} else {
+			log.Debugf("hook %s done", name)
+			r.logf(name, "done in %s", time.Since(start).Round(time.Millisecond))
+		}
+	}
+}
+
+func (r *hookRunner) runCommand(ctx context.Context, name, point string, hook *config.Hook, payload []byte) error {
+	cmd := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...)
+	cmd.Dir = r.dir
+	cmd.Env = append(os.Environ(), "RAILYARD_HOOK="+point)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.WaitDelay = time.Second
+
+	out, err := cmd.CombinedOutput()
+	r.logOutput(name, out)
+
+	if ctx.Err() != nil {
+		return fmt.Errorf("timed out: %w", ctx.Err())
+	}
+
+	//nolint:wrapcheck
+	return err
+}
+
+func (r *hookRunner) post(ctx context.Context, name, point string, hook *config.Hook, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("invalid hook url: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Railyard-Hook", point)
+
+	for key, value := range hook.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post to %s: %w", req.URL.Redacted(), err)
+	}
+
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, hookResponseMax))
+	r.logOutput(name, body)
+
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("%s returned %s", req.URL.Redacted(), resp.Status)
+	}
+
+	return nil
+}
+
+func (r *hookRunner) logOutput(name string, out []byte) {
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if line != "" {
+			r.logf(name, "%s", line)
+		}
+	}
+}
+
+func (r *hookRunner) logf(name, format string, args ...any) {
+	line := fmt.Sprintf("%s %s: %s\n", time.Now().Format(time.RFC3339), name, fmt.Sprintf(format, args...))
+
+	if r.logs != nil {
+		r.logs <- applog.Message{Subsystem: hookStream, Data: []byte(line)}
+	}
+}
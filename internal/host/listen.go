@@ -80,7 +80,7 @@ func (l *Listener) Forward(id string, guestIP net.IP, ports map[GuestPort]util.S
 	var listeners []net.Listener
 
 	for guestPort, hostPorts := range ports {
-		raddr := guestIP.String() + ":" + strconv.Itoa(guestPort.Port)
+		raddr := net.JoinHostPort(guestIP.String(), strconv.Itoa(guestPort.Port))
 		if guestPort.Proto != ListenerProtoUDP {
 			for hostPort := range hostPorts {
 				for _, addr := range l.addrs {
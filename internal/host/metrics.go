@@ -0,0 +1,124 @@
+package host
+
+import (
+	"context"
+	"time"
+
+	"github.com/amadigan/macoby/internal/applog"
+	"github.com/amadigan/macoby/internal/event"
+	"github.com/amadigan/macoby/internal/rpc"
+	"github.com/amadigan/macoby/internal/util"
+)
+
+// handleGuestEvent... dispatches an event pushed by the guest on the event stream
+func (vm *VirtualMachine) handleGuestEvent(ctx context.Context, ge rpc.GuestEvent) {
+	switch ev := ge.Event.(type) {
+	case rpc.LogEvent:
+		vm.LogChannel <- applog.Message{Subsystem: ev.Name, Data: ev.Data}
+	case event.Metrics:
+		vm.imageAllocation(ev.Disks)
+
+		vm.mutex.Lock()
+		vm.metrics = ev
+		vm.mutex.Unlock()
+
+		event.Emit(ctx, ev)
+		vm.checkDiskAlerts(ctx, ev.Disks)
+	case event.ContainerMetrics:
+		for i, stats := range ev.Containers {
+			ev.Containers[i].Name = vm.names.get(stats.ID)
+		}
+
+		vm.setContainerMetrics(ev)
+		event.Emit(ctx, ev)
+	case event.OOMKill:
+		if ev.ContainerID != "" {
+			ev.Name = vm.names.get(ev.ContainerID)
+			log.Warnf("container %s (%s) killed by OOM %d times", ev.Name, ev.ContainerID, ev.Kills)
+		} else {
+			log.Warnf("process killed by OOM %d times", ev.Kills)
+		}
+
+		event.Emit(ctx, ev)
+	case event.ClockStats:
+		if ev.Step {
+			log.Infof("guest clock stepped by %v", ev.Offset)
+		}
+
+		event.Emit(ctx, ev)
+	case event.AddressChange:
+		log.Infof("guest address changed to %s", ev.Address)
+
+		var state DaemonState
+
+		vm.mutex.Lock()
+		if ev.Address.To4() != nil {
+			vm.ipv4 = ev.Address
+			state.IPv4Address = ev.Address.String()
+		} else {
+			vm.ipv6 = ev.Address
+			state.IPv6Address = ev.Address.String()
+		}
+		vm.mutex.Unlock()
+
+		vm.UpdateState(state)
+		event.Emit(ctx, ev)
+	case event.ServiceState:
+		log.Infof("service %s (pid %d) %s", ev.Name, ev.Pid, ev.State)
+		event.Emit(ctx, ev)
+	default:
+		log.Warnf("unexpected guest event: %T", ge.Event)
+	}
+}
+
+// Watch... registers an interested party for metrics, the returned function must be called when it is no longer
+// interested
+func (vm *VirtualMachine) Watch() func() {
+	vm.mutex.Lock()
+	vm.watchers++
+	first := vm.watchers == 1
+	vm.mutex.Unlock()
+
+	if first {
+		if err := vm.pushMetrics(); err != nil {
+			log.Warnf("failed to request metrics: %s", err)
+		}
+	}
+
+	return func() {
+		vm.mutex.Lock()
+		vm.watchers--
+		last := vm.watchers == 0
+		vm.mutex.Unlock()
+
+		if last {
+			if err := vm.pushMetrics(); err != nil {
+				log.Warnf("failed to request metrics: %s", err)
+			}
+		}
+	}
+}
+
+// pushMetrics... asks the guest to push metrics at the active interval if there are watchers, otherwise at the idle
+// interval
+func (vm *VirtualMachine) pushMetrics() error {
+	vm.mutex.RLock()
+	client := vm.client
+	req := rpc.MetricsRequest{
+		Disks:    util.MapKeys(vm.metrics.Disks),
+		Interval: time.Duration(vm.Layout.IdleMetrics) * time.Second,
+	}
+
+	if vm.watchers > 0 {
+		req.Interval = time.Duration(vm.Layout.MetricInterval) * time.Second
+	}
+	vm.mutex.RUnlock()
+
+	if client == nil {
+		// the guest is not up yet, Start requests metrics once it is
+		return nil
+	}
+
+	//nolint:wrapcheck
+	return client.PushMetrics(req, nil)
+}
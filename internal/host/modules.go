@@ -0,0 +1,46 @@
+package host
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/amadigan/macoby/internal/event"
+	"github.com/amadigan/macoby/internal/rpc"
+)
+
+// Modules... the loaded kernel modules of the guest, or with all every module the guest kernel knows
+func (vm *VirtualMachine) Modules(all bool) ([]rpc.Module, error) {
+	var modules []rpc.Module
+
+	if err := vm.client.ListModules(all, &modules); err != nil {
+		return nil, fmt.Errorf("failed to list kernel modules: %w", err)
+	}
+
+	return modules, nil
+}
+
+// Modprobe... loads or unloads kernel modules in the guest. A module that is missing or fails to load is reported in
+// its result, not as an error.
+func (vm *VirtualMachine) Modprobe(modules []string, remove bool) ([]rpc.ModuleResult, error) {
+	var results []rpc.ModuleResult
+
+	if err := vm.client.Modprobe(rpc.ModprobeRequest{Modules: modules, Remove: remove}, &results); err != nil {
+		return nil, fmt.Errorf("failed to run modprobe: %w", err)
+	}
+
+	return results, nil
+}
+
+// reportModules... logs the results of the modules loaded at boot and publishes each as a ModuleLoad event
+func reportModules(ctx context.Context, results []rpc.ModuleResult) {
+	for _, result := range results {
+		switch result.Status {
+		case rpc.ModuleLoaded, rpc.ModuleBuiltin:
+			log.Infof("kernel module %s %s", result.Name, result.Status)
+		default:
+			log.Errorf("kernel module %s %s: %s", result.Name, result.Status, result.Error)
+		}
+
+		event.Emit(ctx, event.ModuleLoad{Name: result.Name, Status: result.Status, Error: result.Error})
+	}
+}
@@ -0,0 +1,73 @@
+package host
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/amadigan/macoby/internal/event"
+)
+
+// ModprobeRequest... the body of POST /modules/load and /modules/unload, each module is a name optionally followed by
+// its parameters
+type ModprobeRequest struct {
+	Modules []string `json:"modules"`
+}
+
+func (c *ControlServer) handleModules(w http.ResponseWriter, r *http.Request) {
+	if c.vm == nil || c.vm.Status() != event.StatusReady {
+		http.Error(w, "the VM is not running", http.StatusServiceUnavailable)
+
+		return
+	}
+
+	all, _ := strconv.ParseBool(r.URL.Query().Get("all"))
+
+	modules, err := c.vm.Modules(all)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, modules)
+}
+
+func (c *ControlServer) handleModuleLoad(w http.ResponseWriter, r *http.Request) {
+	c.modprobe(w, r, false)
+}
+
+func (c *ControlServer) handleModuleUnload(w http.ResponseWriter, r *http.Request) {
+	c.modprobe(w, r, true)
+}
+
+// modprobe... loads or unloads modules, the response holds a result for each module even if some failed
+func (c *ControlServer) modprobe(w http.ResponseWriter, r *http.Request, remove bool) {
+	var req ModprobeRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid modprobe request: %v", err), http.StatusBadRequest)
+
+		return
+	} else if len(req.Modules) == 0 {
+		http.Error(w, "no modules in request", http.StatusBadRequest)
+
+		return
+	}
+
+	if c.vm == nil || c.vm.Status() != event.StatusReady {
+		http.Error(w, "the VM is not running", http.StatusServiceUnavailable)
+
+		return
+	}
+
+	results, err := c.vm.Modprobe(req.Modules, remove)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, results)
+}
@@ -0,0 +1,119 @@
+package host
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Code-Hex/vz/v3"
+	"github.com/amadigan/macoby/internal/host/config"
+	"github.com/amadigan/macoby/internal/host/disk"
+	"github.com/amadigan/macoby/internal/rpc"
+)
+
+// overlayDisk... the disk holding the upper layer of the root overlay. It is formatted and mounted by the guest before
+// the root is pivoted, so it is prepared with the init request rather than mounted like the other disks.
+type overlayDisk struct {
+	label    string
+	info     *config.DiskImage
+	device   string
+	size     int64
+	identify func() (*disk.Filesystem, error)
+}
+
+// prepareExtensions... attaches the extension images of the overlay as read-only block devices
+func (vm *VirtualMachine) prepareExtensions() error {
+	for _, ext := range vm.Layout.Overlay.Extensions {
+		fs, err := extensionType(ext.Resolved)
+		if err != nil {
+			return err
+		}
+
+		dev, err := newBlockDevice(ext.Resolved, true, vz.DiskImageCachingModeCached, vz.DiskImageSynchronizationModeNone)
+		if err != nil {
+			return fmt.Errorf("failed to create extension %s configuration: %w", ext.Resolved, err)
+		}
+
+		device := fmt.Sprintf("/dev/vd%c", 'a'+len(vm.storages))
+		vm.storages = append(vm.storages, dev)
+		vm.extensions = append(vm.extensions, rpc.OverlayLayer{Device: device, FS: fs})
+
+		log.Debugf("overlay extension %s: %s (%s)", ext.Resolved, device, fs)
+	}
+
+	return nil
+}
+
+// extensionType... squashfs, or tar for an uncompressed tar archive. A block device is a whole number of sectors, as is
+// a tar archive.
+func extensionType(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open extension %s: %w", path, err)
+	}
+
+	defer f.Close()
+
+	if fs, err := disk.IdentifySquashfs(f); err != nil {
+		return "", fmt.Errorf("failed to identify extension %s: %w", path, err)
+	} else if fs != nil {
+		return string(disk.FSsquash), nil
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		return "", fmt.Errorf("failed to stat extension %s: %w", path, err)
+	}
+
+	header := make([]byte, 512)
+
+	if _, err := f.ReadAt(header, 0); err != nil && err != io.EOF {
+		return "", fmt.Errorf("failed to read extension %s: %w", path, err)
+	}
+
+	if bytes.HasPrefix(header[257:], []byte("ustar")) && stat.Size()%512 == 0 {
+		return rpc.LayerTar, nil
+	}
+
+	return "", fmt.Errorf("extension %s is neither a squashfs image nor an uncompressed tar archive", path)
+}
+
+// overlayConfig... the overlay of the init request. The overlay disk is formatted by the guest if it has no filesystem,
+// and grown if the disk is larger than its filesystem. It cannot shrink.
+func (vm *VirtualMachine) overlayConfig() (rpc.OverlayConfig, error) {
+	size, err := vm.Layout.Overlay.Bytes(vm.Layout.Ram)
+	if err != nil {
+		//nolint:wrapcheck
+		return rpc.OverlayConfig{}, err
+	}
+
+	cfg := rpc.OverlayConfig{Size: size, Extensions: vm.extensions}
+
+	od := vm.overlayDisk
+	if od == nil {
+		return cfg, nil
+	}
+
+	result, err := od.identify()
+	if err != nil {
+		return cfg, fmt.Errorf("failed to identify overlay disk %s: %w", od.label, err)
+	}
+
+	cfg.Device = od.device
+	cfg.FS = od.info.FS
+
+	switch {
+	case result == nil || string(result.Type) != od.info.FS:
+		cmd := mkfsCommand(od.label, od.info, od.device)
+		cfg.Mkfs = append([]string{cmd.Path}, cmd.Args[1:]...)
+	case od.size > result.Size:
+		log.Infof("growing overlay disk %s from %d to %d", od.label, result.Size, od.size)
+
+		cfg.Grow = true
+	case od.size != 0 && od.size < result.Size:
+		log.Warnf("overlay disk %s cannot shrink, keeping its size of %d", od.label, result.Size)
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,773 @@
+package host
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/amadigan/macoby/internal/event"
+	"github.com/amadigan/macoby/internal/host/config"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	preloadInterval  = 2 * time.Second
+	maxLayoutJSON    = 1 << 20 // manifests, indexes and configs kept in memory while reading a tarball
+	imageNameLabel   = "io.containerd.image.name"
+	imageRefLabel    = "org.opencontainers.image.ref.name"
+	ociIndexType     = "application/vnd.oci.image.index.v1+json"
+	dockerListType   = "application/vnd.docker.distribution.manifest.list.v2+json"
+	dockerSaveConfig = "manifest.json"
+	ociIndexFile     = "index.json"
+	preloadCacheFile = "preload-cache.json"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// preloadSource... a docker save tarball or an OCI layout, as a tarball or a directory
+type preloadSource struct {
+	path   string
+	dir    bool
+	images []preloadImage
+	// manifest... the manifest.json added to an OCI layout without one, dockerd only loads images listed in it
+	manifest []byte
+	size     uint64
+}
+
+type preloadImage struct {
+	ID   string   `json:"id"`
+	Tags []string `json:"tags,omitempty"`
+}
+
+// preloadCache... the images of the preload tarballs scanned at earlier starts, by path. A compressed tarball must be
+// decompressed entirely to find its manifest.json, so it is only scanned again when its size or mtime change.
+type preloadCache struct {
+	path    string
+	entries map[string]preloadScan
+	seen    map[string]preloadScan
+	changed bool
+}
+
+type preloadScan struct {
+	Size     int64          `json:"size"`
+	ModTime  time.Time      `json:"mtime"`
+	Images   []preloadImage `json:"images"`
+	Manifest []byte         `json:"manifest,omitempty"`
+}
+
+// dockerSaveManifest... an entry of the manifest.json written by docker save
+type dockerSaveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations"`
+	Platform    *struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+	} `json:"platform"`
+}
+
+type ociIndex struct {
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	Config ociDescriptor   `json:"config"`
+	Layers []ociDescriptor `json:"layers"`
+}
+
+// preloadImages... loads the images of the preload directories that dockerd does not have yet. It runs at every start,
+// but once the images are loaded, it only restores missing tags. The scanned tarballs are cached in stateDir.
+func preloadImages(ctx context.Context, dclient *client.Client, dirs config.Paths, stateDir string) {
+	if err := waitForDockerd(ctx, dclient); err != nil {
+		return
+	}
+
+	cache := openPreloadCache(filepath.Join(stateDir, preloadCacheFile))
+	defer cache.save()
+
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir.Resolved)
+		if err != nil {
+			log.Errorf("failed to read preload directory %s: %v", dir.Resolved, err)
+
+			continue
+		}
+
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+
+			src, err := cache.scan(filepath.Join(dir.Resolved, entry.Name()))
+			if err != nil {
+				log.Warnf("skipping preload source %s: %v", entry.Name(), err)
+
+				continue
+			} else if src == nil {
+				continue
+			}
+
+			if err := src.load(ctx, dclient); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+
+				log.Errorf("failed to preload %s: %v", src.path, err)
+				event.Emit(ctx, src.progress(event.PreloadFailed, 0, err))
+			}
+		}
+	}
+}
+
+func waitForDockerd(ctx context.Context, dclient *client.Client) error {
+	delay := 100 * time.Millisecond
+
+	for {
+		if _, err := dclient.Ping(ctx); err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			//nolint:wrapcheck
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+
+		delay = min(delay*2, 5*time.Second)
+	}
+}
+
+func openPreloadCache(path string) *preloadCache {
+	cache := &preloadCache{path: path, entries: map[string]preloadScan{}, seen: map[string]preloadScan{}}
+
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &cache.entries); err != nil {
+			log.Warnf("ignoring invalid preload cache %s: %v", path, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		log.Warnf("failed to read preload cache %s: %v", path, err)
+	}
+
+	return cache
+}
+
+// scan... the images of a preload source, from the cache if it is a tarball that did not change since it was scanned
+func (c *preloadCache) scan(p string) (*preloadSource, error) {
+	stat, err := os.Stat(p)
+	if err != nil || !stat.Mode().IsRegular() {
+		return scanPreloadSource(p)
+	}
+
+	if entry, ok := c.entries[p]; ok && entry.Size == stat.Size() && entry.ModTime.Equal(stat.ModTime()) {
+		c.seen[p] = entry
+
+		//nolint:gosec
+		return &preloadSource{path: p, images: entry.Images, manifest: entry.Manifest, size: uint64(stat.Size())}, nil
+	}
+
+	src, err := scanPreloadSource(p)
+	if err == nil && src != nil {
+		// the stat from before the scan, a tarball changed while it was read is scanned again next time
+		c.seen[p] = preloadScan{Size: stat.Size(), ModTime: stat.ModTime(), Images: src.images, Manifest: src.manifest}
+		c.changed = true
+	}
+
+	return src, err
+}
+
+// save... writes the entries seen by this run, and those not reached before it was canceled, dropping the tarballs
+// that were removed
+func (c *preloadCache) save() {
+	for p, entry := range c.entries {
+		if _, ok := c.seen[p]; !ok && fileExists(p) {
+			c.seen[p] = entry
+		}
+	}
+
+	if !c.changed && len(c.seen) == len(c.entries) {
+		return
+	}
+
+	data, err := json.Marshal(c.seen)
+	if err != nil {
+		log.Warnf("failed to marshal preload cache: %v", err)
+
+		return
+	}
+
+	tmp := c.path + ".tmp"
+
+	//nolint:gosec
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		log.Warnf("failed to write preload cache: %v", err)
+
+		return
+	}
+
+	if err := os.Rename(tmp, c.path); err != nil {
+		log.Warnf("failed to write preload cache: %v", err)
+		_ = os.Remove(tmp)
+	}
+}
+
+// scanPreloadSource... reads the images of a tarball or an OCI layout directory, returns nil if the path is neither
+func scanPreloadSource(p string) (*preloadSource, error) {
+	stat, err := os.Stat(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat %s: %w", p, err)
+	}
+
+	src := &preloadSource{path: p, dir: stat.IsDir()}
+	files := map[string][]byte{}
+
+	if src.dir {
+		if !fileExists(filepath.Join(p, "oci-layout")) && !fileExists(filepath.Join(p, dockerSaveConfig)) {
+			return nil, nil
+		}
+
+		if err := filepath.WalkDir(p, func(_ string, d os.DirEntry, err error) error {
+			if err == nil && d.Type().IsRegular() {
+				if info, err := d.Info(); err == nil {
+					src.size += uint64(info.Size()) //nolint:gosec
+				}
+			}
+
+			//nolint:wrapcheck
+			return err
+		}); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", p, err)
+		}
+	} else if stat.Mode().IsRegular() {
+		src.size = uint64(stat.Size()) //nolint:gosec
+
+		if files, err = readTarJSON(p); err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, nil
+	}
+
+	readFile := func(name string) ([]byte, error) {
+		if src.dir {
+			//nolint:wrapcheck
+			return os.ReadFile(filepath.Join(p, filepath.FromSlash(name)))
+		}
+
+		if data, ok := files[name]; ok {
+			return data, nil
+		}
+
+		return nil, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+
+	if data, err := readFile(dockerSaveConfig); err == nil {
+		var manifests []dockerSaveManifest
+
+		if err := json.Unmarshal(data, &manifests); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", dockerSaveConfig, err)
+		}
+
+		for _, m := range manifests {
+			id := "sha256:" + strings.TrimSuffix(path.Base(m.Config), ".json")
+			src.images = append(src.images, preloadImage{ID: id, Tags: m.RepoTags})
+		}
+	} else if src.manifest, err = ociSaveManifest(readFile, src); err != nil {
+		return nil, err
+	}
+
+	if len(src.images) == 0 {
+		return nil, errors.New("no images found")
+	}
+
+	return src, nil
+}
+
+// ociSaveManifest... the manifest.json for the images of an OCI layout, one image per platform of the host
+func ociSaveManifest(readFile func(string) ([]byte, error), src *preloadSource) ([]byte, error) {
+	data, err := readFile(ociIndexFile)
+	if err != nil {
+		return nil, errors.New("neither manifest.json nor index.json found")
+	}
+
+	var index ociIndex
+
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", ociIndexFile, err)
+	}
+
+	var manifests []dockerSaveManifest
+
+	for _, desc := range index.Manifests {
+		m, err := resolveOCIManifest(readFile, desc, 0)
+		if err != nil {
+			return nil, err
+		} else if m == nil {
+			continue
+		}
+
+		if name := ociImageName(desc.Annotations); name != "" {
+			m.RepoTags = []string{name}
+		}
+
+		manifests = append(manifests, *m)
+		src.images = append(src.images, preloadImage{ID: digestOf(m.Config), Tags: m.RepoTags})
+	}
+
+	//nolint:wrapcheck
+	return json.Marshal(manifests)
+}
+
+// resolveOCIManifest... follows image indexes down to the manifest for the platform of the host, nil if there is none
+func resolveOCIManifest(readFile func(string) ([]byte, error), desc ociDescriptor, depth int) (*dockerSaveManifest, error) {
+	if desc.Platform != nil && (desc.Platform.OS != "linux" || desc.Platform.Architecture != runtime.GOARCH) {
+		return nil, nil
+	}
+
+	data, err := readFile(blobPath(desc.Digest))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob %s: %w", desc.Digest, err)
+	}
+
+	if desc.MediaType == ociIndexType || desc.MediaType == dockerListType {
+		if depth > 4 {
+			return nil, fmt.Errorf("index %s is nested too deeply", desc.Digest)
+		}
+
+		var index ociIndex
+
+		if err := json.Unmarshal(data, &index); err != nil {
+			return nil, fmt.Errorf("invalid index %s: %w", desc.Digest, err)
+		}
+
+		for _, child := range index.Manifests {
+			if m, err := resolveOCIManifest(readFile, child, depth+1); err != nil || m != nil {
+				return m, err
+			}
+		}
+
+		return nil, nil
+	}
+
+	var manifest ociManifest
+
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %w", desc.Digest, err)
+	}
+
+	m := &dockerSaveManifest{Config: blobPath(manifest.Config.Digest)}
+
+	for _, layer := range manifest.Layers {
+		m.Layers = append(m.Layers, blobPath(layer.Digest))
+	}
+
+	return m, nil
+}
+
+// ociImageName... the reference of an image in an OCI index, the ref.name annotation is only used if it is a full
+// reference rather than just a tag
+func ociImageName(annotations map[string]string) string {
+	if name := annotations[imageNameLabel]; name != "" {
+		return name
+	}
+
+	if name := annotations[imageRefLabel]; strings.Contains(name, "/") || strings.Contains(name, ":") {
+		return name
+	}
+
+	return ""
+}
+
+func blobPath(digest string) string {
+	return path.Join("blobs", strings.Replace(digest, ":", "/", 1))
+}
+
+func digestOf(blob string) string {
+	return path.Base(path.Dir(blob)) + ":" + path.Base(blob)
+}
+
+// readTarJSON... the JSON files of a tarball, which may be compressed. manifest.json is usually at the end of the
+// tarball, an uncompressed tarball is read by seeking past the layers.
+func readTarJSON(p string) (map[string][]byte, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", p, err)
+	}
+
+	defer f.Close()
+
+	r, closeReader, err := decompressed(f, p)
+	if err != nil {
+		return nil, err
+	}
+
+	defer closeReader()
+
+	tr := tar.NewReader(r)
+	files := map[string][]byte{}
+
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", p, err)
+		}
+
+		if hdr.Typeflag != tar.TypeReg || hdr.Size > maxLayoutJSON {
+			continue
+		}
+
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", p, err)
+		}
+
+		if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) || bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+			files[path.Clean(hdr.Name)] = data
+		}
+	}
+
+	return files, nil
+}
+
+// decompressed... a reader for a tarball that may be compressed with gzip or zstd. An uncompressed tarball is returned
+// as is, so tar can seek in it.
+func decompressed(f io.ReadSeeker, name string) (io.Reader, func(), error) {
+	magic := make([]byte, len(zstdMagic))
+
+	n, err := io.ReadFull(f, magic)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, fmt.Errorf("failed to seek %s: %w", name, err)
+	}
+
+	magic = magic[:n]
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		zr, err := gzip.NewReader(bufio.NewReader(f))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+
+		return zr, func() { zr.Close() }, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(bufio.NewReader(f))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+
+		return zr, zr.Close, nil
+	default:
+		return f, func() {}, nil
+	}
+}
+
+// load... loads the source unless dockerd already has all of its images, in which case only missing tags are added
+func (s *preloadSource) load(ctx context.Context, dclient *client.Client) error {
+	missing := slices.ContainsFunc(s.images, func(img preloadImage) bool {
+		_, err := dclient.ImageInspect(ctx, img.ID)
+
+		return err != nil
+	})
+
+	if !missing {
+		for _, img := range s.images {
+			for _, tag := range img.Tags {
+				if _, err := dclient.ImageInspect(ctx, tag); err == nil {
+					continue
+				}
+
+				if err := dclient.ImageTag(ctx, img.ID, tag); err != nil {
+					log.Warnf("failed to tag %s as %s: %v", img.ID, tag, err)
+				}
+			}
+		}
+
+		log.Infof("preload %s is already loaded", s.path)
+		event.Emit(ctx, s.progress(event.PreloadSkipped, 0, nil))
+
+		return nil
+	}
+
+	var sent atomic.Uint64
+
+	input, err := s.open(&sent)
+	if err != nil {
+		return err
+	}
+
+	defer input.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		ticker := time.NewTicker(preloadInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				event.Emit(ctx, s.progress(event.PreloadLoading, sent.Load(), nil))
+			}
+		}
+	}()
+
+	log.Infof("preloading %s", s.path)
+	event.Emit(ctx, s.progress(event.PreloadLoading, 0, nil))
+
+	resp, err := dclient.ImageLoad(ctx, input, client.ImageLoadWithQuiet(true))
+	if err != nil {
+		return fmt.Errorf("failed to load images: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+
+	for {
+		var msg jsonmessage.JSONMessage
+
+		if err := dec.Decode(&msg); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to read load response: %w", err)
+		}
+
+		if msg.Error != nil {
+			return fmt.Errorf("failed to load images: %w", msg.Error)
+		} else if msg.ErrorMessage != "" {
+			return fmt.Errorf("failed to load images: %s", msg.ErrorMessage)
+		}
+
+		if line := strings.TrimSpace(msg.Stream); line != "" {
+			log.Infof("preload %s: %s", filepath.Base(s.path), line)
+		}
+	}
+
+	log.Infof("preloaded %s", s.path)
+	event.Emit(ctx, s.progress(event.PreloadLoaded, sent.Load(), nil))
+
+	return nil
+}
+
+func (s *preloadSource) progress(status string, sent uint64, err error) event.PreloadProgress {
+	// the magic number of a compressed tarball is read twice
+	ev := event.PreloadProgress{Source: s.path, Status: status, Sent: min(sent, s.size), Total: s.size}
+
+	for _, img := range s.images {
+		if len(img.Tags) > 0 {
+			ev.Images = append(ev.Images, img.Tags...)
+		} else {
+			ev.Images = append(ev.Images, img.ID)
+		}
+	}
+
+	if err != nil {
+		ev.Error = err.Error()
+	}
+
+	return ev
+}
+
+// open... the tarball to send to dockerd, sent counts the bytes read from the source. A tarball with a manifest.json
+// is sent as is, dockerd decompresses it. A directory, or a tarball without manifest.json, is written as a tarball on
+// the fly, with the manifest.json built from its OCI index.
+func (s *preloadSource) open(sent *atomic.Uint64) (io.ReadCloser, error) {
+	if s.dir {
+		pr, pw := io.Pipe()
+
+		go func() {
+			pw.CloseWithError(s.writeDir(pw, sent))
+		}()
+
+		return pr, nil
+	}
+
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", s.path, err)
+	}
+
+	counted := &countingFile{File: f, count: sent}
+
+	if s.manifest == nil {
+		return counted, nil
+	}
+
+	pr, pw := io.Pipe()
+
+	go func() {
+		defer f.Close()
+
+		pw.CloseWithError(s.rewriteTar(pw, counted))
+	}()
+
+	return pr, nil
+}
+
+func (s *preloadSource) writeDir(w io.Writer, sent *atomic.Uint64) error {
+	tw := tar.NewWriter(w)
+
+	err := filepath.WalkDir(s.path, func(p string, d os.DirEntry, err error) error {
+		if err != nil || p == s.path || !(d.IsDir() || d.Type().IsRegular()) {
+			//nolint:wrapcheck
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			//nolint:wrapcheck
+			return err
+		}
+
+		rel, err := filepath.Rel(s.path, p)
+		if err != nil {
+			//nolint:wrapcheck
+			return err
+		}
+
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			//nolint:wrapcheck
+			return err
+		}
+
+		hdr.Name = filepath.ToSlash(rel)
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			//nolint:wrapcheck
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			//nolint:wrapcheck
+			return err
+		}
+
+		defer f.Close()
+
+		n, err := io.Copy(tw, f)
+		sent.Add(uint64(n)) //nolint:gosec
+
+		//nolint:wrapcheck
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", s.path, err)
+	}
+
+	if s.manifest == nil {
+		//nolint:wrapcheck
+		return tw.Close()
+	}
+
+	return s.finishTar(tw)
+}
+
+func (s *preloadSource) rewriteTar(w io.Writer, f *countingFile) error {
+	r, closeReader, err := decompressed(f, s.path)
+	if err != nil {
+		return err
+	}
+
+	defer closeReader()
+
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to read %s: %w", s.path, err)
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			//nolint:wrapcheck
+			return err
+		}
+
+		if _, err := io.Copy(tw, tr); err != nil {
+			return fmt.Errorf("failed to read %s: %w", s.path, err)
+		}
+	}
+
+	return s.finishTar(tw)
+}
+
+// finishTar... adds the manifest.json built from the OCI index
+func (s *preloadSource) finishTar(tw *tar.Writer) error {
+	hdr := &tar.Header{Name: dockerSaveConfig, Mode: 0644, Size: int64(len(s.manifest)), ModTime: time.Now()}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		//nolint:wrapcheck
+		return err
+	}
+
+	if _, err := tw.Write(s.manifest); err != nil {
+		//nolint:wrapcheck
+		return err
+	}
+
+	//nolint:wrapcheck
+	return tw.Close()
+}
+
+func fileExists(p string) bool {
+	_, err := os.Stat(p)
+
+	return err == nil
+}
+
+// countingFile... counts the bytes read from a file
+type countingFile struct {
+	*os.File
+	count *atomic.Uint64
+}
+
+func (f *countingFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	f.count.Add(uint64(n)) //nolint:gosec
+
+	//nolint:wrapcheck
+	return n, err
+}
@@ -0,0 +1,163 @@
+package host
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/amadigan/macoby/internal/event"
+	"github.com/amadigan/macoby/internal/host/config"
+	"github.com/amadigan/macoby/internal/rpc"
+)
+
+const (
+	provisionDir     = "/run/railyard/provision"
+	provisionMarkers = ".railyard/provision" // relative to the mount point of the disk of a once script
+	provisionOutput  = 4096                  // bytes of output kept in a provision-result event
+)
+
+// provision... runs the provisioning scripts in order. Only a failed script that is required stops the start.
+func (vm *VirtualMachine) provision(ctx context.Context) error {
+	for i, script := range vm.Layout.Provision {
+		name, data, err := provisionScript(i, script)
+		if err == nil {
+			err = vm.runProvisionScript(ctx, name, script, data)
+		} else {
+			event.Emit(ctx, event.ProvisionResult{Name: name, Run: script.Run, Status: event.ProvisionFailed, Error: err.Error()})
+		}
+
+		if err != nil && script.Required {
+			return fmt.Errorf("provision script %s failed: %w", name, err)
+		} else if err != nil {
+			log.Errorf("provision script %s failed: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// provisionScript... the name and contents of a script
+func provisionScript(index int, script *config.ProvisionScript) (string, []byte, error) {
+	data := []byte(script.Script)
+	name := script.Name
+
+	if script.Path != nil {
+		var err error
+
+		if data, err = os.ReadFile(script.Path.Resolved); err != nil {
+			return fmt.Sprintf("#%d", index), nil, fmt.Errorf("failed to read %s: %w", script.Path.Resolved, err)
+		}
+
+		if name == "" {
+			name = filepath.Base(script.Path.Resolved)
+		}
+	}
+
+	if name == "" {
+		sum := sha256.Sum256(data)
+		name = "script-" + hex.EncodeToString(sum[:6])
+	}
+
+	if name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return name, nil, fmt.Errorf("invalid provision script name %q", name)
+	}
+
+	return name, data, nil
+}
+
+func (vm *VirtualMachine) runProvisionScript(ctx context.Context, name string, script *config.ProvisionScript, data []byte) error {
+	result := event.ProvisionResult{Name: name, Run: script.Run}
+
+	if result.Run == "" {
+		result.Run = config.ProvisionBoot
+	}
+
+	fail := func(err error) error {
+		result.Status = event.ProvisionFailed
+		result.Error = err.Error()
+		event.Emit(ctx, result)
+
+		return err
+	}
+
+	var marker string
+	sum := sha256.Sum256(data)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+
+	switch result.Run {
+	case config.ProvisionBoot:
+	case config.ProvisionOnce:
+		mount, err := vm.Layout.ProvisionDisk(script)
+		if err != nil {
+			return fail(err)
+		}
+
+		marker = path.Join(mount, provisionMarkers, name)
+
+		out, err := vm.Run(rpc.Command{Path: "/bin/cat", Args: []string{"cat", marker}})
+		if err == nil && out.Exit == 0 && string(bytes.TrimSpace(out.Output)) == digest {
+			log.Debugf("provision script %s already ran", name)
+
+			return nil
+		}
+	default:
+		return fail(fmt.Errorf("unknown run mode %s", script.Run))
+	}
+
+	file := path.Join(provisionDir, name)
+
+	if err := vm.Write(file, data); err != nil {
+		return fail(fmt.Errorf("failed to write %s: %w", file, err))
+	}
+
+	log.Infof("running provision script %s", name)
+
+	cmd := rpc.Command{
+		Path:    "/bin/sh",
+		Args:    []string{"sh", file},
+		Env:     []string{"RAILYARD_PROVISION=" + name},
+		Timeout: time.Duration(script.Timeout) * time.Second,
+	}
+
+	start := time.Now()
+	out, err := vm.Run(cmd)
+	result.Duration = time.Since(start)
+	result.Exit = out.Exit
+	result.Output = string(out.Output[max(0, len(out.Output)-provisionOutput):])
+
+	for _, line := range strings.Split(strings.TrimSpace(string(out.Output)), "\n") {
+		if line != "" {
+			log.Infof("provision %s: %s", name, line)
+		}
+	}
+
+	switch {
+	case err != nil:
+		err = fmt.Errorf("failed to run: %w", err)
+	case out.TimedOut:
+		err = fmt.Errorf("timed out after %s", cmd.Timeout)
+	case out.Exit != 0:
+		err = fmt.Errorf("exited with status %d", out.Exit)
+	case marker != "":
+		if werr := vm.Write(marker, []byte(digest+"\n")); werr != nil {
+			err = fmt.Errorf("failed to write marker %s: %w", marker, werr)
+		}
+	}
+
+	if err != nil {
+		return fail(err)
+	}
+
+	result.Status = event.ProvisionDone
+	log.Infof("provision script %s done in %s", name, result.Duration)
+	event.Emit(ctx, result)
+
+	return nil
+}
@@ -0,0 +1,51 @@
+package host
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/amadigan/macoby/internal/host/config"
+)
+
+// ForwardLoopbackProxies... a proxy listening on the host loopback interface is not reachable from the guest, so the
+// guest listens on the same address and forwards the connections to the host. The proxy URLs in the guest are
+// therefore unchanged.
+func (vm *VirtualMachine) ForwardLoopbackProxies(proxy config.ProxyConfig) error {
+	forwarded := map[string]struct{}{}
+
+	for _, proxyURL := range []string{proxy.HTTP, proxy.HTTPS} {
+		if proxyURL == "" {
+			continue
+		}
+
+		host, port, err := config.ProxyAddress(proxyURL)
+		if err != nil {
+			return err
+		}
+
+		if !config.IsLoopbackHost(host) {
+			continue
+		}
+
+		target := net.JoinHostPort(host, port)
+		if _, ok := forwarded[target]; ok {
+			continue
+		}
+
+		forwarded[target] = struct{}{}
+
+		listen := target
+		if strings.EqualFold(host, "localhost") {
+			listen = net.JoinHostPort("127.0.0.1", port)
+		}
+
+		if err := vm.Listen("tcp", listen, ForwardToHost("tcp", target)); err != nil {
+			return fmt.Errorf("failed to forward proxy %s: %w", target, err)
+		}
+
+		log.Infof("forwarding proxy %s from guest to host", target)
+	}
+
+	return nil
+}
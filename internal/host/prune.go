@@ -0,0 +1,265 @@
+package host
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amadigan/macoby/internal/event"
+	"github.com/amadigan/macoby/internal/host/config"
+	"github.com/amadigan/macoby/internal/util"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+)
+
+// ErrDockerNotReady... dockerd has not started yet, or has exited
+var ErrDockerNotReady = errors.New("dockerd is not ready")
+
+// dockerPruner... removes unused docker data through the dockerd client of MonitorDockerd
+type dockerPruner struct {
+	client *client.Client
+	mutex  sync.Mutex // one prune at a time
+}
+
+// Prune... removes the unused docker data selected by a prune policy, or in a dry run only reports it
+func (vm *VirtualMachine) Prune(ctx context.Context, policy config.PrunePolicy, dryRun bool) (event.PruneReport, error) {
+	vm.mutex.RLock()
+	pruner := vm.pruner
+	vm.mutex.RUnlock()
+
+	if pruner == nil {
+		return event.PruneReport{}, ErrDockerNotReady
+	}
+
+	return pruner.prune(ctx, policy, dryRun)
+}
+
+// runPolicy... prunes when a disk-low event reports a disk running low, and at the interval of the policy
+func (p *dockerPruner) runPolicy(ctx context.Context, policy config.PrunePolicy) {
+	lowCh := make(chan event.TypedEnvelope[event.DiskLow], 10)
+	event.Listen(ctx, lowCh)
+
+	var tick <-chan time.Time
+
+	if policy.Interval > 0 {
+		ticker := time.NewTicker(time.Duration(policy.Interval) * time.Second)
+		defer ticker.Stop()
+
+		tick = ticker.C
+	}
+
+	for {
+		var reason string
+
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-lowCh:
+			if !ok {
+				return
+			}
+
+			if !ev.Event.LowSpace && !ev.Event.LowInodes {
+				continue
+			}
+
+			reason = "disk " + ev.Event.Label + " is low"
+		case <-tick:
+			reason = "interval"
+		}
+
+		report, err := p.prune(ctx, policy, policy.DryRun)
+		if err != nil {
+			log.Errorf("failed to prune docker data: %v", err)
+
+			continue
+		}
+
+		report.Reason = reason
+		logPruneReport(report)
+		event.Emit(ctx, report)
+	}
+}
+
+func (p *dockerPruner) prune(ctx context.Context, policy config.PrunePolicy, dryRun bool) (event.PruneReport, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	report := event.PruneReport{DryRun: dryRun}
+
+	minAge, err := policy.MinAge()
+	if err != nil {
+		//nolint:wrapcheck
+		return report, err
+	}
+
+	cutoff := time.Now().Add(-minAge)
+	all := !policy.Containers && !policy.Images && !policy.BuildCache
+
+	// containers first, they may hold on to images
+	if all || policy.Containers {
+		if report.Containers, err = p.pruneContainers(ctx, policy.KeepLast, cutoff, dryRun); err != nil {
+			return report, err
+		}
+	}
+
+	if all || policy.Images {
+		if report.Images, err = p.pruneImages(ctx, policy.KeepLast, cutoff, dryRun); err != nil {
+			return report, err
+		}
+	}
+
+	if all || policy.BuildCache {
+		if report.BuildCache, err = p.pruneBuildCache(ctx, policy.KeepLast, cutoff, dryRun); err != nil {
+			return report, err
+		}
+	}
+
+	for _, items := range [][]event.PrunedItem{report.Containers, report.Images, report.BuildCache} {
+		for _, item := range items {
+			report.Reclaimed += item.Size
+		}
+	}
+
+	return report, nil
+}
+
+func (p *dockerPruner) pruneContainers(ctx context.Context, keep int, cutoff time.Time, dryRun bool) ([]event.PrunedItem, error) {
+	stopped := filters.NewArgs(filters.Arg("status", "created"), filters.Arg("status", "exited"), filters.Arg("status", "dead"))
+
+	conts, err := p.client.ContainerList(ctx, container.ListOptions{All: true, Size: true, Filters: stopped})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	items := make([]event.PrunedItem, 0, len(conts))
+
+	for _, cont := range conts {
+		item := event.PrunedItem{ID: cont.ID, Size: util.Uint64(cont.SizeRw), Created: time.Unix(cont.Created, 0)}
+
+		if len(cont.Names) > 0 {
+			item.Name = strings.TrimPrefix(cont.Names[0], "/")
+		}
+
+		items = append(items, item)
+	}
+
+	return removeItems(prunable(items, keep, cutoff), dryRun, func(id string) error {
+		//nolint:wrapcheck
+		return p.client.ContainerRemove(ctx, id, container.RemoveOptions{})
+	}), nil
+}
+
+func (p *dockerPruner) pruneImages(ctx context.Context, keep int, cutoff time.Time, dryRun bool) ([]event.PrunedItem, error) {
+	dangling := filters.NewArgs(filters.Arg("dangling", "true"))
+
+	imgs, err := p.client.ImageList(ctx, image.ListOptions{Filters: dangling, ContainerCount: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list images: %w", err)
+	}
+
+	items := make([]event.PrunedItem, 0, len(imgs))
+
+	for _, img := range imgs {
+		if img.Containers > 0 {
+			continue
+		}
+
+		items = append(items, event.PrunedItem{ID: img.ID, Size: util.Uint64(img.Size), Created: time.Unix(img.Created, 0)})
+	}
+
+	return removeItems(prunable(items, keep, cutoff), dryRun, func(id string) error {
+		_, err := p.client.ImageRemove(ctx, id, image.RemoveOptions{PruneChildren: true})
+
+		//nolint:wrapcheck
+		return err
+	}), nil
+}
+
+// pruneBuildCache... the age of a build cache record is the time since it was last used. Records are pruned one at a
+// time with an id filter, so the records to keep are left alone.
+func (p *dockerPruner) pruneBuildCache(ctx context.Context, keep int, cutoff time.Time, dryRun bool) ([]event.PrunedItem, error) {
+	usage, err := p.client.DiskUsage(ctx, types.DiskUsageOptions{Types: []types.DiskUsageObject{types.BuildCacheObject}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list build cache: %w", err)
+	}
+
+	items := make([]event.PrunedItem, 0, len(usage.BuildCache))
+
+	for _, record := range usage.BuildCache {
+		if record.InUse {
+			continue
+		}
+
+		item := event.PrunedItem{ID: record.ID, Name: record.Description, Size: util.Uint64(record.Size), Created: record.CreatedAt}
+
+		if record.LastUsedAt != nil {
+			item.Created = *record.LastUsedAt
+		}
+
+		items = append(items, item)
+	}
+
+	return removeItems(prunable(items, keep, cutoff), dryRun, func(id string) error {
+		opts := types.BuildCachePruneOptions{All: true, Filters: filters.NewArgs(filters.Arg("id", id))}
+		_, err := p.client.BuildCachePrune(ctx, opts)
+
+		//nolint:wrapcheck
+		return err
+	}), nil
+}
+
+// prunable... the items to remove, all but the keep most recent items that were created before cutoff
+func prunable(items []event.PrunedItem, keep int, cutoff time.Time) []event.PrunedItem {
+	slices.SortFunc(items, func(a, b event.PrunedItem) int {
+		return b.Created.Compare(a.Created)
+	})
+
+	var rv []event.PrunedItem
+
+	for i, item := range items {
+		if i >= keep && item.Created.Before(cutoff) {
+			rv = append(rv, item)
+		}
+	}
+
+	return rv
+}
+
+// removeItems... removes each item, the items that could not be removed are left out of the result
+func removeItems(items []event.PrunedItem, dryRun bool, remove func(string) error) []event.PrunedItem {
+	if dryRun {
+		return items
+	}
+
+	removed := make([]event.PrunedItem, 0, len(items))
+
+	for _, item := range items {
+		if err := remove(item.ID); err != nil {
+			log.Warnf("failed to remove %s: %v", item.ID, err)
+
+			continue
+		}
+
+		removed = append(removed, item)
+	}
+
+	return removed
+}
+
+func logPruneReport(report event.PruneReport) {
+	verb := "removed"
+	if report.DryRun {
+		verb = "would remove"
+	}
+
+	log.Infof("prune (%s) %s %d containers, %d images and %d build cache records, %d bytes", report.Reason, verb,
+		len(report.Containers), len(report.Images), len(report.BuildCache), report.Reclaimed)
+}
@@ -0,0 +1,82 @@
+package host
+
+import (
+	"fmt"
+
+	"github.com/amadigan/macoby/internal/host/config"
+	"github.com/amadigan/macoby/internal/host/disk"
+	"github.com/amadigan/macoby/internal/rpc"
+)
+
+// SnapshotsSupported... snapshots are btrfs subvolumes, other filesystems and read-only disks have none
+func SnapshotsSupported(label string, info *config.DiskImage) error {
+	if info.FS != string(disk.FSbtrfs) {
+		return fmt.Errorf("disk %s holds a %s filesystem, snapshots need btrfs", label, info.FS)
+	} else if info.Mount == "" {
+		return fmt.Errorf("disk %s is not mounted", label)
+	} else if info.ReadOnly {
+		return fmt.Errorf("disk %s is read-only", label)
+	}
+
+	return nil
+}
+
+// Snapshots... lists the snapshots of a disk, oldest first
+func (vm *VirtualMachine) Snapshots(label string) ([]rpc.Snapshot, error) {
+	return vm.snapshot(rpc.SnapshotList, label, "")
+}
+
+// CreateSnapshot... snapshots the live tree of a disk, while it is in use
+func (vm *VirtualMachine) CreateSnapshot(label, name string) (rpc.Snapshot, error) {
+	snapshots, err := vm.snapshot(rpc.SnapshotCreate, label, name)
+	if err != nil || len(snapshots) == 0 {
+		return rpc.Snapshot{Name: name}, err
+	}
+
+	return snapshots[0], nil
+}
+
+// DeleteSnapshot... deletes a snapshot of a disk
+func (vm *VirtualMachine) DeleteSnapshot(label, name string) error {
+	_, err := vm.snapshot(rpc.SnapshotDelete, label, name)
+
+	return err
+}
+
+// RestoreSnapshot... replaces the live tree of a disk with a copy of a snapshot. The disk is unmounted, nothing may use
+// it anymore, the restored tree is mounted on the next start.
+func (vm *VirtualMachine) RestoreSnapshot(label, name string) error {
+	_, err := vm.snapshot(rpc.SnapshotRestore, label, name)
+
+	return err
+}
+
+func (vm *VirtualMachine) snapshot(op, label, name string) ([]rpc.Snapshot, error) {
+	info, ok := vm.Layout.Disks[label]
+	if !ok {
+		return nil, fmt.Errorf("no such disk: %s", label)
+	}
+
+	if err := SnapshotsSupported(label, info); err != nil {
+		return nil, err
+	}
+
+	device, ok := vm.devices[label]
+	if !ok {
+		return nil, fmt.Errorf("disk %s is not attached", label)
+	}
+
+	if info.Encrypt {
+		device = rpc.MapperDevice(label)
+	}
+
+	req := rpc.SnapshotRequest{Op: op, Device: device, Mount: info.Mount, Name: name}
+
+	var snapshots []rpc.Snapshot
+
+	if err := vm.client.Snapshot(req, &snapshots); err != nil {
+		return nil, fmt.Errorf("failed to %s snapshot of disk %s: %w", op, label, err)
+	}
+
+	return snapshots, nil
+}
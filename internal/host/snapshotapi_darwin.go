@@ -0,0 +1,163 @@
+package host
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/amadigan/macoby/internal/event"
+	"github.com/amadigan/macoby/internal/rpc"
+)
+
+// SnapshotCreateRequest... the body of POST /disks/{label}/snapshots
+type SnapshotCreateRequest struct {
+	Name string `json:"name"`
+}
+
+func (c *ControlServer) handleSnapshots(w http.ResponseWriter, r *http.Request) {
+	_, snapshots, ok := c.snapshots(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, snapshots)
+}
+
+func (c *ControlServer) handleSnapshotCreate(w http.ResponseWriter, r *http.Request) {
+	var req SnapshotCreateRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid snapshot request: %v", err), http.StatusBadRequest)
+
+		return
+	} else if !rpc.ValidSnapshotName(req.Name) {
+		http.Error(w, fmt.Sprintf("invalid snapshot name %q", req.Name), http.StatusBadRequest)
+
+		return
+	}
+
+	label, snapshots, ok := c.snapshots(w, r)
+	if !ok {
+		return
+	}
+
+	if findSnapshot(snapshots, req.Name) >= 0 {
+		http.Error(w, fmt.Sprintf("snapshot %s of disk %s already exists", req.Name, label), http.StatusConflict)
+
+		return
+	}
+
+	snapshot, err := c.vm.CreateSnapshot(label, req.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, snapshot)
+}
+
+func (c *ControlServer) handleSnapshotDelete(w http.ResponseWriter, r *http.Request) {
+	label, name, ok := c.snapshot(w, r)
+	if !ok {
+		return
+	}
+
+	if err := c.vm.DeleteSnapshot(label, name); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleSnapshotRestore... the daemon stops dockerd, restores the snapshot, then stops the VM and exits like for a
+// disk change
+func (c *ControlServer) handleSnapshotRestore(w http.ResponseWriter, r *http.Request) {
+	label, name, ok := c.snapshot(w, r)
+	if !ok {
+		return
+	}
+
+	c.scheduleDiskChange(DiskChange{Label: label, Restore: name})
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// RestoreSnapshots... restores the snapshots scheduled with the disk changes, dockerd must have exited and the VM must
+// still be running
+func (c *ControlServer) RestoreSnapshots() {
+	c.mutex.RLock()
+	changes := slices.Clone(c.diskChanges)
+	c.mutex.RUnlock()
+
+	for _, change := range changes {
+		if change.Restore == "" {
+			continue
+		}
+
+		log.Infof("restoring disk %s to snapshot %s", change.Label, change.Restore)
+
+		if err := c.vm.RestoreSnapshot(change.Label, change.Restore); err != nil {
+			log.Errorf("failed to %s: %v", change, err)
+		}
+	}
+}
+
+// snapshot... the disk label and snapshot name of a request, the snapshot must exist
+func (c *ControlServer) snapshot(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	label, snapshots, ok := c.snapshots(w, r)
+	if !ok {
+		return "", "", false
+	}
+
+	name := r.PathValue("name")
+
+	if findSnapshot(snapshots, name) < 0 {
+		http.Error(w, fmt.Sprintf("disk %s has no snapshot %s", label, name), http.StatusNotFound)
+
+		return "", "", false
+	}
+
+	return label, name, true
+}
+
+// snapshots... the disk label of a request and the snapshots of the disk, the VM must be running
+func (c *ControlServer) snapshots(w http.ResponseWriter, r *http.Request) (string, []rpc.Snapshot, bool) {
+	label := r.PathValue("label")
+
+	info, ok := c.Layout.Disks[label]
+	if !ok {
+		http.Error(w, "no such disk: "+label, http.StatusNotFound)
+
+		return "", nil, false
+	}
+
+	if err := SnapshotsSupported(label, info); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return "", nil, false
+	}
+
+	if c.vm == nil || c.vm.Status() != event.StatusReady {
+		http.Error(w, "the VM is not running", http.StatusServiceUnavailable)
+
+		return "", nil, false
+	}
+
+	snapshots, err := c.vm.Snapshots(label)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return "", nil, false
+	}
+
+	return label, snapshots, true
+}
+
+func findSnapshot(snapshots []rpc.Snapshot, name string) int {
+	return slices.IndexFunc(snapshots, func(s rpc.Snapshot) bool {
+		return s.Name == name
+	})
+}
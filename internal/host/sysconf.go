@@ -0,0 +1,80 @@
+package host
+
+import (
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/amadigan/macoby/internal/rpc"
+)
+
+const zoneInfoDir = "/usr/share/zoneinfo"
+
+// hostEntries... groups the configured hosts by address, sorted so that /etc/hosts is stable across boots
+func hostEntries(hosts map[string]string) ([]rpc.HostEntry, error) {
+	byAddr := map[string][]string{}
+
+	for name, addr := range hosts {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %s for host %s", addr, name)
+		}
+
+		byAddr[ip.String()] = append(byAddr[ip.String()], name)
+	}
+
+	entries := make([]rpc.HostEntry, 0, len(byAddr))
+
+	for addr, names := range byAddr {
+		slices.Sort(names)
+		entries = append(entries, rpc.HostEntry{Address: addr, Names: names})
+	}
+
+	slices.SortFunc(entries, func(a, b rpc.HostEntry) int {
+		return strings.Compare(a.Address, b.Address)
+	})
+
+	return entries, nil
+}
+
+// hostTimeZone... the IANA name of the host time zone, from the /etc/localtime symlink into the zoneinfo database
+func hostTimeZone() (string, error) {
+	target, err := os.Readlink("/etc/localtime")
+	if err != nil {
+		return "", fmt.Errorf("failed to read /etc/localtime: %w", err)
+	}
+
+	_, name, ok := strings.Cut(target, "zoneinfo/")
+	if !ok {
+		return "", fmt.Errorf("/etc/localtime does not link into a zoneinfo directory: %s", target)
+	}
+
+	return name, nil
+}
+
+// loadZoneInfo... the TZif data of a time zone, from the zoneinfo database of the host. If name is empty, the host
+// time zone is used.
+func loadZoneInfo(name string) (string, []byte, error) {
+	if name == "" {
+		var err error
+
+		if name, err = hostTimeZone(); err != nil {
+			return "", nil, err
+		}
+	}
+
+	if !fs.ValidPath(name) {
+		return "", nil, fmt.Errorf("invalid time zone %s", name)
+	}
+
+	data, err := os.ReadFile(filepath.Join(zoneInfoDir, name))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read time zone %s: %w", name, err)
+	}
+
+	return name, data, nil
+}
@@ -0,0 +1,101 @@
+package host
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/amadigan/macoby/internal/event"
+	"github.com/amadigan/macoby/internal/host/disk"
+	"github.com/amadigan/macoby/internal/rpc"
+	"github.com/amadigan/macoby/internal/util"
+)
+
+// imageAllocation... adds the size and allocation of each disk image on the host to the disk metrics from the guest,
+// the difference between allocated and used space is what a trim can give back to the host
+func (vm *VirtualMachine) imageAllocation(disks map[string]event.DiskMetrics) {
+	for label, info := range vm.Layout.Disks {
+		metrics, ok := disks[info.Mount]
+		if !ok || info.Mount == "" || info.Path == nil {
+			continue
+		}
+
+		size, allocated, err := disk.Allocation(info.Path.Resolved)
+		if err != nil {
+			log.Debugf("failed to stat disk %s: %v", label, err)
+
+			continue
+		}
+
+		metrics.ImageSize = util.Uint64(size)
+		metrics.Allocated = util.Uint64(allocated)
+		disks[info.Mount] = metrics
+	}
+}
+
+// trimMounts... the mount points of writable disks, swap is discarded by the kernel when enabled with discard
+func (vm *VirtualMachine) trimMounts() []string {
+	var mounts []string
+
+	for _, label := range util.SortKeys(vm.Layout.Disks) {
+		info := vm.Layout.Disks[label]
+
+		if info.Mount != "" && !info.ReadOnly && info.FS != string(disk.FSswap) {
+			mounts = append(mounts, info.Mount)
+		}
+	}
+
+	return mounts
+}
+
+// Trim... discards the unused blocks of all writable disks, so the host can release the space in the images
+func (vm *VirtualMachine) Trim() ([]rpc.TrimResult, error) {
+	var results []rpc.TrimResult
+
+	mounts := vm.trimMounts()
+	if len(mounts) == 0 {
+		return results, nil
+	}
+
+	if err := vm.client.Trim(mounts, &results); err != nil {
+		return nil, fmt.Errorf("failed to trim disks: %w", err)
+	}
+
+	for _, result := range results {
+		if result.Error != "" {
+			log.Warnf("trim of %s failed: %s", result.Mount, result.Error)
+		}
+	}
+
+	return results, nil
+}
+
+// trimPeriodically... trims the disks at the configured interval while the VM is ready
+func (vm *VirtualMachine) trimPeriodically(ctx context.Context) {
+	if vm.Layout.TrimInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(vm.Layout.TrimInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		switch vm.Status() { //nolint:exhaustive
+		case event.StatusReady:
+		case event.StatusStopping, event.StatusStopped:
+			return
+		default:
+			continue
+		}
+
+		if _, err := vm.Trim(); err != nil {
+			log.Warnf("periodic trim failed: %v", err)
+		}
+	}
+}
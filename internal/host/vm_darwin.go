@@ -18,6 +18,8 @@ import (
 	"github.com/amadigan/macoby/internal/applog"
 	"github.com/amadigan/macoby/internal/event"
 	"github.com/amadigan/macoby/internal/host/config"
+	"github.com/amadigan/macoby/internal/host/dns"
+	"github.com/amadigan/macoby/internal/host/vnet"
 	"github.com/amadigan/macoby/internal/rpc"
 	"github.com/amadigan/macoby/internal/util"
 )
@@ -35,15 +37,58 @@ type VirtualMachine struct {
 	rpcConn   net.Conn
 	client    rpc.Guest
 	mounts    []diskMount
+	devices   map[string]string        // disk label to block device in the guest
+	lowDisks  map[string]event.DiskLow // disks below their alert thresholds, by label
+	pruner    *dockerPruner
 	shares    []vz.DirectorySharingDeviceConfiguration
 	storages  []vz.StorageDeviceConfiguration
 	inits     []guestCommand
 	listeners map[net.Listener]struct{}
-	metrics   event.Metrics
+	// guestListeners... handlers for connections accepted on listeners in the guest, see Listen
+	guestListeners map[rpc.ListenRequest]func(net.Conn, rpc.ConnectionRequest)
+	overlayDisk    *overlayDisk
+	extensions     []rpc.OverlayLayer
+	metrics        event.Metrics
+	cmetrics       event.ContainerMetrics
+	names          *containerNames
+	watchers       int
 
 	ipv4 net.IP
+	ipv6 net.IP
 
 	mutex sync.RWMutex
+	// stateMutex... guards sends on StateChannel against CloseState, stateClosed is set once it is closed
+	stateMutex  sync.Mutex
+	stateClosed bool
+}
+
+// UpdateState... sends an update to StateChannel, updates sent after CloseState are dropped
+func (vm *VirtualMachine) UpdateState(state DaemonState) {
+	vm.stateMutex.Lock()
+	defer vm.stateMutex.Unlock()
+
+	if vm.stateClosed {
+		log.Debugf("dropping state update after shutdown: %+v", state)
+
+		return
+	}
+
+	vm.StateChannel <- state
+}
+
+// CloseState... sends the final update and closes StateChannel, later updates from event handlers and background
+// tasks are dropped
+func (vm *VirtualMachine) CloseState(state DaemonState) {
+	vm.stateMutex.Lock()
+	defer vm.stateMutex.Unlock()
+
+	if vm.stateClosed {
+		return
+	}
+
+	vm.stateClosed = true
+	vm.StateChannel <- state
+	close(vm.StateChannel)
 }
 
 func (vm *VirtualMachine) UpdateStatus(ctx context.Context, status event.Status) {
@@ -57,36 +102,50 @@ func (vm *VirtualMachine) UpdateStatus(ctx context.Context, status event.Status)
 	}
 }
 
+func (vm *VirtualMachine) Status() event.Status {
+	vm.mutex.RLock()
+	defer vm.mutex.RUnlock()
+
+	return vm.status
+}
+
 func (vm *VirtualMachine) Start(ctx context.Context, state DaemonState) error {
 	vm.UpdateStatus(ctx, event.StatusBooting)
 	vm.listeners = make(map[net.Listener]struct{})
+	vm.guestListeners = make(map[rpc.ListenRequest]func(net.Conn, rpc.ConnectionRequest))
 	configs := prepareConfigsAsync(vm.Layout)
 
 	log.Debug("creating VM config")
 
-	config, err := vm.createVMConfig()
+	vmConfig, err := vm.createVMConfig()
 	if err != nil {
 		return err
 	}
 
 	log.Debug("setting up VM base")
 
-	if err := setupVMBase(config, &state); err != nil {
+	if err := setupVMBase(vmConfig, &state); err != nil {
 		return err
 	}
 
 	log.Debug("setting up VM network")
 
-	if err := setupVMNetwork(config, &state); err != nil {
-		return err
+	if vm.Layout.Network.Mode != rpc.NetworkVsock {
+		if err := setupVMNetwork(vmConfig, &state); err != nil {
+			return err
+		}
 	}
 
 	log.Debug("preparing disks")
 
-	if err := vm.prepareDisks(); err != nil {
+	if err := vm.prepareDisks(state.Disks); err != nil {
 		return fmt.Errorf("failed to prepare disks: %w", err)
 	}
 
+	if err := vm.prepareExtensions(); err != nil {
+		return fmt.Errorf("failed to prepare overlay extensions: %w", err)
+	}
+
 	log.Debug("setting up shares")
 
 	if err := vm.setupShares(); err != nil {
@@ -97,17 +156,17 @@ func (vm *VirtualMachine) Start(ctx context.Context, state DaemonState) error {
 		return err
 	}
 
-	config.SetStorageDevicesVirtualMachineConfiguration(vm.storages)
-	config.SetDirectorySharingDevicesVirtualMachineConfiguration(vm.shares)
+	vmConfig.SetStorageDevicesVirtualMachineConfiguration(vm.storages)
+	vmConfig.SetDirectorySharingDevicesVirtualMachineConfiguration(vm.shares)
 
-	validated, err := config.Validate()
+	validated, err := vmConfig.Validate()
 	if !validated || err != nil {
 		return fmt.Errorf("validation failed: %w", err)
 	}
 
 	log.Debug("creating VM")
 
-	vm.vm, err = vz.NewVirtualMachine(config)
+	vm.vm, err = vz.NewVirtualMachine(vmConfig)
 	if err != nil {
 		return fmt.Errorf("failed to create virtual machine: %w", err)
 	}
@@ -143,22 +202,62 @@ func (vm *VirtualMachine) Start(ctx context.Context, state DaemonState) error {
 		log.Debug("VM state channel closed")
 	}()
 
-	if err := vm.handshake(); err != nil {
+	vm.names = &containerNames{names: map[string]string{}}
+
+	if err := vm.handshake(ctx); err != nil {
 		return err
 	}
 
 	log.Debug("sending init request")
 
+	overlay, err := vm.overlayConfig()
+	if err != nil {
+		return err
+	}
+
 	initMsg := rpc.InitRequest{
-		OverlaySize:   16 * 1024 * 1024,
+		Overlay:       overlay,
 		ClockInterval: 10 * time.Second,
 		Sysctl:        vm.Layout.Sysctl,
+		Modules:       vm.Layout.Modules,
+		Network: rpc.NetworkConfig{
+			Address: vm.Layout.Network.Address,
+			Gateway: vm.Layout.Network.Gateway,
+			DNS:     vm.Layout.Network.DNS,
+			Search:  vm.Layout.Network.Search,
+			IPv6:    vm.Layout.Network.IPv6,
+			Mode:    vm.Layout.Network.Mode,
+		},
+	}
+
+	if initMsg.Network.Mode == rpc.NetworkVsock && initMsg.Network.Address == "" {
+		initMsg.Network.Address = vnet.GuestAddress.String()
+		initMsg.Network.Gateway = vnet.Gateway.String()
+	}
+
+	if hostDNS := vm.Layout.Network.HostDNS; hostDNS != nil && *hostDNS {
+		initMsg.DNSStub = config.HostDNSAddress
+	}
+
+	if initMsg.Hosts, err = hostEntries(vm.Layout.Hosts); err != nil {
+		return err
+	}
+
+	initMsg.Hostname = vm.Layout.Hostname
+	initMsg.GatewayNames = []string{config.GatewayHostname}
+
+	if initMsg.TimeZone, initMsg.ZoneInfo, err = loadZoneInfo(vm.Layout.TimeZone); err != nil {
+		log.Warnf("guest time zone not set: %v", err)
 	}
 
-	if err := vm.client.Init(initMsg, nil); err != nil {
+	var initResp rpc.InitResponse
+
+	if err := vm.client.Init(initMsg, &initResp); err != nil {
 		return fmt.Errorf("failed to initialize guest: %w", err)
 	}
 
+	reportModules(ctx, initResp.Modules)
+
 	dhcp := util.Await(func() (net.IP, error) {
 		var result rpc.DHCPResponse
 
@@ -182,11 +281,27 @@ func (vm *VirtualMachine) Start(ctx context.Context, state DaemonState) error {
 		}
 	}
 
+	if err := vm.enableZram(); err != nil {
+		return err
+	}
+
 	if err := vm.mountFilesystems(); err != nil {
 		return err
 	}
 
-	go vm.metricsLoop(ctx)
+	if err := vm.installCACertificates(); err != nil {
+		return err
+	}
+
+	if err := vm.ForwardLoopbackProxies(vm.Layout.Proxy); err != nil {
+		log.Warnf("failed to forward proxy: %v", err)
+	}
+
+	if err := vm.pushMetrics(); err != nil {
+		log.Warnf("failed to request metrics: %s", err)
+	}
+
+	go vm.trimPeriodically(ctx)
 
 	if vm.ipv4, err = dhcp(); err != nil {
 		return fmt.Errorf("failed to get DHCP address: %w", err)
@@ -194,12 +309,16 @@ func (vm *VirtualMachine) Start(ctx context.Context, state DaemonState) error {
 
 	state.IPv4Address = vm.ipv4.String()
 
-	vm.StateChannel <- state
+	if err := vm.provision(ctx); err != nil {
+		return err
+	}
+
+	vm.UpdateState(state)
 
 	return nil
 }
 
-func (vm *VirtualMachine) handshake() error {
+func (vm *VirtualMachine) handshake(ctx context.Context) error {
 	if socks := vm.vm.SocketDevices(); len(socks) > 0 {
 		vm.vsock = socks[0]
 	} else {
@@ -222,8 +341,8 @@ func (vm *VirtualMachine) handshake() error {
 	go func() {
 		log.Debug("listening for guest events")
 
-		for event := range rpc.NewReceiver(eventStream, 32) {
-			vm.LogChannel <- applog.Message{Subsystem: event.Name, Data: event.Data}
+		for ev := range rpc.NewReceiver(eventStream, 32) {
+			vm.handleGuestEvent(ctx, ev)
 		}
 	}()
 
@@ -255,6 +374,51 @@ func (vm *VirtualMachine) handshake() error {
 		rpc.HostClock(conn)
 	}()
 
+	proxyListener, err := vm.vsock.Listen(5)
+	if err != nil {
+		return fmt.Errorf("failed to listen on socket: %w", err)
+	}
+
+	vm.mutex.Lock()
+	vm.listeners[proxyListener] = struct{}{}
+	vm.mutex.Unlock()
+
+	go applog.FanOut(proxyListener.Accept, vm.acceptGuestConnection, log)
+
+	if hostDNS := vm.Layout.Network.HostDNS; hostDNS != nil && *hostDNS {
+		dnsListener, err := vm.vsock.Listen(3)
+		if err != nil {
+			return fmt.Errorf("failed to listen on socket: %w", err)
+		}
+
+		vm.mutex.Lock()
+		vm.listeners[dnsListener] = struct{}{}
+		vm.mutex.Unlock()
+
+		forwarder := &dns.Forwarder{}
+
+		go applog.FanOut(dnsListener.Accept, forwarder.Serve, log)
+	}
+
+	if vm.Layout.Network.Mode == rpc.NetworkVsock {
+		netListener, err := vm.vsock.Listen(4)
+		if err != nil {
+			return fmt.Errorf("failed to listen on socket: %w", err)
+		}
+
+		vm.mutex.Lock()
+		vm.listeners[netListener] = struct{}{}
+		vm.mutex.Unlock()
+
+		netstack := &vnet.Stack{}
+
+		go applog.FanOut(netListener.Accept, func(conn net.Conn) {
+			if err := netstack.Serve(ctx, conn); err != nil {
+				log.Errorf("guest network failed: %v", err)
+			}
+		}, log)
+	}
+
 	return nil
 }
 
@@ -281,32 +445,6 @@ func (vm *VirtualMachine) mountFilesystems() error {
 	return nil
 }
 
-func (vm *VirtualMachine) metricsLoop(ctx context.Context) {
-	interval := time.Duration(vm.Layout.MetricInterval) * time.Second
-
-	vm.mutex.Lock()
-	keys := util.MapKeys(vm.metrics.Disks)
-	vm.mutex.Unlock()
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-time.After(interval):
-			var metrics event.Metrics
-			if err := vm.client.Metrics(keys, &metrics); err != nil {
-				log.Warnf("failed to get metrics: %s", err)
-			} else {
-				vm.mutex.Lock()
-				vm.metrics = metrics
-				vm.mutex.Unlock()
-
-				event.Emit(ctx, metrics)
-			}
-		}
-	}
-}
-
 func (vm *VirtualMachine) createVMConfig() (*vz.VirtualMachineConfiguration, error) {
 	cmdline := []string{"ro", "root=/dev/vda"}
 
@@ -534,3 +672,17 @@ func (vm *VirtualMachine) Metrics() event.Metrics {
 
 	return vm.metrics
 }
+
+func (vm *VirtualMachine) LastContainerMetrics() event.ContainerMetrics {
+	vm.mutex.RLock()
+	defer vm.mutex.RUnlock()
+
+	return vm.cmetrics
+}
+
+func (vm *VirtualMachine) setContainerMetrics(metrics event.ContainerMetrics) {
+	vm.mutex.Lock()
+	defer vm.mutex.Unlock()
+
+	vm.cmetrics = metrics
+}
@@ -1,7 +1,9 @@
 package host
 
 import (
+	"bufio"
 	"context"
+	"encoding/gob"
 	"fmt"
 	"io"
 	"net"
@@ -52,9 +54,90 @@ func (vm *VirtualMachine) WaitService(name string) (int, error) {
 	return exit, err
 }
 
-func (vm *VirtualMachine) Listen(network, address string) error {
+// Listen... listens on a stream address in the guest, handler is called with each connection accepted on it
+func (vm *VirtualMachine) Listen(network, address string, handler func(net.Conn, rpc.ConnectionRequest)) error {
+	req := rpc.ListenRequest{Network: network, Address: address}
+
+	vm.mutex.Lock()
+	vm.guestListeners[req] = handler
+	vm.mutex.Unlock()
+
+	if err := vm.client.Listen(req, nil); err != nil {
+		vm.mutex.Lock()
+		delete(vm.guestListeners, req)
+		vm.mutex.Unlock()
+
+		//nolint:wrapcheck
+		return err
+	}
+
+	return nil
+}
+
+// bufferedConn... a connection whose reads go through the reader that decoded its ConnectionRequest, which may hold
+// bytes sent by the client right after it
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
 	//nolint:wrapcheck
-	return vm.client.Listen(rpc.ListenRequest{Network: network, Address: address}, nil)
+	return c.reader.Read(p)
+}
+
+// acceptGuestConnection... dispatches a connection from the guest proxy to the handler of its listener
+func (vm *VirtualMachine) acceptGuestConnection(conn net.Conn) {
+	var req rpc.ConnectionRequest
+
+	// gob wraps a reader that is not an io.ByteReader in its own buffer, sharing one keeps the bytes it reads ahead
+	buffered := &bufferedConn{Conn: conn, reader: bufio.NewReader(conn)}
+
+	if err := gob.NewDecoder(buffered.reader).Decode(&req); err != nil {
+		log.Warnf("failed to read connection request: %v", err)
+		_ = conn.Close()
+
+		return
+	}
+
+	vm.mutex.RLock()
+	handler := vm.guestListeners[rpc.ListenRequest{Network: req.Network, Address: req.Listen}]
+	vm.mutex.RUnlock()
+
+	if handler == nil {
+		log.Warnf("no listener for connection to %s/%s", req.Listen, req.Network)
+		_ = conn.Close()
+
+		return
+	}
+
+	handler(buffered, req)
+}
+
+// ForwardToHost... a Listen handler that connects to address on the host
+func ForwardToHost(network, address string) func(net.Conn, rpc.ConnectionRequest) {
+	return func(conn net.Conn, req rpc.ConnectionRequest) {
+		defer conn.Close()
+
+		remote, err := net.Dial(network, address)
+		if err != nil {
+			log.Warnf("failed to connect %s to %s: %v", req.Remote, address, err)
+
+			return
+		}
+		defer remote.Close()
+
+		go func() {
+			_, _ = io.Copy(remote, conn)
+
+			if cw, ok := remote.(interface{ CloseWrite() error }); ok {
+				_ = cw.CloseWrite()
+			}
+		}()
+
+		log.Debugf("forwarding %s in guest to %s", req.Remote, address)
+		_, _ = io.Copy(conn, remote)
+	}
 }
 
 func (vm *VirtualMachine) Signal(pid int64, sig int) error {
@@ -202,6 +285,14 @@ func (vm *VirtualMachine) Shutdown(ctx context.Context) error {
 	return nil
 }
 
+func (vm *VirtualMachine) ContainerMetrics() (event.ContainerMetrics, error) {
+	var out event.ContainerMetrics
+	err := vm.client.ContainerMetrics(struct{}{}, &out)
+
+	//nolint:wrapcheck
+	return out, err
+}
+
 func (vm *VirtualMachine) GC() error {
 	//nolint:wrapcheck
 	return vm.client.GC(struct{}{}, nil)
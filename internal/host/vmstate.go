@@ -3,6 +3,7 @@ package host
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 )
@@ -14,6 +15,17 @@ type DaemonState struct {
 	MachineID     []byte `json:"machine-id,omitempty"`
 	ControlSocket string `json:"control-socket,omitempty"`
 	IPv4Address   string `json:"ipv4-address,omitempty"`
+	IPv6Address   string `json:"ipv6-address,omitempty"`
+	// Disks... sizes set with the disk resize command, by disk label
+	Disks map[string]DiskState `json:"disks,omitempty"`
+	// DiskErrors... the disk changes of the last stop that were not applied, by disk label
+	DiskErrors map[string]string `json:"disk-errors,omitempty"`
+}
+
+// DiskState... a disk size set at runtime, it applies until the size in the configuration file is changed
+type DiskState struct {
+	Size       int64  `json:"size"`
+	ConfigSize string `json:"config-size,omitempty"` // the configured size when Size was set
 }
 
 type Status string
@@ -58,11 +70,23 @@ func OpenDaemonState(path string, status Status, ch <-chan DaemonState) (DaemonS
 				state.IPv4Address = update.IPv4Address
 			}
 
+			if update.IPv6Address != "" {
+				state.IPv6Address = update.IPv6Address
+			}
+
+			if update.Disks != nil {
+				state.Disks = update.Disks
+			}
+
+			if update.DiskErrors != nil {
+				state.DiskErrors = update.DiskErrors
+			}
+
 			if newbs, err := json.Marshal(state); err != nil {
 				log.Warnf("failed to marshal daemon state: %v", err)
 			} else if !bytes.Equal(bs, newbs) {
 				//nolint:gosec
-				if err := os.WriteFile(path, bs, 0644); err != nil {
+				if err := os.WriteFile(path, newbs, 0644); err != nil {
 					log.Warnf("failed to write daemon state: %v", err)
 				} else {
 					bs = newbs
@@ -75,3 +99,47 @@ func OpenDaemonState(path string, status Status, ch <-chan DaemonState) (DaemonS
 
 	return state, done, nil
 }
+
+// UpdateDaemonState... modifies the state file while the daemon is not running
+func UpdateDaemonState(path string, update func(*DaemonState)) error {
+	bs, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read daemon state file %s: %w", path, err)
+	}
+
+	var state DaemonState
+	_ = json.Unmarshal(bs, &state)
+
+	update(&state)
+
+	if bs, err = json.Marshal(state); err != nil {
+		return fmt.Errorf("failed to marshal daemon state: %w", err)
+	}
+
+	//nolint:gosec
+	if err := os.WriteFile(path, bs, 0644); err != nil {
+		return fmt.Errorf("failed to write daemon state file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// DiskChangeError... the error of a disk change that the daemon did not apply when it last stopped
+func DiskChangeError(path string, label string) error {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read daemon state file %s: %w", path, err)
+	}
+
+	var state DaemonState
+
+	if err := json.Unmarshal(bs, &state); err != nil {
+		return fmt.Errorf("failed to parse daemon state file %s: %w", path, err)
+	}
+
+	if msg, ok := state.DiskErrors[label]; ok {
+		return errors.New(msg)
+	}
+
+	return nil
+}
@@ -0,0 +1,306 @@
+package vnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/amadigan/macoby/internal/applog"
+	"github.com/amadigan/macoby/internal/rpc"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/link/ethernet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/arp"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+var log = applog.New("vnet")
+
+const (
+	nicID             = 1
+	mtu               = 1500
+	outboundQueue     = 1024
+	maxInFlight       = 1024
+	defaultDialTimout = 30 * time.Second
+	defaultUDPTimeout = 90 * time.Second
+)
+
+var (
+	// Gateway... the address of the stack on the guest network, connections to it are made to the host loopback
+	Gateway = netip.MustParseAddr("192.168.127.1")
+	// GuestAddress... the static address of the guest
+	GuestAddress = netip.MustParsePrefix("192.168.127.2/24")
+
+	gatewayMAC = tcpip.LinkAddress([]byte{0x5a, 0x94, 0xef, 0xe4, 0x0c, 0xdd})
+)
+
+// Stack... a userspace TCP/IP stack that terminates the TCP and UDP traffic of the guest, making the outbound
+// connections from the host process. Frames are exchanged with the guest over a stream, see rpc.PumpFrames.
+type Stack struct {
+	// Dial... makes outbound connections, defaults to a net.Dialer
+	Dial       func(ctx context.Context, network, address string) (net.Conn, error)
+	UDPTimeout time.Duration
+}
+
+// Serve... runs a network for the guest on the other end of conn until either side closes it
+func (s *Stack) Serve(ctx context.Context, conn io.ReadWriteCloser) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer conn.Close()
+
+	link := channel.New(outboundQueue, mtu+header.EthernetMinimumSize, gatewayMAC)
+	defer link.Close()
+
+	ns, err := s.newStack(ctx, link)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		ns.Close()
+		ns.Wait()
+	}()
+
+	go func() {
+		defer conn.Close()
+
+		for {
+			pkt := link.ReadContext(ctx)
+			if pkt == nil {
+				return
+			}
+
+			view := pkt.ToView()
+			err := rpc.WriteFrame(conn, view.AsSlice())
+
+			view.Release()
+			pkt.DecRef()
+
+			if err != nil {
+				log.Warnf("failed to write frame to guest: %v", err)
+
+				return
+			}
+		}
+	}()
+
+	var buf []byte
+
+	for {
+		frame, err := rpc.ReadFrame(conn, buf)
+		if err != nil {
+			if errors.Is(err, io.EOF) || ctx.Err() != nil {
+				return nil
+			}
+
+			return err
+		}
+
+		buf = frame
+
+		pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(frame)})
+		link.InjectInbound(0, pkt) // the ethernet endpoint reads the protocol from the header
+		pkt.DecRef()
+	}
+}
+
+func (s *Stack) newStack(ctx context.Context, link *channel.Endpoint) (*stack.Stack, error) {
+	ns := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, arp.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+
+	if err := ns.CreateNIC(nicID, ethernet.New(link)); err != nil {
+		return nil, fmt.Errorf("failed to create NIC: %s", err)
+	}
+
+	addr := tcpip.ProtocolAddress{
+		Protocol: ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddressWithPrefix{
+			Address:   tcpip.AddrFrom4(Gateway.As4()),
+			PrefixLen: GuestAddress.Bits(),
+		},
+	}
+
+	if err := ns.AddProtocolAddress(nicID, addr, stack.AddressProperties{}); err != nil {
+		return nil, fmt.Errorf("failed to add gateway address: %s", err)
+	}
+
+	// accept packets for any destination, the stack acts as the router for the guest
+	if err := ns.SetPromiscuousMode(nicID, true); err != nil {
+		return nil, fmt.Errorf("failed to enable promiscuous mode: %s", err)
+	}
+
+	if err := ns.SetSpoofing(nicID, true); err != nil {
+		return nil, fmt.Errorf("failed to enable spoofing: %s", err)
+	}
+
+	ns.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: nicID}})
+
+	tcpForwarder := tcp.NewForwarder(ns, 0, maxInFlight, func(r *tcp.ForwarderRequest) {
+		s.forwardTCP(ctx, r)
+	})
+	ns.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder.HandlePacket)
+
+	udpForwarder := udp.NewForwarder(ns, func(r *udp.ForwarderRequest) {
+		s.forwardUDP(ctx, r)
+	})
+	ns.SetTransportProtocolHandler(udp.ProtocolNumber, udpForwarder.HandlePacket)
+
+	return ns, nil
+}
+
+// forwardTCP... dials the destination before completing the handshake with the guest, so that a refused connection
+// is reported to the guest with a reset
+func (s *Stack) forwardTCP(ctx context.Context, r *tcp.ForwarderRequest) {
+	id := r.ID()
+	target := s.target(id.LocalAddress, id.LocalPort)
+
+	remote, err := s.dial(ctx, "tcp", target)
+	if err != nil {
+		log.Debugf("failed to connect to %s: %v", target, err)
+		r.Complete(true)
+
+		return
+	}
+
+	var wq waiter.Queue
+
+	ep, tcpErr := r.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		log.Debugf("failed to create endpoint for %s: %s", target, tcpErr)
+		r.Complete(true)
+		_ = remote.Close()
+
+		return
+	}
+
+	r.Complete(false)
+	ep.SocketOptions().SetKeepAlive(true)
+
+	proxy(gonet.NewTCPConn(&wq, ep), remote)
+}
+
+// forwardUDP... creates an endpoint for the flow, which must be done before the handler returns, and relays
+// datagrams until the flow is idle
+func (s *Stack) forwardUDP(ctx context.Context, r *udp.ForwarderRequest) {
+	id := r.ID()
+	target := s.target(id.LocalAddress, id.LocalPort)
+
+	var wq waiter.Queue
+
+	ep, tcpErr := r.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		log.Debugf("failed to create endpoint for %s: %s", target, tcpErr)
+
+		return
+	}
+
+	local := gonet.NewUDPConn(&wq, ep)
+
+	go func() {
+		defer local.Close()
+
+		remote, err := s.dial(ctx, "udp", target)
+		if err != nil {
+			log.Debugf("failed to connect to %s: %v", target, err)
+
+			return
+		}
+		defer remote.Close()
+
+		timeout := s.UDPTimeout
+		if timeout <= 0 {
+			timeout = defaultUDPTimeout
+		}
+
+		done := make(chan struct{})
+
+		go func() {
+			defer close(done)
+			relayDatagrams(remote, local, timeout)
+		}()
+
+		relayDatagrams(local, remote, timeout)
+		_ = local.Close()
+		_ = remote.Close()
+		<-done
+	}()
+}
+
+// target... the host address for a destination in the guest network
+func (s *Stack) target(addr tcpip.Address, port uint16) string {
+	ip := netip.AddrFrom4(addr.As4())
+	if ip == Gateway {
+		ip = netip.AddrFrom4([4]byte{127, 0, 0, 1})
+	}
+
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+func (s *Stack) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if s.Dial != nil {
+		return s.Dial(ctx, network, address)
+	}
+
+	dialer := net.Dialer{Timeout: defaultDialTimout}
+
+	//nolint:wrapcheck
+	return dialer.DialContext(ctx, network, address)
+}
+
+// proxy... copies between two connections until both directions are closed
+func proxy(local, remote net.Conn) {
+	defer local.Close()
+	defer remote.Close()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		_, _ = io.Copy(remote, local)
+		closeWrite(remote)
+	}()
+
+	_, _ = io.Copy(local, remote)
+	closeWrite(local)
+	<-done
+}
+
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	} else {
+		_ = conn.Close()
+	}
+}
+
+// relayDatagrams... copies datagrams from src to dst until src is idle for timeout or either side fails
+func relayDatagrams(dst, src net.Conn, timeout time.Duration) {
+	buf := make([]byte, 0xffff)
+
+	for {
+		_ = src.SetReadDeadline(time.Now().Add(timeout))
+
+		n, err := src.Read(buf)
+		if err != nil {
+			return
+		}
+
+		if _, err := dst.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
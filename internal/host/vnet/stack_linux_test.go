@@ -0,0 +1,312 @@
+package vnet
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amadigan/macoby/internal/rpc"
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/link/ethernet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/arp"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+var guestMAC = tcpip.LinkAddress([]byte{0x5a, 0x94, 0xef, 0xe4, 0x0c, 0xee})
+
+// fakeDialer... records the dialed addresses and connects each one to an echo server, refused is dialed with an error
+type fakeDialer struct {
+	mutex   sync.Mutex
+	dialed  []string
+	refused string
+}
+
+func (d *fakeDialer) Dial(_ context.Context, network, address string) (net.Conn, error) {
+	d.mutex.Lock()
+	d.dialed = append(d.dialed, network+" "+address)
+	d.mutex.Unlock()
+
+	if address == d.refused {
+		return nil, errors.New("connection refused")
+	}
+
+	local, remote := net.Pipe()
+
+	go func() {
+		defer remote.Close()
+
+		buf := make([]byte, 0xffff)
+
+		for {
+			n, err := remote.Read(buf)
+			if err != nil {
+				return
+			}
+
+			if _, err := remote.Write(append([]byte(network+":"), buf[:n]...)); err != nil {
+				return
+			}
+		}
+	}()
+
+	return local, nil
+}
+
+func (d *fakeDialer) addresses() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return append([]string(nil), d.dialed...)
+}
+
+func socketpair(t *testing.T, typ int) (*os.File, *os.File) {
+	t.Helper()
+
+	// non-blocking so that the files use the runtime poller, and a close interrupts a pending read
+	fds, err := unix.Socketpair(unix.AF_UNIX, typ|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, 0)
+	if err != nil {
+		t.Fatalf("socketpair: %v", err)
+	}
+
+	return os.NewFile(uintptr(fds[0]), "host"), os.NewFile(uintptr(fds[1]), "guest")
+}
+
+// startGuest... runs a stack with the guest address whose frames go through a seqpacket socket standing in for the
+// TAP device, pumped to stream the way the guest does
+func startGuest(ctx context.Context, t *testing.T, stream io.ReadWriteCloser) *stack.Stack {
+	t.Helper()
+
+	tapHost, tapGuest := socketpair(t, unix.SOCK_SEQPACKET)
+
+	link := channel.New(outboundQueue, mtu+header.EthernetMinimumSize, guestMAC)
+	ns := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, arp.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+
+	if err := ns.CreateNIC(nicID, ethernet.New(link)); err != nil {
+		t.Fatalf("failed to create NIC: %s", err)
+	}
+
+	addr := tcpip.ProtocolAddress{
+		Protocol: ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddressWithPrefix{
+			Address:   tcpip.AddrFrom4(GuestAddress.Addr().As4()),
+			PrefixLen: GuestAddress.Bits(),
+		},
+	}
+
+	if err := ns.AddProtocolAddress(nicID, addr, stack.AddressProperties{}); err != nil {
+		t.Fatalf("failed to add guest address: %s", err)
+	}
+
+	ns.SetRouteTable([]tcpip.Route{{
+		Destination: header.IPv4EmptySubnet,
+		Gateway:     tcpip.AddrFrom4(Gateway.As4()),
+		NIC:         nicID,
+	}})
+
+	go func() {
+		for {
+			pkt := link.ReadContext(ctx)
+			if pkt == nil {
+				return
+			}
+
+			view := pkt.ToView()
+			_, _ = tapGuest.Write(view.AsSlice())
+
+			view.Release()
+			pkt.DecRef()
+		}
+	}()
+
+	go func() {
+		buf := make([]byte, 0xffff)
+
+		for {
+			n, err := tapGuest.Read(buf)
+			if err != nil {
+				return
+			}
+
+			pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(buf[:n])})
+			link.InjectInbound(0, pkt)
+			pkt.DecRef()
+		}
+	}()
+
+	go func() {
+		_ = rpc.PumpFrames(tapHost, stream)
+	}()
+
+	t.Cleanup(func() {
+		_ = stream.Close()
+		_ = tapHost.Close()
+		_ = tapGuest.Close()
+		ns.Close()
+		link.Close()
+	})
+
+	return ns
+}
+
+func startStack(t *testing.T, dialer *fakeDialer) *stack.Stack {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	t.Cleanup(cancel)
+
+	hostEnd, guestEnd := socketpair(t, unix.SOCK_STREAM)
+
+	s := &Stack{Dial: dialer.Dial, UDPTimeout: time.Second}
+	done := make(chan error, 1)
+
+	go func() {
+		done <- s.Serve(ctx, hostEnd)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		_ = hostEnd.Close()
+		<-done
+	})
+
+	return startGuest(ctx, t, guestEnd)
+}
+
+func fullAddress(ip string, port uint16) tcpip.FullAddress {
+	return tcpip.FullAddress{NIC: nicID, Addr: tcpip.AddrFromSlice(net.ParseIP(ip).To4()), Port: port}
+}
+
+func roundTrip(t *testing.T, conn net.Conn, msg string) string {
+	t.Helper()
+
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	buf := make([]byte, 1024)
+
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	return string(buf[:n])
+}
+
+func TestForwardTCP(t *testing.T) {
+	dialer := &fakeDialer{}
+	guest := startStack(t, dialer)
+
+	conn, err := gonet.DialTCP(guest, fullAddress("10.1.2.3", 80), ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	if got := roundTrip(t, conn, "hello"); got != "tcp:hello" {
+		t.Errorf("echo = %q, want %q", got, "tcp:hello")
+	}
+
+	if got := dialer.addresses(); len(got) != 1 || got[0] != "tcp 10.1.2.3:80" {
+		t.Errorf("dialed %v, want [tcp 10.1.2.3:80]", got)
+	}
+}
+
+func TestForwardTCPGateway(t *testing.T) {
+	dialer := &fakeDialer{}
+	guest := startStack(t, dialer)
+
+	conn, err := gonet.DialTCP(guest, fullAddress(Gateway.String(), 8080), ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	if got := roundTrip(t, conn, "ping"); got != "tcp:ping" {
+		t.Errorf("echo = %q, want %q", got, "tcp:ping")
+	}
+
+	// the gateway is the host loopback interface
+	if got := dialer.addresses(); len(got) != 1 || got[0] != "tcp 127.0.0.1:8080" {
+		t.Errorf("dialed %v, want [tcp 127.0.0.1:8080]", got)
+	}
+}
+
+func TestForwardTCPRefused(t *testing.T) {
+	dialer := &fakeDialer{refused: "10.1.2.3:81"}
+	guest := startStack(t, dialer)
+
+	conn, err := gonet.DialTCP(guest, fullAddress("10.1.2.3", 81), ipv4.ProtocolNumber)
+	if err == nil {
+		_ = conn.Close()
+		t.Fatal("connected to a refused address")
+	}
+}
+
+func TestForwardUDP(t *testing.T) {
+	dialer := &fakeDialer{}
+	guest := startStack(t, dialer)
+
+	remote := fullAddress("10.1.2.3", 53)
+
+	conn, err := gonet.DialUDP(guest, nil, &remote, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("failed to create udp endpoint: %v", err)
+	}
+	defer conn.Close()
+
+	for _, msg := range []string{"query", "another"} {
+		if got := roundTrip(t, conn, msg); got != "udp:"+msg {
+			t.Errorf("echo = %q, want %q", got, "udp:"+msg)
+		}
+	}
+
+	// both datagrams belong to the same flow
+	if got := dialer.addresses(); len(got) != 1 || got[0] != "udp 10.1.2.3:53" {
+		t.Errorf("dialed %v, want [udp 10.1.2.3:53]", got)
+	}
+}
+
+func TestServeReturnsOnClose(t *testing.T) {
+	hostEnd, guestEnd := socketpair(t, unix.SOCK_STREAM)
+	done := make(chan error, 1)
+
+	go func() {
+		done <- (&Stack{}).Serve(context.Background(), hostEnd)
+	}()
+
+	frame := bytes.Repeat([]byte{0}, header.EthernetMinimumSize)
+	if err := rpc.WriteFrame(guestEnd, frame); err != nil {
+		t.Fatalf("failed to write frame: %v", err)
+	}
+
+	_ = guestEnd.Close()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Serve returned %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Serve did not return after the guest closed the connection")
+	}
+}
@@ -5,8 +5,20 @@ import (
 	"errors"
 	"fmt"
 	"io"
+
+	"github.com/amadigan/macoby/internal/event"
 )
 
+func init() {
+	RegisterGuestEvent(LogEvent{})
+	RegisterGuestEvent(event.Metrics{})
+	RegisterGuestEvent(event.ContainerMetrics{})
+	RegisterGuestEvent(event.OOMKill{})
+	RegisterGuestEvent(event.ServiceState{})
+	RegisterGuestEvent(event.ClockStats{})
+	RegisterGuestEvent(event.AddressChange{})
+}
+
 type LogMethod int8
 
 const (
@@ -22,16 +34,26 @@ type LogEvent struct {
 	Data   []byte
 }
 
-func NewEmitter(w io.WriteCloser, bufsize int) chan<- LogEvent {
+// GuestEvent... a typed event pushed from the guest to the host on the event stream
+type GuestEvent struct {
+	Event any
+}
+
+// RegisterGuestEvent... registers an event type that may be sent on the event stream
+func RegisterGuestEvent(e any) {
+	gob.Register(e)
+}
+
+func NewEmitter(w io.WriteCloser, bufsize int) chan<- GuestEvent {
 	enc := gob.NewEncoder(w)
-	ch := make(chan LogEvent, bufsize)
+	ch := make(chan GuestEvent, bufsize)
 
 	go func() {
 		defer w.Close()
 
 		for e := range ch {
 			if err := enc.Encode(e); err != nil {
-				panic(fmt.Errorf("failed to encode log event: %w", err))
+				panic(fmt.Errorf("failed to encode %T event: %w", e.Event, err))
 			}
 		}
 	}()
@@ -39,23 +61,23 @@ func NewEmitter(w io.WriteCloser, bufsize int) chan<- LogEvent {
 	return ch
 }
 
-func NewReceiver(r io.ReadCloser, bufsize int) <-chan LogEvent {
+func NewReceiver(r io.ReadCloser, bufsize int) <-chan GuestEvent {
 	dec := gob.NewDecoder(r)
-	ch := make(chan LogEvent, bufsize)
+	ch := make(chan GuestEvent, bufsize)
 
 	go func() {
 		defer r.Close()
 		defer close(ch)
 
 		for {
-			var e LogEvent
+			var e GuestEvent
 
 			if err := dec.Decode(&e); err != nil {
 				if errors.Is(err, io.EOF) {
 					return
 				}
 
-				panic(fmt.Errorf("failed to decode log event: %w", err))
+				panic(fmt.Errorf("failed to decode guest event: %w", err))
 			}
 
 			ch <- e
@@ -66,7 +88,7 @@ func NewReceiver(r io.ReadCloser, bufsize int) <-chan LogEvent {
 }
 
 type emitterWriter struct {
-	emitter chan<- LogEvent
+	emitter chan<- GuestEvent
 	name    string
 	method  LogMethod
 }
@@ -74,16 +96,16 @@ type emitterWriter struct {
 func (ew *emitterWriter) Write(p []byte) (int, error) {
 	data := make([]byte, len(p))
 	copy(data, p)
-	ew.emitter <- LogEvent{
+	ew.emitter <- GuestEvent{Event: LogEvent{
 		Name:   ew.name,
 		Method: ew.method,
 		Data:   data,
-	}
+	}}
 
 	return len(data), nil
 }
 
-func NewEmitterWriter(emitter chan<- LogEvent, name string, method LogMethod) io.Writer {
+func NewEmitterWriter(emitter chan<- GuestEvent, name string, method LogMethod) io.Writer {
 	return &emitterWriter{
 		emitter: emitter,
 		name:    name,
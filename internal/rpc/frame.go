@@ -0,0 +1,100 @@
+package rpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Streams carrying messages, such as DNS queries or ethernet frames, prefix each message with its length as a 16 bit
+// big endian integer, as on a DNS TCP connection (RFC 1035 4.2.2).
+
+// ReadFrame... reads a length prefixed message, reusing buf if it is large enough
+func ReadFrame(r io.Reader, buf []byte) ([]byte, error) {
+	var size uint16
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		//nolint:wrapcheck
+		return nil, err
+	}
+
+	if cap(buf) < int(size) {
+		buf = make([]byte, size)
+	}
+
+	buf = buf[:size]
+
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("failed to read frame: %w", err)
+	}
+
+	return buf, nil
+}
+
+func WriteFrame(w io.Writer, msg []byte) error {
+	if len(msg) > 0xffff {
+		return fmt.Errorf("frame too large: %d bytes", len(msg))
+	}
+
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg))) //nolint:gosec
+	copy(buf[2:], msg)
+
+	_, err := w.Write(buf)
+
+	//nolint:wrapcheck
+	return err
+}
+
+// PumpFrames... copies ethernet frames between a TAP device, which returns a single frame from each read, and a
+// stream of length prefixed frames. Returns the first error from either direction, the caller should close both.
+func PumpFrames(tap io.ReadWriter, stream io.ReadWriter) error {
+	errs := make(chan error, 2)
+
+	go func() {
+		buf := make([]byte, 0xffff)
+
+		for {
+			n, err := tap.Read(buf)
+			if err != nil {
+				errs <- fmt.Errorf("failed to read from tap: %w", err)
+
+				return
+			}
+
+			if err := WriteFrame(stream, buf[:n]); err != nil {
+				errs <- fmt.Errorf("failed to write frame: %w", err)
+
+				return
+			}
+		}
+	}()
+
+	go func() {
+		var buf []byte
+
+		for {
+			frame, err := ReadFrame(stream, buf)
+			if err != nil {
+				errs <- err
+
+				return
+			}
+
+			buf = frame
+
+			if _, err := tap.Write(frame); err != nil {
+				errs <- fmt.Errorf("failed to write to tap: %w", err)
+
+				return
+			}
+		}
+	}()
+
+	err := <-errs
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+
+	return err
+}
@@ -5,6 +5,7 @@ import (
 	"io"
 	"net"
 	"net/rpc"
+	"strings"
 	"time"
 
 	"github.com/amadigan/macoby/internal/event"
@@ -12,15 +13,30 @@ import (
 
 type Guest interface {
 	// Init... initialize the guest
-	Init(InitRequest, *struct{}) error
-	// DHCP... start DHCPv4 on the main network interface
+	Init(InitRequest, *InitResponse) error
+	// DHCP... configure the main network interface, with DHCPv4 unless a static address was set by Init. IPv6 is
+	// configured in the background, its address is reported with an AddressChange event.
 	DHCP(struct{}, *DHCPResponse) error
 	// Write... overwrite/create a file
 	Write(WriteRequest, *struct{}) error
 	// Mkdir... create a directory, including parents
 	Mkdir(string, *struct{}) error
-	// Mount... mount a filesystem
+	// Mount... mount a filesystem, or enable swap on a device if FS is swap
 	Mount(MountRequest, *struct{}) error
+	// Zram... enable a compressed swap device in memory
+	Zram(ZramRequest, *struct{}) error
+	// Trim... discard the unused blocks of mounted filesystems, like fstrim
+	Trim([]string, *[]TrimResult) error
+	// DeviceSize... the size in bytes of a block device, as currently seen by the guest kernel
+	DeviceSize(string, *uint64) error
+	// Unlock... open an encrypted device, returns the path of the unlocked device
+	Unlock(UnlockRequest, *string) error
+	// Snapshot... create, list, delete or restore btrfs snapshots of a disk, returns the snapshots affected
+	Snapshot(SnapshotRequest, *[]Snapshot) error
+	// Modprobe... load or unload kernel modules and their dependencies, returns the outcome for each module
+	Modprobe(ModprobeRequest, *[]ModuleResult) error
+	// ListModules... the loaded kernel modules, or with true all modules known to the guest kernel
+	ListModules(bool, *[]Module) error
 	// Run... execute a command synchronously
 	Run(Command, *CommandOutput) error
 	// Launch... execute a command asynchronously, output sent to event stream
@@ -29,12 +45,18 @@ type Guest interface {
 	Wait(string, *int) error
 	// Release... release a service without calling Wait
 	Release(string, *struct{}) error
-	// Listen... listen on a network address
+	// Listen... listen on a stream address in the guest, connections are forwarded to the host proxy port
 	Listen(ListenRequest, *struct{}) error
+	// AddCertificates... trust CA certificates in the guest, and for dockerd registries, replacing those added before
+	AddCertificates([]Certificate, *struct{}) error
 	// Signal... send a signal to a process
 	Signal(SignalRequest, *struct{}) error
 	// Metrics... get system metrics
 	Metrics([]string, *event.Metrics) error
+	// ContainerMetrics... get per-container cgroup metrics
+	ContainerMetrics(struct{}, *event.ContainerMetrics) error
+	// PushMetrics... set the interval at which metrics are pushed on the event stream
+	PushMetrics(MetricsRequest, *struct{}) error
 	// Shutdown... initiate shutdown
 	Shutdown(struct{}, *struct{}) error
 	// GC... run garbage collection
@@ -42,11 +64,74 @@ type Guest interface {
 }
 
 type InitRequest struct {
-	OverlaySize   uint64
+	Overlay       OverlayConfig
 	ClockInterval time.Duration
 	Sysctl        map[string]string
+	Modules       []string // kernel modules loaded before the sysctls are written, as in ModprobeRequest
+	Network       NetworkConfig
+	DNSStub       string // address of the DNS stub forwarding to the host resolver, empty to disable
+	Hostname      string
+	Hosts         []HostEntry // static entries for /etc/hosts
+	GatewayNames  []string    // names for the default gateway in /etc/hosts, added once the network is configured
+	TimeZone      string      // IANA name of the time zone, empty for UTC
+	ZoneInfo      []byte      // TZif data for TimeZone
 }
 
+// InitResponse... the result of each module of InitRequest.Modules
+type InitResponse struct {
+	Modules []ModuleResult
+}
+
+// OverlayConfig... the layers of the overlay over the read-only root. The upper layer is a tmpfs of Size bytes, unless
+// Device is set, then it is kept on that device so it survives a reboot. Mkfs is the command line to format the device
+// with first, if it has no filesystem yet. Grow grows the filesystem of the device to the size of the device.
+// Extensions are stacked between the upper layer and the root, the first one on top.
+type OverlayConfig struct {
+	Size       uint64
+	Device     string
+	FS         string
+	Mkfs       []string
+	Grow       bool
+	Extensions []OverlayLayer
+}
+
+// OverlayLayer... a read-only block device holding a squashfs filesystem, or an uncompressed tar archive that is
+// unpacked to a tmpfs
+type OverlayLayer struct {
+	Device string
+	FS     string
+}
+
+const LayerTar = "tar"
+
+type HostEntry struct {
+	Address string
+	Names   []string
+}
+
+// NetworkConfig... if Address is set, the guest uses a static configuration instead of DHCP. DNS replaces the
+// nameservers from DHCP, Search is added to the search domains from DHCP. IPv6 selects the IPv6 configuration mode.
+// Mode selects how the guest is attached to the network, in vsock mode Address must be set.
+type NetworkConfig struct {
+	Address string // CIDR notation
+	Gateway string
+	DNS     []string
+	Search  []string
+	IPv6    string
+	Mode    string
+}
+
+const (
+	NetworkNAT   = "nat"   // the NAT attachment of Virtualization.framework, the default
+	NetworkVsock = "vsock" // a TAP interface connected to a userspace network stack on the host over vsock
+)
+
+const (
+	IPv6SLAAC = "slaac"  // stateless address autoconfiguration only, the default
+	IPv6DHCP  = "dhcpv6" // SLAAC, with resolvers from stateless DHCPv6
+	IPv6Off   = "off"
+)
+
 type DHCPResponse struct {
 	Address net.IP
 }
@@ -69,18 +154,118 @@ type MountRequest struct {
 	Flags  []string
 }
 
+type ZramRequest struct {
+	Size      uint64 // in bytes
+	Algorithm string // compression algorithm, empty for the kernel default
+	Priority  int    // swap priority, zero for the default which is above disk swap
+}
+
+// TrimResult... the outcome of trimming one mount point, Trimmed is the number of bytes discarded as reported by the
+// kernel, which may include blocks that were already discarded
+type TrimResult struct {
+	Mount   string
+	Trimmed uint64
+	Error   string
+}
+
+// UnlockRequest... opens the LUKS device Device as /dev/mapper/Name. Key is passed to cryptsetup on stdin, it is never
+// stored in the guest. Format formats the device with LUKS first, destroying its contents. Discard passes discards
+// through to the device, which lets trim release space in the image but reveals which blocks are unused.
+type UnlockRequest struct {
+	Device   string
+	Name     string
+	Key      []byte
+	Format   bool
+	Discard  bool
+	ReadOnly bool
+}
+
+// MapperDevice... the path of a device opened with Unlock
+func MapperDevice(name string) string {
+	return "/dev/mapper/" + name
+}
+
+// SnapshotRequest... a snapshot operation on the btrfs filesystem of Device. Snapshots are kept in the top level
+// subvolume, a restore unmounts Mount and makes a copy of the snapshot the default subvolume, which is mounted at Mount
+// on the next start.
+type SnapshotRequest struct {
+	Op     string
+	Device string
+	Mount  string
+	Name   string
+}
+
+const (
+	SnapshotList    = "list"
+	SnapshotCreate  = "create"
+	SnapshotDelete  = "delete"
+	SnapshotRestore = "restore"
+)
+
+// Snapshot... a snapshot of a disk, including the subvolumes nested in it
+type Snapshot struct {
+	Name    string
+	Created time.Time
+}
+
+// ValidSnapshotName... a snapshot name is a single path element that does not start with a dot
+func ValidSnapshotName(name string) bool {
+	return name != "" && len(name) <= 255 && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, "/\x00")
+}
+
+// ModprobeRequest... each module is a name, optionally followed by its parameters as in /etc/modules. Remove unloads
+// the modules instead, their dependencies stay loaded.
+type ModprobeRequest struct {
+	Modules []string
+	Remove  bool
+}
+
+// ModuleResult... the outcome for one module of a Modprobe request, Error is set unless the status is loaded, builtin
+// or removed
+type ModuleResult struct {
+	Name   string
+	Status string
+	Error  string
+}
+
+const (
+	ModuleLoaded  = "loaded"
+	ModuleBuiltin = "builtin" // built into the kernel, it cannot be unloaded
+	ModuleRemoved = "removed"
+	ModuleMissing = "missing" // not built for the guest kernel
+	ModuleFailed  = "failed"
+)
+
+// Module... a kernel module, State is its state in /proc/modules, builtin, or empty if it is not loaded
+type Module struct {
+	Name   string
+	Size   uint64
+	Refs   int
+	UsedBy []string
+	State  string
+}
+
 type Command struct {
 	Name  string // only applies to Launch, identifies the service in the event log
 	Path  string
 	Dir   string
 	Args  []string
-	Env   []string
+	Env   []string // added to the environment of the guest init process
 	Input []byte
+	// Timeout... only applies to Run, once it expires the process and everything it started are killed
+	Timeout time.Duration
 }
 
+// CommandOutput... the combined output and exit status of Run, TimedOut is set if the command was killed by its timeout
 type CommandOutput struct {
-	Output []byte
-	Exit   int
+	Output   []byte
+	Exit     int
+	TimedOut bool
+}
+
+type MetricsRequest struct {
+	Disks    []string
+	Interval time.Duration // zero disables pushed metrics
 }
 
 type ListenRequest struct {
@@ -88,6 +273,23 @@ type ListenRequest struct {
 	Address string
 }
 
+// Certificate... PEM encoded CA certificates, installed as Name.crt. If Registry is set, the certificates are also
+// installed for that registry in /etc/docker/certs.d.
+type Certificate struct {
+	Name     string
+	Registry string
+	PEM      []byte
+}
+
+// ConnectionRequest... sent gob-encoded by the guest at the beginning of each connection accepted on a socket created
+// by Listen. Listen is the address of the ListenRequest, Local and Remote are the addresses of the accepted connection.
+type ConnectionRequest struct {
+	Network string
+	Listen  string
+	Local   string
+	Remote  string
+}
+
 // The guest API only runs on one connection per VM
 func ServeGuestAPI(g Guest, conn io.ReadWriteCloser) error {
 	server := rpc.NewServer()
@@ -109,9 +311,9 @@ func NewGuestClient(c *rpc.Client) Guest {
 	return &GuestClient{c}
 }
 
-func (c *GuestClient) Init(req InitRequest, _ *struct{}) error {
+func (c *GuestClient) Init(req InitRequest, out *InitResponse) error {
 	//nolint:wrapcheck
-	return c.Call("Guest.Init", req, nil)
+	return c.Call("Guest.Init", req, out)
 }
 
 func (c *GuestClient) DHCP(_ struct{}, out *DHCPResponse) error {
@@ -159,6 +361,46 @@ func (c *GuestClient) Listen(req ListenRequest, _ *struct{}) error {
 	return c.Call("Guest.Listen", req, nil)
 }
 
+func (c *GuestClient) AddCertificates(certs []Certificate, _ *struct{}) error {
+	//nolint:wrapcheck
+	return c.Call("Guest.AddCertificates", certs, nil)
+}
+
+func (c *GuestClient) Zram(req ZramRequest, _ *struct{}) error {
+	//nolint:wrapcheck
+	return c.Call("Guest.Zram", req, nil)
+}
+
+func (c *GuestClient) Trim(mounts []string, out *[]TrimResult) error {
+	//nolint:wrapcheck
+	return c.Call("Guest.Trim", mounts, out)
+}
+
+func (c *GuestClient) DeviceSize(device string, out *uint64) error {
+	//nolint:wrapcheck
+	return c.Call("Guest.DeviceSize", device, out)
+}
+
+func (c *GuestClient) Unlock(req UnlockRequest, out *string) error {
+	//nolint:wrapcheck
+	return c.Call("Guest.Unlock", req, out)
+}
+
+func (c *GuestClient) Snapshot(req SnapshotRequest, out *[]Snapshot) error {
+	//nolint:wrapcheck
+	return c.Call("Guest.Snapshot", req, out)
+}
+
+func (c *GuestClient) Modprobe(req ModprobeRequest, out *[]ModuleResult) error {
+	//nolint:wrapcheck
+	return c.Call("Guest.Modprobe", req, out)
+}
+
+func (c *GuestClient) ListModules(all bool, out *[]Module) error {
+	//nolint:wrapcheck
+	return c.Call("Guest.ListModules", all, out)
+}
+
 func (c *GuestClient) Shutdown(_ struct{}, _ *struct{}) error {
 	//nolint:wrapcheck
 	return c.Call("Guest.Shutdown", struct{}{}, nil)
@@ -169,6 +411,16 @@ func (c *GuestClient) Metrics(req []string, out *event.Metrics) error {
 	return c.Call("Guest.Metrics", req, out)
 }
 
+func (c *GuestClient) ContainerMetrics(_ struct{}, out *event.ContainerMetrics) error {
+	//nolint:wrapcheck
+	return c.Call("Guest.ContainerMetrics", struct{}{}, out)
+}
+
+func (c *GuestClient) PushMetrics(req MetricsRequest, _ *struct{}) error {
+	//nolint:wrapcheck
+	return c.Call("Guest.PushMetrics", req, nil)
+}
+
 func (c *GuestClient) Signal(req SignalRequest, _ *struct{}) error {
 	//nolint:wrapcheck
 	return c.Call("Guest.Signal", req, nil)
@@ -3,11 +3,15 @@ package rpc
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"runtime"
 	"time"
+
+	"github.com/amadigan/macoby/internal/event"
 )
 
 type clockMessage struct {
@@ -16,10 +20,48 @@ type clockMessage struct {
 	TimeNsec int64
 }
 
+// Clock... a source of time and timers, allows the clock protocol and filter to be driven by a simulated clock
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (systemClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+// ClockAdjuster... applies corrections to the local clock
+type ClockAdjuster interface {
+	// Step... jump the clock by the given offset
+	Step(offset time.Duration) error
+	// SetFrequency... set the frequency correction of the clock, in ppm
+	SetFrequency(ppm float64) error
+}
+
+// ClockSample... a single exchange with the host clock
+type ClockSample struct {
+	Time   time.Time     // local time the response was received
+	Offset time.Duration // host time minus local time
+	Delay  time.Duration // round trip time
+}
+
 func HostClock(conn net.Conn) {
+	serveClock(conn, systemClock{})
+}
+
+func serveClock(conn io.ReadWriteCloser, clock Clock) {
 	defer conn.Close()
-	//runtime.LockOSThread()
-	//defer runtime.UnlockOSThread()
 
 	var cm clockMessage
 
@@ -32,7 +74,7 @@ func HostClock(conn net.Conn) {
 			return
 		}
 
-		now := time.Now()
+		now := clock.Now()
 		cm.TimeSec = now.Unix()
 		cm.TimeNsec = int64(now.Nanosecond())
 
@@ -43,78 +85,323 @@ func HostClock(conn net.Conn) {
 	}
 }
 
-func GuestClock(ctx context.Context, conn net.Conn, interval time.Duration, adjtime func(time.Duration) error) {
+const (
+	defaultClockBurst     = 8
+	defaultClockInterval  = 10 * time.Second
+	defaultProbeInterval  = 2 * time.Second
+	defaultStepThreshold  = 128 * time.Millisecond
+	defaultJumpThreshold  = time.Second
+	defaultMaxClockDelay  = 50 * time.Millisecond
+	defaultFrequencyGain  = 0.25
+	maxFrequencyPPM       = 500.0
+	clockBurstSpacing     = 2 * time.Millisecond
+	nanosecondsPerPPMSecs = 1e3
+)
+
+func GuestClock(ctx context.Context, conn net.Conn, interval time.Duration, adj ClockAdjuster, stats func(event.ClockStats)) {
 	defer conn.Close()
 
 	log.Infof("clock client started on interval %v", interval)
 
-	maxLatency := 5 * time.Millisecond
+	cs := &ClockSync{
+		Conn:     conn,
+		Clock:    systemClock{},
+		Adjuster: adj,
+		Stats:    stats,
+		Interval: interval,
+	}
 
-	for id := uint32(0); ; id++ {
-		log.Debugf("clock client sync %d", id)
+	if err := cs.Run(ctx); err != nil {
+		log.Errorf("clock client failed: %v", err)
+	}
+}
 
-		var err error
-		if maxLatency, err = syncClock(conn, id, adjtime, maxLatency); err != nil {
-			log.Errorf("clock client failed: %v", err)
+// ClockSync... periodically samples the host clock in bursts and disciplines the local clock. Between bursts, single
+// probes detect large jumps, such as the host waking from sleep.
+type ClockSync struct {
+	Conn          io.ReadWriter
+	Clock         Clock
+	Adjuster      ClockAdjuster
+	Filter        ClockFilter
+	Stats         func(event.ClockStats)
+	Interval      time.Duration
+	ProbeInterval time.Duration
+	Burst         int
 
-			return
+	id uint32
+}
+
+func (cs *ClockSync) Run(ctx context.Context) error {
+	if cs.Burst <= 0 {
+		cs.Burst = defaultClockBurst
+	}
+
+	if cs.Interval <= 0 {
+		cs.Interval = defaultClockInterval
+	}
+
+	if cs.ProbeInterval <= 0 || cs.ProbeInterval > cs.Interval {
+		cs.ProbeInterval = min(defaultProbeInterval, cs.Interval)
+	}
+
+	next := cs.Clock.Now()
+
+	for {
+		if !cs.Clock.Now().Before(next) {
+			samples, err := cs.burst()
+			if err != nil {
+				return err
+			}
+
+			if adj, ok := cs.Filter.Update(samples, cs.Interval); ok {
+				if err := cs.apply(adj); err != nil {
+					return err
+				}
+			} else {
+				log.Warnf("clock client discarded burst of %d samples", len(samples))
+			}
+
+			next = cs.Clock.Now().Add(cs.Interval)
+		} else {
+			sample, err := cs.sample()
+			if err != nil {
+				return err
+			}
+
+			if adj, ok := cs.Filter.Probe(sample); ok {
+				log.Infof("clock jumped by %v, stepping", sample.Offset)
+
+				if err := cs.apply(adj); err != nil {
+					return err
+				}
+
+				next = cs.Clock.Now().Add(cs.Interval)
+			}
 		}
 
 		select {
 		case <-ctx.Done():
-			return
-		case <-time.After(interval):
+			return nil
+		case <-cs.Clock.After(cs.ProbeInterval):
 		}
 	}
 }
 
-func syncClock(conn net.Conn, id uint32, adjtime func(time.Duration) error, maxlatency time.Duration) (time.Duration, error) {
+func (cs *ClockSync) apply(adj ClockAdjustment) error {
+	if adj.Step != 0 {
+		log.Infof("stepping clock by %v", adj.Step)
+
+		if err := cs.Adjuster.Step(adj.Step); err != nil {
+			return fmt.Errorf("clock step failed: %w", err)
+		}
+	} else {
+		log.Debugf("clock offset %v, frequency %.3fppm", adj.Stats.Offset, adj.Frequency)
+	}
+
+	if err := cs.Adjuster.SetFrequency(adj.Frequency); err != nil {
+		return fmt.Errorf("clock frequency adjustment failed: %w", err)
+	}
+
+	if cs.Stats != nil {
+		cs.Stats(adj.Stats)
+	}
+
+	return nil
+}
+
+func (cs *ClockSync) burst() ([]ClockSample, error) {
+	samples := make([]ClockSample, 0, cs.Burst)
+
+	for i := range cs.Burst {
+		if i > 0 {
+			cs.Clock.Sleep(clockBurstSpacing)
+		}
+
+		sample, err := cs.sample()
+		if err != nil {
+			return samples, err
+		}
+
+		samples = append(samples, sample)
+	}
+
+	return samples, nil
+}
+
+func (cs *ClockSync) sample() (ClockSample, error) {
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 
-	start := time.Now()
+	cs.id++
 
-	if err := binary.Write(conn, binary.LittleEndian, id); err != nil {
-		if err != io.EOF {
-			return maxlatency, fmt.Errorf("clock client write failed: %v", err)
-		}
+	start := cs.Clock.Now()
 
-		return maxlatency, nil
+	if err := binary.Write(cs.Conn, binary.LittleEndian, cs.id); err != nil {
+		return ClockSample{}, fmt.Errorf("clock client write failed: %w", err)
 	}
 
 	var cm clockMessage
-	if err := binary.Read(conn, binary.LittleEndian, &cm); err != nil {
-		if err != io.EOF {
-			return maxlatency, fmt.Errorf("clock client read failed: %v", err)
+	if err := binary.Read(cs.Conn, binary.LittleEndian, &cm); err != nil {
+		if errors.Is(err, io.EOF) {
+			return ClockSample{}, fmt.Errorf("clock server closed connection: %w", err)
 		}
 
-		return maxlatency, nil
+		return ClockSample{}, fmt.Errorf("clock client read failed: %w", err)
 	}
 
-	stop := time.Now()
-	latency := stop.Sub(start) / 2
-	if latency > maxlatency {
-		log.Warnf("clock client sync took too long: %v", latency)
+	stop := cs.Clock.Now()
 
-		return latency * 2, nil
+	if cm.Id != cs.id {
+		return ClockSample{}, fmt.Errorf("clock client got unexpected id: %d, expected %d", cm.Id, cs.id)
 	}
 
-	if cm.Id != id {
-		return latency * 2, fmt.Errorf("clock client got unexpected id: %d, expected %d", cm.Id, id)
+	delay := stop.Sub(start)
+	serverTime := time.Unix(cm.TimeSec, cm.TimeNsec)
+
+	return ClockSample{Time: stop, Offset: serverTime.Sub(start.Add(delay / 2)), Delay: delay}, nil
+}
+
+// ClockAdjustment... a correction computed by the ClockFilter
+type ClockAdjustment struct {
+	Step      time.Duration // if non-zero, step the clock by this amount
+	Frequency float64       // the frequency to set, in ppm
+	Stats     event.ClockStats
+}
+
+// ClockFilter... computes clock corrections from samples. Offsets under StepThreshold are slewed out over the next
+// interval by temporarily adjusting the frequency, the remaining error after the slew is used to estimate the
+// frequency error of the local clock. Zero-valued thresholds use defaults.
+type ClockFilter struct {
+	StepThreshold time.Duration
+	JumpThreshold time.Duration
+	MaxDelay      time.Duration
+	Gain          float64
+
+	synced   bool
+	freq     float64       // estimated frequency correction, in ppm
+	slew     float64       // frequency added to slew out the last offset, in ppm
+	jitter   float64       // in seconds
+	last     time.Time     // time of the last accepted sample
+	expected time.Duration // offset remaining at last, before slewing
+}
+
+// Update... selects the sample with the lowest delay from a burst and computes a correction, returns false if no
+// sample was usable
+func (f *ClockFilter) Update(samples []ClockSample, interval time.Duration) (ClockAdjustment, bool) {
+	f.setDefaults()
+
+	best, ok := minDelay(samples)
+	if !ok || best.Delay > f.MaxDelay {
+		return ClockAdjustment{}, false
 	}
 
-	serverTime := time.Unix(cm.TimeSec, cm.TimeNsec)
-	offset := serverTime.Sub(start.Add(latency))
+	if !f.synced || best.Offset.Abs() > f.StepThreshold {
+		return f.step(best, len(samples)), true
+	}
+
+	dt := best.Time.Sub(f.last).Seconds()
+	residual := best.Offset - f.remaining(best.Time)
+
+	if dt > 0 {
+		f.freq = clampFrequency(f.freq + f.Gain*residual.Seconds()/dt*1e6)
+	}
+
+	r := residual.Seconds()
+	f.jitter = math.Sqrt(f.jitter*f.jitter + (r*r-f.jitter*f.jitter)/4)
+
+	f.slew = 0
+
+	if interval > 0 {
+		f.slew = clampFrequency(f.freq+best.Offset.Seconds()/interval.Seconds()*1e6) - f.freq
+	}
+
+	f.expected = best.Offset
+	f.last = best.Time
+
+	return ClockAdjustment{Frequency: f.freq + f.slew, Stats: f.stats(best, len(samples), false)}, true
+}
+
+// Probe... checks a single sample for a jump larger than JumpThreshold, returning a step if one is found
+func (f *ClockFilter) Probe(sample ClockSample) (ClockAdjustment, bool) {
+	f.setDefaults()
+
+	if !f.synced || sample.Delay > f.MaxDelay {
+		return ClockAdjustment{}, false
+	}
 
-	if offset.Abs() > time.Millisecond/2 {
-		log.Infof("adjusting clock by %v - latency %v", offset, latency)
+	if (sample.Offset - f.remaining(sample.Time)).Abs() < f.JumpThreshold {
+		return ClockAdjustment{}, false
+	}
+
+	return f.step(sample, 1), true
+}
+
+// remaining... the offset expected at the given time if the frequency estimate is correct
+func (f *ClockFilter) remaining(at time.Time) time.Duration {
+	slewed := time.Duration(f.slew * at.Sub(f.last).Seconds() * nanosecondsPerPPMSecs)
+
+	// the slew stops once the next update is applied, but never overshoots on a late update
+	if f.expected > 0 {
+		return max(f.expected-slewed, 0)
+	}
+
+	return min(f.expected-slewed, 0)
+}
 
-		if err := adjtime(offset); err != nil {
-			return latency * 2, fmt.Errorf("clock adjustment failed: %v", err)
+func (f *ClockFilter) step(sample ClockSample, samples int) ClockAdjustment {
+	f.synced = true
+	f.slew = 0
+	f.expected = 0
+	f.last = sample.Time.Add(sample.Offset)
+
+	return ClockAdjustment{Step: sample.Offset, Frequency: f.freq, Stats: f.stats(sample, samples, true)}
+}
+
+func (f *ClockFilter) stats(sample ClockSample, samples int, step bool) event.ClockStats {
+	return event.ClockStats{
+		Offset:    sample.Offset,
+		Delay:     sample.Delay,
+		Jitter:    time.Duration(f.jitter * float64(time.Second)),
+		Frequency: f.freq,
+		Samples:   samples,
+		Step:      step,
+	}
+}
+
+func (f *ClockFilter) setDefaults() {
+	if f.StepThreshold <= 0 {
+		f.StepThreshold = defaultStepThreshold
+	}
+
+	if f.JumpThreshold <= 0 {
+		f.JumpThreshold = defaultJumpThreshold
+	}
+
+	if f.MaxDelay <= 0 {
+		f.MaxDelay = defaultMaxClockDelay
+	}
+
+	if f.Gain <= 0 {
+		f.Gain = defaultFrequencyGain
+	}
+}
+
+func minDelay(samples []ClockSample) (ClockSample, bool) {
+	if len(samples) == 0 {
+		return ClockSample{}, false
+	}
+
+	best := samples[0]
+
+	for _, sample := range samples[1:] {
+		if sample.Delay < best.Delay {
+			best = sample
 		}
-	} else {
-		log.Debugf("clock is in sync (%v) - latency %v", offset, latency)
 	}
 
-	return latency * 2, nil
+	return best, true
+}
+
+func clampFrequency(ppm float64) float64 {
+	return max(-maxFrequencyPPM, min(ppm, maxFrequencyPPM))
 }
@@ -0,0 +1,335 @@
+package rpc
+
+import (
+	"context"
+	"math"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amadigan/macoby/internal/event"
+)
+
+var epoch = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// simClock... a simulated guest clock and the host clock it follows. The guest clock is ahead of the host by offset,
+// and runs fast by drift plus the frequency correction set by the adjuster, in ppm.
+type simClock struct {
+	mutex  sync.Mutex
+	host   time.Time
+	offset time.Duration
+	drift  float64
+	freq   float64
+	steps  []time.Duration
+	end    time.Time
+	cancel context.CancelFunc
+}
+
+func (s *simClock) Now() time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.host.Add(s.offset)
+}
+
+func (s *simClock) advance(d time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.host = s.host.Add(d)
+	s.offset += time.Duration(float64(d) * (s.drift + s.freq) / 1e6)
+}
+
+func (s *simClock) After(d time.Duration) <-chan time.Time {
+	s.advance(d)
+
+	if !s.hostClock().Now().Before(s.end) {
+		s.cancel()
+
+		return nil
+	}
+
+	ch := make(chan time.Time, 1)
+	ch <- s.Now()
+
+	return ch
+}
+
+func (s *simClock) Sleep(d time.Duration) {
+	s.advance(d)
+}
+
+func (s *simClock) Step(offset time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.offset += offset
+	s.steps = append(s.steps, offset)
+
+	return nil
+}
+
+func (s *simClock) SetFrequency(ppm float64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.freq = ppm
+
+	return nil
+}
+
+// jump... moves the host clock without the guest noticing, like the host waking from sleep
+func (s *simClock) jump(d time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.host = s.host.Add(d)
+	s.offset -= d
+}
+
+func (s *simClock) hostClock() Clock {
+	return hostClock{s}
+}
+
+type hostClock struct {
+	sim *simClock
+}
+
+func (h hostClock) Now() time.Time {
+	h.sim.mutex.Lock()
+	defer h.sim.mutex.Unlock()
+
+	return h.sim.host
+}
+
+func (h hostClock) After(d time.Duration) <-chan time.Time {
+	return h.sim.After(d)
+}
+
+func (h hostClock) Sleep(d time.Duration) {
+	h.sim.Sleep(d)
+}
+
+func (s *simClock) state() (time.Duration, float64, []time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.offset, s.freq, s.steps
+}
+
+func runClockSync(t *testing.T, sim *simClock, duration time.Duration, during func(event.ClockStats)) []event.ClockStats {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sim.end = sim.host.Add(duration)
+	sim.cancel = cancel
+
+	guest, host := net.Pipe()
+	defer guest.Close()
+
+	go serveClock(host, sim.hostClock())
+
+	var stats []event.ClockStats
+
+	cs := &ClockSync{
+		Conn:     guest,
+		Clock:    sim,
+		Adjuster: sim,
+		Interval: 10 * time.Second,
+		Stats: func(s event.ClockStats) {
+			stats = append(stats, s)
+
+			if during != nil {
+				during(s)
+			}
+		},
+	}
+
+	if err := cs.Run(ctx); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	return stats
+}
+
+func TestClockSyncStepsThenSlews(t *testing.T) {
+	sim := &simClock{host: epoch, offset: 3 * time.Second, drift: 50}
+
+	stats := runClockSync(t, sim, time.Hour, nil)
+
+	if len(stats) == 0 || !stats[0].Step {
+		t.Fatalf("expected the first adjustment to be a step, got %+v", stats)
+	}
+
+	offset, freq, steps := sim.state()
+
+	if len(steps) != 1 {
+		t.Errorf("expected a single step, got %v", steps)
+	}
+
+	if offset.Abs() > time.Millisecond {
+		t.Errorf("offset after an hour is %v, expected under 1ms", offset)
+	}
+
+	if math.Abs(freq+50) > 5 {
+		t.Errorf("frequency correction is %.2fppm, expected about -50ppm", freq)
+	}
+}
+
+func TestClockSyncStepsOnJump(t *testing.T) {
+	sim := &simClock{host: epoch, drift: -20}
+	jumped := false
+
+	stats := runClockSync(t, sim, 30*time.Minute, func(event.ClockStats) {
+		if !jumped && sim.hostClock().Now().Sub(epoch) > 10*time.Minute {
+			jumped = true
+
+			sim.jump(5 * time.Minute)
+		}
+	})
+
+	_, _, steps := sim.state()
+
+	// the clocks start in sync, so the only step is for the jump
+	if len(steps) != 1 {
+		t.Fatalf("expected a single step for the jump, got %v", steps)
+	}
+
+	if (steps[0] - 5*time.Minute).Abs() > time.Millisecond {
+		t.Errorf("expected a step of 5m, got %v", steps[0])
+	}
+
+	if last := stats[len(stats)-1]; last.Step || last.Offset.Abs() > time.Millisecond {
+		t.Errorf("expected the clock to be slewed after the jump, got %+v", last)
+	}
+}
+
+func TestClockFilterStep(t *testing.T) {
+	var f ClockFilter
+
+	samples := []ClockSample{
+		{Time: epoch, Offset: 2 * time.Second, Delay: 30 * time.Millisecond},
+		{Time: epoch, Offset: 2*time.Second + time.Millisecond, Delay: time.Millisecond},
+	}
+
+	adj, ok := f.Update(samples, 10*time.Second)
+	if !ok {
+		t.Fatal("burst was discarded")
+	}
+
+	if adj.Step != 2*time.Second+time.Millisecond || !adj.Stats.Step || adj.Stats.Samples != 2 {
+		t.Errorf("expected a step to the sample with the lowest delay, got %+v", adj)
+	}
+
+	// an offset beyond the step threshold steps again
+	adj, _ = f.Update([]ClockSample{{Time: epoch.Add(10 * time.Second), Offset: time.Second}}, 10*time.Second)
+
+	if adj.Step != time.Second {
+		t.Errorf("expected a step of 1s, got %+v", adj)
+	}
+}
+
+func TestClockFilterSlew(t *testing.T) {
+	var f ClockFilter
+
+	f.Update([]ClockSample{{Time: epoch}}, 10*time.Second)
+
+	adj, ok := f.Update([]ClockSample{{Time: epoch.Add(10 * time.Second), Offset: 10 * time.Millisecond}}, 10*time.Second)
+	if !ok || adj.Step != 0 {
+		t.Fatalf("expected a slew, got %+v", adj)
+	}
+
+	// 10ms remaining over 10s is 1000ppm, the estimate takes a quarter of the 10ms error over 10s
+	if math.Abs(adj.Stats.Frequency-250) > 1e-6 {
+		t.Errorf("expected a frequency estimate of 250ppm, got %.3f", adj.Stats.Frequency)
+	}
+
+	if adj.Frequency != maxFrequencyPPM {
+		t.Errorf("expected the slew to be clamped to %.0fppm, got %.3f", maxFrequencyPPM, adj.Frequency)
+	}
+}
+
+func TestClockFilterFrequency(t *testing.T) {
+	var f ClockFilter
+
+	const drift = 30.0 // ppm, the local clock falls behind
+
+	interval := 10 * time.Second
+	now := epoch
+	offset := time.Duration(0)
+	freq := 0.0
+
+	for i := range 200 {
+		adj, ok := f.Update([]ClockSample{{Time: now, Offset: offset}}, interval)
+		if !ok {
+			t.Fatalf("update %d discarded", i)
+		}
+
+		offset -= adj.Step
+		freq = adj.Frequency
+
+		// over the interval, the local clock loses drift ppm and gains the corrected frequency
+		now = now.Add(interval)
+		offset += time.Duration(float64(interval) * (drift - freq) / 1e6)
+	}
+
+	if est := f.freq; math.Abs(est-drift) > 0.5 {
+		t.Errorf("expected a frequency estimate of %.1fppm, got %.3f", drift, est)
+	}
+
+	if offset.Abs() > 10*time.Microsecond {
+		t.Errorf("expected the offset to converge, got %v", offset)
+	}
+}
+
+func TestClockFilterDiscards(t *testing.T) {
+	var f ClockFilter
+
+	if _, ok := f.Update(nil, time.Second); ok {
+		t.Error("an empty burst was accepted")
+	}
+
+	if _, ok := f.Update([]ClockSample{{Time: epoch, Delay: time.Second}}, time.Second); ok {
+		t.Error("a sample over the maximum delay was accepted")
+	}
+
+	if _, ok := f.Probe(ClockSample{Time: epoch, Offset: time.Hour}); ok {
+		t.Error("a probe stepped before the first burst")
+	}
+
+	f.Update([]ClockSample{{Time: epoch}}, time.Second)
+
+	if _, ok := f.Probe(ClockSample{Time: epoch.Add(time.Second), Offset: 500 * time.Millisecond}); ok {
+		t.Error("a probe under the jump threshold stepped")
+	}
+
+	if adj, ok := f.Probe(ClockSample{Time: epoch.Add(time.Second), Offset: 2 * time.Second}); !ok || adj.Step != 2*time.Second {
+		t.Errorf("expected a probe to step by 2s, got %+v", adj)
+	}
+}
+
+func TestClockSyncDefaultInterval(t *testing.T) {
+	sim := &simClock{host: epoch}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sim.end = epoch.Add(time.Minute)
+	sim.cancel = cancel
+
+	guest, host := net.Pipe()
+	defer guest.Close()
+
+	go serveClock(host, sim.hostClock())
+
+	cs := &ClockSync{Conn: guest, Clock: sim, Adjuster: sim}
+
+	if err := cs.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if cs.Interval != defaultClockInterval || cs.ProbeInterval != defaultProbeInterval {
+		t.Errorf("expected default intervals, got %v and %v", cs.Interval, cs.ProbeInterval)
+	}
+}